@@ -9,19 +9,21 @@ require (
 )
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.4
 	github.com/go4org/hashtriemap v0.0.0-20251130024219-545ba229f689
 	github.com/pion/ice/v4 v4.1.0
+	github.com/pion/logging v0.2.4
+	github.com/pion/stun/v3 v3.0.2
 )
 
 require (
 	github.com/pion/dtls/v3 v3.0.9 // indirect
-	github.com/pion/logging v0.2.4 // indirect
 	github.com/pion/mdns/v2 v2.1.0 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/stun/v3 v3.0.2 // indirect
 	github.com/pion/transport/v3 v3.1.1 // indirect
 	github.com/pion/turn/v4 v4.1.3 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
@@ -2,18 +2,46 @@ package internal
 
 import (
 	"crypto/rand"
+	"errors"
+	"strings"
 
 	qp2p "github.com/BrownNPC/QuicP2P"
 )
 
+// Returned by GenerateUniqueRoomID when every attempt collided with a taken ID.
+var ErrRoomIdSpaceExhausted = errors.New("no free room id found")
+
+// Characters of generated room IDs.
+//
+// Uppercase letters and digits, without 0, O, 1 and I, which are easily confused
+// when reading a code off someone else's screen. 32 characters, so each byte maps evenly.
+const roomIdAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
 func SixCharRoomID() qp2p.RoomId {
-	return qp2p.RoomId(rand.Text()[:6])
+	b := make([]byte, 6)
+	rand.Read(b)
+	for i := range b {
+		b[i] = roomIdAlphabet[int(b[i])%len(roomIdAlphabet)]
+	}
+	return qp2p.RoomId(b)
+}
+
+// Returns the canonical form of a room ID, so IDs typed in any case find the same room.
+//
+// Surrounding spaces are removed and letters are uppercased.
+func NormalizeRoomID(id qp2p.RoomId) qp2p.RoomId {
+	return qp2p.RoomId(strings.ToUpper(strings.TrimSpace(string(id))))
 }
 
-func GenerateUniqueRoomID(isUnique func(roomId qp2p.RoomId) bool) qp2p.RoomId {
-	id := SixCharRoomID()
-	for !isUnique(id) {
-		id = SixCharRoomID()
+// Generates room IDs with gen until reserve accepts one, up to attempts times.
+//
+// reserve must atomically claim the ID, returning false if it is taken.
+func GenerateUniqueRoomID(gen func() qp2p.RoomId, reserve func(roomId qp2p.RoomId) bool, attempts int) (qp2p.RoomId, error) {
+	for range attempts {
+		id := gen()
+		if reserve(id) {
+			return id, nil
+		}
 	}
-	return id
+	return "", ErrRoomIdSpaceExhausted
 }
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// Generated IDs are six characters of the alphabet, already in canonical form.
+func TestSixCharRoomID(t *testing.T) {
+	seen := make(map[qp2p.RoomId]bool)
+	for range 10000 {
+		id := SixCharRoomID()
+		if len(id) != 6 {
+			t.Fatalf("%q is not 6 characters", id)
+		}
+		if i := strings.IndexFunc(string(id), func(r rune) bool { return !strings.ContainsRune(roomIdAlphabet, r) }); i >= 0 {
+			t.Fatalf("%q has %q, which is not in the alphabet", id, id[i])
+		}
+		if NormalizeRoomID(id) != id {
+			t.Fatalf("%q is not in canonical form", id)
+		}
+		seen[id] = true
+	}
+	// 32^6 IDs, so a handful of collisions in 10000 would mean a broken generator.
+	if len(seen) < 9990 {
+		t.Fatalf("%d distinct IDs in 10000", len(seen))
+	}
+}
+
+// The alphabet leaves out characters that are easily confused, and maps bytes evenly.
+func TestRoomIdAlphabet(t *testing.T) {
+	if strings.ContainsAny(roomIdAlphabet, "0O1I") {
+		t.Fatalf("alphabet %q has easily confused characters", roomIdAlphabet)
+	}
+	if 256%len(roomIdAlphabet) != 0 {
+		t.Fatalf("alphabet of %d characters does not map bytes evenly", len(roomIdAlphabet))
+	}
+	if strings.ToUpper(roomIdAlphabet) != roomIdAlphabet {
+		t.Fatalf("alphabet %q is not uppercase", roomIdAlphabet)
+	}
+}
+
+func TestNormalizeRoomID(t *testing.T) {
+	for in, want := range map[qp2p.RoomId]qp2p.RoomId{
+		"abc234":   "ABC234",
+		" AbC234 ": "ABC234",
+		"ABC234":   "ABC234",
+		"finals":   "FINALS",
+	} {
+		if got := NormalizeRoomID(in); got != want {
+			t.Errorf("NormalizeRoomID(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// IDs that reserve turns down are retried, and GenerateUniqueRoomID gives up after attempts.
+func TestGenerateUniqueRoomID(t *testing.T) {
+	taken := make(map[qp2p.RoomId]bool)
+	reserve := func(id qp2p.RoomId) bool {
+		if taken[id] {
+			return false
+		}
+		taken[id] = true
+		return true
+	}
+	for range 1000 {
+		if _, err := GenerateUniqueRoomID(SixCharRoomID, reserve, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(taken) != 1000 {
+		t.Fatalf("%d IDs reserved for 1000 rooms", len(taken))
+	}
+
+	calls := 0
+	_, err := GenerateUniqueRoomID(func() qp2p.RoomId { calls++; return "TAKEN1" }, func(qp2p.RoomId) bool { return false }, 5)
+	if !errors.Is(err, ErrRoomIdSpaceExhausted) || calls != 5 {
+		t.Fatalf("got %v after %d attempts, want ErrRoomIdSpaceExhausted after 5", err, calls)
+	}
+}
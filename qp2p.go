@@ -14,3 +14,11 @@ const (
 	ClientTypeGuest SignalingClientType = false
 )
 
+// ProtocolVersion is the version of the signaling protocol spoken by this module.
+//
+// Clients send it to the signaling server as ?v= when connecting,
+// and the server turns away versions it does not support.
+//
+// Version 2 adds the envelope subprotocols, see signaling.SubprotocolMsgpackV2.
+// Version 1 clients keep the flat Msg array.
+const ProtocolVersion = 2
@@ -0,0 +1,149 @@
+package signaling
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/google/uuid"
+)
+
+// A room in the GET /admin/rooms listing.
+type AdminRoom struct {
+	RoomId qp2p.RoomId `json:"roomId"`
+	// Players in the room, spectators are counted in Spectators.
+	GuestCount int       `json:"guestCount"`
+	Spectators int       `json:"spectators"`
+	CreatedAt  time.Time `json:"createdAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	// Empty while the host is away.
+	HostAddr string `json:"hostAddr"`
+	// Identity of the host from ServerOptions.Authenticator, or empty.
+	HostIdentity string       `json:"hostIdentity,omitempty"`
+	Guests       []AdminGuest `json:"guests,omitempty"`
+}
+
+// A guest in the GET /admin/rooms/{roomId} response.
+type AdminGuest struct {
+	GuestId  qp2p.GuestID `json:"guestId"`
+	IP       string       `json:"ip"`
+	JoinedAt time.Time    `json:"joinedAt"`
+	// Identity of the guest from ServerOptions.Authenticator, or empty.
+	Identity string `json:"identity,omitempty"`
+	// True once the host has sent HostAuth to the guest.
+	Connected bool `json:"connected"`
+	// "player", or "spectator" if the guest joined with GET /spectate/{roomId}.
+	Role string `json:"role"`
+}
+
+// Wraps an admin handler with bearer token authentication.
+func (s *WebsocketSignalingServer) admin(handler http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + s.sopts.AdminToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(want, got) != 1 {
+			writeHTTPError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// GET /admin/rooms
+func (s *WebsocketSignalingServer) adminListRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := make([]AdminRoom, 0)
+	for _, rm := range s.rooms.All() {
+		rooms = append(rooms, rm.adminRoom(false))
+	}
+	slices.SortFunc(rooms, func(a, b AdminRoom) int { return cmp.Compare(a.RoomId, b.RoomId) })
+	writeJSON(w, rooms)
+}
+
+// GET /admin/rooms/{roomId}
+func (s *WebsocketSignalingServer) adminGetRoom(w http.ResponseWriter, r *http.Request) {
+	rm, ok := s.rooms.Load(pathRoomId(r))
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, CodeRoomNotFound, "room not found")
+		return
+	}
+	writeJSON(w, rm.adminRoom(true))
+}
+
+// GET /admin/rooms/closed
+//
+// Lists the summaries of the rooms that closed last, newest first.
+func (s *WebsocketSignalingServer) adminClosedRooms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.ClosedRooms())
+}
+
+// DELETE /admin/rooms/{roomId}?reason=
+//
+// Kicks every guest with reason and closes the host connection.
+func (s *WebsocketSignalingServer) adminCloseRoom(w http.ResponseWriter, r *http.Request) {
+	rm, ok := s.rooms.Load(pathRoomId(r))
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, CodeRoomNotFound, "room not found")
+		return
+	}
+	s.closeRoom(rm, StatusRoomClosed, cmp.Or(r.URL.Query().Get("reason"), "Room closed by admin."))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /admin/rooms/{roomId}/guests/{guestId}?reason=
+func (s *WebsocketSignalingServer) adminKickGuest(w http.ResponseWriter, r *http.Request) {
+	roomId := pathRoomId(r)
+	guestId, err := uuid.Parse(r.PathValue("guestId"))
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid guest id")
+		return
+	}
+	g, ok := s.guests.Load(guestId)
+	if !ok || g.room.id != roomId || !s.kickGuest(g, "admin", KickByAdmin, cmp.Or(r.URL.Query().Get("reason"), "Kicked by admin.")) {
+		writeHTTPError(w, http.StatusNotFound, CodeGuestNotFound, "guest not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the room for the admin endpoints, with its guests if withGuests is set.
+func (r *room) adminRoom(withGuests bool) AdminRoom {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ar := AdminRoom{
+		RoomId:     r.id,
+		GuestCount: r.count(RolePlayer),
+		Spectators: r.count(RoleSpectator),
+		CreatedAt:  r.createdAt,
+		AgeSeconds: time.Since(r.createdAt).Seconds(),
+
+		HostIdentity: r.hostIdentity,
+	}
+	if r.hConn != nil {
+		ar.HostAddr = r.hostAddr
+	}
+	if withGuests {
+		ar.Guests = make([]AdminGuest, 0, len(r.members))
+		for _, g := range r.members {
+			ar.Guests = append(ar.Guests, AdminGuest{
+				GuestId:   g.id,
+				IP:        g.ip,
+				JoinedAt:  g.authAt,
+				Identity:  g.identity,
+				Connected: r.guests[g.id] != nil,
+				Role:      g.role.String(),
+			})
+		}
+		slices.SortFunc(ar.Guests, func(a, b AdminGuest) int { return a.JoinedAt.Compare(b.JoinedAt) })
+	}
+	return ar
+}
+
+// Writes v as a JSON response body.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
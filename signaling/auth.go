@@ -0,0 +1,145 @@
+package signaling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// ErrUnauthenticated is returned by an Authenticator when the request has no credentials,
+// or credentials it does not recognize. The server responds 401.
+//
+// Any other error from an Authenticator is a 403.
+var ErrUnauthenticated = errors.New("signaling: unauthenticated")
+
+// Authenticator checks a GET /host or GET /join request before the websocket is accepted.
+//
+// role is qp2p.ClientTypeHost for /host and qp2p.ClientTypeGuest for /join.
+//
+// It returns the identity of the client, which is shown in events, logs and the admin API.
+type Authenticator func(r *http.Request, role qp2p.SignalingClientType) (identity string, err error)
+
+// Context key of the identity passed to a GuestIDAssigner.
+type identityKey struct{}
+
+// Returns the identity the server's Authenticator returned for the request r
+// passed to a GuestIDAssigner. Empty if the server has no Authenticator.
+func Identity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+// Returns r with identity for Identity.
+func withIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Runs the server's Authenticator on r, responding 401 or 403 if it fails.
+//
+// Returns false if the request must not be accepted.
+func (s *WebsocketSignalingServer) authenticate(w http.ResponseWriter, r *http.Request, role qp2p.SignalingClientType) (string, bool) {
+	if s.sopts.Authenticator == nil {
+		return "", true
+	}
+	identity, err := s.sopts.Authenticator(r, role)
+	if errors.Is(err, ErrUnauthenticated) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeHTTPError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthenticated")
+		return "", false
+	} else if err != nil {
+		s.log.Debug("Authenticator rejected request", "path", r.URL.Path, "error", err)
+		writeHTTPError(w, http.StatusForbidden, CodeForbidden, "forbidden")
+		return "", false
+	}
+	return identity, true
+}
+
+// Returns the credential from the "Authorization: Bearer" header, or the ?auth= query
+// for browsers, which can't set headers on websockets.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("auth")
+}
+
+// Returns an Authenticator that accepts the bearer tokens in tokens, mapped to their identity.
+//
+// Both hosts and guests can use any of the tokens.
+func BearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	return func(r *http.Request, role qp2p.SignalingClientType) (string, error) {
+		got := []byte(bearerToken(r))
+		if len(got) == 0 {
+			return "", ErrUnauthenticated
+		}
+		for token, identity := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), got) == 1 {
+				return identity, nil
+			}
+		}
+		return "", ErrUnauthenticated
+	}
+}
+
+var errTicketExpired = errors.New("signaling: ticket expired")
+var errTicketRole = errors.New("signaling: ticket not valid for role")
+
+// Returns an Authenticator that accepts tickets made by SignTicket with secret.
+//
+// Tickets are sent like bearer tokens. They are only valid for their role, and until they expire.
+func HMACTicketAuthenticator(secret []byte) Authenticator {
+	return func(r *http.Request, role qp2p.SignalingClientType) (string, error) {
+		ticket := bearerToken(r)
+		// identity.role.expiry.signature
+		parts := strings.Split(ticket, ".")
+		if len(parts) != 4 {
+			return "", ErrUnauthenticated
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+		if err != nil || !hmac.Equal(sig, ticketMAC(secret, strings.Join(parts[:3], "."))) {
+			return "", ErrUnauthenticated
+		}
+		identity, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return "", ErrUnauthenticated
+		}
+		if parts[1] != ticketRole(role) {
+			return "", errTicketRole
+		}
+		expiry, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || time.Now().Unix() > expiry {
+			return "", errTicketExpired
+		}
+		return string(identity), nil
+	}
+}
+
+// Signs a ticket for HMACTicketAuthenticator, letting identity connect as role until expiry.
+//
+// Tickets are made by the application's own backend, which shares secret with the signaling server.
+func SignTicket(secret []byte, identity string, role qp2p.SignalingClientType, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(identity)) + "." + ticketRole(role) + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(secret, payload))
+}
+
+func ticketMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func ticketRole(role qp2p.SignalingClientType) string {
+	if role == qp2p.ClientTypeHost {
+		return "host"
+	}
+	return "guest"
+}
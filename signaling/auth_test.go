@@ -0,0 +1,129 @@
+package signaling_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+)
+
+// Returns the next server event of type E, skipping others.
+func waitEvent[E signaling.ServerEvent](t *testing.T, srv *signalingtest.Server) E {
+	t.Helper()
+	timeout := time.After(signalingtest.Timeout)
+	for {
+		select {
+		case e := <-srv.Events():
+			if e, ok := e.(E); ok {
+				return e
+			}
+		case <-timeout:
+			var e E
+			t.Fatalf("no %T", e)
+			return e
+		}
+	}
+}
+
+// Sends a GET for path with an Authorization header, and returns the response status.
+func getWithAuth(t *testing.T, srv *signalingtest.Server, path, authorization string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/%s?v=%d", srv.Addr, path, qp2p.ProtocolVersion), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", authorization)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Hosts and guests without a known token are turned away with 401, and the identities of the ones
+// with a token show up in events and the admin API.
+func TestBearerTokenAuthenticator(t *testing.T) {
+	const adminToken = "admin"
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+		Authenticator: signaling.BearerTokenAuthenticator(map[string]string{"hostToken": "alice", "guestToken": "bob"}),
+		AdminToken:    adminToken,
+	})
+
+	for _, auth := range []url.Values{nil, {"auth": {"wrong"}}} {
+		status, body := getError(t, srv, "host", auth)
+		if status != http.StatusUnauthorized || body.Code != signaling.CodeUnauthorized {
+			t.Fatalf("host with auth %v got %d %q, want %d %q", auth, status, body.Code, http.StatusUnauthorized, signaling.CodeUnauthorized)
+		}
+	}
+	if status := getWithAuth(t, srv, "host", "Bearer wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("host with a wrong Authorization header got %d, want %d", status, http.StatusUnauthorized)
+	}
+	host := srv.Host(t, url.Values{"auth": {"hostToken"}})
+	if e := waitEvent[signaling.RoomOpenedEvent](t, srv); e.Identity != "alice" {
+		t.Fatalf("RoomOpenedEvent identity %q, want alice", e.Identity)
+	}
+
+	if status, _ := getError(t, srv, "join/"+string(host.RoomId), nil); status != http.StatusUnauthorized {
+		t.Fatalf("guest without a token got %d, want %d", status, http.StatusUnauthorized)
+	}
+	g := &signalingtest.FakeGuest{Conn: srv.Dial(t, "join/"+string(host.RoomId), url.Values{"auth": {"guestToken"}})}
+	g.Expect(signaling.RoomInfo)
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	if e := waitEvent[signaling.GuestJoinedEvent](t, srv); e.Identity != "bob" {
+		t.Fatalf("GuestJoinedEvent identity %q, want bob", e.Identity)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/admin/rooms/%s", srv.Addr, host.RoomId), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var room signaling.AdminRoom
+	if err := json.NewDecoder(resp.Body).Decode(&room); err != nil {
+		t.Fatal(err)
+	}
+	if room.HostIdentity != "alice" || len(room.Guests) != 1 || room.Guests[0].GuestId != joined.GuestId || room.Guests[0].Identity != "bob" {
+		t.Fatalf("admin API shows host %q and guests %+v, want alice and bob", room.HostIdentity, room.Guests)
+	}
+}
+
+// Tickets are only accepted for their role, before they expire, and when signed with the server's secret.
+func TestHMACTicketAuthenticator(t *testing.T) {
+	secret := []byte("ticket secret")
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Authenticator: signaling.HMACTicketAuthenticator(secret)})
+	later := time.Now().Add(time.Hour)
+	hostTicket := signaling.SignTicket(secret, "alice", qp2p.ClientTypeHost, later)
+
+	for _, tc := range []struct {
+		name   string
+		ticket string
+		want   int
+	}{
+		{"guest ticket", signaling.SignTicket(secret, "alice", qp2p.ClientTypeGuest, later), http.StatusForbidden},
+		{"expired", signaling.SignTicket(secret, "alice", qp2p.ClientTypeHost, time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"other secret", signaling.SignTicket([]byte("other"), "alice", qp2p.ClientTypeHost, later), http.StatusUnauthorized},
+		{"tampered", hostTicket[:len(hostTicket)-2] + "AA", http.StatusUnauthorized},
+		{"not a ticket", "alice", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := getWithAuth(t, srv, "host", "Bearer "+tc.ticket); status != tc.want {
+				t.Fatalf("got %d, want %d", status, tc.want)
+			}
+		})
+	}
+
+	srv.Host(t, url.Values{"auth": {hostTicket}})
+	if e := waitEvent[signaling.RoomOpenedEvent](t, srv); e.Identity != "alice" {
+		t.Fatalf("RoomOpenedEvent identity %q, want alice", e.Identity)
+	}
+}
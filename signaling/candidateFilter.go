@@ -0,0 +1,38 @@
+package signaling
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/pion/ice/v4"
+)
+
+// Reports whether the host client exchanges candidate c with a guest, see ClientOptions.CandidateFilter.
+type CandidateFilter func(c ice.Candidate) bool
+
+// Keeps relay candidates only, so guests only ever see the TURN server's address.
+func RelayCandidatesOnly(c ice.Candidate) bool {
+	return c.Type() == ice.CandidateTypeRelay
+}
+
+// Drops host candidates, so guests don't learn the host's local network address.
+// Guests on the same network then connect through the router, which needs it to support hairpinning.
+func NoHostCandidates(c ice.Candidate) bool {
+	return c.Type() != ice.CandidateTypeHost
+}
+
+// Keeps host candidates on a private, loopback or link-local address, or an mDNS name, so nothing
+// public is exchanged and only guests on the same network can connect.
+//
+// With ice.WithMulticastDNSMode(ice.MulticastDNSModeQueryAndGather) in ClientOptions.AgentOptions the host's
+// candidates carry a random .local name instead of its address.
+func LANCandidatesOnly(c ice.Candidate) bool {
+	if c.Type() != ice.CandidateTypeHost {
+		return false
+	}
+	if strings.HasSuffix(c.Address(), ".local") {
+		return true
+	}
+	addr, err := netip.ParseAddr(c.Address())
+	return err == nil && (addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast())
+}
@@ -0,0 +1,46 @@
+package signaling_test
+
+import (
+	"testing"
+
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/pion/ice/v4"
+)
+
+// Which candidates each preset keeps.
+func TestCandidateFilterPresets(t *testing.T) {
+	tests := []struct {
+		name, candidate            string
+		noHost, relayOnly, lanOnly bool
+	}{
+		{"private host", "candidate:1 1 udp 2130706431 192.168.1.20 5000 typ host", false, false, true},
+		{"public host", "candidate:1 1 udp 2130706431 203.0.113.9 5000 typ host", false, false, false},
+		{"loopback host", "candidate:1 1 udp 2130706431 127.0.0.1 5000 typ host", false, false, true},
+		{"link-local host", "candidate:1 1 udp 2130706431 fe80::1 5000 typ host", false, false, true},
+		{"mDNS host", "candidate:1 1 udp 2130706431 1f0e7c1a-42a4-4c5c-9e0b-2d7f1a3b6c8d.local 5000 typ host", false, false, true},
+		{"srflx", "candidate:1 1 udp 1694498815 203.0.113.9 5000 typ srflx raddr 192.168.1.20 rport 5000", true, false, false},
+		{"private srflx", "candidate:1 1 udp 1694498815 10.0.0.2 5000 typ srflx raddr 192.168.1.20 rport 5000", true, false, false},
+		{"relay", "candidate:1 1 udp 16777215 198.51.100.7 3478 typ relay raddr 203.0.113.9 rport 5000", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ice.UnmarshalCandidate(tt.candidate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []struct {
+				name   string
+				filter signaling.CandidateFilter
+				want   bool
+			}{
+				{"NoHostCandidates", signaling.NoHostCandidates, tt.noHost},
+				{"RelayCandidatesOnly", signaling.RelayCandidatesOnly, tt.relayOnly},
+				{"LANCandidatesOnly", signaling.LANCandidatesOnly, tt.lanOnly},
+			} {
+				if got := f.filter(c); got != f.want {
+					t.Errorf("%s = %v, want %v", f.name, got, f.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/shamaton/msgpack/v2"
+)
+
+// Websocket subprotocols that select the wire encoding of a connection.
+//
+// Clients that offer none of them use msgpack.
+const (
+	// Msg as a msgpack array in binary frames.
+	SubprotocolMsgpack = "qp2p.msgpack"
+	// Msg as a JSON object in text frames, keyed by the Msg field names, for browser clients.
+	// Payload and Metadata are base64 strings, and GuestId is a UUID string.
+	SubprotocolJSON = "qp2p.json"
+	// Protocol version 2. An Envelope with a typed Payload, in msgpack binary frames.
+	// Only offered to clients that connect with ?v=2 or later.
+	SubprotocolMsgpackV2 = "qp2p.msgpack.v2"
+	// Protocol version 2. An Envelope with a typed Payload, as JSON text frames.
+	// Only offered to clients that connect with ?v=2 or later.
+	SubprotocolJSONV2 = "qp2p.json.v2"
+	// Msg as a CBOR map in binary frames, keyed by the Msg field names, for clients without msgpack.
+	// Payload and Metadata are byte strings, and GuestId is a 16 byte string.
+	SubprotocolCBOR = "qp2p.cbor"
+	// Protocol version 2. An Envelope with a typed Payload, as CBOR maps in binary frames.
+	// Only offered to clients that connect with ?v=2 or later.
+	SubprotocolCBORV2 = "qp2p.cbor.v2"
+)
+
+// Wire encoding of Msg on a connection, selected by the connection's websocket subprotocol.
+//
+// The server decodes every message it reads, so it transcodes messages forwarded
+// between connections with different codecs.
+type Codec interface {
+	// The websocket subprotocol that selects the codec.
+	Subprotocol() string
+	// The websocket frame type that carries encoded messages.
+	FrameType() websocket.MessageType
+	Marshal(msg Msg) ([]byte, error)
+	Unmarshal(b []byte, msg *Msg) error
+}
+
+// The codecs the server supports.
+var (
+	// Default for clients that offer no subprotocol, see SubprotocolMsgpack.
+	CodecMsgpack Codec = msgpackCodec{}
+	// See SubprotocolJSON.
+	CodecJSON Codec = jsonCodec{}
+	// See SubprotocolCBOR.
+	CodecCBOR Codec = cborCodec{}
+	// Envelope in msgpack, see SubprotocolMsgpackV2.
+	CodecMsgpackV2 Codec = envelopeCodec{msgpackCodec{}, SubprotocolMsgpackV2}
+	// Envelope in JSON, see SubprotocolJSONV2.
+	CodecJSONV2 Codec = envelopeCodec{jsonCodec{}, SubprotocolJSONV2}
+	// Envelope in CBOR, see SubprotocolCBORV2.
+	CodecCBORV2 Codec = envelopeCodec{cborCodec{}, SubprotocolCBORV2}
+)
+
+// Every codec, in the server's order of preference.
+var codecs = []Codec{CodecMsgpackV2, CodecJSONV2, CodecCBORV2, CodecMsgpack, CodecJSON, CodecCBOR}
+
+// Returns the codec negotiated for conn with its subprotocol.
+func ConnCodec(conn *websocket.Conn) Codec {
+	sub := conn.Subprotocol()
+	for _, c := range codecs {
+		if c.Subprotocol() == sub {
+			return c
+		}
+	}
+	return CodecMsgpack
+}
+
+// A codec that can encode into a buffer, so writes can reuse pooled buffers.
+type bufferCodec interface {
+	marshalTo(buf *bytes.Buffer, msg Msg) error
+}
+
+// A codec that can also encode the Envelopes of protocol version 2.
+type envelopeEncoding interface {
+	Codec
+	// Encodes an Envelope of p with seq.
+	marshalEnvelope(p Payload, seq uint64) ([]byte, error)
+	// Decodes an Envelope, leaving its Payload encoded.
+	unmarshalEnvelope(b []byte) (Envelope, error)
+	// Decodes the Payload of an Envelope into p.
+	unmarshalPayload(b []byte, p Payload) error
+}
+
+// Msg as an array, see SubprotocolMsgpack.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string                { return SubprotocolMsgpack }
+func (msgpackCodec) FrameType() websocket.MessageType   { return websocket.MessageBinary }
+func (msgpackCodec) Marshal(msg Msg) ([]byte, error)    { return msgpack.MarshalAsArray(msg) }
+func (msgpackCodec) Unmarshal(b []byte, msg *Msg) error { return unmarshalMsgpack(b, msg, true) }
+
+func (msgpackCodec) marshalTo(buf *bytes.Buffer, msg Msg) error {
+	return msgpack.MarshalWriteAsArray(buf, msg)
+}
+
+// The Envelope is an array, its Payload a map.
+func (msgpackCodec) marshalEnvelope(p Payload, seq uint64) ([]byte, error) {
+	b, err := msgpack.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.MarshalAsArray(Envelope{Type: p.MsgType(), Payload: b, Seq: seq})
+}
+
+func (msgpackCodec) unmarshalEnvelope(b []byte) (env Envelope, err error) {
+	err = unmarshalMsgpack(b, &env, true)
+	return env, err
+}
+
+func (msgpackCodec) unmarshalPayload(b []byte, p Payload) error {
+	return unmarshalMsgpack(b, p, false)
+}
+
+// Msg as an object, see SubprotocolJSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string                { return SubprotocolJSON }
+func (jsonCodec) FrameType() websocket.MessageType   { return websocket.MessageText }
+func (jsonCodec) Marshal(msg Msg) ([]byte, error)    { return json.Marshal(msg) }
+func (jsonCodec) Unmarshal(b []byte, msg *Msg) error { return json.Unmarshal(b, msg) }
+
+func (jsonCodec) marshalTo(buf *bytes.Buffer, msg Msg) error {
+	if err := json.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+	// Encode ends the object with a newline, which Marshal does not.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// The Envelope is an object, with its Payload inline.
+func (jsonCodec) marshalEnvelope(p Payload, seq uint64) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonEnvelope{Type: p.MsgType(), Payload: b, Seq: seq})
+}
+
+func (jsonCodec) unmarshalEnvelope(b []byte) (Envelope, error) {
+	var env jsonEnvelope
+	err := json.Unmarshal(b, &env)
+	return Envelope{Type: env.Type, Payload: env.Payload, Seq: env.Seq}, err
+}
+
+func (jsonCodec) unmarshalPayload(b []byte, p Payload) error {
+	return json.Unmarshal(b, p)
+}
+
+// Msg as a map, see SubprotocolCBOR.
+type cborCodec struct{}
+
+func (cborCodec) Subprotocol() string                { return SubprotocolCBOR }
+func (cborCodec) FrameType() websocket.MessageType   { return websocket.MessageBinary }
+func (cborCodec) Marshal(msg Msg) ([]byte, error)    { return cbor.Marshal(msg) }
+func (cborCodec) Unmarshal(b []byte, msg *Msg) error { return cbor.Unmarshal(b, msg) }
+
+func (cborCodec) marshalTo(buf *bytes.Buffer, msg Msg) error {
+	return cbor.NewEncoder(buf).Encode(msg)
+}
+
+// The Envelope is a map, with its Payload inline.
+func (cborCodec) marshalEnvelope(p Payload, seq uint64) ([]byte, error) {
+	b, err := cbor.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(cborEnvelope{Type: p.MsgType(), Payload: b, Seq: seq})
+}
+
+func (cborCodec) unmarshalEnvelope(b []byte) (Envelope, error) {
+	var env cborEnvelope
+	err := cbor.Unmarshal(b, &env)
+	return Envelope{Type: env.Type, Payload: env.Payload, Seq: env.Seq}, err
+}
+
+func (cborCodec) unmarshalPayload(b []byte, p Payload) error {
+	return cbor.Unmarshal(b, p)
+}
+
+// An Envelope in the encoding of base, see SubprotocolMsgpackV2.
+type envelopeCodec struct {
+	base        envelopeEncoding
+	subprotocol string
+}
+
+func (c envelopeCodec) Subprotocol() string              { return c.subprotocol }
+func (c envelopeCodec) FrameType() websocket.MessageType { return c.base.FrameType() }
+
+func (c envelopeCodec) Marshal(msg Msg) ([]byte, error) {
+	return c.base.marshalEnvelope(PayloadOf(msg), msg.Seq)
+}
+
+func (c envelopeCodec) Unmarshal(b []byte, msg *Msg) error {
+	p, seq, err := decodeEnvelope(c.base, b)
+	if err != nil {
+		return err
+	}
+	*msg = p.AsMsg()
+	msg.Seq = seq
+	return nil
+}
+
+// Returns the encoding of codec's Envelopes: its base if it is a version 2 codec, otherwise its own.
+func envelopeEncodingOf(codec Codec) (envelopeEncoding, error) {
+	switch c := codec.(type) {
+	case envelopeCodec:
+		return c.base, nil
+	case envelopeEncoding:
+		return c, nil
+	}
+	return nil, fmt.Errorf("signaling: codec %s has no envelope", codec.Subprotocol())
+}
+
+// Decodes b into v with msgpack, as an array if asArray is set, otherwise as a map.
+//
+// The msgpack decoder can panic on truncated input, so a panic is returned as an error.
+func unmarshalMsgpack(b []byte, v any, asArray bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed msgpack: %v", r)
+		}
+	}()
+	if asArray {
+		return msgpack.UnmarshalAsArray(b, v)
+	}
+	return msgpack.Unmarshal(b, v)
+}
+
+// Returns the subprotocols the server accepts from a client on protocol version v,
+// in order of preference.
+func subprotocols(v int) []string {
+	var out []string
+	for _, c := range codecs {
+		if _, v2 := c.(envelopeCodec); v2 && v < 2 {
+			continue
+		}
+		out = append(out, c.Subprotocol())
+	}
+	return out
+}
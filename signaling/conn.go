@@ -0,0 +1,345 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+)
+
+var (
+	errQueueFull  = errors.New("signaling: write queue full")
+	errConnClosed = errors.New("signaling: connection closed")
+	errPingFailed = errors.New("signaling: ping failed")
+)
+
+// A websocket connection whose writes are serialized by a single writer goroutine.
+//
+// Messages are written in the order they are queued.
+type queuedConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+	// messages waiting to be written, at most depth.
+	pending []outgoing
+	depth   int
+	// signals the writer goroutine that pending is not empty.
+	wake chan struct{}
+	// closed and replaced when the writer takes a message, waking senders waiting for room.
+	space chan struct{}
+	// per write timeout, and how long senders wait for room in the queue.
+	timeout time.Duration
+	// the connection's lifetime. Cancelled when it closes, cancelling in-flight reads and writes.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed when the writer goroutine exits.
+	done     chan struct{}
+	stopOnce sync.Once
+	// called when a write fails, can be nil.
+	onWriteErr func(error)
+	// called when an IceCandidate is dropped because the queue is full, can be nil.
+	onDrop func()
+	// Seq of the last message written. Only used by the writer goroutine.
+	seq uint64
+}
+
+// A message, or a close frame, waiting to be written.
+type outgoing struct {
+	msg Msg
+	// if set, the connection is closed with code and reason instead of writing msg.
+	close  bool
+	code   websocket.StatusCode
+	reason string
+}
+
+// Wraps ws and starts its writer goroutine.
+//
+// The connection's context is derived from ctx. Cancelling ctx closes the connection.
+// depth is how many messages can wait to be written. timeout is the per write timeout.
+//
+// onWriteErr is called when a write fails, and onDrop when an IceCandidate is dropped
+// because the queue is full. Both can be nil.
+func newQueuedConn(ctx context.Context, ws *websocket.Conn, depth int, timeout time.Duration, onWriteErr func(error), onDrop func()) *queuedConn {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &queuedConn{
+		Conn:       ws,
+		depth:      depth,
+		wake:       make(chan struct{}, 1),
+		space:      make(chan struct{}),
+		timeout:    timeout,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		onWriteErr: onWriteErr,
+		onDrop:     onDrop,
+	}
+	go c.writeLoop()
+	return c
+}
+
+// The host's connection to the signaling server.
+//
+// Messages from the host to the server are written on a HostConn by the host client,
+// and messages from the server to the host are written on it by the server.
+type HostConn struct {
+	*queuedConn
+	// set for a room created with CreateRoom, which shares the host's websocket.
+	// Messages sent on the HostConn carry it, so the other side can tell rooms apart.
+	roomId qp2p.RoomId
+}
+
+// Returns a HostConn for roomId that shares c's websocket. See CreateRoom.
+func (c *HostConn) forRoom(roomId qp2p.RoomId) *HostConn {
+	return &HostConn{queuedConn: c.queuedConn, roomId: roomId}
+}
+
+// Queues msg to be written, see queuedConn.send. msg carries the connection's RoomId, if it has one.
+func (c *HostConn) send(ctx context.Context, msg Msg) error {
+	return c.queuedConn.send(ctx, c.tag(msg))
+}
+
+// Sets msg.RoomId to the connection's RoomId, if it has one.
+func (c *HostConn) tag(msg Msg) Msg {
+	if c.roomId != "" {
+		msg.RoomId = c.roomId
+	}
+	return msg
+}
+
+// Queues messages on a connection: a *queuedConn, *HostConn or *GuestConn.
+type msgSender interface {
+	send(ctx context.Context, msg Msg) error
+}
+
+// A guest's connection to the signaling server.
+//
+// Messages from the guest to the server are written on a GuestConn by the guest client,
+// and messages from the server to the guest are written on it by the server.
+type GuestConn struct {
+	*queuedConn
+}
+
+// Wraps the host's websocket ws. See newQueuedConn.
+func newHostConn(ctx context.Context, ws *websocket.Conn, depth int, timeout time.Duration, onWriteErr func(error), onDrop func()) *HostConn {
+	return &HostConn{queuedConn: newQueuedConn(ctx, ws, depth, timeout, onWriteErr, onDrop)}
+}
+
+// Wraps a guest's websocket ws. See newQueuedConn.
+func newGuestConn(ctx context.Context, ws *websocket.Conn, depth int, timeout time.Duration, onWriteErr func(error), onDrop func()) *GuestConn {
+	return &GuestConn{newQueuedConn(ctx, ws, depth, timeout, onWriteErr, onDrop)}
+}
+
+func (c *queuedConn) writeLoop() {
+	deadline := writeDeadline{parent: c.ctx}
+	defer deadline.release()
+	for {
+		out, ok := c.next()
+		if !ok {
+			select {
+			case <-c.done:
+				return
+			case <-c.ctx.Done():
+				c.CloseNow()
+				return
+			case <-c.wake:
+			}
+			continue
+		}
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if out.close {
+			// tell the peer why first, as some websocket libraries hide the close reason.
+			if _, ok := closeStatuses[out.code]; ok {
+				WriteMsg(deadline.start(c.timeout), c.Conn, ErrorMsg{Code: int(out.code), Detail: out.reason}.AsMsg())
+				deadline.stop()
+			}
+			c.Conn.Close(out.code, out.reason)
+			c.stop()
+			return
+		}
+		// a message that already has a Seq, e.g. one replayed, keeps it.
+		if out.msg.Seq == 0 {
+			c.seq++
+			out.msg.Seq = c.seq
+		}
+		err := WriteMsg(deadline.start(c.timeout), c.Conn, out.msg)
+		deadline.stop()
+		if err != nil {
+			if c.onWriteErr != nil {
+				c.onWriteErr(err)
+			}
+			c.Conn.CloseNow()
+			c.stop()
+			return
+		}
+	}
+}
+
+// A context for the writes on a connection, reused from write to write.
+//
+// The websocket library takes a context per write instead of a deadline,
+// and a context with a timeout per write allocates on every message.
+// Only used by the writer goroutine.
+type writeDeadline struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+}
+
+// Returns the write context, done after timeout unless stop is called first.
+func (d *writeDeadline) start(timeout time.Duration) context.Context {
+	if d.ctx == nil {
+		ctx, cancel := context.WithCancelCause(d.parent)
+		d.ctx, d.cancel = ctx, cancel
+		d.timer = time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+		return d.ctx
+	}
+	d.timer.Reset(timeout)
+	return d.ctx
+}
+
+// Stops the timeout of the current write.
+func (d *writeDeadline) stop() {
+	// the timeout fired, or is firing, so the next write needs a new context.
+	if !d.timer.Stop() {
+		d.cancel(context.DeadlineExceeded)
+		d.ctx = nil
+	}
+}
+
+// Releases the context.
+func (d *writeDeadline) release() {
+	if d.ctx != nil {
+		d.timer.Stop()
+		d.cancel(nil)
+	}
+}
+
+// Takes the oldest queued message, and wakes the senders waiting for room.
+func (c *queuedConn) next() (outgoing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return outgoing{}, false
+	}
+	out := c.pending[0]
+	c.pending[0] = outgoing{}
+	c.pending = c.pending[1:]
+	close(c.space)
+	c.space = make(chan struct{})
+	return out, true
+}
+
+// Queues msg to be written.
+//
+// If the queue is full, an IceCandidate message replaces the oldest queued IceCandidate,
+// or is dropped if none is queued.
+// Other messages wait for room in the queue until ctx is done, or up to the connection's
+// write timeout, closing the connection if there is none by then.
+func (c *queuedConn) send(ctx context.Context, msg Msg) error {
+	return c.enqueue(ctx, outgoing{msg: msg}, msg.Type == IceCandidate)
+}
+
+func (c *queuedConn) enqueue(ctx context.Context, out outgoing, droppable bool) error {
+	var expired <-chan time.Time
+	for {
+		space, err := c.tryEnqueue(out, droppable)
+		if space == nil {
+			return err
+		}
+		if expired == nil {
+			t := time.NewTimer(c.timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-c.done:
+			return errConnClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-space:
+		case <-expired:
+			c.CloseNow()
+			return fmt.Errorf("%w, closed connection", errQueueFull)
+		}
+	}
+}
+
+// Queues out if there is room for it.
+//
+// Returns a channel that is closed when there is room if out has to wait.
+func (c *queuedConn) tryEnqueue(out outgoing, droppable bool) (<-chan struct{}, error) {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return nil, errConnClosed
+	default:
+	}
+	if len(c.pending) < c.depth {
+		c.pending = append(c.pending, out)
+		c.mu.Unlock()
+		c.signal()
+		return nil, nil
+	}
+	if !droppable {
+		space := c.space
+		c.mu.Unlock()
+		return space, nil
+	}
+	// the oldest candidate is the least useful, as the guest has likely moved past it.
+	i := slices.IndexFunc(c.pending, func(o outgoing) bool { return !o.close && o.msg.Type == IceCandidate })
+	if i >= 0 {
+		c.pending = append(slices.Delete(c.pending, i, i+1), out)
+	}
+	c.mu.Unlock()
+	if c.onDrop != nil {
+		c.onDrop()
+	}
+	if i < 0 {
+		return nil, errQueueFull
+	}
+	c.signal()
+	return nil, nil
+}
+
+// Wakes the writer goroutine.
+func (c *queuedConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Closes the connection with the status code and reason, after the queued messages are written.
+//
+// Blocks until the connection is closed.
+func (c *queuedConn) Close(code websocket.StatusCode, reason string) error {
+	if err := c.enqueue(c.ctx, outgoing{close: true, code: code, reason: reason}, false); err != nil {
+		return err
+	}
+	<-c.done
+	return nil
+}
+
+// Closes the connection without writing the queued messages.
+func (c *queuedConn) CloseNow() error {
+	c.stop()
+	return c.Conn.CloseNow()
+}
+
+// Stops the writer goroutine, and cancels the connection's context.
+func (c *queuedConn) stop() {
+	c.stopOnce.Do(func() {
+		c.cancel()
+		close(c.done)
+	})
+}
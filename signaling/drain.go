@@ -0,0 +1,55 @@
+package signaling
+
+// Header set to "true" on the 503 sent to new hosts while the server is draining.
+const DrainingHeader = "X-Server-Draining"
+
+// SetDraining stops or resumes accepting new hosts.
+//
+// While draining, GET /host responds 503 with the DrainingHeader header.
+// Guests can still join and rejoin existing rooms, and hosts can still resume them.
+// The channel returned by Drained closes once the last room closes.
+//
+// Call Shutdown to close the remaining rooms at a deadline.
+func (s *WebsocketSignalingServer) SetDraining(draining bool) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	s.draining.Store(draining)
+	if !draining {
+		select {
+		case <-s.drained:
+			// drained before, wait for the next drain.
+			s.drained = make(chan struct{})
+		default:
+		}
+		return
+	}
+	s.checkDrainedLocked()
+}
+
+// Drained returns a channel that is closed once the server is draining and has no rooms left.
+func (s *WebsocketSignalingServer) Drained() <-chan struct{} {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	return s.drained
+}
+
+// Releases a room slot taken by reserveRoom.
+func (s *WebsocketSignalingServer) releaseRoom() {
+	if s.roomCount.Add(-1) == 0 && s.draining.Load() {
+		s.drainMu.Lock()
+		defer s.drainMu.Unlock()
+		s.checkDrainedLocked()
+	}
+}
+
+// Closes s.drained if the server is draining and has no rooms. s.drainMu must be held.
+func (s *WebsocketSignalingServer) checkDrainedLocked() {
+	if !s.draining.Load() || s.roomCount.Load() != 0 {
+		return
+	}
+	select {
+	case <-s.drained:
+	default:
+		close(s.drained)
+	}
+}
@@ -0,0 +1,48 @@
+package signaling_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+)
+
+// While draining, new hosts are turned away, but existing rooms keep signaling and admitting guests.
+// Drained closes once the last of them closes.
+func TestDraining(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	idle := srv.Host(t)
+
+	srv.SetDraining(true)
+	status, body := getError(t, srv, "host", nil)
+	if status != http.StatusServiceUnavailable || body.Code != signaling.CodeDraining {
+		t.Fatalf("new host got %d %q, want %d %q", status, body.Code, http.StatusServiceUnavailable, signaling.CodeDraining)
+	}
+
+	g.SendCandidate(0)
+	if c := host.Expect(signaling.IceCandidate); c.GuestId != guestId || c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q from %v", c.Candidate, c.GuestId)
+	}
+	host.SendCandidate(guestId, 1)
+	if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q", c.Candidate)
+	}
+	joinRoom(t, srv, host)
+
+	idle.Close()
+	select {
+	case <-srv.Drained():
+		t.Fatal("Drained closed with a room still open")
+	case <-time.After(200 * time.Millisecond):
+	}
+	host.Close()
+	select {
+	case <-srv.Drained():
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("Drained not closed after the last room closed")
+	}
+}
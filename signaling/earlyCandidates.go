@@ -0,0 +1,63 @@
+package signaling
+
+import (
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// How long remote candidates that arrived before their agent are kept, see earlyCandidates.
+const earlyCandidatesTimeout = 5 * time.Second
+
+// Most remote candidates kept for one guest, see earlyCandidates.
+const maxEarlyCandidates = 64
+
+// Remote candidates that arrived before the client could add them to an agent, e.g. a guest's
+// candidates the server forwarded before its GuestJoined. They are kept as read, still sealed,
+// until taken or for earlyCandidatesTimeout.
+//
+// Only used by the reading goroutine.
+type earlyCandidates struct {
+	m map[qp2p.GuestID]*earlyBatch
+}
+
+type earlyBatch struct {
+	raw     []string
+	arrived time.Time
+}
+
+// Keeps guestId's candidates in raw, up to maxEarlyCandidates, and drops the ones kept too long.
+func (e *earlyCandidates) add(guestId qp2p.GuestID, raw []string) {
+	if e.m == nil {
+		e.m = make(map[qp2p.GuestID]*earlyBatch)
+	}
+	now := time.Now()
+	for id, b := range e.m {
+		if now.Sub(b.arrived) > earlyCandidatesTimeout {
+			delete(e.m, id)
+		}
+	}
+	b, ok := e.m[guestId]
+	if !ok {
+		b = &earlyBatch{arrived: now}
+		e.m[guestId] = b
+	}
+	for _, c := range raw {
+		if c != "" && len(b.raw) < maxEarlyCandidates {
+			b.raw = append(b.raw, c)
+		}
+	}
+}
+
+// Returns the candidates kept for guestId, and forgets them.
+func (e *earlyCandidates) take(guestId qp2p.GuestID) []string {
+	b, ok := e.m[guestId]
+	if !ok {
+		return nil
+	}
+	delete(e.m, guestId)
+	if time.Since(b.arrived) > earlyCandidatesTimeout {
+		return nil
+	}
+	return b.raw
+}
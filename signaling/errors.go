@@ -0,0 +1,212 @@
+package signaling
+
+import (
+	"errors"
+
+	"github.com/coder/websocket"
+)
+
+// ErrRoomNotFound is returned to a guest joining a room that does not exist,
+// or that closed before the guest could join.
+var ErrRoomNotFound = errors.New("signaling: room not found")
+
+// ErrWrongPassword is returned to a guest whose password does not match the room password.
+var ErrWrongPassword = errors.New("signaling: wrong password")
+
+// ErrRoomFull is returned to a guest joining a room that has MaxGuests guests.
+var ErrRoomFull = errors.New("signaling: room full")
+
+// ErrHostTimeout is returned to a guest when the host does not answer its
+// GuestAuth with HostAuth within the server's handshake timeout.
+var ErrHostTimeout = errors.New("signaling: host did not respond")
+
+// ErrRoomLocked is returned to a guest joining a room the host has locked.
+var ErrRoomLocked = errors.New("signaling: room locked")
+
+// ErrJoinRejected is returned to a guest the host rejected from a room that needs approval.
+var ErrJoinRejected = errors.New("signaling: join rejected by host")
+
+// ErrHostUnresponsive is returned to the host and guests when the server closes the room
+// because the host stopped sending Heartbeat messages.
+var ErrHostUnresponsive = errors.New("signaling: host unresponsive")
+
+// ErrKicked is returned to a guest the host or an admin kicked from the room.
+var ErrKicked = errors.New("signaling: kicked")
+
+// ErrHostOffline is returned to a guest when the host leaves and the room closes.
+var ErrHostOffline = errors.New("signaling: host offline")
+
+// ErrBanned is returned to a guest joining a room that banned its IP address.
+var ErrBanned = errors.New("signaling: banned")
+
+// ErrRateLimited is returned when the server closes a connection that sent too many messages,
+// or turns away a request like CheckRoom.
+var ErrRateLimited = errors.New("signaling: rate limited")
+
+// ErrInvalidMessage is returned when the server closes a connection that sent a message
+// it does not accept, like an unexpected message type, and by ReadMsg for a frame
+// that can't be decoded.
+var ErrInvalidMessage = errors.New("signaling: invalid message")
+
+// ErrInvalidCredentials is returned for ICE credentials that RFC 8445 does not allow,
+// by ValidateCredentials, or when the server closes a connection that sent them in GuestAuth or HostAuth.
+var ErrInvalidCredentials = errors.New("signaling: invalid ICE credentials")
+
+// ErrRoomSecretMismatch is logged by the clients when a peer's ICE credentials or candidates
+// can't be opened, because only one side set ClientOptions.RoomSecret, or their secrets differ.
+var ErrRoomSecretMismatch = errors.New("signaling: room secret mismatch")
+
+// ErrInviteNotFound is returned to a guest joining with an invite token the server does not know,
+// e.g. because its room closed.
+var ErrInviteNotFound = errors.New("signaling: invite not found")
+
+// ErrInviteExpired is returned to a guest joining with an invite token that was already used or has expired.
+var ErrInviteExpired = errors.New("signaling: invite used or expired")
+
+// ErrMetadataTooLong is returned for guest metadata longer than MaxGuestMetadataLen.
+var ErrMetadataTooLong = errors.New("signaling: guest metadata too long")
+
+// ErrUnauthorized is returned when the server's Authenticator or admin token rejects the request.
+var ErrUnauthorized = errors.New("signaling: unauthorized")
+
+// ErrServerUnavailable is returned when the server turns a host or guest away because it is
+// shutting down, draining or at capacity, or the node hosting the room can't be reached.
+// HTTPError.RetryAfter says when to try again, if set.
+var ErrServerUnavailable = errors.New("signaling: server unavailable")
+
+// ErrInvalidResumeToken is returned when resuming a room or rejoining as a guest with a wrong
+// or already used resume token.
+var ErrInvalidResumeToken = errors.New("signaling: invalid resume token")
+
+// ErrInvalidRoomId is returned to a host that asked for a room ID the server does not allow,
+// see ServerOptions.VanityRoomIds and ServerOptions.RoomIdFilter.
+var ErrInvalidRoomId = errors.New("signaling: invalid room id")
+
+// ErrRoomIdTaken is returned to a host that asked for a room ID another room has.
+var ErrRoomIdTaken = errors.New("signaling: room id taken")
+
+// ErrReplaced is returned when the connection is replaced by a newer one
+// that resumed the room or rejoined as the same guest.
+var ErrReplaced = errors.New("signaling: replaced by another connection")
+
+// ErrDuplicateGuest is returned to a guest whose GuestID, from ServerOptions.GuestIDAssigner,
+// is already used by a guest on the server.
+var ErrDuplicateGuest = errors.New("signaling: duplicate guest id")
+
+// ErrRoomExpired is returned when the server closes a room that reached ServerOptions.MaxRoomAge,
+// or had no guests for ServerOptions.IdleRoomTimeout.
+var ErrRoomExpired = errors.New("signaling: room expired")
+
+// ErrUnsupportedVersion is returned when the signaling server does not support
+// qp2p.ProtocolVersion.
+var ErrUnsupportedVersion = errors.New("signaling: unsupported protocol version")
+
+// ErrMessageTooLarge is returned by ReadMsg when the peer sends a message over
+// the connection's read limit. The connection is closed with StatusMessageTooBig.
+var ErrMessageTooLarge = errors.New("signaling: message too large")
+
+// ErrCandidateRejected is matched by a ServerError for an IceCandidate the server dropped,
+// e.g. for being too long.
+var ErrCandidateRejected = errors.New("signaling: candidate rejected")
+
+// ErrNotJoined is returned by the guest client for messages it can only send once the server
+// has sent Joined, see GuestClient.WaitJoined.
+var ErrNotJoined = errors.New("signaling: not joined yet")
+
+// ErrConnectionLost is returned by the host client's Listen when the connection to the server closes
+// without a close status the server sends, or breaks, e.g. because the server went offline.
+var ErrConnectionLost = errors.New("signaling: connection to server lost")
+
+// ErrGuestNotConnected is returned by the host client for a guest it has no ICE agent for,
+// e.g. one that already left.
+var ErrGuestNotConnected = errors.New("signaling: guest not connected")
+
+// Close statuses the server closes hosts and guests with.
+//
+// Switch on websocket.CloseStatus(err), or use errors.Is with the matching Err value.
+// The close reason is the status name, e.g. "kicked", optionally followed by ": " and details.
+const (
+	// StatusKicked is sent to a guest kicked by the host or an admin.
+	StatusKicked websocket.StatusCode = 4001
+	// StatusHostOffline is sent to guests when the host leaves and the room closes.
+	StatusHostOffline websocket.StatusCode = 4002
+	// StatusWrongPassword is the close status sent to a guest whose
+	// password does not match the room password.
+	StatusWrongPassword websocket.StatusCode = 4003
+	// StatusRoomClosed is the close status sent to a guest when the room
+	// closes while its websocket is being accepted, or is closed by an admin or shutdown.
+	StatusRoomClosed websocket.StatusCode = 4004
+	// StatusRoomFull is the close status sent to a guest when the room
+	// fills up while its websocket is being accepted.
+	StatusRoomFull websocket.StatusCode = 4005
+	// StatusRateLimited is sent to a host or guest that sent too many messages.
+	StatusRateLimited websocket.StatusCode = 4006
+	// StatusInvalidMessage is sent to a host or guest that sent a message the server does not accept.
+	StatusInvalidMessage websocket.StatusCode = 4007
+	// StatusHostTimeout is the close status sent to a guest when the host
+	// does not send HostAuth within the handshake timeout.
+	StatusHostTimeout websocket.StatusCode = 4008
+	// StatusJoinRejected is the close status sent to a guest when the host
+	// rejects its JoinRequest. The close reason is the host's.
+	StatusJoinRejected websocket.StatusCode = 4009
+	// StatusRoomLocked is the close status sent to a guest when the host
+	// locks the room while the guest's websocket is being accepted.
+	StatusRoomLocked websocket.StatusCode = 4010
+	// StatusReplaced is sent to a host or guest connection replaced by a newer one.
+	StatusReplaced websocket.StatusCode = 4011
+	// StatusRoomExpired is sent to the host and guests of a room closed for its age or for being idle.
+	StatusRoomExpired websocket.StatusCode = 4012
+	// StatusHostUnresponsive is sent to the host and guests of a room closed because the host
+	// missed too many Heartbeat messages.
+	StatusHostUnresponsive websocket.StatusCode = 4013
+	// StatusDuplicateGuest is sent to a guest whose GuestID is already used by another guest,
+	// see ServerOptions.DuplicateGuests.
+	StatusDuplicateGuest websocket.StatusCode = 4014
+)
+
+// The name and error of each close status.
+var closeStatuses = map[websocket.StatusCode]struct {
+	name string
+	err  error
+}{
+	StatusKicked:           {"kicked", ErrKicked},
+	StatusHostOffline:      {"host_offline", ErrHostOffline},
+	StatusWrongPassword:    {"wrong_password", ErrWrongPassword},
+	StatusRoomClosed:       {"room_closed", ErrRoomNotFound},
+	StatusRoomFull:         {"room_full", ErrRoomFull},
+	StatusRateLimited:      {"rate_limited", ErrRateLimited},
+	StatusInvalidMessage:   {"invalid_message", ErrInvalidMessage},
+	StatusHostTimeout:      {"host_timeout", ErrHostTimeout},
+	StatusJoinRejected:     {"join_rejected", ErrJoinRejected},
+	StatusRoomLocked:       {"room_locked", ErrRoomLocked},
+	StatusReplaced:         {"replaced", ErrReplaced},
+	StatusRoomExpired:      {"room_expired", ErrRoomExpired},
+	StatusHostUnresponsive: {"host_unresponsive", ErrHostUnresponsive},
+	StatusDuplicateGuest:   {"duplicate_guest", ErrDuplicateGuest},
+
+	// the server only closes with a policy violation for invalid ICE credentials.
+	websocket.StatusPolicyViolation: {"invalid_credentials", ErrInvalidCredentials},
+}
+
+// Returns the close reason for code, "name" or "name: detail".
+//
+// The reason is cut to the 123 bytes a close frame can carry.
+func closeReason(code websocket.StatusCode, detail string) string {
+	reason := closeStatuses[code].name
+	if reason == "" {
+		reason = detail // e.g. websocket.StatusNormalClosure.
+	} else if detail != "" {
+		reason += ": " + detail
+	}
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return reason
+}
+
+// Maps the close status of err to an exported error.
+//
+// Returns nil if the status has no matching error.
+func closeError(err error) error {
+	return closeStatuses[websocket.CloseStatus(err)].err
+}
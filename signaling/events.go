@@ -0,0 +1,178 @@
+package signaling
+
+import (
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// ServerEvent is sent on the channel returned by WebsocketSignalingServer.Events.
+//
+// It is one of RoomOpenedEvent, RoomClosedEvent, GuestJoinedEvent, GuestLeftEvent or MessageRejectedEvent.
+type ServerEvent interface {
+	serverEvent()
+}
+
+// A host created a room.
+type RoomOpenedEvent struct {
+	RoomId qp2p.RoomId
+	// Identity of the host from ServerOptions.Authenticator, or empty.
+	Identity string
+}
+
+// A room closed and its guests were kicked.
+type RoomClosedEvent struct {
+	RoomId qp2p.RoomId
+	Reason string
+}
+
+// A guest sent GuestAuth and the host was told that it joined.
+type GuestJoinedEvent struct {
+	RoomId     qp2p.RoomId
+	GuestId    qp2p.GuestID
+	RemoteAddr string
+	// Identity of the guest from ServerOptions.Authenticator, or empty.
+	Identity string
+}
+
+// A guest left its room.
+type GuestLeftEvent struct {
+	RoomId  qp2p.RoomId
+	GuestId qp2p.GuestID
+	Reason  string
+}
+
+// The server dropped a message, or closed a connection, because it broke the rules.
+//
+// RoomId is empty if the connection was not in a room yet.
+type MessageRejectedEvent struct {
+	RoomId qp2p.RoomId
+	Reason string
+}
+
+func (RoomOpenedEvent) serverEvent()      {}
+func (RoomClosedEvent) serverEvent()      {}
+func (GuestJoinedEvent) serverEvent()     {}
+func (GuestLeftEvent) serverEvent()       {}
+func (MessageRejectedEvent) serverEvent() {}
+
+// Events returns the channel that server events are sent on.
+//
+// Events never block the server. When the buffer is full the oldest event is dropped.
+// The channel is closed by Shutdown.
+func (s *WebsocketSignalingServer) Events() <-chan ServerEvent {
+	return s.events
+}
+
+// Sends ev on the events channel, dropping the oldest event if it is full.
+func (s *WebsocketSignalingServer) emit(ev ServerEvent) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if s.eventsClosed {
+		return
+	}
+	if s.webhooks != nil {
+		s.webhooks.send(ev)
+	}
+	for {
+		select {
+		case s.events <- ev:
+			return
+		default:
+		}
+		// drop the oldest event to make room.
+		select {
+		case <-s.events:
+		default:
+		}
+	}
+}
+
+// Closes the events channel.
+func (s *WebsocketSignalingServer) closeEvents() {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if !s.eventsClosed {
+		s.eventsClosed = true
+		close(s.events)
+		if s.webhooks != nil {
+			s.webhooks.close()
+		}
+	}
+}
+
+// HostEvent is passed to the function set with HostClient.OnEvent.
+//
+// It is one of GuestConnectingEvent, GuestConnectedEvent, GuestConnectFailedEvent or GuestDisconnectedEvent.
+// Each guest's events come in that order: GuestConnectingEvent, then GuestConnectedEvent or GuestConnectFailedEvent,
+// unless the guest disconnects first, then one GuestDisconnectedEvent.
+//
+// Or it is one of ReconnectingEvent, ReconnectedEvent or ResumeFailedEvent, about the connection to the server.
+type HostEvent interface {
+	guestId() qp2p.GuestID
+}
+
+// The server told the host a guest joined, and the host is dialing it.
+type GuestConnectingEvent struct {
+	GuestId qp2p.GuestID
+	// The room the guest joined, see HostClient.CreateRoom.
+	RoomId qp2p.RoomId
+}
+
+// The host's ICE connection to a guest is open. It is the PeerConn passed to Listen's onConnection.
+type GuestConnectedEvent struct {
+	GuestId qp2p.GuestID
+	Conn    PeerConn
+}
+
+// The host could not connect to a guest, and kicked it with KickConnectionFailed.
+type GuestConnectFailedEvent struct {
+	GuestId qp2p.GuestID
+	Err     error
+}
+
+// A guest is gone: the server said it disconnected, its ICE connection failed, the host kicked it, or its room closed.
+type GuestDisconnectedEvent struct {
+	GuestId qp2p.GuestID
+	// From the server's GuestDisconnected, e.g. ReasonLeft, or one of the reasons below.
+	Reason string
+}
+
+// Reasons in GuestDisconnectedEvent for disconnects the host client notices itself.
+const (
+	// The guest's ICE connection failed after it was open. The host kicks the guest with KickConnectionFailed.
+	ReasonConnectionLost = "connection_lost"
+	// The host closed the guest's room, or its connection to the server.
+	ReasonRoomClosed = "room_closed"
+	// The host kicked the guest with HostClient.Kick.
+	ReasonKickedByHost = "kicked_by_host"
+	// The host banned the guest with HostClient.Ban.
+	ReasonBannedByHost = "banned_by_host"
+)
+
+func (e GuestConnectingEvent) guestId() qp2p.GuestID    { return e.GuestId }
+func (e GuestConnectedEvent) guestId() qp2p.GuestID     { return e.GuestId }
+func (e GuestConnectFailedEvent) guestId() qp2p.GuestID { return e.GuestId }
+func (e GuestDisconnectedEvent) guestId() qp2p.GuestID  { return e.GuestId }
+
+// The connection to the server dropped, and the host client is dialing it again to resume the room,
+// see ClientOptions.DisableReconnect. Connections to guests are kept meanwhile.
+type ReconnectingEvent struct {
+	// 1 for the first attempt.
+	Attempt int
+	// Why the connection, or the previous attempt, failed.
+	Err error
+}
+
+// The host client resumed the room on a new connection to the server.
+type ReconnectedEvent struct {
+	Attempts int
+}
+
+// The server would not resume the room, e.g. because its grace period ended. Listen returns Err.
+type ResumeFailedEvent struct {
+	Err error
+}
+
+// Events about the connection to the server have no guest.
+func (ReconnectingEvent) guestId() qp2p.GuestID { return qp2p.GuestID{} }
+func (ReconnectedEvent) guestId() qp2p.GuestID  { return qp2p.GuestID{} }
+func (ResumeFailedEvent) guestId() qp2p.GuestID { return qp2p.GuestID{} }
@@ -0,0 +1,62 @@
+package signaling_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+)
+
+// Reads the next event, failing the test if none arrives or the channel is closed.
+func nextEvent(t *testing.T, srv *signalingtest.Server) signaling.ServerEvent {
+	t.Helper()
+	select {
+	case e, ok := <-srv.Events():
+		if !ok {
+			t.Fatal("events channel closed")
+		}
+		return e
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+// A room's life is reported in order, and the channel is closed by Shutdown.
+func TestEventsOfRoomInOrder(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	g.Send(signaling.Msg{Type: signaling.GuestLeave, Reason: "bye"})
+	host.Expect(signaling.GuestDisconnected)
+	host.Close()
+
+	if e, ok := nextEvent(t, srv).(signaling.RoomOpenedEvent); !ok || e.RoomId != host.RoomId {
+		t.Fatalf("first event %#v, want RoomOpenedEvent for %v", e, host.RoomId)
+	}
+	if e, ok := nextEvent(t, srv).(signaling.GuestJoinedEvent); !ok || e.RoomId != host.RoomId || e.GuestId != guestId {
+		t.Fatalf("second event %#v, want GuestJoinedEvent for %v", e, guestId)
+	}
+	if e, ok := nextEvent(t, srv).(signaling.GuestLeftEvent); !ok || e.RoomId != host.RoomId || e.GuestId != guestId || e.Reason != "bye" {
+		t.Fatalf("third event %#v, want GuestLeftEvent for %v with reason bye", e, guestId)
+	}
+	if e, ok := nextEvent(t, srv).(signaling.RoomClosedEvent); !ok || e.RoomId != host.RoomId {
+		t.Fatalf("fourth event %#v, want RoomClosedEvent for %v", e, host.RoomId)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalingtest.Timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e, ok := <-srv.Events():
+		if ok {
+			t.Fatalf("got %#v after the room closed, want the channel closed", e)
+		}
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("events channel not closed by Shutdown")
+	}
+}
@@ -0,0 +1,24 @@
+package signaling
+
+import (
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+)
+
+// Seals ufrag and pwd as a host with the room secret does in its HostAuth to guestId.
+func SealHostCredentials(secret string, guestId qp2p.GuestID, ufrag, pwd string) (string, string, error) {
+	return roomSealer{secret: secret}.sealCredentials(guestId, sealedByHost, ufrag, pwd)
+}
+
+// Decodes a frame of type t as ReadMsgCodec does once it has read it.
+func DecodeFrame(codec Codec, t websocket.MessageType, b []byte) (Msg, error) {
+	var msg Msg
+	err := decodeFrame(codec, t, b, &msg)
+	return msg, err
+}
+
+// Checks a candidate as the server does before forwarding it, see checkCandidate.
+var CheckCandidate = checkCandidate
+
+// Prefix of candidates sealed with the room secret.
+const SealedPrefix = sealedPrefix
@@ -0,0 +1,119 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Identifies why the server failed an HTTP request, in HTTPError.Code.
+type ErrorCode string
+
+// Error codes the server sends in HTTPError.
+const (
+	CodeInvalidRequest     ErrorCode = "invalid_request"
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+	CodeRoomNotFound       ErrorCode = "room_not_found"
+	CodeRoomFull           ErrorCode = "room_full"
+	CodeRoomLocked         ErrorCode = "room_locked"
+	CodeBanned             ErrorCode = "banned"
+	CodeGuestNotFound      ErrorCode = "guest_not_found"
+	CodeInviteNotFound     ErrorCode = "invite_not_found"
+	CodeInviteExpired      ErrorCode = "invite_expired"
+	CodeInvalidResumeToken ErrorCode = "invalid_resume_token"
+	CodeShuttingDown       ErrorCode = "shutting_down"
+	CodeDraining           ErrorCode = "draining"
+	CodeAtCapacity         ErrorCode = "at_capacity"
+	CodeInvalidRoomId      ErrorCode = "invalid_room_id"
+	CodeRoomIdTaken        ErrorCode = "room_id_taken"
+	CodeNodeUnavailable    ErrorCode = "node_unavailable"
+)
+
+// The error each code maps to on the client.
+var errorCodes = map[ErrorCode]error{
+	CodeUnauthorized:       ErrUnauthorized,
+	CodeForbidden:          ErrUnauthorized,
+	CodeRateLimited:        ErrRateLimited,
+	CodeUnsupportedVersion: ErrUnsupportedVersion,
+	CodeRoomNotFound:       ErrRoomNotFound,
+	CodeRoomFull:           ErrRoomFull,
+	CodeRoomLocked:         ErrRoomLocked,
+	CodeBanned:             ErrBanned,
+	CodeGuestNotFound:      ErrRoomNotFound,
+	CodeInviteNotFound:     ErrInviteNotFound,
+	CodeInviteExpired:      ErrInviteExpired,
+	CodeInvalidResumeToken: ErrInvalidResumeToken,
+	CodeShuttingDown:       ErrServerUnavailable,
+	CodeDraining:           ErrServerUnavailable,
+	CodeAtCapacity:         ErrServerUnavailable,
+	CodeInvalidRoomId:      ErrInvalidRoomId,
+	CodeRoomIdTaken:        ErrRoomIdTaken,
+	CodeNodeUnavailable:    ErrServerUnavailable,
+}
+
+// HTTPError is the JSON body of the server's error responses, sent before the websocket upgrade.
+//
+// The clients return it for a failed dial. errors.Is matches it against the Err value for its Code,
+// e.g. ErrRoomFull for CodeRoomFull.
+type HTTPError struct {
+	// HTTP status of the response. Not part of the body.
+	Status  int       `json:"-"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Seconds to wait before retrying, also sent in the Retry-After header. 0 if unset.
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Protocol versions the server supports, set with CodeUnsupportedVersion.
+	MinVersion int `json:"minVersion,omitempty"`
+	MaxVersion int `json:"maxVersion,omitempty"`
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("signaling: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Returns the Err value for the error's Code, or nil if it has none.
+func (e *HTTPError) Unwrap() error {
+	return errorCodes[e.Code]
+}
+
+// Responds with status and an HTTPError body.
+//
+// Used for failures before the websocket is accepted.
+func writeHTTPError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	writeHTTPErrorBody(w, status, HTTPError{Code: code, Message: message})
+}
+
+// Responds with status and an HTTPError body, telling the client to retry after d.
+func writeRetryAfter(w http.ResponseWriter, status int, code ErrorCode, message string, d time.Duration) {
+	seconds := max(int(d.Seconds()), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeHTTPErrorBody(w, status, HTTPError{Code: code, Message: message, RetryAfter: seconds})
+}
+
+func writeHTTPErrorBody(w http.ResponseWriter, status int, body HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Returns the HTTPError in a failed response from the server.
+//
+// Responses without an HTTPError body, e.g. from a proxy, get an empty Code,
+// or CodeUnsupportedVersion for 426 Upgrade Required.
+func responseError(resp *http.Response) *HTTPError {
+	e := new(HTTPError)
+	json.NewDecoder(resp.Body).Decode(e)
+	e.Status = resp.StatusCode
+	if e.Code == "" && resp.StatusCode == http.StatusUpgradeRequired {
+		e.Code = CodeUnsupportedVersion
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
@@ -0,0 +1,243 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/pion/ice/v4"
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+)
+
+// Public STUN servers for ClientOptions.STUNServers, for applications without their own.
+var DefaultSTUNServers = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun.cloudflare.com:3478",
+}
+
+// Returns a copy of o for play on the local network only, e.g. two machines on the same Wi-Fi with no internet
+// access, and the signaling server on one of them or elsewhere on the LAN.
+//
+// Candidates carry mDNS names instead of addresses, see MulticastDNS, over IPv4 only. No STUN or TURN server is
+// asked, so gathering doesn't wait on servers that can't be reached, and the host only exchanges
+// LANCandidatesOnly. Guests on other networks can't connect.
+func (o ClientOptions) LAN() ClientOptions {
+	o.MulticastDNS = true
+	o.NetworkTypes = []ice.NetworkType{ice.NetworkTypeUDP4}
+	o.STUNServers = nil
+	o.TURNServers = nil
+	o.TURNCredentials = nil
+	o.RelayOnly = false
+	o.CandidateFilter = LANCandidatesOnly
+	return o
+}
+
+// Parses ClientOptions.STUNServers.
+func parseSTUNServers(servers []string) ([]*stun.URI, error) {
+	urls := make([]*stun.URI, 0, len(servers))
+	for _, raw := range servers {
+		u, err := stun.ParseURI(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STUN server %q: %w", raw, err)
+		}
+		if u.Scheme != stun.SchemeTypeSTUN && u.Scheme != stun.SchemeTypeSTUNS {
+			return nil, fmt.Errorf("invalid STUN server %q: scheme must be stun or stuns", raw)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// Parses ClientOptions.TURNServers.
+func parseTURNServers(servers []TURNServer) ([]*stun.URI, error) {
+	urls := make([]*stun.URI, 0, len(servers))
+	for _, server := range servers {
+		u, err := stun.ParseURI(server.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN server %q: %w", server.URL, err)
+		}
+		if u.Scheme != stun.SchemeTypeTURN && u.Scheme != stun.SchemeTypeTURNS {
+			return nil, fmt.Errorf("invalid TURN server %q: scheme must be turn or turns", server.URL)
+		}
+		u.Username, u.Password = server.Username, server.Credential
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// How long ClientOptions.TURNCredentials has to return.
+const turnCredentialsTimeout = 5 * time.Second
+
+// Returns the TURN servers for a new agent, with fresh credentials from ClientOptions.TURNCredentials.
+// If they can't be fetched, the agent only has TURNServers.
+func (s *HostClient) turnServers() []*stun.URI {
+	if s.opts.TURNCredentials == nil {
+		return s.turnURLs
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, turnCredentialsTimeout)
+	defer cancel()
+	servers, err := s.opts.TURNCredentials(ctx)
+	if err != nil {
+		s.log.Warn("Failed to fetch TURN credentials", "error", err)
+		return s.turnURLs
+	}
+	fetched, err := parseTURNServers(servers)
+	if err != nil {
+		s.log.Warn("Fetched TURN server invalid", "error", err)
+		return s.turnURLs
+	}
+	return append(slices.Clip(s.turnURLs), fetched...)
+}
+
+// Creates an ICE agent for a guest, on the client's UDP mux, STUN and TURN servers.
+func (s *HostClient) newAgent() (*ice.Agent, error) {
+	opts := []ice.AgentOption{
+		ice.WithUDPMux(s.mux),
+		ice.WithNetworkTypes(s.networks),
+		ice.WithLoggerFactory(s.opts.iceLoggerFactory(s.log)),
+	}
+	if s.opts.MulticastDNS {
+		opts = append(opts, ice.WithMulticastDNSMode(ice.MulticastDNSModeQueryAndGather))
+	}
+	urls := append(slices.Clip(s.stunURLs), s.turnServers()...)
+	if len(urls) > 0 {
+		opts = append(opts, ice.WithUrls(urls))
+	}
+	// server-reflexive candidates share the mux's port, so a forwarded Port keeps working.
+	if srflx, ok := s.mux.(ice.UniversalUDPMux); ok && len(s.stunURLs) > 0 {
+		opts = append(opts, ice.WithUDPMuxSrflx(srflx))
+	}
+	if s.opts.RelayOnly {
+		opts = append(opts, ice.WithCandidateTypes([]ice.CandidateType{ice.CandidateTypeRelay}))
+	}
+	if s.opts.GatherTimeout > 0 {
+		opts = append(opts, ice.WithSTUNGatherTimeout(s.opts.GatherTimeout))
+	}
+	// last, so they can override the ones above.
+	opts = append(opts, s.opts.AgentOptions...)
+	return ice.NewAgentWithOptions(opts...)
+}
+
+// Creates an ICE agent for the connection to the host, on ClientOptions.NetworkTypes and with MulticastDNS,
+// then AgentOptions and opts. It logs to the client's logger, see ClientOptions.ICELogLevels.
+func (s *GuestClient) NewAgent(opts ...ice.AgentOption) (*ice.Agent, error) {
+	all := []ice.AgentOption{ice.WithLoggerFactory(s.opts.iceLoggerFactory(s.log))}
+	if len(s.opts.NetworkTypes) > 0 {
+		all = append(all, ice.WithNetworkTypes(s.opts.NetworkTypes))
+	}
+	if s.opts.MulticastDNS {
+		all = append(all, ice.WithMulticastDNSMode(ice.MulticastDNSModeQueryAndGather))
+	}
+	all = append(all, s.opts.AgentOptions...)
+	return ice.NewAgentWithOptions(append(all, opts...)...)
+}
+
+// Returns ClientOptions.ICELoggerFactory, or a factory logging to log at ICELogLevels.
+func (o ClientOptions) iceLoggerFactory(log *slog.Logger) logging.LoggerFactory {
+	if o.ICELoggerFactory != nil {
+		return o.ICELoggerFactory
+	}
+	return iceLoggerFactory{log: log, levels: o.ICELogLevels}
+}
+
+// Levels pion's messages are logged at, unless ClientOptions.ICELogLevels has theirs. Warnings, e.g. a STUN
+// server that didn't answer, are kept at their level, and the rest are logged at debug as pion is chatty.
+// Trace messages are dropped.
+var defaultICELogLevels = map[logging.LogLevel]slog.Level{
+	logging.LogLevelDebug: slog.LevelDebug,
+	logging.LogLevelInfo:  slog.LevelDebug,
+	logging.LogLevelWarn:  slog.LevelWarn,
+	logging.LogLevelError: slog.LevelError,
+}
+
+// Logs pion's messages to a slog.Logger, see defaultICELogLevels.
+type iceLoggerFactory struct {
+	log    *slog.Logger
+	levels map[logging.LogLevel]slog.Level
+}
+
+func (f iceLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return iceLogger{f.log.With("ice", scope), f.levels}
+}
+
+type iceLogger struct {
+	log    *slog.Logger
+	levels map[logging.LogLevel]slog.Level
+}
+
+// Returns the slog level messages at level are logged at, or false if they aren't logged.
+func (l iceLogger) level(level logging.LogLevel) (slog.Level, bool) {
+	lvl, ok := l.levels[level]
+	if !ok {
+		lvl, ok = defaultICELogLevels[level]
+	}
+	return lvl, ok && l.log.Enabled(context.Background(), lvl)
+}
+
+func (l iceLogger) logMsg(level logging.LogLevel, msg string) {
+	if lvl, ok := l.level(level); ok {
+		l.log.Log(context.Background(), lvl, msg)
+	}
+}
+
+// formatting is skipped for the many messages that aren't logged.
+func (l iceLogger) logf(level logging.LogLevel, format string, args ...any) {
+	if lvl, ok := l.level(level); ok {
+		l.log.Log(context.Background(), lvl, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l iceLogger) Trace(msg string)                  { l.logMsg(logging.LogLevelTrace, msg) }
+func (l iceLogger) Tracef(format string, args ...any) { l.logf(logging.LogLevelTrace, format, args...) }
+func (l iceLogger) Debug(msg string)                  { l.logMsg(logging.LogLevelDebug, msg) }
+func (l iceLogger) Debugf(format string, args ...any) { l.logf(logging.LogLevelDebug, format, args...) }
+func (l iceLogger) Info(msg string)                   { l.logMsg(logging.LogLevelInfo, msg) }
+func (l iceLogger) Infof(format string, args ...any)  { l.logf(logging.LogLevelInfo, format, args...) }
+func (l iceLogger) Warn(msg string)                   { l.logMsg(logging.LogLevelWarn, msg) }
+func (l iceLogger) Warnf(format string, args ...any)  { l.logf(logging.LogLevelWarn, format, args...) }
+func (l iceLogger) Error(msg string)                  { l.logMsg(logging.LogLevelError, msg) }
+func (l iceLogger) Errorf(format string, args ...any) { l.logf(logging.LogLevelError, format, args...) }
+
+// Cancels a guest's dial once ClientOptions.DialRetries+1 attempts of DialTimeout each failed.
+// Between attempts it waits DialRetryBackoff and restarts ICE with the guest, as an agent can only be dialed once.
+// Returns once ctx is done.
+func (s *HostClient) dialAttempts(ctx context.Context, cancel context.CancelFunc, guestId qp2p.GuestID, agent *ice.Agent) {
+	defer s.endOfCandidates.Delete(guestId)
+	backoff := s.opts.DialRetryBackoff
+	for attempt := 0; ; attempt++ {
+		expired := make(chan struct{})
+		expire := sync.OnceFunc(func() { close(expired) })
+		timeout := time.AfterFunc(s.opts.DialTimeout, expire)
+		// once the guest has no more candidates, the remaining checks finish quickly.
+		s.endOfCandidates.Store(guestId, func() { time.AfterFunc(endOfCandidatesTimeout, expire) })
+		select {
+		case <-ctx.Done():
+			timeout.Stop()
+			return
+		case <-expired:
+		}
+		if attempt >= s.opts.DialRetries {
+			cancel()
+			return
+		}
+		s.log.Info("Retrying ICE with guest", "guest", guestId, "attempt", attempt+2)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		s.restarting.Store(guestId, struct{}{})
+		if err := s.restartICE(guestId, agent); err != nil {
+			s.restarting.Delete(guestId)
+			s.log.Error("Failed to restart ice agent", "guest", guestId, "error", err)
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package signaling
+
+import (
+	"crypto/rand"
+	"net/http"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// An invite token created by the host with CreateInvites.
+type invite struct {
+	expires time.Time
+	used    bool
+}
+
+// GET /join/token/{token}
+//
+// Joins the room the invite token was created for, like GET /join/{roomId} without the room password.
+// Each token admits one guest. Responds 404 if the token is unknown, and 410 if it was used or expired.
+func (s *WebsocketSignalingServer) joinInvite(w http.ResponseWriter, r *http.Request) {
+	s.joinAs(w, r, RolePlayer, r.PathValue("token"))
+}
+
+// Marks the invite token as used.
+//
+// Returns the room it was created for, ErrInviteNotFound if the token is unknown,
+// or ErrInviteExpired if it was already used or has expired.
+func (s *WebsocketSignalingServer) useInvite(token string) (qp2p.RoomId, error) {
+	rm, ok := s.invites.Load(token)
+	if !ok {
+		return "", ErrInviteNotFound
+	}
+	if !rm.useInvite(token) {
+		return "", ErrInviteExpired
+	}
+	return rm.id, nil
+}
+
+// Creates up to n invite tokens for the room, valid for ttl.
+//
+// A room has at most limit unexpired tokens, used or not. store is called with each new token,
+// and drop with each expired one, while the room is locked so they can't race close.
+func (r *room) createInvites(n, limit int, ttl time.Duration, store, drop func(token string)) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	now := time.Now()
+	for token, inv := range r.invites {
+		if now.After(inv.expires) {
+			delete(r.invites, token)
+			drop(token)
+		}
+	}
+	if r.invites == nil {
+		r.invites = make(map[string]*invite)
+	}
+	n = min(n, limit-len(r.invites))
+	tokens := make([]string, 0, max(n, 0))
+	for range n {
+		token := rand.Text()
+		r.invites[token] = &invite{expires: now.Add(ttl)}
+		store(token)
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// Marks token as used. Returns false if it was already used or has expired.
+func (r *room) useInvite(token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inv, ok := r.invites[token]
+	if !ok || inv.used || time.Now().After(inv.expires) {
+		return false
+	}
+	inv.used = true
+	return true
+}
+
+// Removes the room's invite tokens, returning them. Called once the room is closed.
+func (r *room) takeInvites() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tokens := make([]string, 0, len(r.invites))
+	for token := range r.invites {
+		tokens = append(tokens, token)
+	}
+	r.invites = nil
+	return tokens
+}
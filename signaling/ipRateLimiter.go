@@ -0,0 +1,73 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limits requests per IP address.
+type ipRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*ipLimiter
+	// limiters idle since the last sweep are removed.
+	lastSweep time.Time
+}
+
+type ipLimiter struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+func newIPRateLimiter(limit rate.Limit, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[string]*ipLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Returns true if ip can make a request now.
+func (l *ipRateLimiter) allow(ip string) bool {
+	const sweepInterval = time.Minute
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// forget IP addresses that have not made a request since the last sweep.
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for key, entry := range l.limiters {
+			if entry.seen.Before(l.lastSweep) {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.seen = now
+	return entry.lim.AllowN(now, 1)
+}
+
+// Returns a limiter of r messages per second that allows burst+extra messages until end,
+// and only burst after it.
+//
+// The extra burst covers the handshake, when peers trickle candidates faster than the steady-state rate.
+func newHandshakeLimiter(r rate.Limit, burst, extra int, end time.Time) *rate.Limiter {
+	wait := time.Until(end)
+	if extra <= 0 || wait <= 0 {
+		return rate.NewLimiter(r, burst)
+	}
+	lim := rate.NewLimiter(r, burst+extra)
+	// tokens above the new burst are discarded on the next Allow.
+	time.AfterFunc(wait, func() { lim.SetBurst(burst) })
+	return lim
+}
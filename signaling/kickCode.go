@@ -0,0 +1,92 @@
+package signaling
+
+import (
+	"fmt"
+
+	"github.com/coder/websocket"
+)
+
+// Why a guest was kicked, sent in KickGuest alongside the human readable Reason,
+// so clients can decide e.g. whether to offer to reconnect without matching strings.
+//
+// Servers may add codes. Codes a client does not know are kept as they are, and print as KickCode(n).
+type KickCode uint8
+
+const (
+	// Sent by servers and hosts that predate KickCode.
+	KickUnspecified KickCode = iota
+	// The host kicked the guest.
+	KickByHost
+	// An admin kicked the guest with the admin API.
+	KickByAdmin
+	// The host left, and did not resume the room within the server's grace period.
+	KickHostOffline
+	// The host could not open the P2P connection to the guest.
+	KickConnectionFailed
+	// The room reached ServerOptions.MaxRoomAge, or was idle for ServerOptions.IdleRoomTimeout.
+	KickRoomExpired
+	// The host or an admin closed the room.
+	KickRoomClosed
+	// The server is shutting down.
+	KickServerShutdown
+	// The host kicked the guest and banned it from rejoining the room.
+	KickBanned
+	// The host stopped sending Heartbeat messages.
+	KickHostUnresponsive
+)
+
+var kickCodeNames = [...]string{
+	KickUnspecified:      "unspecified",
+	KickByHost:           "by_host",
+	KickByAdmin:          "by_admin",
+	KickHostOffline:      "host_offline",
+	KickConnectionFailed: "connection_failed",
+	KickRoomExpired:      "room_expired",
+	KickRoomClosed:       "room_closed",
+	KickServerShutdown:   "server_shutdown",
+	KickBanned:           "banned",
+	KickHostUnresponsive: "host_unresponsive",
+}
+
+func (c KickCode) String() string {
+	if int(c) < len(kickCodeNames) {
+		return kickCodeNames[c]
+	}
+	return fmt.Sprintf("KickCode(%d)", uint8(c))
+}
+
+// KickError is returned by the guest client's Listen when the guest was sent KickGuest
+// before its connection closed.
+//
+// errors.Is matches it against the error of the close status, e.g. ErrKicked or ErrHostOffline.
+type KickError struct {
+	Code   KickCode
+	Reason string
+	// the error the connection closed with.
+	err error
+}
+
+func (e *KickError) Error() string {
+	return fmt.Sprintf("signaling: kicked (%v): %s", e.Code, e.Reason)
+}
+
+// Returns the error the connection closed with.
+func (e *KickError) Unwrap() error {
+	return e.err
+}
+
+// Returns the KickCode for guests kicked from a room closed with the status code.
+func (s *WebsocketSignalingServer) kickCode(code websocket.StatusCode) KickCode {
+	switch code {
+	case StatusHostOffline:
+		return KickHostOffline
+	case StatusRoomExpired:
+		return KickRoomExpired
+	case StatusHostUnresponsive:
+		return KickHostUnresponsive
+	}
+	if s.shuttingDown.Load() {
+		return KickServerShutdown
+	}
+	return KickRoomClosed
+}
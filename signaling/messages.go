@@ -1,13 +1,15 @@
 package signaling
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	qp2p "github.com/BrownNPC/QuicP2P"
 	"github.com/coder/websocket"
-	"github.com/shamaton/msgpack/v2"
 )
 
 //go:generate stringer -type=MsgType
@@ -15,11 +17,12 @@ type MsgType int
 
 const (
 	Invalid MsgType = iota
-	// Server -> Host Msg{RoomCreated: RoomId)
+	// Server -> Host Msg{RoomCreated: RoomId,ResumeToken,Region,HeartbeatInterval)
 	//
 	// This message is sent by the server right after the socket is opened.
 	//
-	// It contains the RoomId.
+	// It contains the RoomId, the ResumeToken if the server allows the host to resume the room,
+	// the Region the room lives in, and the HeartbeatInterval if the host asked for heartbeats.
 	RoomCreated
 	// Guest -> Server Msg{GuestAuth: Ufrag,Pwd}
 	//
@@ -27,11 +30,12 @@ const (
 	//
 	// It contains Ufrag & Pwd (ICE credentials of the guest).
 	GuestAuth
-	// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd}
+	// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd,Role,Metadata}
 	//
 	// A GuestJoined message is sent to the Host the first time a Guest joins the room.
 	//
-	// It contains the GuestId, Ufrag & Pwd (ICE credentials of the guest).
+	// It contains the GuestId, Ufrag & Pwd (ICE credentials of the guest),
+	// RoleSpectator if the Guest joined with GET /spectate/{roomId}, and the Metadata the Guest sent in GuestAuth.
 	GuestJoined
 	// Host -> Server -> Guest Msg{HostAuth: GuestId,Ufrag,Pwd}
 	//
@@ -39,44 +43,285 @@ const (
 	//
 	// The server forwards the message to the Guest.
 	//
+	// If the Host does not send it within the server's HandshakeTimeout, the Guest is
+	// closed with StatusHostTimeout and the Host is sent GuestDisconnected.
+	//
 	// It contains GuestId, Ufrag & Pwd (ICE credentials of the host).
 	HostAuth
-	// Guest -> Server Msg{IceCandidate: Candidate}
+	// Guest -> Server Msg{IceCandidate: Candidate,Candidates}
 	//
-	// Host  -> Server Msg{IceCandidate: GuestId,Candidate}
+	// Host  -> Server Msg{IceCandidate: GuestId,Candidate,Candidates}
 	//
 	// The Guest or Host trickle their ICE Candidates to the server.
 	//
 	// The server forwards them to the recipient
+	//
+	// Candidates batches candidates gathered close together into one message.
+	// Receivers must handle both Candidate and Candidates.
 	IceCandidate
-	// Server -> Host Msg{GuestDisconnected: GuestId}
+	// Server -> Host Msg{GuestDisconnected: GuestId,Reason}
 	//
 	// This message is sent by the Server to the Host after the Guest has disconnected from the signaling server.
 	//
-	// It contains GuestId.
+	// It contains GuestId, and Reason. Reason is the Guest's own if it sent GuestLeave,
+	// otherwise it is set by the server (e.g. "disconnected", "kicked by host").
 	GuestDisconnected
-	// Host -> Server -> Guest Msg{KickGuest: GuestId,Reason "Kicked by host"}
-	// Server -> Guest Msg{KickGuest: GuestId, Reason "Host is offline"}
+	// Host -> Server -> Guest Msg{KickGuest: GuestId,Reason "Kicked by host",ReasonCode}
+	// Server -> Guest Msg{KickGuest: GuestId, Reason "Host is offline",ReasonCode KickHostOffline}
 	//
 	// This message is sent by the Server to the Guest after the Host disconnects from the signaling server.
 	//
 	// It could also be sent by the Host to the Server and forwarded to the Guest if the Host decides to kick the Guest.
+	// The server then closes the Guest's socket and confirms with GuestDisconnected.
+	//
+	// It contains GuestId, and Reason (for the Kick). ReasonCode says why for programs, see KickCode.
 	//
-	// It contains GuestId, and Reason (for the Kick).
+	// If the Host sets Ban, the server also bans the Guest's IP address from rejoining the room.
 	KickGuest
+	// Host -> Server Msg{SetRoomInfo: Name,Public,MaxGuests,Metadata}
+	//
+	// This message can be sent by the Host any time after RoomCreated.
+	//
+	// Public rooms are listed by GET /rooms with their Name, MaxGuests, Metadata and current guest count.
+	// Guests are turned away once the room has MaxGuests guests, 0 means no limit.
+	//
+	// The server pushes the new info to Guests already in the room with RoomInfo.
+	SetRoomInfo
+	// Server -> Guest Msg{RoomInfo: Name,MaxGuests,Metadata,Region}
+	//
+	// This message is sent by the server right after the Guest's socket is opened,
+	// and again whenever the Host sends SetRoomInfo.
+	//
+	// It lets the Guest check the room (e.g. game version in Metadata) before sending GuestAuth.
+	RoomInfo
+	// Guest -> Server Msg{GuestLeave: Reason}
+	//
+	// This message is sent by the Guest when it leaves the room on purpose.
+	//
+	// The server sends the Host GuestDisconnected with the Guest's Reason, and closes the Guest's socket.
+	GuestLeave
+	// Guest -> Server -> Host Msg{Relay: Payload}, forwarded as Msg{Relay: GuestId,Payload}
+	//
+	// Host  -> Server -> Guest Msg{Relay: GuestId,Payload}
+	//
+	// Opaque application data (lobby chat, loading progress) exchanged before the P2P link is up.
+	//
+	// The server does not inspect Payload. Relays over the server's size limit,
+	// or addressed to guests not in the room, are dropped.
+	Relay
+	// Server -> Host Msg{JoinRequest: GuestId,Metadata,Role}
+	//
+	// Sent instead of GuestJoined in rooms created with GET /host?approval=true.
+	//
+	// It contains the GuestId, and the Metadata the Guest sent in GuestAuth (e.g. player name).
+	// The Guest waits until the Host answers with AcceptGuest or RejectGuest.
+	JoinRequest
+	// Host -> Server Msg{AcceptGuest: GuestId}
+	//
+	// Accepts a Guest from JoinRequest. The server then sends the Host GuestJoined.
+	AcceptGuest
+	// Host -> Server Msg{RejectGuest: GuestId,Reason}
+	//
+	// Rejects a Guest from JoinRequest. The server closes the Guest with StatusJoinRejected and Reason.
+	RejectGuest
+	// Host -> Server Msg{LockRoom}
+	//
+	// Turns new guests away (GET /join responds 423) until UnlockRoom.
+	// Guests already in the room are not affected.
+	LockRoom
+	// Host -> Server Msg{UnlockRoom}
+	//
+	// Lets new guests join the room again after LockRoom.
+	UnlockRoom
+	// Server -> Guest Msg{Joined: GuestId,ResumeToken}
+	//
+	// This message is sent by the server after the Host is sent GuestJoined, and after every rejoin.
+	//
+	// It contains the Guest's GuestId, and the ResumeToken if the server lets guests rejoin.
+	// A Guest whose websocket drops can rejoin with GET /rejoin/{roomId}?guest=GuestId&token=ResumeToken
+	// and keep its GuestId. Each ResumeToken can only be used once.
+	Joined
+	// Guest -> Server Msg{EndOfCandidates}
+	//
+	// Host  -> Server Msg{EndOfCandidates: GuestId}
+	//
+	// Sent after the last IceCandidate, once ICE gathering is complete.
+	//
+	// The server forwards it to the recipient like an IceCandidate.
+	// The recipient stops waiting for more candidates, so a failed connection is noticed sooner.
+	EndOfCandidates
+	// Server -> Host Msg{RoomExpired: Reason}
+	//
+	// Sent before the server closes a room that reached ServerOptions.MaxRoomAge,
+	// or had no guests for ServerOptions.IdleRoomTimeout.
+	//
+	// Reason is "room expired" or "room idle". Guests are kicked with the same Reason.
+	RoomExpired
+	// Server -> Host Msg{RoomStatus: GuestCount,MaxGuests,Locked}
+	//
+	// Server -> Guest Msg{RoomStatus: GuestCount,MaxGuests,Locked} (public rooms only)
+	//
+	// Sent when a guest joins or leaves, and when the room is locked, unlocked or its MaxGuests changes.
+	// Updates are sent at most once per 250ms per room, with the latest status.
+	RoomStatus
+	// Server -> Guest Msg{WaitingForHost: Reason "waiting for host"}
+	//
+	// Sent every few seconds to a guest that is waiting for the host to answer earlier guests,
+	// if the host created the room with GET /host?joinWindow=N.
+	// The host is only sent GuestJoined for N guests at a time, and is sent the next
+	// once it answers one with HostAuth.
+	WaitingForHost
+	// Host -> Server Msg{CloseRoom: Reason}
+	//
+	// Server -> Host Msg{CloseRoom}
+	//
+	// Closes the room. Every Guest is kicked with the Reason and a normal closure status,
+	// then the server acknowledges with CloseRoom and closes the Host's connection.
+	CloseRoom
+	// Host -> Server Msg{CreateInvites: InviteCount}
+	//
+	// Server -> Host Msg{CreateInvites: Invites}
+	//
+	// Creates one-time invite tokens. A guest joins with GET /join/token/{token}
+	// without the room password, and each token admits one guest.
+	// Fewer tokens than InviteCount are sent if the room has ServerOptions.MaxInvitesPerRoom unexpired tokens.
+	CreateInvites
+	// Host -> Server Msg{Heartbeat}
+	//
+	// Sent by the Host every HeartbeatInterval from RoomCreated, if it created the room with
+	// GET /host?heartbeat=true, to show its application is still running, not just its connection.
+	// If the server misses ServerOptions.HostHeartbeatMisses in a row, it closes the room
+	// and kicks every Guest with StatusHostUnresponsive.
+	Heartbeat
+	// Host -> Server Msg{CreateRoom: Password}
+	//
+	// Server -> Host Msg{CreateRoom: Reason}
+	//
+	// Creates another room on the Host's connection, with the settings of its first room
+	// and its own Password. The server answers with RoomCreated, or with CreateRoom and the Reason
+	// it could not create the room.
+	//
+	// Messages between the server and the Host for the new room carry its RoomId.
+	// Messages for the first room do not, so a Host with one room is unaffected.
+	// The rooms close when the Host's connection does, and can't be resumed.
+	// The server tells the Host a room closed with CloseRoom and its RoomId.
+	CreateRoom
+	// Server -> Guest Msg{QueuePosition: Position}
+	//
+	// Sent every few seconds to a Guest waiting for a slot in a full room, if the Host created
+	// the room with GET /host?queue=true and the Guest joined with ?queue=true.
+	// Position 1 is the next Guest admitted once another leaves, and the Guest then joins as usual.
+	// A Guest turned away from the queue is closed with StatusRoomFull.
+	QueuePosition
+	// Host -> Server Msg{QueuedGuests}
+	//
+	// Server -> Host Msg{QueuedGuests: Queued}
+	//
+	// Lists the Guests waiting for a slot in the room, in join order.
+	QueuedGuests
+	// Host -> Server Msg{ClearQueue: Reason}
+	//
+	// Turns away every Guest waiting for a slot in the room, closing them with StatusRoomFull and Reason.
+	ClearQueue
+	// Server -> Host Msg{Error: GuestId,Code,Detail}
+	//
+	// Server -> Guest Msg{Error: Code,Detail}
+	//
+	// Host  -> Server -> Guest Msg{Error: GuestId,Code,Detail}
+	//
+	// Guest -> Server -> Host Msg{Error: Code,Detail}, forwarded as Msg{Error: GuestId,Code,Detail}
+	//
+	// Tells the other side why something went wrong, see ServerError for the codes.
+	// The server sends it right before closing a connection with one of the Status codes,
+	// with the close status as the Code, and for messages it drops without closing the connection,
+	// e.g. a candidate that is too long. GuestId is the Guest the dropped message was for.
+	//
+	// Hosts and Guests can send each other Errors with recoverable codes, from ErrorCandidateRejected up.
+	// The server drops Errors with other codes.
+	Error
+	// Host  -> Server Msg{Ping: Nonce}
+	//
+	// Guest -> Server Msg{Ping: Nonce}
+	//
+	// Asks the server for a Pong, to measure the round trip time to it. Nonce is chosen by the sender.
+	// Guests can send it before GuestAuth, e.g. to pick a region before joining.
+	//
+	// Pings do not count toward the server's message rate limits, but have their own:
+	// pings over it are dropped.
+	Ping
+	// Server -> Host Msg{Pong: Nonce,ServerTime}
+	//
+	// Server -> Guest Msg{Pong: Nonce,ServerTime}
+	//
+	// Answers a Ping with its Nonce, and the server's clock in ServerTime.
+	Pong
+	// Host  -> Server -> Guest Msg{IceRestart: GuestId,Ufrag,Pwd}
+	//
+	// Guest -> Server -> Host Msg{IceRestart: GuestId,Ufrag,Pwd}
+	//
+	// Restarts ICE with fresh credentials, e.g. after the sender's network changed and the
+	// selected candidate pair died. The receiver restarts its own agent and answers with its
+	// fresh credentials in an IceRestart, unless it started a restart itself. Both sides then
+	// gather and trickle candidates again, keeping the connection object.
+	//
+	// Only forwarded once the Host has sent the Guest HostAuth. The server sets GuestId to the
+	// sender on an IceRestart from the Guest.
+	IceRestart
 )
 
+// The last MsgType this version of the package knows. Update it when adding a MsgType.
+const lastMsgType = IceRestart
+
+// Reports whether t is a MsgType this version of the package knows.
+//
+// Invalid is not valid. Types from a newer peer are not either: the server and clients
+// drop them, see ServerOptions.ReplyUnknownTypes.
+func (t MsgType) Valid() bool {
+	return t > Invalid && t <= lastMsgType
+}
+
+// Returns every valid MsgType, in order.
+func KnownTypes() []MsgType {
+	types := make([]MsgType, 0, lastMsgType)
+	for t := Invalid + 1; t <= lastMsgType; t++ {
+		types = append(types, t)
+	}
+	return types
+}
+
 // ### Full Signaling Flow
 //
-// Host -> Server POST /host
+// Host -> Server GET /host?v=ProtocolVersion
 //
-// Server -> Host Msg{RoomCreated: RoomId)
+// Server -> Host Msg{RoomCreated: RoomId,Region)
 //
-// Guest -> Server POST /join/{roomId}
+// (Optional) Host -> Server Msg{SetRoomInfo: Name,Public,MaxGuests,Metadata}
 //
-// Guest -> Server Msg{GuestAuth: Ufrag,Pwd}
+// (Optional) Host -> Server GET /host?roomId=FINALS, picks the RoomId if the server allows it.
+//
+// (Optional) Host -> Server GET /host?region=eu-west, overrides the server's Region for the room.
+//
+// (Optional) Host -> Server GET /host?approval=true, guests wait for the Host's approval.
+//
+// (Optional) Host -> Server GET /host?joinWindow=N, the Host is sent at most N GuestJoined it has not answered.
 //
-// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd}
+// (Optional) Host -> Server GET /host?heartbeat=true, then Host -> Server Msg{Heartbeat} every HeartbeatInterval.
+//
+// (Optional) Host -> Server Msg{CreateInvites: InviteCount}, Server -> Host Msg{CreateInvites: Invites}
+//
+// (Optional) Host -> Server GET /host?queue=true, guests that join a full room with ?queue=true wait for a slot.
+//
+// Guest -> Server GET /join/{roomId}?v=ProtocolVersion
+//
+// (Or) Guest -> Server GET /join/token/{token}?v=ProtocolVersion, with an invite token instead of the room password.
+//
+// Server -> Guest Msg{RoomInfo: Name,MaxGuests,Metadata}
+//
+// Guest -> Server Msg{GuestAuth: Ufrag,Pwd,Metadata}
+//
+// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd,Role,Metadata}
+//
+// Server -> Guest Msg{Joined: GuestId,ResumeToken}
 //
 // Host -> Server -> Guest Msg{HostAuth: GuestId,Ufrag,Pwd}
 //
@@ -84,29 +329,125 @@ const (
 //
 // Host  -> Server -> Guest Msg{IceCandidate: GuestId,Candidate}
 //
-// (Guest Lost Connection) Server -> Host Msg{GuestDisconnected: GuestId}
+// Guest <-> Server <-> Host Msg{EndOfCandidates: GuestId}
+//
+// (Any time after GuestAuth) Guest <-> Server <-> Host Msg{Relay: GuestId,Payload}
+//
+// (Any time) Server -> Guest or Host Msg{Error: Code,Detail}, right before the server closes the connection, or when it drops a message.
+//
+// (Any time after HostAuth) Guest <-> Server <-> Host Msg{IceRestart: GuestId,Ufrag,Pwd}, answered in kind, then candidates are trickled again.
+//
+// (Any time, also before GuestAuth) Guest or Host -> Server Msg{Ping: Nonce}, Server -> Guest or Host Msg{Pong: Nonce,ServerTime}
+//
+// (Room Full, Queued) Server -> Guest Msg{QueuePosition: Position}, until a slot frees up and the Guest joins as usual.
+//
+// (Guest Left) Guest -> Server Msg{GuestLeave: Reason}, Server -> Host Msg{GuestDisconnected: GuestId,Reason}
+//
+// (Guest Lost Connection) Server -> Host Msg{GuestDisconnected: GuestId, Reason "disconnected"}
 //
 // (Host Lost Connection) Server -> Guest Msg{KickGuest: GuestId, Reason "Host is offline."}
+//
+// (Host Closed Room) Host -> Server Msg{CloseRoom: Reason}, Server -> Guest Msg{KickGuest: GuestId,Reason}, Server -> Host Msg{CloseRoom}
+//
+// (Room Expired) Server -> Host Msg{RoomExpired: Reason}, Server -> Guest Msg{KickGuest: GuestId,Reason}
+//
+// (More Rooms) Host -> Server Msg{CreateRoom: Password}, Server -> Host Msg{RoomCreated: RoomId}, then messages for the room carry its RoomId.
+//
+// If the server has a guest grace period, a Guest whose websocket drops can rejoin with
+// GET /rejoin/{roomId}?guest=GuestId&token=ResumeToken, and the Host is only sent GuestDisconnected once it expires.
+//
+// If the server has a host grace period, guests are only kicked once it expires.
+// Until then the host can reconnect with GET /host/resume/{roomId}?token=ResumeToken,
+// and messages for the host are queued until it does.
 type Msg struct {
-	Type       MsgType
+	Type MsgType
+	// Set in RoomCreated, and in messages for rooms created with CreateRoom.
 	RoomId     qp2p.RoomId
 	GuestId    qp2p.GuestID
 	Ufrag, Pwd string
 	Candidate  string
 	Reason     string
+	// Room password. Only read by the server from GuestAuth, never forwarded.
+	Password string
+	// Sent to the host in RoomCreated if the server allows resuming the room.
+	ResumeToken string
+	// Set by the host in KickGuest to also ban the guest from rejoining the room.
+	Ban bool
+	// Room info set by the host with SetRoomInfo, and sent to guests in RoomInfo.
+	Name      string
+	Public    bool
+	MaxGuests int
+	Metadata  []byte
+	// Reserved for future wire format changes. Ignored when zero.
+	Version int
+	// Application data in Relay.
+	Payload []byte
+	// Batched ICE candidates in IceCandidate, sent as well as or instead of Candidate.
+	Candidates []string
+	// Guests in the room in RoomStatus, not counting spectators or guests waiting for approval.
+	GuestCount int
+	// Set in RoomStatus if the room is locked.
+	Locked bool
+	// Role of the Guest in GuestJoined and JoinRequest.
+	Role Role
+	// How many invite tokens the host asks for in CreateInvites.
+	InviteCount int
+	// Invite tokens sent to the host in CreateInvites.
+	Invites []string
+	// Region the room lives in, sent in RoomCreated and RoomInfo.
+	Region string
+	// How often the host must send Heartbeat, sent in RoomCreated. 0 if heartbeats are off.
+	HeartbeatInterval time.Duration
+	// Place of the Guest in a full room's queue in QueuePosition, 1 is next.
+	Position int
+	// Guests waiting for a slot in QueuedGuests, in join order.
+	Queued []qp2p.GuestID
+	// Error code and details in Error, see ServerError.
+	Code   int
+	Detail string
+	// Chosen by the sender of a Ping, and echoed in its Pong.
+	Nonce uint32
+	// Server's clock when it sent a Pong, in Unix milliseconds.
+	ServerTime int64
+	// Why the Guest was kicked in KickGuest, alongside the human readable Reason.
+	ReasonCode KickCode
+	// Position of the message among those written on its connection, starting at 1.
+	// Stamped by the writer, and used by the clients to drop duplicates. 0 means unsequenced.
+	Seq uint64
 }
 
-// Server -> Host Msg{RoomCreated: RoomId)
+// Role of a guest in a room.
+type Role uint8
+
+const (
+	// Joined with GET /join/{roomId}. Counts toward the room's MaxGuests.
+	RolePlayer Role = iota
+	// Joined with GET /spectate/{roomId}, to only receive from the host.
+	// Counts toward the server's MaxSpectatorsPerRoom instead of MaxGuests.
+	RoleSpectator
+)
+
+func (r Role) String() string {
+	if r == RoleSpectator {
+		return "spectator"
+	}
+	return "player"
+}
+
+// Server -> Host Msg{RoomCreated: RoomId,ResumeToken,Region,HeartbeatInterval)
 //
 // This message is sent by the server right after the socket is opened.
 //
-// It contains the RoomId.
-func msgRoomCreated(conn hostConn, timeout time.Duration, roomId qp2p.RoomId) error {
-	msg := Msg{
-		Type:   RoomCreated,
-		RoomId: roomId,
+// It contains the RoomId, the ResumeToken if the server allows the host to resume the room,
+// the Region the room lives in, and the HeartbeatInterval if the host asked for heartbeats.
+func msgRoomCreated(ctx context.Context, conn *HostConn, roomId qp2p.RoomId, resumeToken, region string, heartbeatInterval time.Duration) error {
+	msg := RoomCreatedMsg{
+		RoomId:            roomId,
+		ResumeToken:       resumeToken,
+		Region:            region,
+		HeartbeatInterval: heartbeatInterval,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg.AsMsg())
 }
 
 // Guest -> Server Msg{GuestAuth: Ufrag,Pwd}
@@ -114,28 +455,58 @@ func msgRoomCreated(conn hostConn, timeout time.Duration, roomId qp2p.RoomId) er
 // This message is sent by the guest to the server right after the socket is opened.
 //
 // It contains Ufrag & Pwd (ICE credentials of the guest).
-func MsgGuestAuth(conn guestConn, timeout time.Duration, ufrag, pwd string) error {
-	msg := Msg{
-		Type:  GuestAuth,
+//
+// Returns an error wrapping ErrInvalidCredentials without sending if they are invalid.
+func MsgGuestAuth(ctx context.Context, conn *GuestConn, ufrag, pwd string) error {
+	if err := ValidateCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+	msg := GuestAuthMsg{
 		Ufrag: ufrag,
 		Pwd:   pwd,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Largest Metadata a Guest can send in GuestAuth.
+const MaxGuestMetadataLen = 1024
+
+// Guest -> Server Msg{GuestAuth: Ufrag,Pwd,Metadata}
+//
+// Like MsgGuestAuth, with Metadata introducing the Guest (e.g. player name).
+// The server passes it to the Host unchanged in GuestJoined, and in JoinRequest in rooms that need approval.
+//
+// Returns ErrMetadataTooLong without sending if metadata is longer than MaxGuestMetadataLen.
+func MsgGuestAuthMetadata(ctx context.Context, conn *GuestConn, ufrag, pwd string, metadata []byte) error {
+	if err := ValidateCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+	if len(metadata) > MaxGuestMetadataLen {
+		return ErrMetadataTooLong
+	}
+	msg := GuestAuthMsg{
+		Ufrag:    ufrag,
+		Pwd:      pwd,
+		Metadata: metadata,
+	}
+	return conn.send(ctx, msg.AsMsg())
 }
 
-// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd}
+// Server -> Host Msg{GuestJoined: GuestId,Ufrag,Pwd,Role,Metadata}
 //
 // A GuestJoined message is sent to the Host the first time a Guest joins the room.
 //
-// It contains the GuestId, Ufrag & Pwd (ICE credentials of the guest).
-func msgGuestJoined(conn hostConn, timeout time.Duration, id qp2p.GuestID, ufrag, pwd string) error {
-	msg := Msg{
-		Type:    GuestJoined,
-		GuestId: id,
-		Ufrag:   ufrag,
-		Pwd:     pwd,
+// It contains the GuestId, Ufrag & Pwd (ICE credentials of the guest),
+// RoleSpectator if the Guest joined with GET /spectate/{roomId}, and the Metadata the Guest sent in GuestAuth.
+func msgGuestJoined(ctx context.Context, rm *room, id qp2p.GuestID, ufrag, pwd string, role Role, metadata []byte) error {
+	msg := GuestJoinedMsg{
+		GuestId:  id,
+		Ufrag:    ufrag,
+		Pwd:      pwd,
+		Role:     role,
+		Metadata: metadata,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return rm.writeHost(ctx, msg.AsMsg())
 }
 
 // Host -> Server -> Guest Msg{HostAuth: GuestId,Ufrag,Pwd}
@@ -145,14 +516,18 @@ func msgGuestJoined(conn hostConn, timeout time.Duration, id qp2p.GuestID, ufrag
 // The server forwards the message to the Guest.
 //
 // It contains GuestId, Ufrag & Pwd (ICE credentials of the host).
-func MsgHostAuth(conn hostConn, timeout time.Duration, GuestId qp2p.GuestID, ufrag, pwd string) error {
-	msg := Msg{
-		Type:    HostAuth,
+//
+// Returns an error wrapping ErrInvalidCredentials without sending if they are invalid.
+func MsgHostAuth(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID, ufrag, pwd string) error {
+	if err := ValidateCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+	msg := HostAuthMsg{
 		Ufrag:   ufrag,
 		Pwd:     pwd,
 		GuestId: GuestId,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg.AsMsg())
 }
 
 // Guest -> Server Msg{IceCandidate: Candidate}
@@ -164,85 +539,554 @@ func MsgHostAuth(conn hostConn, timeout time.Duration, GuestId qp2p.GuestID, ufr
 // # The server forwards them to the recipient
 //
 // GuestId is ignored when Guest -> Server
-func msgIceCandidate(conn *websocket.Conn, timeout time.Duration, GuestId qp2p.GuestID, Candidate string) error {
-	msg := Msg{
-		Type:      IceCandidate,
+func msgIceCandidate(ctx context.Context, conn msgSender, GuestId qp2p.GuestID, Candidate string) error {
+	msg := IceCandidateMsg{
 		Candidate: Candidate,
 		GuestId:   GuestId,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg.AsMsg())
 }
 
-// Server -> Host Msg{GuestDisconnected: GuestId}
+// Guest -> Server Msg{IceCandidate: Candidates}
 //
-// This message is sent by the Server to the Host after the Guest has disconnected from the signaling server.
+// Host  -> Server Msg{IceCandidate: GuestId,Candidates}
+//
+// Like msgIceCandidate, with several candidates in one message.
+func msgIceCandidates(ctx context.Context, conn msgSender, GuestId qp2p.GuestID, Candidates []string) error {
+	msg := IceCandidateMsg{
+		Candidates: Candidates,
+		GuestId:    GuestId,
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Guest -> Server Msg{EndOfCandidates}
 //
-// It contains GuestId.
-func msgGuestDisconnected(conn hostConn, timeout time.Duration, GuestId qp2p.GuestID) error {
+// Host  -> Server Msg{EndOfCandidates: GuestId}
+//
+// Tells the recipient that ICE gathering is complete.
+//
+// GuestId is ignored when Guest -> Server
+func msgEndOfCandidates(ctx context.Context, conn msgSender, GuestId qp2p.GuestID) error {
 	msg := Msg{
-		Type:    GuestDisconnected,
+		Type:    EndOfCandidates,
 		GuestId: GuestId,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg)
 }
 
-// Host -> Server -> Guest Msg{KickGuest: GuestId,Reason "Kicked by host"}
-// Server -> Guest Msg{KickGuest: GuestId, Reason "Host is offline"}
+// Reasons the server sends in GuestDisconnected when the guest did not give one with GuestLeave.
+const (
+	// The guest sent GuestLeave without a reason.
+	ReasonLeft = "left"
+	// The guest closed its websocket without GuestLeave.
+	ReasonClosed = "closed"
+	// The guest's websocket dropped, or failed to read a message.
+	ReasonDisconnected = "disconnected"
+	// The guest stopped answering pings.
+	ReasonTimeout = "timeout"
+	// The guest sent too many messages.
+	ReasonRateLimited = "rate_limited"
+	// The guest sent a message over ServerOptions.MaxMessageSize.
+	ReasonMessageTooLarge = "message_too_large"
+	// The server is shutting down.
+	ReasonShutdown = "server_shutdown"
+	// A new guest joined with the guest's GuestID, see ServerOptions.DuplicateGuests.
+	ReasonReplaced = "replaced"
+)
+
+// Server -> Host Msg{GuestDisconnected: GuestId,Reason}
 //
-// This message is sent by the Server to the Guest after the Host disconnects from the signaling server.
+// This message is sent by the Server to the Host after the Guest has disconnected from the signaling server.
 //
-// It could also be sent by the Host to the Server and forwarded to the Guest if the Host decides to kick the Guest.
+// It contains GuestId, and Reason.
+func msgGuestDisconnected(ctx context.Context, rm *room, GuestId qp2p.GuestID, Reason string) error {
+	msg := GuestDisconnectedMsg{
+		GuestId: GuestId,
+		Reason:  Reason,
+	}
+	return rm.writeHost(ctx, msg.AsMsg())
+}
+
+// Server -> Host Msg{RoomExpired: Reason}
+//
+// This message is sent by the Server to the Host before it closes an expired room.
+//
+// It contains Reason, "room expired" or "room idle".
+func msgRoomExpired(ctx context.Context, rm *room, Reason string) error {
+	msg := Msg{
+		Type:   RoomExpired,
+		Reason: Reason,
+	}
+	return rm.writeHost(ctx, msg)
+}
+
+// Host -> Server Msg{KickGuest: GuestId,Reason "Kicked by host"}
+//
+// This message is sent by the Host to the Server if the Host decides to kick the Guest.
+// The Server forwards it to the Guest with msgKicked, and ReasonCode KickByHost.
 //
 // It contains GuestId, and Reason (for the Kick).
-func MsgKickGuest(conn hostConn, timeout time.Duration, GuestId qp2p.GuestID, Reason string) error {
+func MsgKickGuest(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID, Reason string) error {
+	return MsgKickGuestCode(ctx, conn, GuestId, KickByHost, Reason)
+}
+
+// Host -> Server Msg{KickGuest: GuestId,Reason,ReasonCode}
+//
+// Like MsgKickGuest, with the ReasonCode the Guest is sent, e.g. KickConnectionFailed.
+func MsgKickGuestCode(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID, ReasonCode KickCode, Reason string) error {
+	msg := KickGuestMsg{
+		GuestId:    GuestId,
+		Reason:     Reason,
+		ReasonCode: ReasonCode,
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Server -> Guest Msg{KickGuest: GuestId,Reason,ReasonCode}
+//
+// This message is sent by the Server to the Guest when the Host or an admin kicks it,
+// or when the room closes, e.g. with Reason "Host is offline." and ReasonCode KickHostOffline.
+func msgKicked(ctx context.Context, conn *GuestConn, GuestId qp2p.GuestID, ReasonCode KickCode, Reason string) error {
+	msg := KickGuestMsg{
+		GuestId:    GuestId,
+		Reason:     Reason,
+		ReasonCode: ReasonCode,
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Host -> Server Msg{KickGuest: GuestId,Reason,Ban}
+//
+// Kicks the Guest like MsgKickGuest, and bans the Guest's IP address from rejoining the room.
+// The Guest is sent ReasonCode KickBanned.
+//
+// The ban lasts until the room closes.
+func MsgBanGuest(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID, Reason string) error {
+	msg := KickGuestMsg{
+		GuestId:    GuestId,
+		Reason:     Reason,
+		Ban:        true,
+		ReasonCode: KickBanned,
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Host -> Server Msg{SetRoomInfo: Name,Public,MaxGuests,Metadata}
+//
+// This message can be sent by the Host any time after RoomCreated.
+//
+// Public rooms are listed by GET /rooms with their Name, MaxGuests, Metadata and current guest count.
+// Guests are turned away once the room has MaxGuests guests, 0 means no limit.
+func MsgSetRoomInfo(ctx context.Context, conn *HostConn, name string, public bool, maxGuests int, metadata []byte) error {
+	msg := Msg{
+		Type:      SetRoomInfo,
+		Name:      name,
+		Public:    public,
+		MaxGuests: maxGuests,
+		Metadata:  metadata,
+	}
+	return conn.send(ctx, msg)
+}
+
+// Server -> Guest Msg{RoomInfo: Name,MaxGuests,Metadata,Region}
+//
+// This message is sent by the server right after the Guest's socket is opened,
+// and again whenever the Host sends SetRoomInfo.
+//
+// It lets the Guest check the room (e.g. game version in Metadata) before sending GuestAuth.
+func msgRoomInfo(ctx context.Context, conn *GuestConn, info roomInfo, region string) error {
+	msg := Msg{
+		Type:      RoomInfo,
+		Name:      info.Name,
+		MaxGuests: info.MaxGuests,
+		Metadata:  info.Metadata,
+		Region:    region,
+	}
+	return conn.send(ctx, msg)
+}
+
+// Server -> Host Msg{RoomStatus: GuestCount,MaxGuests,Locked}
+//
+// This message is sent by the server when the guest count, MaxGuests or lock state of the room changes.
+//
+// guests is empty unless the room is public.
+func msgRoomStatus(ctx context.Context, rm *room, GuestCount, MaxGuests int, Locked bool, guests []*guest) error {
+	msg := Msg{
+		Type:       RoomStatus,
+		GuestCount: GuestCount,
+		MaxGuests:  MaxGuests,
+		Locked:     Locked,
+	}
+	for _, g := range guests {
+		g.send(ctx, msg)
+	}
+	return rm.writeHost(ctx, msg)
+}
+
+// Guest -> Server Msg{GuestLeave: Reason}
+//
+// This message is sent by the Guest when it leaves the room on purpose.
+//
+// The server forwards Reason to the Host in GuestDisconnected.
+func MsgGuestLeave(ctx context.Context, conn *GuestConn, Reason string) error {
+	msg := Msg{
+		Type:   GuestLeave,
+		Reason: Reason,
+	}
+	return conn.send(ctx, msg)
+}
+
+// Guest -> Server -> Host Msg{Relay: GuestId,Payload}
+//
+// Host  -> Server -> Guest Msg{Relay: GuestId,Payload}
+//
+// Sends opaque application data through the signaling server.
+//
+// GuestId is the recipient when sent by the Host, and the sender when forwarded to the Host.
+// Guests leave it empty.
+func MsgRelay(ctx context.Context, conn msgSender, GuestId qp2p.GuestID, Payload []byte) error {
+	msg := Msg{
+		Type:    Relay,
+		GuestId: GuestId,
+		Payload: Payload,
+	}
+	return conn.send(ctx, msg)
+}
+
+// Host  -> Server -> Guest Msg{IceRestart: GuestId,Ufrag,Pwd}
+//
+// Guest -> Server -> Host Msg{IceRestart: Ufrag,Pwd}
+//
+// Sends the other side fresh ICE credentials after a restart. GuestId is the recipient
+// when sent by the Host. Guests leave it empty.
+//
+// Returns an error wrapping ErrInvalidCredentials without sending if they are invalid.
+func MsgIceRestart(ctx context.Context, conn msgSender, guestId qp2p.GuestID, ufrag, pwd string) error {
+	if err := ValidateCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+	msg := IceRestartMsg{
+		GuestId: guestId,
+		Ufrag:   ufrag,
+		Pwd:     pwd,
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Host  -> Server -> Guest Msg{Error: GuestId,Code,Detail}
+//
+// Guest -> Server -> Host Msg{Error: Code,Detail}
+//
+// Tells the other side about a problem that does not end the connection, e.g. with an
+// application code from ErrorCodeAppMin to ErrorCodeAppMax.
+// GuestId is the recipient when sent by the Host. Guests leave it empty.
+//
+// Returns an error wrapping ErrInvalidMessage without sending if code is not a recoverable code,
+// or detail is longer than MaxErrorDetailLen.
+func MsgError(ctx context.Context, conn msgSender, guestId qp2p.GuestID, code int, detail string) error {
+	msg := ErrorMsg{
+		GuestId: guestId,
+		Code:    code,
+		Detail:  detail,
+	}
+	if err := msg.Validate(); err != nil {
+		return err
+	} else if !recoverable(code) {
+		return invalidPayload(Error, "Code not recoverable")
+	}
+	return conn.send(ctx, msg.AsMsg())
+}
+
+// Host  -> Server Msg{Ping: Nonce}
+//
+// Guest -> Server Msg{Ping: Nonce}
+//
+// Asks the server for a Pong with the same Nonce.
+func MsgPing(ctx context.Context, conn msgSender, nonce uint32) error {
+	return conn.send(ctx, Msg{Type: Ping, Nonce: nonce})
+}
+
+// Server -> Host Msg{Pong: Nonce,ServerTime}
+//
+// Server -> Guest Msg{Pong: Nonce,ServerTime}
+//
+// Answers a Ping with its Nonce, and the time now.
+func msgPong(ctx context.Context, conn msgSender, nonce uint32) error {
+	return conn.send(ctx, Msg{Type: Pong, Nonce: nonce, ServerTime: time.Now().UnixMilli()})
+}
+
+// Server -> Host Msg{JoinRequest: GuestId,Metadata,Role}
+//
+// Asks the Host to accept or reject the Guest.
+func msgJoinRequest(ctx context.Context, rm *room, GuestId qp2p.GuestID, Metadata []byte, Role Role) error {
+	msg := Msg{
+		Type:     JoinRequest,
+		GuestId:  GuestId,
+		Metadata: Metadata,
+		Role:     Role,
+	}
+	return rm.writeHost(ctx, msg)
+}
+
+// Host -> Server Msg{AcceptGuest: GuestId}
+//
+// Accepts a Guest from JoinRequest.
+func MsgAcceptGuest(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID) error {
 	msg := Msg{
-		Type:    KickGuest,
+		Type:    AcceptGuest,
+		GuestId: GuestId,
+	}
+	return conn.send(ctx, msg)
+}
+
+// Host -> Server Msg{RejectGuest: GuestId,Reason}
+//
+// Rejects a Guest from JoinRequest, closing it with Reason.
+func MsgRejectGuest(ctx context.Context, conn *HostConn, GuestId qp2p.GuestID, Reason string) error {
+	msg := Msg{
+		Type:    RejectGuest,
 		GuestId: GuestId,
 		Reason:  Reason,
 	}
-	return WriteMsg(conn, msg, timeout)
+	return conn.send(ctx, msg)
 }
 
-// Marshal Msg as array and write to Conn.
-// Error if marshal or write fails.
-func WriteMsg(conn *websocket.Conn, msg Msg, timeout time.Duration) error {
-	// marshal Msg
-	b, err := msgpack.MarshalAsArray(msg)
-	if err != nil {
-		return fmt.Errorf("signaling.writeMsg: failed to marshal %T %v", msg, err)
+// Server -> Guest Msg{Joined: GuestId,ResumeToken}
+//
+// Tells the Guest its GuestId, and the ResumeToken for its next rejoin.
+func msgJoined(ctx context.Context, conn *GuestConn, GuestId qp2p.GuestID, ResumeToken string) error {
+	msg := Msg{
+		Type:        Joined,
+		GuestId:     GuestId,
+		ResumeToken: ResumeToken,
 	}
+	return conn.send(ctx, msg)
+}
+
+// Host -> Server Msg{Heartbeat}
+//
+// Shows the server the host application is still running. See Heartbeat.
+func MsgHeartbeat(ctx context.Context, conn *HostConn) error {
+	return conn.send(ctx, Msg{Type: Heartbeat})
+}
+
+// Host -> Server Msg{CreateRoom: Password}
+//
+// Asks for another room on the Host's connection. See CreateRoom.
+func MsgCreateRoom(ctx context.Context, conn *HostConn, Password string) error {
+	return conn.send(ctx, Msg{Type: CreateRoom, Password: Password})
+}
+
+// Server -> Host Msg{CreateRoom: Reason}
+//
+// Tells the Host why its CreateRoom failed, e.g. "server at capacity".
+func msgCreateRoomFailed(ctx context.Context, conn *HostConn, Reason string) error {
+	return conn.send(ctx, Msg{Type: CreateRoom, Reason: Reason})
+}
+
+// Host -> Server Msg{LockRoom}
+//
+// Turns new guests away until MsgUnlockRoom.
+func MsgLockRoom(ctx context.Context, conn *HostConn) error {
+	return conn.send(ctx, Msg{Type: LockRoom})
+}
+
+// Host -> Server Msg{UnlockRoom}
+//
+// Lets new guests join the room again after MsgLockRoom.
+func MsgUnlockRoom(ctx context.Context, conn *HostConn) error {
+	return conn.send(ctx, Msg{Type: UnlockRoom})
+}
+
+// Host -> Server Msg{CloseRoom: Reason}
+//
+// Closes the room, kicking every Guest with the Reason.
+func MsgCloseRoom(ctx context.Context, conn *HostConn, Reason string) error {
+	return conn.send(ctx, Msg{Type: CloseRoom, Reason: Reason})
+}
+
+// Host -> Server Msg{CreateInvites: InviteCount}
+//
+// Asks the server for InviteCount one-time invite tokens.
+func MsgCreateInvites(ctx context.Context, conn *HostConn, InviteCount int) error {
+	return conn.send(ctx, Msg{Type: CreateInvites, InviteCount: InviteCount})
+}
+
+// Server -> Host Msg{CreateInvites: Invites}
+//
+// The invite tokens created for the Host's CreateInvites.
+func msgInvites(ctx context.Context, conn *HostConn, Invites []string) error {
+	return conn.send(ctx, Msg{Type: CreateInvites, Invites: Invites})
+}
+
+// Server -> Guest Msg{QueuePosition: Position}
+//
+// Tells a Guest waiting for a slot in a full room its place in the queue.
+func msgQueuePosition(ctx context.Context, conn *GuestConn, Position int) error {
+	return conn.send(ctx, Msg{Type: QueuePosition, Position: Position})
+}
+
+// Host -> Server Msg{QueuedGuests}
+//
+// Asks the server for the Guests waiting for a slot in the room.
+func MsgQueuedGuests(ctx context.Context, conn *HostConn) error {
+	return conn.send(ctx, Msg{Type: QueuedGuests})
+}
+
+// Server -> Host Msg{QueuedGuests: Queued}
+//
+// The Guests waiting for a slot in the room, in join order.
+func msgQueuedGuests(ctx context.Context, conn *HostConn, Queued []qp2p.GuestID) error {
+	return conn.send(ctx, Msg{Type: QueuedGuests, Queued: Queued})
+}
+
+// Host -> Server Msg{ClearQueue: Reason}
+//
+// Turns away every Guest waiting for a slot in the room.
+func MsgClearQueue(ctx context.Context, conn *HostConn, Reason string) error {
+	return conn.send(ctx, Msg{Type: ClearQueue, Reason: Reason})
+}
 
+// Server -> Host Msg{CloseRoom}
+//
+// Acknowledges the Host's CloseRoom before its connection is closed.
+func msgCloseRoomAck(ctx context.Context, conn *HostConn) error {
+	return conn.send(ctx, Msg{Type: CloseRoom})
+}
+
+// Marshal Msg with the codec negotiated for Conn and write to Conn.
+// Error if marshal or write fails, or ctx is done first.
+func WriteMsg(ctx context.Context, conn *websocket.Conn, msg Msg) error {
+	return WriteMsgCodec(ctx, conn, ConnCodec(conn), msg)
+}
+
+// Like WriteMsg, but gives up after timeout.
+func WriteMsgTimeout(conn *websocket.Conn, msg Msg, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	return WriteMsg(ctx, conn, msg)
+}
+
+// Encode buffers reused by WriteMsgCodec.
+var writeBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Buffers grown past this are dropped instead of pooled, so one large Relay does not pin its buffer.
+const maxPooledBufLen = 64 << 10
 
-	// write to socket, return if error or timeout.
-	err = conn.Write(ctx, websocket.MessageBinary, b)
+// Marshal Msg with codec and write to Conn.
+// Error if marshal or write fails, or ctx is done first.
+func WriteMsgCodec(ctx context.Context, conn *websocket.Conn, codec Codec, msg Msg) error {
+	if msg.Type == Invalid {
+		return fmt.Errorf("signaling.writeMsg: %w: message type is Invalid", ErrInvalidMessage)
+	}
+	msg = msg.Clamp()
+	if err := msg.Validate(); err != nil {
+		return fmt.Errorf("signaling.writeMsg: %w", err)
+	}
+	// marshal Msg, into a pooled buffer if the codec can.
+	var b []byte
+	var err error
+	if bc, ok := codec.(bufferCodec); ok {
+		buf := writeBufs.Get().(*bytes.Buffer)
+		defer func() {
+			if buf.Cap() <= maxPooledBufLen {
+				buf.Reset()
+				writeBufs.Put(buf)
+			}
+		}()
+		err = bc.marshalTo(buf, msg)
+		b = buf.Bytes()
+	} else {
+		b, err = codec.Marshal(msg)
+	}
 	if err != nil {
-		return fmt.Errorf("signaling.writeMsg: failed to write %T %v", msg, err)
+		return fmt.Errorf("signaling.writeMsg: failed to marshal %v: %w", msg.Type, err)
+	}
+
+	// write to socket, return if error or ctx is done.
+	err = conn.Write(ctx, codec.FrameType(), b)
+	if err != nil {
+		return fmt.Errorf("signaling.writeMsg: failed to write %v: %w", msg.Type, err)
 	}
 	return nil
 }
 
-// Marshal Msg as array and write to Conn.
-// Error if marshal or write fails.
-func ReadMsg(conn *websocket.Conn, timeout time.Duration) (Msg, error) {
+// Read a Msg from Conn with the codec negotiated for it, waiting until ctx is done.
+//
+// The connection is closed if ctx is done before a message arrives.
+// A frame that can't be decoded returns an error wrapping ErrInvalidMessage,
+// and the connection stays usable.
+func ReadMsg(ctx context.Context, conn *websocket.Conn) (Msg, error) {
+	return ReadMsgCodec(ctx, conn, ConnCodec(conn))
+}
+
+// Like ReadMsg, but gives up after timeout.
+func ReadMsgTimeout(conn *websocket.Conn, timeout time.Duration) (Msg, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	return ReadMsg(ctx, conn)
+}
+
+// Read a Msg encoded with codec from Conn, waiting until ctx is done.
+func ReadMsgCodec(ctx context.Context, conn *websocket.Conn, codec Codec) (Msg, error) {
+	msg := new(Msg)
+	if err := readMsgInto(ctx, conn, codec, msg); err != nil {
+		return Msg{}, err
+	}
+	return *msg, nil
+}
+
+// Like ReadMsg, but reads into msg, so a read loop can reuse one Msg instead of allocating one per read.
+//
+// msg is reset before it is decoded into, and left zero on error.
+// Its slices are not reused, so messages copied out of it stay valid.
+func ReadMsgInto(ctx context.Context, conn *websocket.Conn, msg *Msg) error {
+	return readMsgInto(ctx, conn, ConnCodec(conn), msg)
+}
+
+// Read a Msg encoded with codec from Conn into msg, see ReadMsgInto.
+//
+// The frame is not pooled, as decoded messages can share its memory.
+func readMsgInto(ctx context.Context, conn *websocket.Conn, codec Codec, msg *Msg) error {
+	*msg = Msg{}
 	// read
 	t, b, err := conn.Read(ctx)
 	if err != nil {
-		return Msg{}, fmt.Errorf("signaling.readMsg: %w", err)
+		if errors.Is(err, websocket.ErrMessageTooBig) {
+			return fmt.Errorf("signaling.readMsg: %w: %w", ErrMessageTooLarge, err)
+		}
+		if closeErr := closeError(err); closeErr != nil {
+			return fmt.Errorf("signaling.readMsg: %w: %w", closeErr, err)
+		}
+		return fmt.Errorf("signaling.readMsg: %w", err)
 	}
-	// return error if message is not binary payload.
-	if t != websocket.MessageBinary {
-		return Msg{}, fmt.Errorf("signaling.readMsg: message type is not binary %w", err)
+	return decodeFrame(codec, t, b, msg)
+}
+
+// Decodes a frame of type t read from a connection using codec into msg.
+//
+// Returns an error wrapping ErrInvalidMessage, and leaves msg zero, if the frame can't be decoded.
+func decodeFrame(codec Codec, t websocket.MessageType, b []byte, msg *Msg) error {
+	*msg = Msg{}
+	// return error if message is not in the codec's frame type, e.g. binary for msgpack and text for JSON.
+	if t != codec.FrameType() {
+		return fmt.Errorf("signaling.readMsg: %w: frame type is %v, not %v", ErrInvalidMessage, t, codec.FrameType())
 	}
-	// unmarshal binary payload
-	msg := new(Msg)
-	err = msgpack.UnmarshalAsArray(b, msg)
+	// unmarshal payload
+	err := codec.Unmarshal(b, msg)
 	if err != nil {
-		return Msg{}, fmt.Errorf("signaling.readMsg: failed to unmarshal message as array %w", err)
+		*msg = Msg{}
 	}
-
-	return *msg, nil
+	if errors.Is(err, ErrInvalidMessage) {
+		return fmt.Errorf("signaling.readMsg: %w", err)
+	} else if err != nil {
+		return fmt.Errorf("signaling.readMsg: %w: failed to unmarshal message: %w", ErrInvalidMessage, err)
+	}
+	// e.g. an empty message. Types the package does not know are left to the caller.
+	if msg.Type == Invalid {
+		*msg = Msg{}
+		return fmt.Errorf("signaling.readMsg: %w: message type is Invalid", ErrInvalidMessage)
+	}
+	return nil
 }
@@ -0,0 +1,271 @@
+package signaling_test
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/frames.golden from the current encoding")
+
+// Golden frames of every MsgType in each codec, one "subprotocol type hex" per line.
+const goldenFrames = "testdata/frames.golden"
+
+// Every codec, in a fixed order so fuzz inputs can pick one by index.
+var allCodecs = []signaling.Codec{
+	signaling.CodecMsgpack, signaling.CodecJSON, signaling.CodecCBOR,
+	signaling.CodecMsgpackV2, signaling.CodecJSONV2, signaling.CodecCBORV2,
+}
+
+// Reports whether codec encodes protocol version 2 Envelopes.
+func isV2(codec signaling.Codec) bool {
+	return strings.HasSuffix(codec.Subprotocol(), ".v2")
+}
+
+// Returns a message of type typ with every field set, valid for every type.
+func goldenMsg(typ signaling.MsgType) signaling.Msg {
+	return signaling.Msg{
+		Type:              typ,
+		RoomId:            "ROOM01",
+		GuestId:           signalingtest.GuestID(1),
+		Ufrag:             signalingtest.Ufrag,
+		Pwd:               signalingtest.Pwd,
+		Candidate:         signalingtest.Candidate(0),
+		Reason:            "reason",
+		Password:          "password",
+		ResumeToken:       "resume",
+		Ban:               true,
+		Name:              "name",
+		Public:            true,
+		MaxGuests:         8,
+		Metadata:          []byte{1, 2, 3},
+		Version:           2,
+		Payload:           []byte{4, 5, 6},
+		Candidates:        []string{signalingtest.Candidate(1)},
+		GuestCount:        3,
+		Locked:            true,
+		Role:              signaling.RoleSpectator,
+		InviteCount:       2,
+		Invites:           []string{"invite"},
+		Region:            "eu",
+		HeartbeatInterval: 5 * time.Second,
+		Position:          1,
+		Queued:            []qp2p.GuestID{signalingtest.GuestID(2)},
+		Code:              signaling.ErrorMessageRejected,
+		Detail:            "detail",
+		Nonce:             42,
+		ServerTime:        1700000000000,
+		ReasonCode:        signaling.KickConnectionFailed,
+		Seq:               7,
+	}
+}
+
+// Returns what codec decodes from the encoding of msg: the whole msg for version 1 codecs,
+// and only its payload's fields for version 2 codecs.
+func decodedMsg(codec signaling.Codec, msg signaling.Msg) signaling.Msg {
+	if !isV2(codec) {
+		return msg
+	}
+	out := signaling.PayloadOf(msg).AsMsg()
+	out.Type = msg.Type
+	out.Seq = msg.Seq
+	return out
+}
+
+func goldenKey(codec signaling.Codec, typ signaling.MsgType) string {
+	return codec.Subprotocol() + " " + typ.String()
+}
+
+// Reads the golden frames, keyed by goldenKey.
+func readGolden(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	f, err := os.Open(goldenFrames)
+	if err != nil {
+		tb.Fatalf("%v, run go test -run TestGoldenFrames -update", err)
+	}
+	defer f.Close()
+	golden := make(map[string][]byte)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			tb.Fatalf("%s: malformed line %q", goldenFrames, sc.Text())
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil {
+			tb.Fatalf("%s: %v", goldenFrames, err)
+		}
+		golden[fields[0]+" "+fields[1]] = b
+	}
+	if err := sc.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return golden
+}
+
+func writeGolden(t *testing.T) {
+	var sb strings.Builder
+	for _, codec := range allCodecs {
+		for _, typ := range signaling.KnownTypes() {
+			b, err := codec.Marshal(goldenMsg(typ))
+			if err != nil {
+				t.Fatalf("%s: marshal %v: %v", codec.Subprotocol(), typ, err)
+			}
+			fmt.Fprintf(&sb, "%s %x\n", goldenKey(codec, typ), b)
+		}
+	}
+	if err := os.MkdirAll("testdata", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(goldenFrames, []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every MsgType encodes to the same bytes in every codec as it did when the golden frames were written,
+// so a reordered or renamed field, which breaks peers on other versions, fails here.
+func TestGoldenFrames(t *testing.T) {
+	if *update {
+		writeGolden(t)
+	}
+	golden := readGolden(t)
+	for _, codec := range allCodecs {
+		for _, typ := range signaling.KnownTypes() {
+			t.Run(goldenKey(codec, typ), func(t *testing.T) {
+				want, ok := golden[goldenKey(codec, typ)]
+				if !ok {
+					t.Fatal("no golden frame, run go test -run TestGoldenFrames -update")
+				}
+				msg := goldenMsg(typ)
+				b, err := codec.Marshal(msg)
+				if err != nil {
+					t.Fatalf("marshal: %v", err)
+				}
+				if string(b) != string(want) {
+					t.Fatalf("encoding changed\n got %x\nwant %x", b, want)
+				}
+				got, err := signaling.DecodeFrame(codec, codec.FrameType(), want)
+				if err != nil {
+					t.Fatalf("decode golden frame: %v", err)
+				}
+				if want := decodedMsg(codec, msg); !reflect.DeepEqual(got, want) {
+					t.Fatalf("golden frame decoded to\n%+v\nwant\n%+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// Adds every golden frame to f, whole, truncated and with trailing garbage,
+// and array and map headers that claim far more elements than follow.
+func addFrameSeeds(f *testing.F, add func(codec int, b []byte)) {
+	golden := readGolden(f)
+	for i, codec := range allCodecs {
+		for _, typ := range signaling.KnownTypes() {
+			b := golden[goldenKey(codec, typ)]
+			add(i, b)
+			add(i, b[:len(b)/2])
+			add(i, b[:len(b)-1])
+			add(i, append(b[:len(b):len(b)], 0xff))
+		}
+		add(i, nil)
+		// msgpack array32 and map32, and CBOR array and map with 64 bit lengths.
+		add(i, []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01})
+		add(i, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0x01})
+		add(i, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+		add(i, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+		add(i, []byte(`{"Type":`))
+		add(i, []byte(`{"Type":3,"Payload":`))
+	}
+}
+
+// ReadMsg never panics on a hostile frame, and returns an error wrapping ErrInvalidMessage
+// with a zero Msg for any frame it can't decode.
+func FuzzReadMsg(f *testing.F) {
+	addFrameSeeds(f, func(codec int, b []byte) {
+		f.Add(uint8(codec), false, b)
+		f.Add(uint8(codec), true, b)
+	})
+	f.Fuzz(func(t *testing.T, i uint8, text bool, b []byte) {
+		codec := allCodecs[int(i)%len(allCodecs)]
+		typ := websocket.MessageBinary
+		if text {
+			typ = websocket.MessageText
+		}
+		msg, err := signaling.DecodeFrame(codec, typ, b)
+		if err != nil {
+			if !errors.Is(err, signaling.ErrInvalidMessage) {
+				t.Fatalf("%s: error does not wrap ErrInvalidMessage: %v", codec.Subprotocol(), err)
+			}
+			if !reflect.DeepEqual(msg, signaling.Msg{}) {
+				t.Fatalf("%s: msg not zero on error: %+v", codec.Subprotocol(), msg)
+			}
+			return
+		}
+		if msg.Type == signaling.Invalid {
+			t.Fatalf("%s: decoded a message of type Invalid", codec.Subprotocol())
+		}
+	})
+}
+
+// Every codec's Unmarshal never panics, and what it decodes can be encoded again.
+func FuzzUnmarshal(f *testing.F) {
+	addFrameSeeds(f, func(codec int, b []byte) {
+		f.Add(uint8(codec), b)
+	})
+	f.Fuzz(func(t *testing.T, i uint8, b []byte) {
+		codec := allCodecs[int(i)%len(allCodecs)]
+		var msg signaling.Msg
+		if err := codec.Unmarshal(b, &msg); err != nil {
+			return
+		}
+		if _, err := codec.Marshal(msg); err != nil {
+			t.Fatalf("%s: decoded %+v can't be encoded: %v", codec.Subprotocol(), msg, err)
+		}
+	})
+}
+
+// Every MsgType survives being decoded from one codec and encoded in another, as the server does
+// when it forwards between connections on different codecs.
+func TestTranscode(t *testing.T) {
+	for _, from := range allCodecs {
+		for _, to := range allCodecs {
+			for _, typ := range signaling.KnownTypes() {
+				t.Run(from.Subprotocol()+" "+to.Subprotocol()+" "+typ.String(), func(t *testing.T) {
+					b, err := from.Marshal(goldenMsg(typ))
+					if err != nil {
+						t.Fatalf("marshal: %v", err)
+					}
+					msg, err := signaling.DecodeFrame(from, from.FrameType(), b)
+					if err != nil {
+						t.Fatalf("decode: %v", err)
+					}
+					b, err = to.Marshal(msg)
+					if err != nil {
+						t.Fatalf("transcode: %v", err)
+					}
+					got, err := signaling.DecodeFrame(to, to.FrameType(), b)
+					if err != nil {
+						t.Fatalf("decode transcoded: %v", err)
+					}
+					if want := decodedMsg(to, decodedMsg(from, goldenMsg(typ))); !reflect.DeepEqual(got, want) {
+						t.Fatalf("transcoded to\n%+v\nwant\n%+v", got, want)
+					}
+				})
+			}
+		}
+	}
+}
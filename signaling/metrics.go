@@ -0,0 +1,203 @@
+package signaling
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metric names reported by the WebsocketSignalingServer.
+//
+// Names with a {label=value} suffix are reported once per value.
+const (
+	// Gauge of rooms that are open.
+	MetricActiveRooms = "active_rooms"
+	// Gauge of guests in rooms.
+	MetricActiveGuests = "active_guests"
+	// Counter of rooms created.
+	MetricRoomsCreated = "rooms_created_total"
+	// Counter of hosts turned away because the server hosts MaxRooms rooms.
+	MetricHostsRejected = "hosts_rejected_total"
+	// Counter of guests turned away, labeled by reason.
+	MetricJoinsRejected = "joins_rejected_total"
+	// Counter of websocket writes that failed.
+	MetricWriteFailures = "write_failures_total"
+	// Counter of messages forwarded between hosts and guests, labeled by type.
+	MetricMessagesForwarded = "messages_forwarded_total"
+	// Counter of ICE candidates dropped instead of forwarded, labeled by reason.
+	MetricCandidatesDropped = "candidates_dropped_total"
+	// Counter of messages for an away host dropped because the room's queue was full, labeled by type.
+	MetricHostQueueDropped = "host_queue_dropped_total"
+	// Counter of guests kicked because their room closed before the host sent them HostAuth.
+	MetricOrphanedGuests = "orphaned_guests_total"
+	// Counter of host messages dropped because they were for a guest in another room, labeled by type.
+	MetricCrossRoomRejected = "cross_room_rejected_total"
+	// Counter of GuestAuth and HostAuth messages with invalid ICE credentials, labeled by reason.
+	MetricCredentialsRejected = "credentials_rejected_total"
+	// Counter of messages of a type the server does not know, e.g. from newer clients, labeled by sender.
+	MetricUnknownMessages = "unknown_messages_total"
+	// Counter of webhooks that failed after every retry.
+	MetricWebhookFailures = "webhook_failures_total"
+	// Counter of webhooks dropped because the webhook queue was full.
+	MetricWebhooksDropped = "webhooks_dropped_total"
+	// Latency from a guest's GuestAuth to the host's HostAuth being forwarded to it.
+	MetricHandshakeLatency = "handshake_latency"
+)
+
+// Metrics receives counters and latencies from the WebsocketSignalingServer.
+//
+// Implementations must be safe for concurrent use, and should not block.
+type Metrics interface {
+	// Adds delta to the counter or gauge name.
+	Add(name string, delta int64)
+	// Records a latency sample for name.
+	Observe(name string, d time.Duration)
+}
+
+// Returns name with a {key=value} label.
+func labeled(name, key, value string) string {
+	return name + "{" + key + "=" + value + "}"
+}
+
+// MemoryMetrics is an in-memory Metrics implementation.
+//
+// It is used by the server if ServerOptions.Metrics is nil.
+type MemoryMetrics struct {
+	mu        sync.Mutex
+	counters  map[string]int64
+	latencies map[string]LatencySummary
+}
+
+// Summary of the latency samples recorded for a metric.
+type LatencySummary struct {
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	Max   time.Duration `json:"max"`
+}
+
+// A point in time copy of MemoryMetrics.
+type MetricsSnapshot struct {
+	Counters  map[string]int64          `json:"counters"`
+	Latencies map[string]LatencySummary `json:"latencies"`
+}
+
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		counters:  make(map[string]int64),
+		latencies: make(map[string]LatencySummary),
+	}
+}
+
+func (m *MemoryMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *MemoryMetrics) Observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.latencies[name]
+	l.Count++
+	l.Sum += d
+	l.Max = max(l.Max, d)
+	m.latencies[name] = l
+}
+
+// Snapshot returns a copy of the recorded metrics.
+func (m *MemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := MetricsSnapshot{
+		Counters:  make(map[string]int64, len(m.counters)),
+		Latencies: make(map[string]LatencySummary, len(m.latencies)),
+	}
+	for name, v := range m.counters {
+		snap.Counters[name] = v
+	}
+	for name, v := range m.latencies {
+		snap.Latencies[name] = v
+	}
+	return snap
+}
+
+// ServeHTTP writes the Snapshot as JSON, so MemoryMetrics can be mounted on /metrics.
+func (m *MemoryMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Snapshot())
+}
+
+// Metrics returns the Metrics the server reports to.
+func (s *WebsocketSignalingServer) Metrics() Metrics {
+	return s.sopts.Metrics
+}
+
+// Counts a guest turned away for reason.
+func (s *WebsocketSignalingServer) joinRejected(reason string) {
+	s.sopts.Metrics.Add(labeled(MetricJoinsRejected, "reason", reason), 1)
+}
+
+// Returns msg's IceCandidate with invalid candidates dropped, in the same single or batched form.
+//
+// Returns false if no candidate is left to forward.
+// If any was dropped, from is sent an Error with ErrorCandidateRejected and the first reason.
+func (s *WebsocketSignalingServer) validCandidates(ctx context.Context, rm *room, from msgSender, msg Msg) (Msg, bool) {
+	var dropped string
+	drop := func(reason string) {
+		s.log.Debug("IceCandidate dropped", "id", rm.id, "reason", reason)
+		s.sopts.Metrics.Add(labeled(MetricCandidatesDropped, "reason", reason), 1)
+		s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "IceCandidate " + reason})
+		dropped = cmp.Or(dropped, reason)
+	}
+	out := Msg{Type: IceCandidate, GuestId: msg.GuestId}
+	if msg.Candidate != "" {
+		if reason := checkCandidate(msg.Candidate); reason != "" {
+			drop(reason)
+		} else {
+			out.Candidate = msg.Candidate
+		}
+	}
+	for i, c := range msg.Candidates {
+		if i == maxBatchCandidates {
+			drop("too_many")
+			break
+		}
+		if reason := checkCandidate(c); reason != "" {
+			drop(reason)
+			continue
+		}
+		out.Candidates = append(out.Candidates, c)
+	}
+	if dropped != "" {
+		from.send(ctx, ErrorMsg{GuestId: msg.GuestId, Code: ErrorCandidateRejected, Detail: "candidate rejected: " + dropped}.AsMsg())
+	}
+	return out, out.Candidate != "" || len(out.Candidates) > 0
+}
+
+// Counts a message forwarded between a host and a guest.
+func (s *WebsocketSignalingServer) forwarded(t MsgType) {
+	s.sopts.Metrics.Add(labeled(MetricMessagesForwarded, "type", t.String()), 1)
+}
+
+// Counts an IceCandidate dropped because a connection's write queue was full.
+func (s *WebsocketSignalingServer) queueDropped() {
+	s.sopts.Metrics.Add(labeled(MetricCandidatesDropped, "reason", "queue_full"), 1)
+}
+
+// Counts a message for an away host dropped because its room's queue was full.
+func (s *WebsocketSignalingServer) hostQueueDropped(t MsgType) {
+	s.sopts.Metrics.Add(labeled(MetricHostQueueDropped, "type", t.String()), 1)
+}
+
+// Counts ICE credentials rejected for reason.
+func (s *WebsocketSignalingServer) credentialsRejected(reason string) {
+	s.sopts.Metrics.Add(labeled(MetricCredentialsRejected, "reason", reason), 1)
+}
+
+// Counts a failed websocket write.
+func (s *WebsocketSignalingServer) writeFailed(err error) {
+	s.sopts.Metrics.Add(MetricWriteFailures, 1)
+}
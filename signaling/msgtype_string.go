@@ -16,11 +16,36 @@ func _() {
 	_ = x[IceCandidate-5]
 	_ = x[GuestDisconnected-6]
 	_ = x[KickGuest-7]
+	_ = x[SetRoomInfo-8]
+	_ = x[RoomInfo-9]
+	_ = x[GuestLeave-10]
+	_ = x[Relay-11]
+	_ = x[JoinRequest-12]
+	_ = x[AcceptGuest-13]
+	_ = x[RejectGuest-14]
+	_ = x[LockRoom-15]
+	_ = x[UnlockRoom-16]
+	_ = x[Joined-17]
+	_ = x[EndOfCandidates-18]
+	_ = x[RoomExpired-19]
+	_ = x[RoomStatus-20]
+	_ = x[WaitingForHost-21]
+	_ = x[CloseRoom-22]
+	_ = x[CreateInvites-23]
+	_ = x[Heartbeat-24]
+	_ = x[CreateRoom-25]
+	_ = x[QueuePosition-26]
+	_ = x[QueuedGuests-27]
+	_ = x[ClearQueue-28]
+	_ = x[Error-29]
+	_ = x[Ping-30]
+	_ = x[Pong-31]
+	_ = x[IceRestart-32]
 }
 
-const _MsgType_name = "InvalidRoomCreatedGuestAuthGuestJoinedHostAuthIceCandidateGuestDisconnectedKickGuest"
+const _MsgType_name = "InvalidRoomCreatedGuestAuthGuestJoinedHostAuthIceCandidateGuestDisconnectedKickGuestSetRoomInfoRoomInfoGuestLeaveRelayJoinRequestAcceptGuestRejectGuestLockRoomUnlockRoomJoinedEndOfCandidatesRoomExpiredRoomStatusWaitingForHostCloseRoomCreateInvitesHeartbeatCreateRoomQueuePositionQueuedGuestsClearQueueErrorPingPongIceRestart"
 
-var _MsgType_index = [...]uint8{0, 7, 18, 27, 38, 46, 58, 75, 84}
+var _MsgType_index = [...]uint16{0, 7, 18, 27, 38, 46, 58, 75, 84, 95, 103, 113, 118, 129, 140, 151, 159, 169, 175, 190, 201, 211, 225, 234, 247, 256, 266, 279, 291, 301, 306, 310, 314, 324}
 
 func (i MsgType) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,68 @@
+package signaling
+
+import (
+	"log/slog"
+	"sync"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// Most host messages parked for one guest, see parkedMsgs. Later ones are dropped.
+const maxParkedMsgs = 64
+
+// A host's messages for guests admitted to its room but not registered yet, e.g. a HostAuth that
+// raced the guest's registration. They are delivered by deliverParked once the guest is registered,
+// off the host's read loop so its other guests' messages aren't held up.
+//
+// Once a guest has parked messages, the host's later messages to it are parked behind them,
+// so they are delivered in the order the host sent them.
+type parkedMsgs struct {
+	mu sync.Mutex
+	m  map[qp2p.GuestID][]parkedMsg
+}
+
+// A parked message, with the room and connection it was read for.
+type parkedMsg struct {
+	msg   Msg
+	rm    *room
+	hConn *HostConn
+	log   *slog.Logger
+}
+
+func newParkedMsgs() *parkedMsgs {
+	return &parkedMsgs{m: make(map[qp2p.GuestID][]parkedMsg)}
+}
+
+// Parks m if its guest has parked messages, or is a member of rm but not registered.
+//
+// Returns whether m was parked, or dropped as too many are, and whether it is the first,
+// in which case the caller starts deliverParked for the guest.
+func (p *parkedMsgs) park(rm *room, registered bool, m parkedMsg) (parked, first bool) {
+	guestId := m.msg.GuestId
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.m[guestId]
+	if !ok && (registered || !rm.isMember(guestId)) {
+		return false, false
+	}
+	if len(q) >= maxParkedMsgs {
+		m.log.Debug("Message for unregistered guest dropped, too many parked", "type", m.msg.Type, "guest", guestId)
+		return true, false
+	}
+	p.m[guestId] = append(q, m)
+	return true, !ok
+}
+
+// Returns the messages parked for guestId. Later messages are parked behind them until
+// take returns none, or drop is set.
+func (p *parkedMsgs) take(guestId qp2p.GuestID, drop bool) []parkedMsg {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q := p.m[guestId]
+	if drop || len(q) == 0 {
+		delete(p.m, guestId)
+		return q
+	}
+	p.m[guestId] = nil
+	return q
+}
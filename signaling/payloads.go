@@ -0,0 +1,422 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The typed body of a message.
+//
+// Connections on protocol version 2 carry every message as an Envelope with its Payload.
+// Message types without a typed payload below carry Msg itself.
+type Payload interface {
+	// Type of the message carrying the payload.
+	MsgType() MsgType
+	// Checks the payload's required fields and length limits.
+	// Returns an error wrapping ErrInvalidMessage if it is invalid.
+	Validate() error
+	// Returns the payload as a flat Msg.
+	AsMsg() Msg
+}
+
+// Server -> Host, see RoomCreated.
+type RoomCreatedMsg struct {
+	RoomId            qp2p.RoomId
+	ResumeToken       string
+	Region            string
+	HeartbeatInterval time.Duration
+}
+
+// Guest -> Server, see GuestAuth.
+type GuestAuthMsg struct {
+	Ufrag, Pwd string
+	// Room password, if it was not passed in the url.
+	Password string
+	Metadata []byte
+}
+
+// Server -> Host, see GuestJoined.
+type GuestJoinedMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId     qp2p.RoomId
+	GuestId    qp2p.GuestID
+	Ufrag, Pwd string
+	Role       Role
+	Metadata   []byte
+}
+
+// Host -> Server -> Guest, see HostAuth.
+type HostAuthMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId     qp2p.RoomId
+	GuestId    qp2p.GuestID
+	Ufrag, Pwd string
+}
+
+// Host <-> Server <-> Guest, see IceCandidate.
+type IceCandidateMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId qp2p.RoomId
+	// Empty when sent by the guest.
+	GuestId    qp2p.GuestID
+	Candidate  string
+	Candidates []string
+}
+
+// Server -> Host, see GuestDisconnected.
+type GuestDisconnectedMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId  qp2p.RoomId
+	GuestId qp2p.GuestID
+	Reason  string
+}
+
+// Host -> Server -> Guest, see KickGuest.
+type KickGuestMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId  qp2p.RoomId
+	GuestId qp2p.GuestID
+	Reason  string
+	Ban     bool
+	// Why the guest was kicked. Codes the receiver does not know are kept as they are.
+	ReasonCode KickCode
+}
+
+// Host <-> Server <-> Guest, see Error.
+type ErrorMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId qp2p.RoomId
+	// The Guest the error is about, or the recipient when sent by the host.
+	GuestId qp2p.GuestID
+	Code    int
+	Detail  string
+}
+
+// Host <-> Server <-> Guest, see IceRestart.
+type IceRestartMsg struct {
+	// Set for rooms created with CreateRoom.
+	RoomId qp2p.RoomId
+	// The recipient when sent by the host, the sender when forwarded to the host.
+	GuestId    qp2p.GuestID
+	Ufrag, Pwd string
+}
+
+func (RoomCreatedMsg) MsgType() MsgType       { return RoomCreated }
+func (GuestAuthMsg) MsgType() MsgType         { return GuestAuth }
+func (GuestJoinedMsg) MsgType() MsgType       { return GuestJoined }
+func (HostAuthMsg) MsgType() MsgType          { return HostAuth }
+func (IceCandidateMsg) MsgType() MsgType      { return IceCandidate }
+func (GuestDisconnectedMsg) MsgType() MsgType { return GuestDisconnected }
+func (KickGuestMsg) MsgType() MsgType         { return KickGuest }
+func (ErrorMsg) MsgType() MsgType             { return Error }
+func (IceRestartMsg) MsgType() MsgType        { return IceRestart }
+
+// Msg is the payload of the message types without a typed one.
+func (m Msg) MsgType() MsgType { return m.Type }
+
+func (m RoomCreatedMsg) Validate() error {
+	switch {
+	case m.RoomId == "":
+		return invalidPayload(RoomCreated, "RoomId missing")
+	case len(m.Region) > maxRegionLen:
+		return invalidPayload(RoomCreated, "Region too long")
+	case m.HeartbeatInterval < 0:
+		return invalidPayload(RoomCreated, "HeartbeatInterval negative")
+	}
+	return nil
+}
+
+func (m GuestAuthMsg) Validate() error {
+	if err := validateCredentials(GuestAuth, m.Ufrag, m.Pwd); err != nil {
+		return err
+	}
+	if len(m.Metadata) > MaxGuestMetadataLen {
+		return invalidPayload(GuestAuth, "Metadata too long")
+	}
+	return nil
+}
+
+func (m GuestJoinedMsg) Validate() error {
+	if m.GuestId == (qp2p.GuestID{}) {
+		return invalidPayload(GuestJoined, "GuestId missing")
+	}
+	if err := validateCredentials(GuestJoined, m.Ufrag, m.Pwd); err != nil {
+		return err
+	}
+	switch {
+	case m.Role > RoleSpectator:
+		return invalidPayload(GuestJoined, "unknown Role")
+	case len(m.Metadata) > MaxGuestMetadataLen:
+		return invalidPayload(GuestJoined, "Metadata too long")
+	}
+	return nil
+}
+
+func (m HostAuthMsg) Validate() error {
+	if m.GuestId == (qp2p.GuestID{}) {
+		return invalidPayload(HostAuth, "GuestId missing")
+	}
+	return validateCredentials(HostAuth, m.Ufrag, m.Pwd)
+}
+
+func (m IceCandidateMsg) Validate() error {
+	if m.Candidate == "" && len(m.Candidates) == 0 {
+		return invalidPayload(IceCandidate, "Candidate missing")
+	}
+	if candidateTooLong(m.Candidate) {
+		return invalidPayload(IceCandidate, "Candidate too long")
+	}
+	for _, c := range m.Candidates {
+		if candidateTooLong(c) {
+			return invalidPayload(IceCandidate, "Candidate too long")
+		}
+	}
+	return nil
+}
+
+func (m GuestDisconnectedMsg) Validate() error {
+	switch {
+	case m.GuestId == (qp2p.GuestID{}):
+		return invalidPayload(GuestDisconnected, "GuestId missing")
+	case len(m.Reason) > MaxReasonLen:
+		return invalidPayload(GuestDisconnected, "Reason too long")
+	}
+	return nil
+}
+
+func (m KickGuestMsg) Validate() error {
+	switch {
+	case m.GuestId == (qp2p.GuestID{}):
+		return invalidPayload(KickGuest, "GuestId missing")
+	case len(m.Reason) > MaxReasonLen:
+		return invalidPayload(KickGuest, "Reason too long")
+	}
+	return nil
+}
+
+func (m ErrorMsg) Validate() error {
+	switch {
+	case m.Code < 1000 || m.Code > ErrorCodeAppMax:
+		return invalidPayload(Error, "Code out of range")
+	case len(m.Detail) > MaxErrorDetailLen:
+		return invalidPayload(Error, "Detail too long")
+	}
+	return nil
+}
+
+func (m IceRestartMsg) Validate() error {
+	return validateCredentials(IceRestart, m.Ufrag, m.Pwd)
+}
+
+// Validates m with its typed payload, if its type has one, and checks the fields any type
+// can carry are within MaxReasonLen, MaxCandidateLen, MaxUfragLen and MaxPwdLen.
+func (m Msg) Validate() error {
+	switch {
+	case len(m.Reason) > MaxReasonLen:
+		return invalidPayload(m.Type, "Reason too long")
+	case len(m.Ufrag) > MaxUfragLen || len(m.Pwd) > MaxPwdLen:
+		return invalidPayload(m.Type, "Ufrag or Pwd too long")
+	case candidateTooLong(m.Candidate) || slices.ContainsFunc(m.Candidates, candidateTooLong):
+		return invalidPayload(m.Type, "Candidate too long")
+	}
+	p := PayloadOf(m)
+	if _, ok := p.(Msg); ok {
+		return nil
+	}
+	return p.Validate()
+}
+
+// Returns m with its Reason safe to forward and show: control characters and invalid UTF-8
+// are removed, and it is cut to MaxReasonLen. Reasons come from the other peer, so a host
+// could otherwise write ANSI escapes to a guest's terminal.
+//
+// Fields that can't be shortened, like candidates, are left for Validate to reject.
+func (m Msg) Clamp() Msg {
+	m.Reason = cleanReason(m.Reason)
+	return m
+}
+
+// Checks that ICE credentials are present and not too long. Their characters are checked by
+// the receiver, see ValidateCredentials.
+func validateCredentials(typ MsgType, ufrag, pwd string) error {
+	switch {
+	case ufrag == "" || pwd == "":
+		return invalidPayload(typ, "Ufrag or Pwd missing")
+	case len(ufrag) > MaxUfragLen || len(pwd) > MaxPwdLen:
+		return invalidPayload(typ, "Ufrag or Pwd too long")
+	}
+	return nil
+}
+
+func invalidPayload(typ MsgType, reason string) error {
+	return fmt.Errorf("%w: %v %s", ErrInvalidMessage, typ, reason)
+}
+
+func (m RoomCreatedMsg) AsMsg() Msg {
+	return Msg{Type: RoomCreated, RoomId: m.RoomId, ResumeToken: m.ResumeToken, Region: m.Region, HeartbeatInterval: m.HeartbeatInterval}
+}
+
+func (m GuestAuthMsg) AsMsg() Msg {
+	return Msg{Type: GuestAuth, Ufrag: m.Ufrag, Pwd: m.Pwd, Password: m.Password, Metadata: m.Metadata}
+}
+
+func (m GuestJoinedMsg) AsMsg() Msg {
+	return Msg{Type: GuestJoined, RoomId: m.RoomId, GuestId: m.GuestId, Ufrag: m.Ufrag, Pwd: m.Pwd, Role: m.Role, Metadata: m.Metadata}
+}
+
+func (m HostAuthMsg) AsMsg() Msg {
+	return Msg{Type: HostAuth, RoomId: m.RoomId, GuestId: m.GuestId, Ufrag: m.Ufrag, Pwd: m.Pwd}
+}
+
+func (m IceCandidateMsg) AsMsg() Msg {
+	return Msg{Type: IceCandidate, RoomId: m.RoomId, GuestId: m.GuestId, Candidate: m.Candidate, Candidates: m.Candidates}
+}
+
+func (m GuestDisconnectedMsg) AsMsg() Msg {
+	return Msg{Type: GuestDisconnected, RoomId: m.RoomId, GuestId: m.GuestId, Reason: m.Reason}
+}
+
+func (m KickGuestMsg) AsMsg() Msg {
+	return Msg{Type: KickGuest, RoomId: m.RoomId, GuestId: m.GuestId, Reason: m.Reason, Ban: m.Ban, ReasonCode: m.ReasonCode}
+}
+
+func (m ErrorMsg) AsMsg() Msg {
+	return Msg{Type: Error, RoomId: m.RoomId, GuestId: m.GuestId, Code: m.Code, Detail: m.Detail}
+}
+
+func (m IceRestartMsg) AsMsg() Msg {
+	return Msg{Type: IceRestart, RoomId: m.RoomId, GuestId: m.GuestId, Ufrag: m.Ufrag, Pwd: m.Pwd}
+}
+
+func (m Msg) AsMsg() Msg { return m }
+
+// Returns the typed payload of msg, e.g. a GuestAuthMsg for a GuestAuth message.
+// Fields the type does not carry are dropped.
+//
+// Returns msg itself if its type has no typed payload.
+func PayloadOf(msg Msg) Payload {
+	switch msg.Type {
+	case RoomCreated:
+		return RoomCreatedMsg{RoomId: msg.RoomId, ResumeToken: msg.ResumeToken, Region: msg.Region, HeartbeatInterval: msg.HeartbeatInterval}
+	case GuestAuth:
+		return GuestAuthMsg{Ufrag: msg.Ufrag, Pwd: msg.Pwd, Password: msg.Password, Metadata: msg.Metadata}
+	case GuestJoined:
+		return GuestJoinedMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Ufrag: msg.Ufrag, Pwd: msg.Pwd, Role: msg.Role, Metadata: msg.Metadata}
+	case HostAuth:
+		return HostAuthMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Ufrag: msg.Ufrag, Pwd: msg.Pwd}
+	case IceCandidate:
+		return IceCandidateMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Candidate: msg.Candidate, Candidates: msg.Candidates}
+	case GuestDisconnected:
+		return GuestDisconnectedMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Reason: msg.Reason}
+	case KickGuest:
+		return KickGuestMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Reason: msg.Reason, Ban: msg.Ban, ReasonCode: msg.ReasonCode}
+	case Error:
+		return ErrorMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Code: msg.Code, Detail: msg.Detail}
+	case IceRestart:
+		return IceRestartMsg{RoomId: msg.RoomId, GuestId: msg.GuestId, Ufrag: msg.Ufrag, Pwd: msg.Pwd}
+	}
+	return msg
+}
+
+// Returns an empty payload of typ to decode into.
+func newPayload(typ MsgType) Payload {
+	switch typ {
+	case RoomCreated:
+		return new(RoomCreatedMsg)
+	case GuestAuth:
+		return new(GuestAuthMsg)
+	case GuestJoined:
+		return new(GuestJoinedMsg)
+	case HostAuth:
+		return new(HostAuthMsg)
+	case IceCandidate:
+		return new(IceCandidateMsg)
+	case GuestDisconnected:
+		return new(GuestDisconnectedMsg)
+	case KickGuest:
+		return new(KickGuestMsg)
+	case Error:
+		return new(ErrorMsg)
+	case IceRestart:
+		return new(IceRestartMsg)
+	}
+	return &Msg{Type: typ}
+}
+
+// A message on a protocol version 2 connection: its type, and its payload encoded on its own.
+//
+// Payloads are keyed by field name, so fields can be added to them in any order.
+// In msgpack the Envelope is an array, in JSON an object.
+type Envelope struct {
+	Type MsgType
+	// The encoded Payload, a msgpack map, JSON object or CBOR map.
+	Payload []byte
+	// The message's Seq, which belongs to the connection rather than the payload.
+	Seq uint64
+}
+
+// The JSON form of Envelope, with Payload as an object instead of base64.
+type jsonEnvelope struct {
+	Type    MsgType
+	Payload json.RawMessage
+	Seq     uint64 `json:",omitempty"`
+}
+
+// The CBOR form of Envelope, with Payload inline instead of as a byte string.
+type cborEnvelope struct {
+	Type    MsgType
+	Payload cbor.RawMessage
+	Seq     uint64 `cbor:",omitempty"`
+}
+
+// Encodes p in an Envelope with codec.
+func EncodeEnvelope(codec Codec, p Payload) ([]byte, error) {
+	return encodeEnvelope(codec, p, 0)
+}
+
+// Encodes p in an Envelope with codec and seq.
+func encodeEnvelope(codec Codec, p Payload, seq uint64) ([]byte, error) {
+	enc, err := envelopeEncodingOf(codec)
+	if err != nil {
+		return nil, err
+	}
+	return enc.marshalEnvelope(p, seq)
+}
+
+// Decodes an Envelope encoded with codec, and validates its payload.
+//
+// Returns the typed payload, or Msg for types without one.
+// Returns an error wrapping ErrInvalidMessage if the payload is invalid.
+func DecodeEnvelope(codec Codec, b []byte) (Payload, error) {
+	p, _, err := decodeEnvelope(codec, b)
+	return p, err
+}
+
+// Like DecodeEnvelope, also returning the Envelope's Seq.
+func decodeEnvelope(codec Codec, b []byte) (Payload, uint64, error) {
+	enc, err := envelopeEncodingOf(codec)
+	if err != nil {
+		return nil, 0, err
+	}
+	env, err := enc.unmarshalEnvelope(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := newPayload(env.Type)
+	if err := enc.unmarshalPayload(env.Payload, p); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v payload: %w", ErrInvalidMessage, env.Type, err)
+	}
+	// the envelope's type is the one the message is handled as.
+	msg := p.AsMsg()
+	msg.Type = env.Type
+	p = PayloadOf(msg)
+	if err := p.Validate(); err != nil {
+		return nil, 0, err
+	}
+	return p, env.Seq, nil
+}
@@ -0,0 +1,139 @@
+package signaling
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/pion/ice/v4"
+)
+
+// Stats of a PeerConn, e.g. for a network diagnostics panel.
+type PeerStats struct {
+	GuestId qp2p.GuestID
+	// Unique among the process's PeerConns, and increasing in the order guests joined,
+	// e.g. to tell a guest's connections apart after it rejoins.
+	ConnId uint64
+	// The ends of the selected candidate pair.
+	Local, Remote PeerCandidate
+	// The connection goes through a TURN server, e.g. for a "relayed connection" indicator.
+	Relayed bool
+	// Latest round trip time of the pair's STUN checks. 0 until one is answered.
+	RTT time.Duration
+	// Application data over the connection.
+	BytesSent     uint64
+	BytesReceived uint64
+	// Application packets over the selected candidate pair.
+	PacketsSent     uint32
+	PacketsReceived uint32
+	// When the agent selected the pair.
+	SelectedAt time.Time
+}
+
+// One end of a PeerConn's selected candidate pair.
+type PeerCandidate struct {
+	Type ice.CandidateType
+	// e.g. "203.0.113.7:5000".
+	Address string
+	// e.g. ice.NetworkTypeUDP4.
+	Network ice.NetworkType
+}
+
+// Last PeerConn ConnId handed out.
+var peerConnIds atomic.Uint64
+
+// State shared by the copies of a PeerConn.
+type peerState struct {
+	guest     JoinedGuest
+	id        uint64
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// zero while the guest is dialed.
+	connectedAt time.Time
+	selectedAt  time.Time
+	// set by close, after which Stats returns last.
+	isClosed bool
+	last     PeerStats
+	hasLast  bool
+}
+
+func newPeerState(guest JoinedGuest) *peerState {
+	return &peerState{guest: guest, id: peerConnIds.Add(1)}
+}
+
+// Records that the connection to the guest opened.
+func (p *peerState) connected() {
+	p.mu.Lock()
+	p.connectedAt = time.Now()
+	p.mu.Unlock()
+}
+
+// Returns the guest's GuestInfo.
+func (p *peerState) info() GuestInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info := GuestInfo{JoinedGuest: p.guest, ConnectedAt: p.connectedAt, State: PeerDialing}
+	if !p.connectedAt.IsZero() {
+		info.State = PeerConnected
+	}
+	return info
+}
+
+// Records that the agent selected a candidate pair.
+func (p *peerState) selected() {
+	p.mu.Lock()
+	p.selectedAt = time.Now()
+	p.mu.Unlock()
+}
+
+// Takes the last stats of c, whose agent is about to close.
+func (p *peerState) closed(c PeerConn) {
+	c.Stats()
+	p.mu.Lock()
+	p.isClosed = true
+	p.mu.Unlock()
+}
+
+// Returns the stats of the connection to the guest, read from its agent, or false if no candidate pair
+// is selected yet. Once the connection is closed, it returns the stats from just before.
+func (c PeerConn) Stats() (PeerStats, bool) {
+	p := c.state
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed {
+		return p.last, p.hasLast
+	}
+	pair, err := c.agent.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return p.last, p.hasLast
+	}
+	stats := PeerStats{
+		GuestId:    p.guest.Id,
+		ConnId:     p.id,
+		Local:      peerCandidate(pair.Local),
+		Remote:     peerCandidate(pair.Remote),
+		SelectedAt: p.selectedAt,
+	}
+	stats.Relayed = stats.Local.Type == ice.CandidateTypeRelay || stats.Remote.Type == ice.CandidateTypeRelay
+	if pairStats, ok := c.agent.GetSelectedCandidatePairStats(); ok {
+		stats.RTT = time.Duration(pairStats.CurrentRoundTripTime * float64(time.Second))
+		stats.PacketsSent, stats.PacketsReceived = pairStats.PacketsSent, pairStats.PacketsReceived
+	}
+	if c.conn != nil {
+		stats.BytesSent, stats.BytesReceived = c.conn.BytesSent(), c.conn.BytesReceived()
+	}
+	p.last, p.hasLast = stats, true
+	return stats, true
+}
+
+func peerCandidate(c ice.Candidate) PeerCandidate {
+	return PeerCandidate{
+		Type:    c.Type(),
+		Address: net.JoinHostPort(c.Address(), strconv.Itoa(c.Port())),
+		Network: c.NetworkType(),
+	}
+}
@@ -0,0 +1,95 @@
+package signaling
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Returns the IP address of the client that sent r.
+//
+// If the direct peer is one of ServerOptions.TrustedProxies, the address is taken from
+// the X-Forwarded-For header, or the Forwarded header if there is none. Addresses added
+// by trusted proxies are skipped, so a client can't spoof its address by sending the headers itself.
+func (s *WebsocketSignalingServer) remoteIP(r *http.Request) string {
+	peer, ok := parseAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !s.trusted(peer) {
+		return peer.String()
+	}
+	hops := forwardedFor(r.Header)
+	ip := peer
+	// the rightmost addresses were added by the proxies closest to us.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			break // the chain can't be trusted past a malformed address.
+		}
+		ip = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Returns the address of the client that sent r, for logs, events and the admin API.
+//
+// This is r.RemoteAddr, or the client's IP address without a port if r came through a trusted proxy.
+func (s *WebsocketSignalingServer) remoteAddr(r *http.Request) string {
+	if peer, ok := parseAddr(r.RemoteAddr); ok && s.trusted(peer) {
+		return s.remoteIP(r)
+	}
+	return r.RemoteAddr
+}
+
+// Returns true if ip is in ServerOptions.TrustedProxies.
+func (s *WebsocketSignalingServer) trusted(ip netip.Addr) bool {
+	for _, prefix := range s.sopts.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the addresses in the X-Forwarded-For header, or the for= addresses
+// in the Forwarded header if there is none, from the client to the last proxy.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	// Forwarded: for=192.0.2.60;proto=https, for="[2001:db8::17]:4711"
+	for _, v := range h.Values("Forwarded") {
+		for elem := range strings.SplitSeq(v, ",") {
+			for pair := range strings.SplitSeq(elem, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// Parses an IP address, with or without a port, and IPv6 addresses in brackets.
+func parseAddr(addr string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
@@ -0,0 +1,152 @@
+package signaling_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+)
+
+// The test server's listener, which every test connection comes from.
+var loopback = netip.MustParsePrefix("127.0.0.0/8")
+
+// Sends a GET for path with an X-Forwarded-For header, unless xff is empty, and returns the response status.
+func getForwardedFor(t *testing.T, srv *signalingtest.Server, path, xff string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/%s?v=%d", srv.Addr, path, qp2p.ProtocolVersion), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Joins the host's room with header, and returns the guest with the RemoteAddr the server saw it from.
+func joinWithHeader(t *testing.T, srv *signalingtest.Server, host *signalingtest.FakeHost, header http.Header) (*signalingtest.FakeGuest, qp2p.GuestID, string) {
+	t.Helper()
+	c := srv.DialOptions(t, "join/"+string(host.RoomId), nil, &websocket.DialOptions{HTTPHeader: header})
+	g := &signalingtest.FakeGuest{Conn: c, Info: c.Expect(signaling.RoomInfo)}
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	e := waitEvent[signaling.GuestJoinedEvent](t, srv)
+	return g, joined.GuestId, e.RemoteAddr
+}
+
+// The client address is only taken from the X-Forwarded-For and Forwarded headers when the direct peer
+// is a trusted proxy, and then only up to the first address no trusted proxy added.
+func TestRemoteAddrBehindTrustedProxy(t *testing.T) {
+	private := netip.MustParsePrefix("10.0.0.0/8")
+	tests := []struct {
+		name    string
+		trusted []netip.Prefix
+		header  http.Header
+		// the client address, or "" for the direct peer's address with its port.
+		want string
+	}{
+		{"no trusted proxies", nil, http.Header{"X-Forwarded-For": {"203.0.113.9"}}, ""},
+		{"untrusted peer", []netip.Prefix{private}, http.Header{"X-Forwarded-For": {"203.0.113.9"}}, ""},
+		{"untrusted peer Forwarded", []netip.Prefix{private}, http.Header{"Forwarded": {"for=203.0.113.9"}}, ""},
+		{"trusted peer", []netip.Prefix{loopback}, http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"trusted peer no header", []netip.Prefix{loopback}, nil, "127.0.0.1"},
+		{"proxy chain", []netip.Prefix{loopback, private}, http.Header{"X-Forwarded-For": {"203.0.113.9, 10.0.0.2"}}, "203.0.113.9"},
+		{"proxy chain in headers", []netip.Prefix{loopback, private}, http.Header{"X-Forwarded-For": {"203.0.113.9", "10.0.0.2"}}, "203.0.113.9"},
+		{"spoofed by client", []netip.Prefix{loopback}, http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.9"}}, "203.0.113.9"},
+		{"malformed hop", []netip.Prefix{loopback}, http.Header{"X-Forwarded-For": {"203.0.113.9, garbage"}}, "127.0.0.1"},
+		{"Forwarded", []netip.Prefix{loopback}, http.Header{"Forwarded": {`for="[2001:db8::17]:4711";proto=https`}}, "2001:db8::17"},
+		{"X-Forwarded-For over Forwarded", []netip.Prefix{loopback}, http.Header{
+			"X-Forwarded-For": {"203.0.113.9"},
+			"Forwarded":       {"for=198.51.100.1"},
+		}, "203.0.113.9"},
+		{"IPv4 mapped", []netip.Prefix{loopback}, http.Header{"X-Forwarded-For": {"::ffff:203.0.113.9"}}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{TrustedProxies: tt.trusted})
+			host := srv.Host(t)
+			_, _, got := joinWithHeader(t, srv, host, tt.header)
+			if tt.want == "" {
+				if !strings.HasPrefix(got, "127.0.0.1:") {
+					t.Fatalf("RemoteAddr %q, want the direct peer's address", got)
+				}
+			} else if got != tt.want {
+				t.Fatalf("RemoteAddr %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A banned guest can't get back in by sending a different X-Forwarded-For itself,
+// and behind a trusted proxy the ban only applies to the client it was meant for.
+func TestBanWithForwardedFor(t *testing.T) {
+	ban := func(t *testing.T, srv *signalingtest.Server, host *signalingtest.FakeHost, xff string) {
+		t.Helper()
+		g, guestId, _ := joinWithHeader(t, srv, host, http.Header{"X-Forwarded-For": {xff}})
+		host.Send(signaling.Msg{Type: signaling.KickGuest, GuestId: guestId, Ban: true})
+		// the guest is banned before it is kicked.
+		g.ExpectAll(signaling.Joined, signaling.KickGuest)
+		host.Expect(signaling.GuestDisconnected)
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		host := srv.Host(t)
+		ban(t, srv, host, "203.0.113.9")
+		for _, xff := range []string{"", "203.0.113.10", "203.0.113.10, 10.0.0.2"} {
+			if status := getForwardedFor(t, srv, "join/"+string(host.RoomId), xff); status != http.StatusForbidden {
+				t.Fatalf("X-Forwarded-For %q: status %d, want %d", xff, status, http.StatusForbidden)
+			}
+		}
+	})
+	t.Run("trusted proxy", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{TrustedProxies: []netip.Prefix{loopback}})
+		host := srv.Host(t)
+		ban(t, srv, host, "203.0.113.9")
+		if status := getForwardedFor(t, srv, "join/"+string(host.RoomId), "203.0.113.9"); status != http.StatusForbidden {
+			t.Fatalf("banned client: status %d, want %d", status, http.StatusForbidden)
+		}
+		// the ban is on the client, not on the proxy every client comes through.
+		joinWithHeader(t, srv, host, http.Header{"X-Forwarded-For": {"203.0.113.10"}})
+	})
+}
+
+// Clients are rate limited by their own address behind a trusted proxy,
+// and by the direct peer's address when the peer sends X-Forwarded-For itself.
+func TestRateLimitWithForwardedFor(t *testing.T) {
+	sopts := func(trusted ...netip.Prefix) signaling.ServerOptions {
+		return signaling.ServerOptions{ListRoomsRate: 0.001, ListRoomsBurst: 1, TrustedProxies: trusted}
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, sopts())
+		if status := getForwardedFor(t, srv, "rooms", "203.0.113.1"); status != http.StatusOK {
+			t.Fatalf("first request: status %d", status)
+		}
+		if status := getForwardedFor(t, srv, "rooms", "203.0.113.2"); status != http.StatusTooManyRequests {
+			t.Fatalf("spoofed X-Forwarded-For: status %d, want %d", status, http.StatusTooManyRequests)
+		}
+	})
+	t.Run("trusted proxy", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, sopts(loopback))
+		for _, xff := range []string{"203.0.113.1", "203.0.113.2"} {
+			if status := getForwardedFor(t, srv, "rooms", xff); status != http.StatusOK {
+				t.Fatalf("client %s: status %d", xff, status)
+			}
+		}
+		if status := getForwardedFor(t, srv, "rooms", "203.0.113.1"); status != http.StatusTooManyRequests {
+			t.Fatalf("client over its limit: status %d, want %d", status, http.StatusTooManyRequests)
+		}
+	})
+}
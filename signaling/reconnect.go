@@ -0,0 +1,118 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+)
+
+// How long the host waits before its second attempt to resume the room, doubled after each up to maxReconnectBackoff.
+const reconnectBackoff = 500 * time.Millisecond
+
+// Longest wait between the host's attempts to resume the room.
+const maxReconnectBackoff = 10 * time.Second
+
+// Resumes the room on a new connection to the server after the old one was lost with cause.
+// Attempts are retried with backoff until the room resumes, the server says it can't be, ctx is done,
+// or the client is closed.
+//
+// Connections to guests are left alone, and candidates gathered meanwhile are sent once it resumed.
+// Rooms created with CreateRoom closed with the old connection.
+func (s *HostClient) reconnect(ctx context.Context, cause error) error {
+	s.log.Warn("Connection to server lost, reconnecting", "error", cause)
+	s.offlineMu.Lock()
+	s.reconnecting = true
+	s.offlineMu.Unlock()
+	old := s.hConn.Load()
+	backoff := reconnectBackoff
+	for attempt := 1; ; attempt++ {
+		s.emit(ReconnectingEvent{Attempt: attempt, Err: cause})
+		hConn, err := s.resume(ctx, old.timeout)
+		if err == nil {
+			s.hConn.Store(hConn)
+			// Close may have missed the new connection.
+			if s.closed.Load() {
+				hConn.CloseNow()
+				return errConnClosed
+			}
+			s.resumed(attempt)
+			return nil
+		}
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.Status != http.StatusTooManyRequests && httpErr.Status < 500 {
+			// e.g. the grace period ended, and the room closed.
+			s.log.Error("Failed to resume room", "error", err)
+			s.emit(ResumeFailedEvent{Err: err})
+			return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		}
+		s.log.Debug("Failed to reconnect to server", "attempt", attempt, "error", err)
+		cause = err
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return errConnClosed
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
+
+// Dials GET /host/resume/{roomId} with the resume token from RoomCreated.
+func (s *HostClient) resume(ctx context.Context, timeout time.Duration) (*HostConn, error) {
+	u := url.URL{
+		Host:   s.host,
+		Scheme: string(s.sceme),
+		Path:   "host/resume/" + string(s.RoomId()),
+	}
+	q := url.Values{"v": {strconv.Itoa(qp2p.ProtocolVersion)}}
+	u.RawQuery = q.Encode()
+	// errors leave the token out, as they are logged.
+	redacted := u
+	q.Set("token", s.resumeToken)
+	u.RawQuery = q.Encode()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ws, resp, err := websocket.Dial(ctx, u.String(), s.opts.dialOptions())
+	if err != nil {
+		// the request's error has the URL in it.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, dialError(redacted, resp, err)
+	}
+	ws.SetReadLimit(s.opts.ReadLimit)
+	return newHostConn(context.Background(), ws, clientWriteQueueDepth, timeout, nil, nil), nil
+}
+
+// Picks up on the resumed connection: sends the candidates queued meanwhile, and closes
+// the rooms created with CreateRoom, which the server closed with the old connection.
+func (s *HostClient) resumed(attempts int) {
+	s.log.Info("Room resumed", "attempts", attempts)
+	// Seq starts over on the new connection.
+	s.seqs.last = nil
+	others := make(map[qp2p.RoomId]bool)
+	for _, roomId := range s.guestRooms.All() {
+		others[roomId] = true
+	}
+	for roomId := range others {
+		s.roomClosed(roomId, "Host is offline.")
+	}
+	// queued sends go first, so candidates gathered now can't overtake them.
+	s.offlineMu.Lock()
+	for _, send := range s.offline {
+		send()
+	}
+	s.offline = nil
+	s.reconnecting = false
+	s.offlineMu.Unlock()
+	s.emit(ReconnectedEvent{Attempts: attempts})
+}
@@ -0,0 +1,200 @@
+// Package redisregistry is a signaling.RoomRelay backed by Redis, for servers on several machines.
+//
+// Each node reserves its rooms in Redis and subscribes to a channel named after its
+// NodeURL, so a guest or host that reaches a node without its room is relayed to the
+// node hosting it:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "redis:6379"})
+//	srv := signaling.NewWebsocketSignalingServer(log, websocket.AcceptOptions{}, signaling.ServerOptions{
+//		Registry: redisregistry.New(client, redisregistry.Options{Prefix: "qp2p:"}),
+//		NodeURL:  "https://eu-1.example.com",
+//	})
+//
+// Rooms are released when they close. Each room's key is a lease the node hosting it renews
+// while the room is open, so the rooms of a node that crashes are released once their
+// leases run out, and guests for them get CodeRoomNotFound instead of being relayed to it.
+package redisregistry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/redis/go-redis/v9"
+)
+
+// Registry is a signaling.RoomRelay that keeps rooms as Redis keys and passes messages
+// between nodes with Redis pub/sub.
+type Registry struct {
+	client redis.UniversalClient
+	opts   Options
+
+	mu sync.Mutex
+	// rooms reserved through this Registry, whose leases it renews, and their node.
+	rooms map[qp2p.RoomId]string
+	// set while the goroutine renewing the leases runs.
+	renewing bool
+}
+
+// Options configures the Registry.
+type Options struct {
+	// Put before every key and channel, e.g. "qp2p:". Servers sharing rooms must use the same prefix.
+	//
+	// Default is empty.
+	Prefix string
+	// How long a room stays reserved after its node last renewed it. Leases are renewed
+	// every third of it, so a crashed node's rooms are released within Lease.
+	//
+	// Default is 30 seconds.
+	Lease time.Duration
+}
+
+var _ signaling.RoomRelay = (*Registry)(nil)
+
+// Returns a Registry using client.
+func New(client redis.UniversalClient, opts Options) *Registry {
+	if opts.Lease == 0 {
+		opts.Lease = 30 * time.Second
+	}
+	return &Registry{client: client, opts: opts, rooms: make(map[qp2p.RoomId]string)}
+}
+
+// Renews a room's lease if node still holds it, or takes it again if it expired, e.g. while
+// Redis was unreachable. Returns 0 if another node took the room.
+var renewScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if owner == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Deletes a room's key if node still holds it.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// The key holding the node hosting roomId.
+func (r *Registry) roomKey(roomId qp2p.RoomId) string {
+	return r.opts.Prefix + "room:" + string(roomId)
+}
+
+// The channel messages to node are published on.
+func (r *Registry) nodeChannel(node string) string {
+	return r.opts.Prefix + "node:" + node
+}
+
+func (r *Registry) ReserveRoom(ctx context.Context, roomId qp2p.RoomId, node string) (bool, error) {
+	ok, err := r.client.SetNX(ctx, r.roomKey(roomId), node, r.opts.Lease).Result()
+	if !ok || err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rooms[roomId] = node
+	if !r.renewing {
+		r.renewing = true
+		go r.renewLoop()
+	}
+	return true, nil
+}
+
+func (r *Registry) ReleaseRoom(ctx context.Context, roomId qp2p.RoomId) error {
+	r.mu.Lock()
+	node, ok := r.rooms[roomId]
+	delete(r.rooms, roomId)
+	r.mu.Unlock()
+	if !ok {
+		// another node took it after its lease ran out.
+		return nil
+	}
+	return releaseScript.Run(ctx, r.client, []string{r.roomKey(roomId)}, node).Err()
+}
+
+// Renews the leases of the rooms reserved through r every third of the lease, until none are left.
+func (r *Registry) renewLoop() {
+	t := time.NewTicker(r.opts.Lease / 3)
+	defer t.Stop()
+	for range t.C {
+		if !r.renew() {
+			return
+		}
+	}
+}
+
+// Renews the leases of the rooms in one round trip, and forgets the rooms another node took.
+// Returns false, and clears renewing, if there are no rooms left.
+//
+// r.mu is held throughout, so a room released meanwhile is not taken again.
+func (r *Registry) renew() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.rooms) == 0 {
+		r.renewing = false
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Lease/3)
+	defer cancel()
+	lease := r.opts.Lease.Milliseconds()
+	cmds := make(map[qp2p.RoomId]*redis.Cmd, len(r.rooms))
+	pipe := r.client.Pipeline()
+	for id, node := range r.rooms {
+		cmds[id] = renewScript.Eval(ctx, pipe, []string{r.roomKey(id)}, node, lease)
+	}
+	// failures are retried on the next tick, before the lease runs out.
+	pipe.Exec(ctx)
+	for id, cmd := range cmds {
+		if n, err := cmd.Int(); err == nil && n == 0 {
+			delete(r.rooms, id)
+		}
+	}
+	return true
+}
+
+func (r *Registry) ResolveRoom(ctx context.Context, roomId qp2p.RoomId) (string, bool, error) {
+	node, err := r.client.Get(ctx, r.roomKey(roomId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return node, true, nil
+}
+
+func (r *Registry) Publish(ctx context.Context, node string, msg []byte) error {
+	return r.client.Publish(ctx, r.nodeChannel(node), msg).Err()
+}
+
+func (r *Registry) Subscribe(ctx context.Context, node string, deliver func(msg []byte)) (func(), error) {
+	pubsub := r.client.Subscribe(ctx, r.nodeChannel(node))
+	// waits for the subscription, so messages published after Subscribe returns are delivered.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() { pubsub.Close() })
+	}
+	stop := context.AfterFunc(ctx, unsubscribe)
+	msgs := pubsub.Channel()
+	go func() {
+		defer stop()
+		for msg := range msgs {
+			deliver([]byte(msg.Payload))
+		}
+	}()
+	return unsubscribe, nil
+}
@@ -0,0 +1,233 @@
+package redisregistry_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/redisregistry"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Returns a Registry on an in-process Redis, with its own client, so each server can have one.
+func newRegistry(t *testing.T, mr *miniredis.Miniredis) *redisregistry.Registry {
+	t.Helper()
+	r, _ := newRegistryLease(t, mr, 0)
+	return r
+}
+
+// Like newRegistry with lease, also returning the client, e.g. to cut the node off Redis.
+func newRegistryLease(t *testing.T, mr *miniredis.Miniredis, lease time.Duration) (*redisregistry.Registry, *redis.Client) {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return redisregistry.New(client, redisregistry.Options{Prefix: "qp2p:", Lease: lease}), client
+}
+
+func TestReserveResolveRelease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := newRegistry(t, mr)
+	ctx := context.Background()
+
+	if ok, err := r.ReserveRoom(ctx, "ABCDEF", "http://a.example"); !ok || err != nil {
+		t.Fatalf("ReserveRoom = %v, %v, want true", ok, err)
+	}
+	if ok, err := newRegistry(t, mr).ReserveRoom(ctx, "ABCDEF", "http://b.example"); ok || err != nil {
+		t.Fatalf("ReserveRoom of a reserved room = %v, %v, want false", ok, err)
+	}
+	if node, ok, err := r.ResolveRoom(ctx, "ABCDEF"); node != "http://a.example" || !ok || err != nil {
+		t.Fatalf("ResolveRoom = %q, %v, %v, want http://a.example", node, ok, err)
+	}
+	if got, _ := mr.Get("qp2p:room:ABCDEF"); got != "http://a.example" {
+		t.Fatalf("room key holds %q, want the prefixed key to hold the node", got)
+	}
+	if err := r.ReleaseRoom(ctx, "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.ResolveRoom(ctx, "ABCDEF"); ok || err != nil {
+		t.Fatalf("ResolveRoom of a released room = %v, %v, want false", ok, err)
+	}
+}
+
+// The node holding a room renews its lease while the room is open.
+func TestLeaseIsRenewed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	const lease = 300 * time.Millisecond
+	r, _ := newRegistryLease(t, mr, lease)
+	ctx := context.Background()
+	if ok, err := r.ReserveRoom(ctx, "ABCDEF", "http://a.example"); !ok || err != nil {
+		t.Fatalf("ReserveRoom = %v, %v, want true", ok, err)
+	}
+
+	// only FastForward moves miniredis' clock, so the lease would run out within it unless renewed.
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for range 5 {
+		mr.FastForward(lease / 2)
+		for mr.TTL("qp2p:room:ABCDEF") <= lease/2 {
+			if time.Now().After(deadline) || !mr.Exists("qp2p:room:ABCDEF") {
+				t.Fatal("lease not renewed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := r.ReleaseRoom(ctx, "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("qp2p:room:ABCDEF") {
+		t.Fatal("released room still reserved")
+	}
+}
+
+// A room whose lease ran out can be reserved by another node, and its old node releasing it
+// leaves the new reservation alone.
+func TestExpiredRoomIsReservedAgain(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, _ := newRegistryLease(t, mr, time.Minute)
+	b, _ := newRegistryLease(t, mr, time.Minute)
+	ctx := context.Background()
+	if ok, err := a.ReserveRoom(ctx, "ABCDEF", "http://a.example"); !ok || err != nil {
+		t.Fatalf("ReserveRoom = %v, %v, want true", ok, err)
+	}
+	mr.FastForward(time.Minute)
+	if ok, err := b.ReserveRoom(ctx, "ABCDEF", "http://b.example"); !ok || err != nil {
+		t.Fatalf("ReserveRoom of an expired room = %v, %v, want true", ok, err)
+	}
+	if err := a.ReleaseRoom(ctx, "ABCDEF"); err != nil {
+		t.Fatal(err)
+	}
+	if node, ok, _ := b.ResolveRoom(ctx, "ABCDEF"); node != "http://b.example" || !ok {
+		t.Fatalf("ResolveRoom = %q, %v after the old node released it, want http://b.example", node, ok)
+	}
+}
+
+func TestResolveError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := newRegistry(t, mr)
+	mr.Close()
+	if _, _, err := r.ResolveRoom(context.Background(), "ABCDEF"); err == nil {
+		t.Fatal("ResolveRoom with Redis down returned no error")
+	}
+}
+
+// Messages published to a node arrive in order, only at that node, until it unsubscribes.
+func TestPublishSubscribe(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := newRegistry(t, mr)
+	ctx := context.Background()
+
+	msgs := make(chan string, 16)
+	unsubscribe, err := r.Subscribe(ctx, "http://a.example", func(msg []byte) { msgs <- string(msg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := r.Subscribe(ctx, "http://b.example", func(msg []byte) { t.Errorf("node b got %q", msg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other()
+
+	for i := range 10 {
+		if err := r.Publish(ctx, "http://a.example", fmt.Appendf(nil, "%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 10 {
+		select {
+		case got := <-msgs:
+			if want := fmt.Sprint(i); got != want {
+				t.Fatalf("got message %q, want %q", got, want)
+			}
+		case <-time.After(signalingtest.Timeout):
+			t.Fatalf("message %d not delivered", i)
+		}
+	}
+
+	unsubscribe()
+	r.Publish(ctx, "http://a.example", []byte("late"))
+	select {
+	case got := <-msgs:
+		t.Fatalf("got %q after unsubscribing", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A guest on one node joins a host's room on another, through Redis.
+func TestGuestJoinsRoomOnOtherNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := signalingtest.StartServerOptions(t, signaling.ServerOptions{Registry: newRegistry(t, mr), NodeURL: "http://a.example"})
+	b := signalingtest.StartServerOptions(t, signaling.ServerOptions{Registry: newRegistry(t, mr), NodeURL: "http://b.example"})
+	host := a.Host(t)
+	if got, _ := mr.Get("qp2p:room:" + string(host.RoomId)); got != "http://a.example" {
+		t.Fatalf("room reserved for %q, want http://a.example", got)
+	}
+
+	g := b.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+	g.SendCandidate(0)
+	if c := host.Expect(signaling.IceCandidate); c.GuestId != joined.GuestId || c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q from %v", c.Candidate, c.GuestId)
+	}
+	host.SendCandidate(joined.GuestId, 1)
+	if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q", c.Candidate)
+	}
+
+	host.Close()
+	g.Expect(signaling.KickGuest)
+	g.ExpectClosed(signaling.StatusHostOffline)
+	waitReleased(t, mr, host.RoomId)
+}
+
+// Waits for roomId's key to be deleted.
+func waitReleased(t *testing.T, mr *miniredis.Miniredis, roomId qp2p.RoomId) {
+	t.Helper()
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for mr.Exists("qp2p:room:" + string(roomId)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("room %v not released", roomId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Once a crashed node's leases run out, guests for its rooms get CodeRoomNotFound from the
+// other nodes instead of being relayed to it, and the room's ID can be reserved again.
+func TestCrashedNodeRoomIsReleased(t *testing.T) {
+	mr := miniredis.RunT(t)
+	registryA, clientA := newRegistryLease(t, mr, time.Minute)
+	registryB, _ := newRegistryLease(t, mr, time.Minute)
+	a := signalingtest.StartServerOptions(t, signaling.ServerOptions{Registry: registryA, NodeURL: "http://a.example"})
+	b := signalingtest.StartServerOptions(t, signaling.ServerOptions{Registry: registryB, NodeURL: "http://b.example"})
+	host := a.Host(t)
+
+	// a can't renew its leases anymore, or answer relayed guests.
+	clientA.Close()
+	mr.FastForward(time.Minute)
+	start := time.Now()
+	resp, err := http.Get(fmt.Sprintf("http://%s/join/%s?v=%d", b.Addr, host.RoomId, qp2p.ProtocolVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body signaling.HTTPError
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || body.Code != signaling.CodeRoomNotFound {
+		t.Fatalf("join got %d %q, want %d %q", resp.StatusCode, body.Code, http.StatusNotFound, signaling.CodeRoomNotFound)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("join took %v, it waited for the crashed node", d)
+	}
+	if ok, err := registryB.ReserveRoom(context.Background(), host.RoomId, "http://b.example"); !ok || err != nil {
+		t.Fatalf("ReserveRoom of the crashed node's room = %v, %v, want true", ok, err)
+	}
+}
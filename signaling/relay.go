@@ -0,0 +1,479 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+)
+
+// A guest or host that reaches a node without its room is relayed to the node hosting it:
+//
+//   - the edge node, the one the client reached, publishes relayOpen with the client's request
+//     to the origin node, the one hosting the room.
+//   - the origin node makes the request to its own handlers over an in-memory connection,
+//     as if the client had reached it, and answers with relayAccepted or relayResponse.
+//   - the edge node accepts the client's websocket, or sends it the origin's HTTP response,
+//     e.g. a room check or a rejected join.
+//   - both nodes pass the frames read from their websocket to the other as relayFrame,
+//     until one of the websockets closes, which is passed on as relayClose.
+//
+// The origin node runs the guest or host like any other, so passwords, bans, limits and
+// GuestAuth, HostAuth and IceCandidate forwarding work as on a single node.
+
+var (
+	errRelayTimeout = errors.New("signaling: relayed node unreachable")
+	errRelayStopped = errors.New("signaling: relay stopped")
+)
+
+// Kinds of relayMsg.
+const (
+	relayOpen     = "open"
+	relayAccepted = "accepted"
+	relayResponse = "response"
+	relayFrame    = "frame"
+	relayClose    = "close"
+	relayPing     = "ping"
+)
+
+// A message between the two nodes of a relayed connection, published with the RoomRelay.
+type relayMsg struct {
+	Kind    string `json:"kind"`
+	Session string `json:"session"`
+	// the node that published it, which replies go to.
+	From string `json:"from"`
+
+	// relayOpen: the client's request. Upgrade is set for websocket requests.
+	Upgrade      bool     `json:"upgrade,omitempty"`
+	Method       string   `json:"method,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	URI          string   `json:"uri,omitempty"`
+	RemoteAddr   string   `json:"remoteAddr,omitempty"`
+	Subprotocols []string `json:"subprotocols,omitempty"`
+	// relayOpen: the client's request headers. relayResponse: the response headers.
+	Header http.Header `json:"header,omitempty"`
+	// relayAccepted: the subprotocol the origin node negotiated.
+	Subprotocol string `json:"subprotocol,omitempty"`
+	// relayResponse: the response status, with the body in Data. 0 if the origin couldn't respond.
+	Status int `json:"status,omitempty"`
+	// relayFrame
+	Type websocket.MessageType `json:"type,omitempty"`
+	Data []byte                `json:"data,omitempty"`
+	// relayClose: the close status, -1 if the websocket dropped without one.
+	Code   websocket.StatusCode `json:"code,omitempty"`
+	Reason string               `json:"reason,omitempty"`
+}
+
+// One end of a relayed connection.
+type relaySession struct {
+	id string
+	// the other node.
+	node string
+	// messages from the other node, except pings.
+	inbox chan relayMsg
+	// when the last message from the other node arrived, in Unix nanoseconds.
+	heard atomic.Int64
+	// cancelled when the session ends, with the reason.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	log    *slog.Logger
+}
+
+// How many messages from the other node a relaySession buffers before it is closed as too slow.
+const relayInboxDepth = 256
+
+// How many RelayKeepalive intervals a node waits to hear from the other node of a relayed connection.
+const relayMisses = 3
+
+// How much of a relayed HTTP response body is kept.
+const relayBodyLimit = 64 << 10
+
+// Request headers that belong to the connection to the edge node, so they are not relayed.
+var hopHeaders = []string{
+	"Connection", "Upgrade", "Host", "Content-Length", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding",
+	"Proxy-Authorization", "Proxy-Connection", "X-Forwarded-For", "Forwarded",
+	"Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol", "Sec-Websocket-Accept",
+}
+
+// Returns a copy of h without hopHeaders.
+func relayHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	return h
+}
+
+// Returns the subprotocols the client asked for in r, in its order of preference.
+func requestedSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for p := range strings.SplitSeq(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// Subscribes the node to relay, and starts serving the connections relayed to it.
+// If it can't subscribe, guests and hosts of other nodes' rooms are redirected instead.
+func (s *WebsocketSignalingServer) startRelay(relay RoomRelay) {
+	unsubscribe, err := relay.Subscribe(s.ctx, s.sopts.NodeURL, s.deliverRelayed)
+	if err != nil {
+		s.log.Error("Failed to subscribe to relay, redirecting to other nodes instead", "node", s.sopts.NodeURL, "error", err)
+		return
+	}
+	s.relay, s.unsubscribe = relay, unsubscribe
+	s.relayListener = newPipeListener()
+	srv := &http.Server{Handler: s.Mux, ErrorLog: slog.NewLogLogger(s.log.Handler(), slog.LevelDebug)}
+	go srv.Serve(s.relayListener)
+}
+
+// Unsubscribes from the relay and drops the relayed connections, which the other nodes close.
+func (s *WebsocketSignalingServer) stopRelay() {
+	if s.relay == nil {
+		return
+	}
+	s.unsubscribe()
+	s.relayListener.Close()
+	for _, sess := range s.relays.All() {
+		sess.cancel(errRelayStopped)
+	}
+}
+
+// Passes a message from another node to its session, or serves the connection it opens.
+func (s *WebsocketSignalingServer) deliverRelayed(b []byte) {
+	var msg relayMsg
+	if err := json.Unmarshal(b, &msg); err != nil {
+		s.log.Debug("Invalid relayed message dropped", "error", err)
+		return
+	}
+	if msg.Kind == relayOpen {
+		go s.serveRelayed(msg)
+		return
+	}
+	sess, ok := s.relays.Load(msg.Session)
+	if !ok {
+		return
+	}
+	sess.heard.Store(time.Now().UnixNano())
+	if msg.Kind == relayPing {
+		return
+	}
+	select {
+	case sess.inbox <- msg:
+	default:
+		sess.log.Warn("Relayed connection too slow, closing it")
+		sess.cancel(errQueueFull)
+	}
+}
+
+// Starts a session with node, receiving its messages until endRelay.
+func (s *WebsocketSignalingServer) newRelaySession(id, node string) *relaySession {
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	sess := &relaySession{
+		id:     id,
+		node:   node,
+		inbox:  make(chan relayMsg, relayInboxDepth),
+		ctx:    ctx,
+		cancel: cancel,
+		log:    s.log.With("session", id, "node", node),
+	}
+	sess.heard.Store(time.Now().UnixNano())
+	s.relays.Store(id, sess)
+	return sess
+}
+
+func (s *WebsocketSignalingServer) endRelay(sess *relaySession) {
+	s.relays.Delete(sess.id)
+	sess.cancel(errConnClosed)
+}
+
+// Publishes msg to the other node of sess.
+func (s *WebsocketSignalingServer) publish(sess *relaySession, msg relayMsg) error {
+	msg.Session, msg.From = sess.id, s.sopts.NodeURL
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// not the session's context, so a close is still published once it ends.
+	ctx, cancel := context.WithTimeout(s.ctx, s.sopts.WriteTimeout)
+	defer cancel()
+	return s.relay.Publish(ctx, sess.node, b)
+}
+
+// Relays the client's request r to node, and then its websocket, until either side closes it.
+func (s *WebsocketSignalingServer) relayTo(w http.ResponseWriter, r *http.Request, node string) {
+	sess := s.newRelaySession(uuid.NewString(), node)
+	defer s.endRelay(sess)
+	open := relayMsg{
+		Kind:         relayOpen,
+		Upgrade:      strings.EqualFold(r.Header.Get("Upgrade"), "websocket"),
+		Method:       r.Method,
+		Host:         r.Host,
+		URI:          r.URL.RequestURI(),
+		RemoteAddr:   s.remoteAddr(r),
+		Subprotocols: requestedSubprotocols(r),
+		Header:       relayHeader(r.Header),
+	}
+	if err := s.publish(sess, open); err != nil {
+		sess.log.Error("Failed to relay request", "error", err)
+		writeHTTPError(w, http.StatusBadGateway, CodeNodeUnavailable, "node hosting the room unavailable")
+		return
+	}
+	var reply relayMsg
+	select {
+	case reply = <-sess.inbox:
+	case <-time.After(relayMisses * s.sopts.RelayKeepalive):
+		sess.log.Warn("Node hosting the room didn't answer relayed request")
+		writeHTTPError(w, http.StatusBadGateway, CodeNodeUnavailable, "node hosting the room unavailable")
+		return
+	case <-sess.ctx.Done():
+		writeHTTPError(w, http.StatusBadGateway, CodeNodeUnavailable, "node hosting the room unavailable")
+		return
+	}
+	if reply.Kind != relayAccepted {
+		if reply.Kind != relayResponse || reply.Status == 0 {
+			writeHTTPError(w, http.StatusBadGateway, CodeNodeUnavailable, "node hosting the room unavailable")
+			return
+		}
+		for k, v := range reply.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(reply.Status)
+		w.Write(reply.Data)
+		return
+	}
+
+	var protocols []string
+	if reply.Subprotocol != "" {
+		protocols = []string{reply.Subprotocol}
+	}
+	ws, err := s.acceptWith(w, r, protocols)
+	if err != nil {
+		sess.log.Debug("Failed to accept relayed client", "error", err)
+		s.publish(sess, relayMsg{Kind: relayClose, Code: -1})
+		return
+	}
+	// the origin node only pings its end of the relay, so the client is pinged here.
+	go s.pingLoop(sess.ctx, sess.cancel, ws, sess.log)
+	s.pumpRelay(sess, ws)
+}
+
+// Makes the relayed request open to this node's own handlers, and relays the websocket
+// they accept until either side closes it.
+func (s *WebsocketSignalingServer) serveRelayed(open relayMsg) {
+	sess := s.newRelaySession(open.Session, open.From)
+	defer s.endRelay(sess)
+	client := &http.Client{
+		Transport: &http.Transport{
+			// the handlers see the client's address as the request's RemoteAddr.
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return s.relayListener.dial(ctx, open.RemoteAddr)
+			},
+			DisableKeepAlives: true,
+		},
+		// the edge node's client follows redirects itself.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	if !open.Upgrade {
+		s.publish(sess, s.relayedResponse(sess, client, open))
+		return
+	}
+	ws, resp, err := websocket.Dial(sess.ctx, "ws://"+open.Host+open.URI, &websocket.DialOptions{
+		HTTPClient:   client,
+		HTTPHeader:   open.Header,
+		Subprotocols: open.Subprotocols,
+	})
+	if err != nil {
+		reply := relayMsg{Kind: relayResponse}
+		if resp != nil {
+			reply.Status = resp.StatusCode
+			reply.Header = relayHeader(resp.Header)
+			// only the start of the body is kept by websocket.Dial.
+			reply.Data, _ = io.ReadAll(io.LimitReader(resp.Body, relayBodyLimit))
+		} else {
+			sess.log.Error("Failed to open relayed connection", "error", err)
+		}
+		s.publish(sess, reply)
+		return
+	}
+	// the handlers already limit what the client sends.
+	ws.SetReadLimit(-1)
+	if err := s.publish(sess, relayMsg{Kind: relayAccepted, Subprotocol: ws.Subprotocol()}); err != nil {
+		sess.log.Error("Failed to accept relayed connection", "error", err)
+		ws.CloseNow()
+		return
+	}
+	s.pumpRelay(sess, ws)
+}
+
+// Makes the relayed request open, which isn't a websocket upgrade, and returns the response to relay.
+func (s *WebsocketSignalingServer) relayedResponse(sess *relaySession, client *http.Client, open relayMsg) relayMsg {
+	reply := relayMsg{Kind: relayResponse}
+	req, err := http.NewRequestWithContext(sess.ctx, open.Method, "http://"+open.Host+open.URI, nil)
+	if err != nil {
+		sess.log.Debug("Invalid relayed request", "error", err)
+		return reply
+	}
+	req.Header = open.Header
+	resp, err := client.Do(req)
+	if err != nil {
+		sess.log.Error("Failed to make relayed request", "error", err)
+		return reply
+	}
+	defer resp.Body.Close()
+	reply.Status = resp.StatusCode
+	reply.Header = relayHeader(resp.Header)
+	reply.Data, _ = io.ReadAll(io.LimitReader(resp.Body, relayBodyLimit))
+	return reply
+}
+
+// Passes frames between ws and the other node of sess, and closes ws when the other node's end closes.
+// If nothing arrives from the other node for relayMisses keepalives, ws is dropped.
+func (s *WebsocketSignalingServer) pumpRelay(sess *relaySession, ws *websocket.Conn) {
+	defer s.endRelay(sess)
+	go func() {
+		for {
+			typ, b, err := ws.Read(sess.ctx)
+			if err != nil {
+				// unless this end closed ws, the other end is told how.
+				if sess.ctx.Err() == nil {
+					var ce websocket.CloseError
+					errors.As(err, &ce)
+					s.publish(sess, relayMsg{Kind: relayClose, Code: websocket.CloseStatus(err), Reason: ce.Reason})
+					sess.cancel(errConnClosed)
+				}
+				return
+			}
+			if err := s.publish(sess, relayMsg{Kind: relayFrame, Type: typ, Data: b}); err != nil {
+				sess.log.Debug("Failed to relay frame", "error", err)
+				sess.cancel(err)
+				return
+			}
+		}
+	}()
+	keepalive := time.NewTicker(s.sopts.RelayKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-sess.inbox:
+			switch msg.Kind {
+			case relayFrame:
+				ctx, cancel := context.WithTimeout(sess.ctx, s.sopts.WriteTimeout)
+				err := ws.Write(ctx, msg.Type, msg.Data)
+				cancel()
+				if err != nil {
+					sess.log.Debug("Failed to write relayed frame", "error", err)
+					sess.cancel(err)
+				}
+			case relayClose:
+				sess.cancel(errConnClosed)
+				closeRelayed(ws, msg.Code, msg.Reason)
+				return
+			}
+		case <-keepalive.C:
+			if time.Since(time.Unix(0, sess.heard.Load())) > relayMisses*s.sopts.RelayKeepalive {
+				sess.log.Warn("Node of relayed connection unreachable")
+				sess.cancel(errRelayTimeout)
+				continue
+			}
+			s.publish(sess, relayMsg{Kind: relayPing})
+		case <-sess.ctx.Done():
+			// the other end drops its websocket too, so its client resumes as after a network failure.
+			if cause := context.Cause(sess.ctx); cause != errConnClosed {
+				sess.log.Debug("Relayed connection dropped", "cause", cause)
+				s.publish(sess, relayMsg{Kind: relayClose, Code: -1})
+			}
+			ws.CloseNow()
+			return
+		}
+	}
+}
+
+// Closes ws like the other node's end was closed: with code and reason, or without a close frame if code is -1.
+func closeRelayed(ws *websocket.Conn, code websocket.StatusCode, reason string) {
+	switch code {
+	case -1, websocket.StatusAbnormalClosure:
+		ws.CloseNow()
+	case websocket.StatusNoStatusRcvd:
+		ws.Close(websocket.StatusNormalClosure, "")
+	default:
+		ws.Close(code, reason)
+	}
+}
+
+// A net.Listener whose connections are made in memory with dial, for the requests relayed to a node.
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr("relay")
+}
+
+// Returns the client end of a new connection, whose server end has remoteAddr as its RemoteAddr.
+func (l *pipeListener) dial(ctx context.Context, remoteAddr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{Conn: server, remote: pipeAddr(remoteAddr)}:
+		return client, nil
+	case <-l.done:
+		err := net.ErrClosed
+		client.Close()
+		server.Close()
+		return nil, err
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// The address of a relayed client, e.g. "203.0.113.9:51234".
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "relay" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// The server end of a relayed connection.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
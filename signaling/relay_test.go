@@ -0,0 +1,204 @@
+package signaling_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+)
+
+// Starts nodes http://a.example and http://b.example sharing registry.
+func startNodes(t *testing.T, registry signaling.RoomRegistry, sopts signaling.ServerOptions) (a, b *signalingtest.Server) {
+	t.Helper()
+	sopts.Registry = registry
+	sopts.NodeURL = "http://a.example"
+	a = signalingtest.StartServerOptions(t, sopts)
+	sopts.NodeURL = "http://b.example"
+	b = signalingtest.StartServerOptions(t, sopts)
+	return a, b
+}
+
+// A guest that reaches a node without the room is relayed to the node hosting it,
+// and signals with the host as if both were on one node.
+func TestRelayedGuestJoinsRoomOnOtherNode(t *testing.T) {
+	a, b := startNodes(t, signaling.NewMemoryRegistry(), signaling.ServerOptions{})
+	host := a.Host(t)
+	host.Send(signaling.Msg{Type: signaling.SetRoomInfo, Name: "lobby", Public: true})
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/room/%s", b.Addr, host.RoomId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check signaling.RoomCheck
+	json.NewDecoder(resp.Body).Decode(&check)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !check.Exists || !check.Public {
+		t.Fatalf("room check through the other node got %d %+v", resp.StatusCode, check)
+	}
+
+	g := b.Join(t, host.RoomId, "")
+	if g.Info.Name != "lobby" {
+		t.Fatalf("RoomInfo through the other node has name %q", g.Info.Name)
+	}
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	if joined.Ufrag != signalingtest.Ufrag || joined.Pwd != signalingtest.Pwd {
+		t.Fatalf("GuestJoined has credentials %q %q, want the guest's", joined.Ufrag, joined.Pwd)
+	}
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+
+	g.SendCandidate(0)
+	if c := host.Expect(signaling.IceCandidate); c.GuestId != joined.GuestId || c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q from %v", c.Candidate, c.GuestId)
+	}
+	host.SendCandidate(joined.GuestId, 1)
+	if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q", c.Candidate)
+	}
+
+	g.Close()
+	if got := host.Expect(signaling.GuestDisconnected).GuestId; got != joined.GuestId {
+		t.Fatalf("GuestDisconnected for %v, want %v", got, joined.GuestId)
+	}
+}
+
+// The origin node's HTTP errors and close statuses reach the relayed guest.
+func TestRelayedRejections(t *testing.T) {
+	a, b := startNodes(t, signaling.NewMemoryRegistry(), signaling.ServerOptions{})
+
+	t.Run("room not found", func(t *testing.T) {
+		status, body := getError(t, b, "join/ABCDEF", nil)
+		if status != http.StatusNotFound || body.Code != signaling.CodeRoomNotFound {
+			t.Fatalf("got %d %q, want %d %q", status, body.Code, http.StatusNotFound, signaling.CodeRoomNotFound)
+		}
+	})
+	t.Run("room locked", func(t *testing.T) {
+		host := a.Host(t)
+		host.Send(signaling.Msg{Type: signaling.LockRoom})
+		expectLocked(host, true)
+		status, body := getError(t, b, "join/"+string(host.RoomId), nil)
+		if status != http.StatusLocked || body.Code != signaling.CodeRoomLocked {
+			t.Fatalf("got %d %q, want %d %q", status, body.Code, http.StatusLocked, signaling.CodeRoomLocked)
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		host := a.Host(t, url.Values{"password": {"secret"}})
+		g := b.Join(t, host.RoomId, "wrong")
+		g.Auth()
+		g.ExpectClosed(signaling.StatusWrongPassword)
+	})
+	t.Run("room closed", func(t *testing.T) {
+		host := a.Host(t)
+		g, _ := joinRoom(t, b, host)
+		host.Close()
+		g.Expect(signaling.KickGuest)
+		g.ExpectClosed(signaling.StatusHostOffline)
+	})
+}
+
+// A host resuming on another node is relayed to its room, and its guests stay connected.
+func TestRelayedHostResume(t *testing.T) {
+	registry := signaling.NewMemoryRegistry()
+	log, away := logHook("host away, waiting for resume")
+	a := startServer(t, log, signaling.ServerOptions{HostGracePeriod: signalingtest.Timeout, Registry: registry, NodeURL: "http://a.example"}, nil)
+	t.Cleanup(func() { a.Shutdown(context.Background()) })
+	b := signalingtest.StartServerOptions(t, signaling.ServerOptions{Registry: registry, NodeURL: "http://b.example"})
+	host := a.Host(t)
+	g, guestId := joinRoom(t, a, host)
+	host.Ws.CloseNow()
+	waitFor(t, away, "host away")
+
+	resumed := b.Dial(t, "host/resume/"+string(host.RoomId), url.Values{"token": {host.ResumeToken}})
+	g.SendCandidate(0)
+	if c := resumed.Expect(signaling.IceCandidate); c.GuestId != guestId {
+		t.Fatalf("resumed host got candidate from %v, want %v", c.GuestId, guestId)
+	}
+	resumed.Send(signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: signalingtest.Candidate(1)})
+	if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q from the resumed host", c.Candidate)
+	}
+}
+
+// A RoomRegistry that drops every published message while partitioned.
+type partitionedRelay struct {
+	*signaling.MemoryRegistry
+	partitioned atomic.Bool
+}
+
+func (p *partitionedRelay) Publish(ctx context.Context, node string, msg []byte) error {
+	if p.partitioned.Load() {
+		return nil
+	}
+	return p.MemoryRegistry.Publish(ctx, node, msg)
+}
+
+// When the nodes stop hearing each other, both drop their end of the relayed connection,
+// and the host is told the guest disconnected.
+func TestRelayKeepalive(t *testing.T) {
+	relay := &partitionedRelay{MemoryRegistry: signaling.NewMemoryRegistry()}
+	a, b := startNodes(t, relay, signaling.ServerOptions{RelayKeepalive: 50 * time.Millisecond})
+	host := a.Host(t)
+	g, guestId := joinRoom(t, b, host)
+
+	// idle longer than the keepalive timeout, so the pings keep it open.
+	g.ExpectNothing(300 * time.Millisecond)
+	relay.partitioned.Store(true)
+	g.ExpectClosed(-1)
+	if got := host.Expect(signaling.GuestDisconnected).GuestId; got != guestId {
+		t.Fatalf("GuestDisconnected for %v, want %v", got, guestId)
+	}
+}
+
+// A registry that is only a RoomRegistry, not a RoomRelay.
+type registryOnly struct {
+	signaling.RoomRegistry
+}
+
+// Without a RoomRelay, guests are redirected to the node hosting the room.
+func TestRegistryWithoutRelayRedirects(t *testing.T) {
+	a, b := startNodes(t, registryOnly{signaling.NewMemoryRegistry()}, signaling.ServerOptions{})
+	host := a.Host(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	path := fmt.Sprintf("/join/%s?v=%d", host.RoomId, qp2p.ProtocolVersion)
+	resp, err := client.Get("http://" + b.Addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "http://a.example"+path {
+		t.Fatalf("got %d to %q, want %d to %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusTemporaryRedirect, "http://a.example"+path)
+	}
+}
+
+// A guest client on one node connects to a host client on another over ICE.
+func TestRelayedClientsConnect(t *testing.T) {
+	a, b := startNodes(t, signaling.NewMemoryRegistry(), signaling.ServerOptions{})
+	hostMux, _ := loopbackMux(t)
+	guestMux, _ := loopbackMux(t)
+	connected := make(chan signaling.PeerConn, 1)
+	h := startHost(t, a, signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent},
+		func(_ signaling.JoinedGuest, c signaling.PeerConn) { connected <- c })
+	_, guestConn, hostConn := connectGuest(t, b, h, connected, guestMux, nil, loopbackAgent...)
+	expectDatagram(t, guestConn, hostConn.Conn(), "across nodes")
+}
+
+// A relayed guest gets the subprotocol the origin node negotiated.
+func TestRelayedSubprotocol(t *testing.T) {
+	a, b := startNodes(t, signaling.NewMemoryRegistry(), signaling.ServerOptions{})
+	host := a.Host(t)
+	c := b.DialOptions(t, "join/"+string(host.RoomId), nil, &websocket.DialOptions{Subprotocols: []string{signaling.SubprotocolJSON}})
+	if got := c.Ws.Subprotocol(); got != signaling.SubprotocolJSON {
+		t.Fatalf("relayed guest negotiated %q, want qp2p.json", got)
+	}
+	c.Expect(signaling.RoomInfo)
+}
@@ -0,0 +1,920 @@
+package signaling
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+	"golang.org/x/time/rate"
+)
+
+// A room owned by a host connection.
+type room struct {
+	id qp2p.RoomId
+	// logs with the room ID and the host's connection.
+	log *slog.Logger
+	// Set by the host when creating the room. Empty if anyone can join.
+	password string
+	// Lets the host resume the room after disconnecting. Empty if resuming is disabled.
+	resumeToken string
+
+	mu sync.Mutex
+	// nil while the host is away.
+	hConn *HostConn
+	// Guests that received HostAuth, with the limiter of the host's messages to each.
+	// Kicked when the room closes.
+	guests map[qp2p.GuestID]*rate.Limiter
+	// Messages for the host, queued while it is away.
+	pending []Msg
+	// resume is writing pending to the host, so newer messages are queued behind them.
+	flushing bool
+	// At most pendingLimit messages are queued, and pendingPerGuest for one guest.
+	pendingLimit    int
+	pendingPerGuest int
+	// Called with the type of each message dropped from pending, can be nil.
+	onPendingDrop func(MsgType)
+	// Closes the room if the host does not resume in time.
+	awayTimer *time.Timer
+	closed    bool
+	// closed by closeRoom once the guests that received HostAuth are kicked,
+	// with the close status and reason set before.
+	done        chan struct{}
+	closeCode   websocket.StatusCode
+	closeReason string
+	// IP addresses banned by the host.
+	bans map[string]struct{}
+	// Set by the host with SetRoomInfo.
+	info roomInfo
+	// Guests in the room, including ones still connecting.
+	members map[qp2p.GuestID]*guest
+	// guests wait for the host to accept them, set with GET /host?approval=true.
+	approval bool
+	// new guests are turned away, set with LockRoom and UnlockRoom.
+	locked bool
+	// guests waiting for the host's answer to their JoinRequest.
+	waiting map[qp2p.GuestID]chan approval
+	// identity of the host from ServerOptions.Authenticator.
+	hostIdentity string
+	// remote address of the host connection.
+	hostAddr  string
+	createdAt time.Time
+	// Closes the room once it reaches ServerOptions.MaxRoomAge.
+	ageTimer *time.Timer
+	// Closes the room once it has no guests for idleTimeout.
+	idleTimer   *time.Timer
+	idleTimeout time.Duration
+	// Closes the room with a reason, set by startExpiry.
+	expire func(reason string)
+	// Sends the pending RoomStatus. Changes are coalesced until it fires.
+	statusTimer  *time.Timer
+	statusSentAt time.Time
+	// How many guests the host can be sent GuestJoined for before it answers
+	// one of them with HostAuth, set with GET /host?joinWindow=N. 0 means no limit.
+	joinWindow int
+	// guests the host was sent GuestJoined for, and has not answered yet.
+	announced map[qp2p.GuestID]struct{}
+	// guests waiting for room in the join window, in join order.
+	joinQueue []queuedJoin
+	// How many guests can wait for a slot while the room is full, set with GET /host?queue=true.
+	// 0 means guests are turned away.
+	queueLimit int
+	// guests waiting for a slot, in join order, with the channel they are admitted on.
+	fullQueue []queuedGuest
+	// counted over the room's life for its RoomSummary.
+	stats roomStats
+	// How many spectators can join, from ServerOptions.MaxSpectatorsPerRoom. -1 means none.
+	maxSpectators int
+	// invite tokens created with CreateInvites, until they expire.
+	invites map[string]*invite
+	// ServerOptions.Region, or the host's hint from /host?region=.
+	region string
+	// How often the host sends Heartbeat, set with GET /host?heartbeat=true. 0 if heartbeats are off.
+	heartbeatInterval time.Duration
+	// Closes the room if the host misses too many heartbeats while connected.
+	heartbeatTimer   *time.Timer
+	heartbeatTimeout time.Duration
+	// Closes the room as unresponsive, set by startHeartbeat.
+	unresponsive func()
+}
+
+// A GuestJoined waiting for room in the join window.
+type queuedJoin struct {
+	g          *guest
+	ufrag, pwd string
+}
+
+// Room info set by the host with SetRoomInfo.
+type roomInfo struct {
+	Name   string
+	Public bool
+	// 0 means no limit.
+	MaxGuests int
+	Metadata  []byte
+}
+
+// Returns true if the password lets a guest join the room.
+//
+// The comparison is constant-time.
+func (r *room) checkPassword(password string) bool {
+	if r.password == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.password), []byte(password)) == 1
+}
+
+// Returns true if token matches the room's resume token.
+//
+// The comparison is constant-time.
+func (r *room) checkResumeToken(token string) bool {
+	if r.resumeToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.resumeToken), []byte(token)) == 1
+}
+
+// Writes msg to the host.
+//
+// While the host is away msg is queued, and written when the host resumes.
+func (r *room) writeHost(ctx context.Context, msg Msg) error {
+	r.mu.Lock()
+	hConn := r.hConn
+	if hConn == nil || r.flushing {
+		if !r.closed {
+			r.queuePending(msg)
+		}
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+	return hConn.send(ctx, msg)
+}
+
+// Queues msg for the host while it is away. Must be called with r.mu held.
+//
+// If the room's or msg's guest's share of the queue is full, the oldest IceCandidate
+// in it is dropped to make room. If there is none, msg is dropped instead,
+// so candidates are lost before GuestJoined.
+func (r *room) queuePending(msg Msg) {
+	// room-wide messages like RoomStatus only count against the room's limit.
+	perGuest := msg.GuestId != (qp2p.GuestID{})
+	forGuest := func(m Msg) bool { return m.GuestId == msg.GuestId }
+	count := 0
+	if perGuest {
+		for _, m := range r.pending {
+			if forGuest(m) {
+				count++
+			}
+		}
+	}
+	var full func(Msg) bool
+	switch {
+	case perGuest && r.pendingPerGuest > 0 && count >= r.pendingPerGuest:
+		full = forGuest
+	case r.pendingLimit > 0 && len(r.pending) >= r.pendingLimit:
+		full = func(Msg) bool { return true }
+	default:
+		r.pending = append(r.pending, msg)
+		return
+	}
+	i := slices.IndexFunc(r.pending, func(m Msg) bool { return m.Type == IceCandidate && full(m) })
+	if i < 0 {
+		r.dropPending(msg.Type)
+		return
+	}
+	r.dropPending(IceCandidate)
+	r.pending = append(slices.Delete(r.pending, i, i+1), msg)
+}
+
+// Logs and counts a message of type t dropped from pending.
+func (r *room) dropPending(t MsgType) {
+	r.log.Debug("message for away host dropped, queue full", "type", t)
+	if r.onPendingDrop != nil {
+		r.onPendingDrop(t)
+	}
+}
+
+// Records that the guest received HostAuth.
+//
+// Returns false if the guest already received HostAuth.
+func (r *room) addGuest(guestId qp2p.GuestID, lim *rate.Limiter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.guests[guestId]; ok {
+		return false
+	}
+	if r.guests == nil {
+		r.guests = make(map[qp2p.GuestID]*rate.Limiter)
+	}
+	r.guests[guestId] = lim
+	return true
+}
+
+// Returns the limiter for the host's messages to guestId.
+//
+// Returns false if the host has not sent HostAuth to the guest.
+func (r *room) hostLimiter(guestId qp2p.GuestID) (*rate.Limiter, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lim, ok := r.guests[guestId]
+	return lim, ok
+}
+
+// Bans ip from joining the room.
+//
+// Returns false if the room already has max bans.
+func (r *room) ban(ip string, max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.bans[ip]; ok {
+		return true
+	}
+	if len(r.bans) >= max {
+		return false
+	}
+	if r.bans == nil {
+		r.bans = make(map[string]struct{})
+	}
+	r.bans[ip] = struct{}{}
+	return true
+}
+
+// Returns true if ip is banned from joining the room.
+func (r *room) isBanned(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bans[ip]
+	return ok
+}
+
+// Sets the room info.
+//
+// Returns the guests in the room, so they can be told about the change.
+func (r *room) setInfo(info roomInfo) []*guest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.info = info
+	r.promote()
+	return slices.Collect(maps.Values(r.members))
+}
+
+// Returns the guests in the room, including ones still connecting.
+func (r *room) getMembers() []*guest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Collect(maps.Values(r.members))
+}
+
+// Returns the room info.
+func (r *room) getInfo() roomInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.info
+}
+
+// Returns true if the room has no room for another guest with role.
+//
+// Players are capped by MaxGuests, and spectators by maxSpectators.
+func (r *room) isFull(role Role) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isFullLocked(role)
+}
+
+func (r *room) isFullLocked(role Role) bool {
+	if role == RoleSpectator {
+		return r.count(RoleSpectator) >= r.maxSpectators
+	}
+	return r.info.MaxGuests > 0 && r.count(RolePlayer) >= r.info.MaxGuests
+}
+
+// Returns how many members of the room have role. Caller must hold r.mu.
+func (r *room) count(role Role) int {
+	n := 0
+	for _, g := range r.members {
+		if g.role == role {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns true if guestId was admitted to the room and has not left.
+func (r *room) isMember(guestId qp2p.GuestID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.members[guestId]
+	return ok
+}
+
+// Calls send once interval has passed since the last RoomStatus was sent.
+//
+// Changes made before send is called share one RoomStatus.
+func (r *room) statusChanged(interval time.Duration, send func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.statusTimer != nil {
+		return // send already pending.
+	}
+	r.statusTimer = time.AfterFunc(max(0, interval-time.Since(r.statusSentAt)), func() {
+		r.mu.Lock()
+		r.statusTimer = nil
+		r.statusSentAt = time.Now()
+		r.mu.Unlock()
+		send()
+	})
+}
+
+// Returns the room's guest count, MaxGuests and lock state,
+// and the guests that are sent RoomStatus.
+//
+// Spectators are not counted, but are sent RoomStatus.
+func (r *room) status() (guestCount, maxGuests int, locked bool, guests []*guest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, g := range r.members {
+		if _, ok := r.waiting[id]; ok {
+			continue
+		}
+		if g.role == RolePlayer {
+			guestCount++
+		}
+		if r.info.Public {
+			guests = append(guests, g)
+		}
+	}
+	return guestCount, r.info.MaxGuests, r.locked, guests
+}
+
+// Returns true if the host can be sent GuestJoined for g now.
+//
+// Otherwise g is queued until the host answers an earlier guest, see answered.
+func (r *room) announce(g *guest, ufrag, pwd string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.joinWindow <= 0 {
+		return true
+	}
+	if len(r.announced) < r.joinWindow {
+		if r.announced == nil {
+			r.announced = make(map[qp2p.GuestID]struct{})
+		}
+		r.announced[g.id] = struct{}{}
+		return true
+	}
+	r.joinQueue = append(r.joinQueue, queuedJoin{g, ufrag, pwd})
+	return false
+}
+
+// Frees the join window slot of guestId, after the host answered it or it left.
+//
+// Returns the queued guests the host can be sent GuestJoined for now.
+func (r *room) answered(guestId qp2p.GuestID) []queuedJoin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.joinQueue = slices.DeleteFunc(r.joinQueue, func(j queuedJoin) bool { return j.g.id == guestId })
+	if _, ok := r.announced[guestId]; !ok {
+		return nil
+	}
+	delete(r.announced, guestId)
+	var next []queuedJoin
+	for len(r.joinQueue) > 0 && len(r.announced) < r.joinWindow {
+		j := r.joinQueue[0]
+		r.joinQueue = r.joinQueue[1:]
+		r.announced[j.g.id] = struct{}{}
+		next = append(next, j)
+	}
+	return next
+}
+
+// Returns true if g is waiting for room in the join window.
+func (r *room) isQueued(g *guest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.ContainsFunc(r.joinQueue, func(j queuedJoin) bool { return j.g == g })
+}
+
+// Locks or unlocks the room to new guests.
+func (r *room) setLocked(locked bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.locked = locked
+	r.promote()
+}
+
+func (r *room) isLocked() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.locked
+}
+
+// Adds a new guest to the room.
+//
+// Returns ErrRoomNotFound if the room closed, ErrRoomLocked if it is locked, ErrRoomFull if it is full,
+// or ErrDuplicateGuest if a member has g's GuestID.
+func (r *room) admit(g *guest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRoomNotFound
+	}
+	if _, ok := r.members[g.id]; ok {
+		return ErrDuplicateGuest
+	}
+	if r.locked {
+		return ErrRoomLocked
+	}
+	if r.isFullLocked(g.role) {
+		return ErrRoomFull
+	}
+	r.addMember(g)
+	return nil
+}
+
+// Adds g to the room's members. r.mu must be held.
+func (r *room) addMember(g *guest) {
+	if r.members == nil {
+		r.members = make(map[qp2p.GuestID]*guest)
+	}
+	r.members[g.id] = g
+	r.stats.guestsJoined++
+	r.stats.peakGuests = max(r.stats.peakGuests, len(r.members))
+	if len(r.members) == 1 {
+		r.resetIdle()
+	}
+}
+
+// Removes an admitted guest from the room.
+func (r *room) removeGuest(guestId qp2p.GuestID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[guestId]; ok {
+		delete(r.members, guestId)
+		if len(r.members) == 0 {
+			r.resetIdle()
+		}
+		r.promote()
+	}
+	delete(r.guests, guestId)
+	delete(r.waiting, guestId)
+}
+
+// Calls expire with "room expired" after maxAge, and with "room idle" once the room
+// has had no guests for idle. A zero duration disables that limit.
+func (r *room) startExpiry(maxAge, idle time.Duration, expire func(reason string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire = expire
+	r.idleTimeout = idle
+	if maxAge > 0 {
+		r.ageTimer = time.AfterFunc(maxAge, func() { expire("room expired") })
+	}
+	r.resetIdle()
+}
+
+// Stops the idle timer, and starts it again if the room is open and has no guests.
+//
+// r.mu must be held.
+func (r *room) resetIdle() {
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	if r.closed || r.idleTimeout <= 0 || len(r.members) > 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(r.idleTimeout, func() {
+		r.mu.Lock()
+		// a guest joined (and maybe left again) since this timer started.
+		expired := r.idleTimer == timer
+		r.mu.Unlock()
+		if expired {
+			r.expire("room idle")
+		}
+	})
+	r.idleTimer = timer
+}
+
+// Starts expecting the host's heartbeats. unresponsive is called once none arrive for timeout.
+//
+// The timer only runs while the host is connected.
+func (r *room) startHeartbeat(timeout time.Duration, unresponsive func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeatTimeout = timeout
+	r.unresponsive = unresponsive
+	r.resetHeartbeat()
+}
+
+// Records a Heartbeat from the host.
+func (r *room) heartbeat() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetHeartbeat()
+}
+
+// Stops the heartbeat timer, and starts it again if the room is open and the host is connected.
+//
+// r.mu must be held.
+func (r *room) resetHeartbeat() {
+	if r.heartbeatTimer != nil {
+		r.heartbeatTimer.Stop()
+		r.heartbeatTimer = nil
+	}
+	if r.closed || r.heartbeatTimeout <= 0 || r.hConn == nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(r.heartbeatTimeout, func() {
+		r.mu.Lock()
+		// a heartbeat arrived, or the host left, since this timer started.
+		missed := r.heartbeatTimer == timer
+		r.mu.Unlock()
+		if missed {
+			r.unresponsive()
+		}
+	})
+	r.heartbeatTimer = timer
+}
+
+// Marks the host as away after hConn closed, and calls expire after grace
+// unless the host resumes first.
+//
+// Returns false if hConn is no longer the room's host connection.
+func (r *room) hostAway(hConn *HostConn, grace time.Duration, expire func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.hConn != hConn {
+		return false
+	}
+	r.hConn = nil
+	// an away host can't send heartbeats, the grace period applies instead.
+	r.resetHeartbeat()
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		// host resumed (and maybe left again) since this timer started.
+		expired := r.awayTimer == timer
+		r.mu.Unlock()
+		if expired {
+			expire()
+		}
+	})
+	r.awayTimer = timer
+	return true
+}
+
+// Attaches hConn as the room's host connection and flushes queued messages to it.
+//
+// Returns the previous host connection, if the host had not been noticed leaving yet.
+// Returns false if the room is closed.
+func (r *room) resume(hConn *HostConn, hostAddr string) (old *HostConn, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	if r.awayTimer != nil {
+		r.awayTimer.Stop()
+		r.awayTimer = nil
+	}
+	old = r.hConn
+	r.hConn = hConn
+	r.hostAddr = hostAddr
+	r.resetHeartbeat()
+	// writeHost queues messages until pending is flushed, so newer messages can't overtake queued ones.
+	// candidates wait for room too, as there can be more of them than the write queue holds,
+	// so they are written unlocked, not to block joins and leaves on a slow host.
+	r.flushing = true
+	for len(r.pending) > 0 {
+		pending := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+		for _, msg := range pending {
+			hConn.enqueue(hConn.ctx, outgoing{msg: hConn.tag(msg)}, false)
+		}
+		r.mu.Lock()
+		// the room closed, or the host left or resumed again and the rest is for the new connection.
+		if r.closed || r.hConn != hConn {
+			return old, true
+		}
+	}
+	r.flushing = false
+	return old, true
+}
+
+// Marks the room as closed.
+//
+// Returns the host connection (nil if the host is away) and the connected guests,
+// or false if the room was already closed.
+func (r *room) close() (*HostConn, []qp2p.GuestID, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, nil, false
+	}
+	hConn := r.hConn
+	r.closed = true
+	if r.awayTimer != nil {
+		r.awayTimer.Stop()
+		r.awayTimer = nil
+	}
+	if r.ageTimer != nil {
+		r.ageTimer.Stop()
+	}
+	if r.statusTimer != nil {
+		r.statusTimer.Stop()
+	}
+	r.resetIdle()
+	r.hConn = nil
+	r.resetHeartbeat()
+	r.pending = nil
+	for guestId, ch := range r.waiting {
+		ch <- approval{code: StatusHostOffline, reason: "Host is offline."}
+		delete(r.waiting, guestId)
+	}
+	for _, q := range r.fullQueue {
+		q.ch <- approval{code: StatusHostOffline, reason: "Host is offline."}
+	}
+	r.fullQueue = nil
+	return hConn, slices.Collect(maps.Keys(r.guests)), true
+}
+
+// The host's answer to a JoinRequest.
+type approval struct {
+	accepted bool
+	// close status and reason for rejected guests.
+	code   websocket.StatusCode
+	reason string
+}
+
+// Parks guestId until the host answers its JoinRequest, or the room closes.
+//
+// Returns the channel the answer is sent on.
+func (r *room) park(guestId qp2p.GuestID) <-chan approval {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch := make(chan approval, 1)
+	if r.closed {
+		ch <- approval{code: StatusHostOffline, reason: "Host is offline."}
+		return ch
+	}
+	if r.waiting == nil {
+		r.waiting = make(map[qp2p.GuestID]chan approval)
+	}
+	r.waiting[guestId] = ch
+	return ch
+}
+
+// Answers the JoinRequest of guestId.
+//
+// Returns false if the guest is not waiting.
+func (r *room) decide(guestId qp2p.GuestID, a approval) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.waiting[guestId]
+	if !ok {
+		return false
+	}
+	delete(r.waiting, guestId)
+	ch <- a
+	return true
+}
+
+// A guest waiting for a slot in a full room.
+type queuedGuest struct {
+	g  *guest
+	ch chan approval
+}
+
+// Queues g until a slot frees up in the room.
+//
+// Returns the channel g is sent an accepted approval on once it is admitted, or a rejection
+// if the room closes or the host clears the queue. Returns false if the queue is full.
+func (r *room) enqueue(g *guest) (<-chan approval, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch := make(chan approval, 1)
+	if r.closed {
+		ch <- approval{code: StatusHostOffline, reason: "Host is offline."}
+		return ch, true
+	}
+	if len(r.fullQueue) >= r.queueLimit {
+		return nil, false
+	}
+	r.fullQueue = append(r.fullQueue, queuedGuest{g: g, ch: ch})
+	// a slot may have freed up since g was turned away.
+	r.promote()
+	return ch, true
+}
+
+// Removes guestId from the queue.
+//
+// Returns false if it is not queued, e.g. because it was just admitted.
+func (r *room) dequeue(guestId qp2p.GuestID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.fullQueue, func(q queuedGuest) bool { return q.g.id == guestId })
+	if i < 0 {
+		return false
+	}
+	r.fullQueue = slices.Delete(r.fullQueue, i, i+1)
+	return true
+}
+
+// Returns guestId's place in the queue, 1 for the next guest admitted. 0 if it is not queued.
+func (r *room) queuePosition(guestId qp2p.GuestID) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.IndexFunc(r.fullQueue, func(q queuedGuest) bool { return q.g.id == guestId }) + 1
+}
+
+// Returns the queued guests in join order.
+func (r *room) queued() []qp2p.GuestID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]qp2p.GuestID, len(r.fullQueue))
+	for i, q := range r.fullQueue {
+		ids[i] = q.g.id
+	}
+	return ids
+}
+
+// Rejects every queued guest with a, returning how many there were.
+func (r *room) clearQueue(a approval) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.fullQueue)
+	for _, q := range r.fullQueue {
+		q.ch <- a
+	}
+	r.fullQueue = nil
+	return n
+}
+
+// Admits queued guests, oldest first, while the room has slots for them.
+//
+// r.mu must be held.
+func (r *room) promote() {
+	if r.closed || r.locked {
+		return
+	}
+	r.fullQueue = slices.DeleteFunc(r.fullQueue, func(q queuedGuest) bool {
+		if r.isFullLocked(q.g.role) {
+			return false
+		}
+		r.addMember(q.g)
+		q.ch <- approval{accepted: true}
+		return true
+	})
+}
+
+// How many messages are queued for a guest while it is away. Later messages are dropped.
+const maxGuestPending = 64
+
+// A guest connected to a room.
+type guest struct {
+	id   qp2p.GuestID
+	room *room
+	// logs with the guest's room, ID and connection.
+	log *slog.Logger
+	// remote IP address of the guest. Used for bans.
+	ip string
+	// RoleSpectator if the guest joined with GET /spectate/{roomId}.
+	role Role
+	// sent by the guest in GuestAuth, passed to the host in GuestJoined.
+	metadata []byte
+	// identity of the guest from ServerOptions.Authenticator.
+	identity string
+	// when GuestAuth was received. Used for the handshake latency metric.
+	authAt time.Time
+	// closes the guest if the host does not send HostAuth in time.
+	// Stopped when HostAuth is forwarded.
+	handshake *time.Timer
+
+	mu sync.Mutex
+	// nil while the guest is away.
+	gConn *GuestConn
+	// lets the guest rejoin with GET /rejoin/{roomId}. Replaced on every rejoin.
+	resumeToken string
+	// Messages for the guest, queued while it is away.
+	pending   []Msg
+	awayTimer *time.Timer
+	// set once the guest is removed from the server.
+	closed bool
+}
+
+// Returns the guest's connection, or nil while it is away.
+func (g *guest) conn() *GuestConn {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.gConn
+}
+
+// Sends msg to the guest, or queues it while the guest is away.
+func (g *guest) send(ctx context.Context, msg Msg) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gConn == nil {
+		if !g.closed && len(g.pending) < maxGuestPending {
+			g.pending = append(g.pending, msg)
+		}
+		return nil
+	}
+	return g.gConn.send(ctx, msg)
+}
+
+// Closes the guest's connection, if it has one.
+func (g *guest) closeConn(code websocket.StatusCode, reason string) {
+	if gConn := g.conn(); gConn != nil {
+		gConn.Close(code, reason)
+	}
+}
+
+// Reports whether the guest was removed with stop.
+func (g *guest) stopped() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+// Marks the guest as removed, stopping its timers. It can no longer rejoin.
+func (g *guest) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	g.pending = nil
+	if g.handshake != nil {
+		g.handshake.Stop()
+	}
+	if g.awayTimer != nil {
+		g.awayTimer.Stop()
+		g.awayTimer = nil
+	}
+}
+
+func (g *guest) checkResumeToken(token string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumeToken != "" && subtle.ConstantTimeCompare([]byte(g.resumeToken), []byte(token)) == 1
+}
+
+// Marks the guest as away after gConn closed, and calls expire after grace
+// unless the guest rejoins first. expire is called right away if the guest was stopped.
+//
+// Returns false if gConn is no longer the guest's connection.
+func (g *guest) away(gConn *GuestConn, grace time.Duration, expire func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gConn != gConn {
+		return false
+	}
+	g.gConn = nil
+	if g.closed {
+		go expire()
+		return true
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		g.mu.Lock()
+		// guest rejoined (and maybe left again) since this timer started.
+		expired := g.awayTimer == timer
+		g.mu.Unlock()
+		if expired {
+			expire()
+		}
+	})
+	g.awayTimer = timer
+	return true
+}
+
+// Attaches gConn as the guest's connection if token matches, and flushes queued messages to it.
+//
+// The token is single use, the guest is given newToken for its next rejoin.
+// Returns the previous connection, if the guest had not been noticed leaving yet.
+func (g *guest) resume(gConn *GuestConn, token, newToken string) (old *GuestConn, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed || g.resumeToken == "" || subtle.ConstantTimeCompare([]byte(g.resumeToken), []byte(token)) != 1 {
+		return nil, false
+	}
+	g.resumeToken = newToken
+	if g.awayTimer != nil {
+		g.awayTimer.Stop()
+		g.awayTimer = nil
+	}
+	old = g.gConn
+	g.gConn = gConn
+	// flush while locked so newer messages can't overtake queued ones.
+	for _, msg := range g.pending {
+		gConn.send(gConn.ctx, msg)
+	}
+	g.pending = nil
+	return old, true
+}
@@ -0,0 +1,68 @@
+package signaling
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Body of GET /room/{roomId} for a room that exists.
+//
+// Only rooms the host made public with SetRoomInfo report more than Exists.
+type RoomCheck struct {
+	Exists bool `json:"exists"`
+	Public bool `json:"public"`
+	// Locked rooms do not accept new guests.
+	Locked bool `json:"locked,omitempty"`
+	// Players in the room, spectators are counted in Spectators.
+	GuestCount int `json:"guestCount,omitempty"`
+	Spectators int `json:"spectators,omitempty"`
+	// 0 means no limit.
+	Capacity int `json:"capacity,omitempty"`
+}
+
+// GET /room/{roomId}
+//
+// Reports whether a room exists, so a room code can be checked without joining.
+// Responds 404 if it does not.
+func (s *WebsocketSignalingServer) checkRoom(w http.ResponseWriter, r *http.Request) {
+	if !s.checkLim.allow(s.remoteIP(r)) {
+		writeRetryAfter(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit", 2*time.Second)
+		return
+	}
+	roomId := pathRoomId(r)
+	rm, ok := s.rooms.Load(roomId)
+	if !ok && s.routeToNode(w, r, roomId) {
+		return
+	}
+	var check RoomCheck
+	if ok {
+		check, ok = rm.check()
+	}
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, CodeRoomNotFound, "room not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
+
+// Returns the room's RoomCheck, or false if the room is closed.
+func (r *room) check() (RoomCheck, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return RoomCheck{}, false
+	}
+	if !r.info.Public {
+		return RoomCheck{Exists: true}, true
+	}
+	return RoomCheck{
+		Exists:     true,
+		Public:     true,
+		Locked:     r.locked,
+		GuestCount: r.count(RolePlayer),
+		Spectators: r.count(RoleSpectator),
+		Capacity:   r.info.MaxGuests,
+	}, true
+}
@@ -0,0 +1,87 @@
+package signaling
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// A public room in the GET /rooms listing.
+type RoomListing struct {
+	RoomId qp2p.RoomId `json:"roomId"`
+	Name   string      `json:"name"`
+	// Players in the room, spectators are counted in Spectators.
+	CurrentGuests int `json:"currentGuests"`
+	Spectators    int `json:"spectators"`
+	// 0 means no limit.
+	MaxGuests int    `json:"maxGuests"`
+	Metadata  string `json:"metadata"`
+	// Locked rooms do not accept new guests.
+	Locked bool `json:"locked"`
+	// Region the room lives in, see ServerOptions.Region.
+	Region string `json:"region,omitempty"`
+}
+
+// GET /rooms?offset=&limit=
+//
+// Lists the rooms that hosts have made public with SetRoomInfo, sorted by RoomId.
+//
+// The total number of public rooms is sent in the X-Total-Count header.
+func (s *WebsocketSignalingServer) listRooms(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit, maxLimit = 50, 100
+
+	if !s.listLim.allow(s.remoteIP(r)) {
+		writeRetryAfter(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit", time.Second)
+		return
+	}
+
+	offset, err := strconv.Atoi(cmp.Or(r.URL.Query().Get("offset"), "0"))
+	if err != nil || offset < 0 {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(cmp.Or(r.URL.Query().Get("limit"), strconv.Itoa(defaultLimit)))
+	if err != nil || limit < 1 || limit > maxLimit {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid limit")
+		return
+	}
+
+	listings := make([]RoomListing, 0)
+	for _, rm := range s.rooms.All() {
+		if listing, ok := rm.listing(); ok {
+			listings = append(listings, listing)
+		}
+	}
+	slices.SortFunc(listings, func(a, b RoomListing) int { return cmp.Compare(a.RoomId, b.RoomId) })
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(listings)))
+	listings = listings[min(offset, len(listings)):]
+	listings = listings[:min(limit, len(listings))]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listings)
+}
+
+// Returns the room's listing, or false if the room is not public.
+func (r *room) listing() (RoomListing, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || !r.info.Public {
+		return RoomListing{}, false
+	}
+	return RoomListing{
+		RoomId:        r.id,
+		Name:          r.info.Name,
+		CurrentGuests: r.count(RolePlayer),
+		Spectators:    r.count(RoleSpectator),
+		MaxGuests:     r.info.MaxGuests,
+		Metadata:      string(r.info.Metadata),
+		Locked:        r.locked,
+		Region:        r.region,
+	}, true
+}
@@ -0,0 +1,158 @@
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/go4org/hashtriemap"
+)
+
+// RoomRegistry records which server node hosts each room.
+//
+// Servers sharing a registry never hand out the same RoomId, and redirect
+// guests that reach the wrong node to the node hosting their room, or relay
+// them there if the registry is a RoomRelay.
+// This lets several servers run behind a load balancer.
+//
+// Implementations must be safe for concurrent use.
+type RoomRegistry interface {
+	// Claims roomId for node. Returns false if another room has it.
+	ReserveRoom(ctx context.Context, roomId qp2p.RoomId, node string) (bool, error)
+	// Releases roomId after its room closes.
+	ReleaseRoom(ctx context.Context, roomId qp2p.RoomId) error
+	// Returns the node hosting roomId. Returns false if no room has it.
+	ResolveRoom(ctx context.Context, roomId qp2p.RoomId) (node string, ok bool, err error)
+}
+
+// RoomRelay is a RoomRegistry that also passes messages between nodes.
+//
+// With one, a guest or host that reaches a node without its room is relayed to the
+// node hosting it, through the node it reached, instead of being redirected.
+// Nodes then don't need to be reachable by clients, and a host and its guests can
+// land on different nodes.
+//
+// Implementations must be safe for concurrent use.
+type RoomRelay interface {
+	RoomRegistry
+	// Sends msg to the node subscribed as node. It is dropped if there is none.
+	// Messages published one after another to a node arrive in that order.
+	Publish(ctx context.Context, node string, msg []byte) error
+	// Calls deliver with each message published to node, one at a time, until ctx is done
+	// or unsubscribe is called. Returns once messages published after it are delivered.
+	Subscribe(ctx context.Context, node string, deliver func(msg []byte)) (unsubscribe func(), err error)
+}
+
+// MemoryRegistry is an in-process RoomRelay.
+//
+// It is used by the server if ServerOptions.Registry is nil.
+// Servers in the same process can share one.
+type MemoryRegistry struct {
+	rooms hashtriemap.HashTrieMap[qp2p.RoomId, string]
+
+	mu sync.Mutex
+	// subscriptions by node.
+	subs map[string][]*memorySub
+}
+
+// A MemoryRegistry subscription, delivering msgs from its own goroutine.
+type memorySub struct {
+	msgs chan []byte
+	done chan struct{}
+}
+
+// How many messages a subscription of a MemoryRegistry buffers before Publish waits.
+const memorySubDepth = 256
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return new(MemoryRegistry)
+}
+
+func (m *MemoryRegistry) ReserveRoom(ctx context.Context, roomId qp2p.RoomId, node string) (bool, error) {
+	_, loaded := m.rooms.LoadOrStore(roomId, node)
+	return !loaded, nil
+}
+
+func (m *MemoryRegistry) ReleaseRoom(ctx context.Context, roomId qp2p.RoomId) error {
+	m.rooms.Delete(roomId)
+	return nil
+}
+
+func (m *MemoryRegistry) ResolveRoom(ctx context.Context, roomId qp2p.RoomId) (string, bool, error) {
+	node, ok := m.rooms.Load(roomId)
+	return node, ok, nil
+}
+
+func (m *MemoryRegistry) Publish(ctx context.Context, node string, msg []byte) error {
+	m.mu.Lock()
+	subs := m.subs[node]
+	m.mu.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub.msgs <- msg:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRegistry) Subscribe(ctx context.Context, node string, deliver func(msg []byte)) (func(), error) {
+	sub := &memorySub{msgs: make(chan []byte, memorySubDepth), done: make(chan struct{})}
+	m.mu.Lock()
+	if m.subs == nil {
+		m.subs = make(map[string][]*memorySub)
+	}
+	m.subs[node] = append(m.subs[node], sub)
+	m.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			m.mu.Lock()
+			m.subs[node] = slices.DeleteFunc(m.subs[node], func(s *memorySub) bool { return s == sub })
+			m.mu.Unlock()
+			close(sub.done)
+		})
+	}
+	stop := context.AfterFunc(ctx, unsubscribe)
+	go func() {
+		defer stop()
+		for {
+			select {
+			case msg := <-sub.msgs:
+				deliver(msg)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return unsubscribe, nil
+}
+
+// Relays r to the node hosting roomId, if it is not this one, or redirects it there
+// if the Registry is not a RoomRelay.
+//
+// Returns false if the room is not hosted by another node.
+func (s *WebsocketSignalingServer) routeToNode(w http.ResponseWriter, r *http.Request, roomId qp2p.RoomId) bool {
+	node, ok, err := s.sopts.Registry.ResolveRoom(r.Context(), roomId)
+	if err != nil {
+		s.log.Error("Failed to resolve room", "id", roomId, "error", err)
+		return false
+	}
+	if !ok || node == "" || node == s.sopts.NodeURL {
+		return false
+	}
+	if s.relay != nil {
+		s.log.Debug("Relaying to node hosting room", "id", roomId, "node", node)
+		s.relayTo(w, r, node)
+		return true
+	}
+	s.log.Debug("Redirecting to node hosting room", "id", roomId, "node", node)
+	http.Redirect(w, r, strings.TrimSuffix(node, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
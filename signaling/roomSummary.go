@@ -0,0 +1,98 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// A room that closed, in the GET /admin/rooms/closed listing.
+type RoomSummary struct {
+	RoomId          qp2p.RoomId `json:"roomId"`
+	CreatedAt       time.Time   `json:"createdAt"`
+	ClosedAt        time.Time   `json:"closedAt"`
+	LifetimeSeconds float64     `json:"lifetimeSeconds"`
+	// Guests admitted to the room over its life.
+	GuestsJoined int `json:"guestsJoined"`
+	// Most guests in the room at once.
+	PeakGuests int `json:"peakGuests"`
+	// Guests closed because the host did not send HostAuth within ServerOptions.HandshakeTimeout.
+	HandshakesFailed int `json:"handshakesFailed"`
+	// Why the room closed, e.g. "Host is offline."
+	Reason string `json:"reason"`
+}
+
+// Counters kept by a room over its life, for its RoomSummary.
+type roomStats struct {
+	guestsJoined     int
+	peakGuests       int
+	handshakesFailed int
+}
+
+// Counts a guest the host did not send HostAuth to in time.
+func (r *room) handshakeFailed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.handshakesFailed++
+}
+
+// Returns the summary of the closed room.
+func (r *room) summary(reason string) RoomSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closedAt := time.Now()
+	return RoomSummary{
+		RoomId:           r.id,
+		CreatedAt:        r.createdAt,
+		ClosedAt:         closedAt,
+		LifetimeSeconds:  closedAt.Sub(r.createdAt).Seconds(),
+		GuestsJoined:     r.stats.guestsJoined,
+		PeakGuests:       r.stats.peakGuests,
+		HandshakesFailed: r.stats.handshakesFailed,
+		Reason:           reason,
+	}
+}
+
+// Ring buffer of the summaries of the most recently closed rooms.
+type roomHistory struct {
+	mu   sync.Mutex
+	buf  []RoomSummary
+	next int
+	full bool
+}
+
+func newRoomHistory(size int) *roomHistory {
+	return &roomHistory{buf: make([]RoomSummary, size)}
+}
+
+// Adds sum, replacing the oldest summary if the buffer is full.
+func (h *roomHistory) add(sum RoomSummary) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf[h.next] = sum
+	h.next = (h.next + 1) % len(h.buf)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Returns the summaries, newest first.
+func (h *roomHistory) list() []RoomSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.buf)
+	}
+	sums := make([]RoomSummary, 0, n)
+	for i := range n {
+		sums = append(sums, h.buf[(h.next-1-i+len(h.buf))%len(h.buf)])
+	}
+	return sums
+}
+
+// ClosedRooms returns the summaries of the last ServerOptions.ClosedRoomHistory rooms that closed, newest first.
+func (s *WebsocketSignalingServer) ClosedRooms() []RoomSummary {
+	return s.closedRooms.list()
+}
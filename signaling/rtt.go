@@ -0,0 +1,47 @@
+package signaling
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/go4org/hashtriemap"
+)
+
+// Pings sent by a client, waiting for their Pong, keyed by Nonce.
+//
+// The client's Listen passes each Pong to deliver, so pings can be measured while it runs.
+type pongWaiters struct {
+	m hashtriemap.HashTrieMap[uint32, chan struct{}]
+}
+
+// Sends a Ping on conn and waits for its Pong, returning the round trip time.
+//
+// Returns ctx.Err() if ctx is done first, or errConnClosed if connCtx, the connection's context, is.
+func (w *pongWaiters) measure(ctx, connCtx context.Context, conn msgSender) (time.Duration, error) {
+	pong := make(chan struct{})
+	nonce := rand.Uint32()
+	for _, loaded := w.m.LoadOrStore(nonce, pong); loaded; _, loaded = w.m.LoadOrStore(nonce, pong) {
+		nonce = rand.Uint32()
+	}
+	defer w.m.Delete(nonce)
+	start := time.Now()
+	if err := MsgPing(ctx, conn, nonce); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-connCtx.Done():
+		return 0, errConnClosed
+	}
+}
+
+// Wakes the waiter for msg, a Pong. Pongs nobody waits for, e.g. late ones, are ignored.
+func (w *pongWaiters) deliver(msg Msg) {
+	if pong, ok := w.m.LoadAndDelete(msg.Nonce); ok {
+		close(pong)
+	}
+}
@@ -0,0 +1,126 @@
+package signaling
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// Sealed ICE credentials and candidates start with sealedPrefix, followed by the
+// nonce and AES-GCM ciphertext in unpadded standard base64. Both are ice-chars,
+// so sealed credentials pass the server's checks as they are.
+const sealedPrefix = "qp2p/sealed/"
+
+// Bytes a sealed field adds before base64: the nonce and the GCM tag.
+const sealOverhead = 12 + 16
+
+// Longest sealed candidate forwarded between hosts and guests, a sealed candidate of MaxCandidateLen.
+var maxSealedCandidateLen = len(sealedPrefix) + base64.RawStdEncoding.EncodedLen(MaxCandidateLen+sealOverhead)
+
+// Who sealed a field. It is bound to the ciphertext along with the field's name, so the server
+// can't pass one field off as another, e.g. send a guest its own credentials back as the host's.
+const (
+	sealedByHost  = "host"
+	sealedByGuest = "guest"
+)
+
+// Returns a random room secret for ClientOptions.RoomSecret, for the host to share with
+// its guests out of band, e.g. alongside the room code in an invite link.
+func NewRoomSecret() string {
+	return rand.Text()
+}
+
+// Seals and opens ICE credentials and candidates with the room secret, see ClientOptions.RoomSecret.
+//
+// Each guest's fields are sealed with a key derived from the secret and its GuestID.
+// GuestAuth is sent before the guest knows its GuestID, so its credentials use the zero GuestID's key.
+type roomSealer struct {
+	// empty if fields are sent in the clear.
+	secret string
+}
+
+// Returns the AEAD for the fields of guestId.
+func (r roomSealer) aead(guestId qp2p.GuestID) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, []byte(r.secret), nil, "qp2p seal "+string(guestId[:]), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seals plain, the field of guestId's handshake sealed by by. Returns plain as it is if there is no secret.
+func (r roomSealer) seal(guestId qp2p.GuestID, by, field, plain string) (string, error) {
+	if r.secret == "" {
+		return plain, nil
+	}
+	aead, err := r.aead(guestId)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(by+" "+field))
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Opens sealed, the field of guestId's handshake sealed by the other peer, by.
+//
+// Returns an error wrapping ErrRoomSecretMismatch if only one side has a secret, or they differ.
+func (r roomSealer) open(guestId qp2p.GuestID, by, field, sealed string) (string, error) {
+	b64, ok := strings.CutPrefix(sealed, sealedPrefix)
+	switch {
+	case r.secret == "" && !ok:
+		return sealed, nil
+	case r.secret == "":
+		return "", fmt.Errorf("%w: %s %s is sealed, but RoomSecret is not set", ErrRoomSecretMismatch, by, field)
+	case !ok:
+		return "", fmt.Errorf("%w: %s %s is not sealed, the %s has no RoomSecret", ErrRoomSecretMismatch, by, field, by)
+	}
+	b, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s %s: %w", ErrRoomSecretMismatch, by, field, err)
+	}
+	aead, err := r.aead(guestId)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: %s %s is too short", ErrRoomSecretMismatch, by, field)
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(by+" "+field))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s %s could not be opened, the secrets differ", ErrRoomSecretMismatch, by, field)
+	}
+	return string(plain), nil
+}
+
+// Seals ufrag and pwd, see seal.
+func (r roomSealer) sealCredentials(guestId qp2p.GuestID, by, ufrag, pwd string) (string, string, error) {
+	ufrag, err := r.seal(guestId, by, "ufrag", ufrag)
+	if err != nil {
+		return "", "", err
+	}
+	pwd, err = r.seal(guestId, by, "pwd", pwd)
+	return ufrag, pwd, err
+}
+
+// Opens ufrag and pwd, see open.
+func (r roomSealer) openCredentials(guestId qp2p.GuestID, by, ufrag, pwd string) (string, string, error) {
+	ufrag, err := r.open(guestId, by, "ufrag", ufrag)
+	if err != nil {
+		return "", "", err
+	}
+	pwd, err = r.open(guestId, by, "pwd", pwd)
+	return ufrag, pwd, err
+}
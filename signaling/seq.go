@@ -0,0 +1,48 @@
+package signaling
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+)
+
+// Drops messages read from a connection that were already delivered, by their Seq.
+//
+// Seq grows with every message written on the connection, so a message whose Seq is at or below
+// the last one read for its GuestID was already delivered, e.g. replayed after a resume.
+// Messages not about a guest are tracked under the zero GuestID. Unsequenced messages are kept.
+type seqTracker struct {
+	// last Seq read for each GuestID. Only used by the reading goroutine.
+	last map[qp2p.GuestID]uint64
+	// duplicates dropped.
+	dropped atomic.Uint64
+	// reused by every read.
+	in Msg
+}
+
+// Reads the next message from conn that is not a duplicate, see ReadMsg.
+//
+// Must only be called from one goroutine at a time.
+func (t *seqTracker) readMsg(ctx context.Context, conn *websocket.Conn, log *slog.Logger) (Msg, error) {
+	for {
+		err := ReadMsgInto(ctx, conn, &t.in)
+		msg := t.in
+		if err != nil || msg.Seq == 0 {
+			return msg, err
+		}
+		if t.last == nil {
+			t.last = make(map[qp2p.GuestID]uint64)
+		}
+		// the writer stamps messages in write order, so an older Seq is a duplicate, or was reordered after it.
+		if last := t.last[msg.GuestId]; msg.Seq <= last {
+			t.dropped.Add(1)
+			log.Debug("Duplicate message dropped", "type", msg.Type, "seq", msg.Seq, "last", last, "guest", msg.GuestId)
+			continue
+		}
+		t.last[msg.GuestId] = msg.Seq
+		return msg, nil
+	}
+}
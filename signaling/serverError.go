@@ -0,0 +1,77 @@
+package signaling
+
+import (
+	"fmt"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/coder/websocket"
+)
+
+// Codes of Error messages, in ServerError.Code and ErrorMsg.Code.
+//
+// Codes below ErrorCandidateRejected are close statuses: the server sends an Error with the
+// close status as its Code, e.g. int(StatusKicked), right before it closes a connection with it,
+// as some websocket libraries truncate or hide the close reason.
+//
+// Codes from ErrorCandidateRejected up are recoverable, the connection stays open.
+// Codes up to 4499 are reserved for the protocol, applications can use
+// ErrorCodeAppMin to ErrorCodeAppMax for their own Errors between hosts and guests.
+const (
+	// A candidate in an IceCandidate was dropped, e.g. for being too long. Detail says why.
+	ErrorCandidateRejected = 4100
+	// A message was dropped, e.g. because it could not be decoded, or was for a guest not in the room.
+	ErrorMessageRejected = 4101
+	// A Relay was dropped for a Payload over the server's MaxRelayPayloadLen.
+	ErrorRelayTooLarge = 4102
+	// A message of a type the server does not know was dropped. Detail has its numeric type.
+	// Only sent if the server's ServerOptions.ReplyUnknownTypes is set.
+	ErrorUnknownMessageType = 4103
+
+	ErrorCodeAppMin = 4500
+	ErrorCodeAppMax = 4999
+)
+
+// Longest Detail in an Error, as long as a close reason.
+const MaxErrorDetailLen = 123
+
+// The error each recoverable code maps to on the client.
+var errorMsgCodes = map[int]error{
+	ErrorCandidateRejected:  ErrCandidateRejected,
+	ErrorMessageRejected:    ErrInvalidMessage,
+	ErrorRelayTooLarge:      ErrMessageTooLarge,
+	ErrorUnknownMessageType: ErrInvalidMessage,
+}
+
+// Reports whether code is an Error code that does not close the connection.
+func recoverable(code int) bool {
+	return code >= ErrorCandidateRejected && code <= ErrorCodeAppMax
+}
+
+// ServerError is an Error message from the server, or from the host or guest on the other side.
+//
+// The clients pass it to the function set with OnServerError. errors.Is matches it against the
+// Err value for its Code, e.g. ErrKicked for int(StatusKicked), or ErrCandidateRejected for
+// ErrorCandidateRejected.
+type ServerError struct {
+	Code   int
+	Detail string
+	// The guest the error is about, or the guest that sent it to the host.
+	GuestId qp2p.GuestID
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("signaling: error %d: %s", e.Code, e.Detail)
+}
+
+// Returns the Err value for the error's Code, or nil if it has none.
+func (e *ServerError) Unwrap() error {
+	if err, ok := errorMsgCodes[e.Code]; ok {
+		return err
+	}
+	return closeStatuses[websocket.StatusCode(e.Code)].err
+}
+
+// Returns the ServerError carried by an Error message.
+func serverError(msg Msg) *ServerError {
+	return &ServerError{Code: msg.Code, Detail: msg.Detail, GuestId: msg.GuestId}
+}
@@ -1,32 +1,337 @@
 package signaling
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	qp2p "github.com/BrownNPC/QuicP2P"
 	"github.com/coder/websocket"
 	"github.com/go4org/hashtriemap"
 	"github.com/pion/ice/v4"
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
 )
 
-type signalingClientGuest struct {
+// GuestClient is a guest's connection to the signaling server, see NewSignalingClientGuest.
+type GuestClient struct {
+	opts  ClientOptions
+	log   *slog.Logger
+	gConn *GuestConn
+	// called with Relay payloads from the host, set with OnRelay.
+	onRelay func(payload []byte)
+	// called with RoomStatus updates of public rooms, set with OnRoomStatus.
+	onRoomStatus func(RoomState)
+	// RoleSpectator if created with NewSignalingClientSpectator.
+	role Role
+	// sent to the host in GuestAuth.
+	metadata []byte
+	// called with the guest's place in a full room's queue, set with OnQueuePosition.
+	onQueuePosition func(position int)
+	// called with Error messages, set with OnServerError.
+	onServerError func(*ServerError)
+	// Pings sent by MeasureRTT.
+	pongs pongWaiters
+	// drops duplicate messages read by Listen.
+	seqs seqTracker
+	// seals the guest's ICE credentials and candidates, and opens the host's.
+	sealer roomSealer
+	// called with the host's credentials from IceRestart, set with OnIceRestart.
+	onIceRestart func(ufrag, pwd string)
+	// called with the host's credentials from HostAuth, set with OnRemoteAuth.
+	onRemoteAuth func(ufrag, pwd string)
+	// called with the host's candidates, set with OnIceCandidate.
+	onIceCandidate func(c ice.Candidate)
+	// closed by Listen once the server sends Joined, and once Listen returns.
+	joined     chan struct{}
+	joinedOnce sync.Once
+	done       chan struct{}
+	// returned by Listen.
+	err error
+	// from the server's Joined message.
+	mu          sync.Mutex
+	guestId     qp2p.GuestID
+	resumeToken string
+	region      string
 }
-type iceConn struct {
-	*ice.Conn
-	*ice.Agent
+
+// PeerConn is the host's ICE connection to a guest, passed to HostClient.Listen's onConnection.
+type PeerConn struct {
+	// nil while the guest is still being dialed.
+	conn  *ice.Conn
+	agent *ice.Agent
+	// shared by the copies of a PeerConn, so it is torn down once.
+	state *peerState
+}
+
+// Returns the connection to the guest.
+func (c PeerConn) Conn() *ice.Conn {
+	return c.conn
 }
-type signalingClientHost struct {
-	opts   websocket.DialOptions
-	guests hashtriemap.HashTrieMap[qp2p.GuestID, iceConn]
+
+// Returns the ICE agent the connection to the guest was dialed with.
+func (c PeerConn) Agent() *ice.Agent {
+	return c.agent
+}
+
+// HostClient is a host's connection to the signaling server, see NewSignalingClientHost.
+type HostClient struct {
+	opts   ClientOptions
+	guests hashtriemap.HashTrieMap[qp2p.GuestID, PeerConn]
 	log    *slog.Logger
 	mux    ice.UDPMux
-	hConn  hostConn
+	// whether mux was bound by the client rather than passed in ClientOptions, and is closed by Close.
+	ownsMux bool
+	// that mux listens on, of ClientOptions.NetworkTypes.
+	networks []ice.NetworkType
+	// from ClientOptions.STUNServers.
+	stunURLs []*stun.URI
+	// from ClientOptions.TURNServers.
+	turnURLs []*stun.URI
+	// called with the candidate types gathered for a guest, set with OnGathered.
+	onGathered func(guestId qp2p.GuestID, types []ice.CandidateType)
+	// replaced when Listen resumes the room on a new connection.
+	hConn atomic.Pointer[HostConn]
+	// the client's lifetime, cancelled by Close. Dials to guests and sends wait on it,
+	// so they outlive a lost connection to the server.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// to dial the server again, see ClientOptions.DisableReconnect.
+	host        string
+	sceme       WebsocketScheme
+	resumeToken string
+	// set while Listen reconnects, when candidates are queued in offline to be sent once the room resumed.
+	offlineMu    sync.Mutex
+	reconnecting bool
+	offline      []func()
+	// shortens the dial to a guest once it has sent EndOfCandidates.
+	endOfCandidates hashtriemap.HashTrieMap[qp2p.GuestID, func()]
+	// called with each guest's events, set with OnEvent.
+	onEvent func(HostEvent)
+	// serialises events, and tracks which were sent for each guest so they come in order.
+	eventMu     sync.Mutex
+	guestStates map[qp2p.GuestID]guestState
+	// called when a guest leaves, set with SetOnGuestDisconnected.
+	onGuestDisconnected func(guestId qp2p.GuestID, reason string)
+	// called with Relay payloads from guests, set with OnRelay.
+	onRelay func(guestId qp2p.GuestID, payload []byte)
+	// set by LockRoom and UnlockRoom.
+	locked atomic.Bool
+	// latest RoomStatus from the server.
+	status atomic.Pointer[RoomState]
+	// called with RoomStatus updates, set with OnRoomStatus.
+	onRoomStatus func(RoomState)
+	// called with invite tokens, set with OnInvites.
+	onInvites func(tokens []string)
+	// called with the guests waiting for a slot, set with OnQueuedGuests.
+	onQueuedGuests func(guestIds []qp2p.GuestID)
+	// from RoomCreated.
+	region atomic.Pointer[string]
+	roomId atomic.Pointer[qp2p.RoomId]
+	// rooms of guests in rooms created with CreateRoom.
+	guestRooms hashtriemap.HashTrieMap[qp2p.GuestID, qp2p.RoomId]
+	// serialises CreateRoom, whose answer Listen passes on in created.
+	createMu sync.Mutex
+	created  chan Msg
+	// called when a room created with CreateRoom closes, set with OnRoomClosed.
+	onRoomClosed func(roomId qp2p.RoomId, reason string)
+	// called with Error messages, set with OnServerError.
+	onServerError func(*ServerError)
+	// Pings sent by MeasureRTT.
+	pongs pongWaiters
+	// drops duplicate messages read by Listen.
+	seqs seqTracker
+	// seals the host's ICE credentials and candidates, and opens the guests'.
+	sealer roomSealer
+	// guests the host sent IceRestart to, until they answer.
+	restarting hashtriemap.HashTrieMap[qp2p.GuestID, struct{}]
+	// set by Close, which Listen returns nil after.
+	closed    atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Room status pushed by the server in RoomStatus messages.
+type RoomState struct {
+	// The room the status is for, see CreateRoom.
+	RoomId qp2p.RoomId
+	// Guests in the room, not counting guests waiting for approval.
+	Guests int
+	// 0 means no limit.
+	MaxGuests int
+	Locked    bool
+}
+
+// How many messages can wait to be written to the signaling server.
+const clientWriteQueueDepth = 32
+
+// How long candidates are collected before they are sent to the signaling server in one message.
+const candidateBatchDelay = 50 * time.Millisecond
+
+// How long the host keeps dialing a guest after the guest's EndOfCandidates.
+const endOfCandidatesTimeout = 5 * time.Second
+
+// Options for the signaling clients' websocket.
+type ClientOptions struct {
+	// Passed to websocket.Dial, e.g. for an HTTPClient or HTTPHeader.
+	Dial websocket.DialOptions
+	// permessage-deflate mode asked of the server. Compression is only used if the server's
+	// ServerOptions.CompressionMode allows it. Batched IceCandidate messages compress well,
+	// which helps over slow links.
+	//
+	// Overrides Dial.CompressionMode if set. Default is websocket.CompressionDisabled.
+	CompressionMode websocket.CompressionMode
+	// Smallest message that is compressed.
+	//
+	// Overrides Dial.CompressionThreshold if set. Default is websocket's,
+	// 128 bytes for CompressionContextTakeover and 512 for CompressionNoContextTakeover.
+	CompressionThreshold int
+	// Largest message read from the signaling server.
+	// RoomInfo carries the room metadata, so this is larger than the server's default limit.
+	//
+	// Default is 16384 bytes.
+	ReadLimit int64
+	// Guests wait for a slot in a full room, if its host created it with GET /host?queue=true,
+	// instead of being turned away with ErrRoomFull. See GuestClient.WaitJoined.
+	// Ignored by the host.
+	Queue bool
+	// ID the host asks for its room, e.g. "FINALS", if the server allows hosts to pick one.
+	// See ServerOptions.VanityRoomIds. Ignored by guests.
+	//
+	// Default is empty, the server generates one.
+	RoomId qp2p.RoomId
+	// Secret the host shares with its guests out of band, e.g. from NewRoomSecret alongside the room code.
+	// If set, ICE credentials and candidates are sealed with it, so the signaling server only forwards
+	// ciphertext and can't man-in-the-middle the ICE handshake.
+	//
+	// The host and its guests must all set the same secret, otherwise their handshakes fail
+	// with ErrRoomSecretMismatch. Default is empty, they are sent in the clear.
+	RoomSecret string
+	// Local address the host's UDP socket for ICE binds to, e.g. one interface's IP.
+	// An IPv6 address binds udp6. Default is every interface of NetworkTypes.
+	BindAddress string
+	// Networks the host's ICE agents gather candidates on, ice.NetworkTypeUDP4 and or ice.NetworkTypeUDP6.
+	// With both, the UDP socket is dual-stack, so guests on IPv6-only networks, e.g. mobile carriers, can connect.
+	//
+	// Default is both, falling back to UDP4 if IPv6 can't be bound.
+	NetworkTypes []ice.NetworkType
+	// Local port the host's UDP socket for ICE binds to, e.g. one forwarded by the router.
+	// Default is 0, a random port.
+	Port int
+	// Ports the host's UDP socket for ICE binds to if Port is 0, e.g. a range a firewall allows.
+	// They are tried in order while they are in use. Default is {0, 0}, a random port.
+	PortRange [2]int
+	// UDP socket for the host's ICE connections, instead of binding one.
+	// BindAddress, Port and PortRange are ignored, and Close leaves it open. Default is nil.
+	PacketConn net.PacketConn
+	// UDP mux for the host's ICE connections, instead of one over a UDP socket.
+	// Takes precedence over PacketConn, and Close leaves it open. Default is nil.
+	UDPMux ice.UDPMux
+	// STUN servers the host's ICE agents ask for their public address, e.g. "stun:stun.l.google.com:19302",
+	// so guests behind another NAT can reach them. See DefaultSTUNServers and HostClient.OnGathered.
+	//
+	// Default is none, only local addresses are gathered, which only reach guests on the same network.
+	STUNServers []string
+	// How long the host's ICE agents wait for each STUN server. Default is 5 seconds.
+	GatherTimeout time.Duration
+	// TURN servers the host's ICE agents relay through when no direct path works, e.g. behind symmetric NAT or CGNAT.
+	// Default is none.
+	TURNServers []TURNServer
+	// Called for time-limited TURN credentials before each guest's ICE agent is created, e.g. from a cache
+	// refreshed by the application, so it should return quickly. The servers are used along with TURNServers.
+	// Default is nil.
+	TURNCredentials func(ctx context.Context) ([]TURNServer, error)
+	// Only relay candidates are gathered, so the other peer never learns the client's IP address.
+	// Needs TURNServers or TURNCredentials. Default is false.
+	RelayOnly bool
+	// Called with each of the host's candidates before it is sent to a guest, and with each of a guest's
+	// candidates before it is added to the guest's ICE agent. Candidates it returns false for are dropped,
+	// e.g. NoHostCandidates so guests don't learn the host's local address, or LANCandidatesOnly for play on
+	// the local network only.
+	//
+	// Every candidate dropped is a path that can't be used, so guests behind some NATs may fail to connect.
+	// The host's agent still gathers the candidates that are dropped, and its connectivity checks from them
+	// can show their address to a guest as a peer-reflexive candidate. To keep the host's address private,
+	// use RelayOnly, which doesn't gather them. Default is nil, all candidates are exchanged.
+	CandidateFilter CandidateFilter
+	// Host candidates carry a random .local name instead of the local address, which peers on the same network
+	// resolve over multicast DNS, so they connect without learning it. See ClientOptions.LAN.
+	// The .local candidates of the other peer are resolved either way. If mDNS can't be set up, e.g. UDP port
+	// 5353 is taken, candidates carry addresses. Default is false.
+	MulticastDNS bool
+	// How long the host tries to connect to a guest over ICE, per attempt. Default is 20 seconds.
+	DialTimeout time.Duration
+	// How many more attempts the host makes to connect to a guest before kicking it with KickConnectionFailed,
+	// e.g. to ride out a burst of packet loss. Each retry restarts ICE with the guest, which must answer it,
+	// see GuestClient.OnIceRestart. Default is 0, no retries.
+	DialRetries int
+	// How long the host waits before the first retry, doubled before each next one. Default is 1 second.
+	DialRetryBackoff time.Duration
+	// HostClient.Listen returns an error wrapping ErrConnectionLost when the connection to the server drops,
+	// instead of dialing it again and resuming the room, e.g. for applications that reconnect themselves.
+	// Rooms can only be resumed if the server has a ServerOptions.HostGracePeriod. Default is false.
+	DisableReconnect bool
+	// Level each of pion's log levels is logged at on the client's logger, e.g. {logging.LogLevelInfo: slog.LevelInfo}
+	// to see which connectivity checks failed. Levels it doesn't have are logged as by default: trace is dropped,
+	// debug and info are logged at slog.LevelDebug, and warn and error at their own level.
+	ICELogLevels map[logging.LogLevel]slog.Level
+	// Creates the loggers of the ICE agents instead, e.g. logging.NewDefaultLoggerFactory() to log like pion does.
+	// ICELogLevels is then ignored. Default is nil.
+	ICELoggerFactory logging.LoggerFactory
+	// Applied to the ICE agents after the client's own options, so they can override them, e.g.
+	// ice.WithCheckInterval, ice.WithKeepaliveInterval or ice.WithHostAcceptanceMinWait.
+	// Guests' agents get them from GuestClient.NewAgent. Default is none.
+	AgentOptions []ice.AgentOption
+}
+
+// A TURN server for ClientOptions.TURNServers.
+type TURNServer struct {
+	// e.g. "turn:turn.example.com:3478?transport=udp" or "turns:turn.example.com:5349".
+	URL        string
+	Username   string
+	Credential string
+}
+
+// Returns a copy of o with zero values replaced by the defaults.
+func (o ClientOptions) withDefaults() ClientOptions {
+	if o.ReadLimit == 0 {
+		o.ReadLimit = 16384
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 20 * time.Second
+	}
+	if o.DialRetryBackoff == 0 {
+		o.DialRetryBackoff = time.Second
+	}
+	return o
+}
+
+// Returns the options for websocket.Dial, with o's compression settings.
+//
+// The client asks for SubprotocolMsgpackV2 unless o.Dial sets subprotocols.
+func (o ClientOptions) dialOptions() *websocket.DialOptions {
+	opts := o.Dial
+	if len(opts.Subprotocols) == 0 {
+		opts.Subprotocols = []string{SubprotocolMsgpackV2}
+	}
+	if o.CompressionMode != websocket.CompressionDisabled {
+		opts.CompressionMode = o.CompressionMode
+	}
+	if o.CompressionThreshold != 0 {
+		opts.CompressionThreshold = o.CompressionThreshold
+	}
+	return &opts
 }
 
 // WebsocketScheme is the websocket scheme (ws:// or wss://)
@@ -34,152 +339,1503 @@ type WebsocketScheme string
 
 const (
 	// Websocket (non-secure)
-	SchemeWs WebsocketScheme = "ws://"
+	SchemeWs WebsocketScheme = "ws"
 	// Websocket secure
-	SchemeWss WebsocketScheme = "wss://"
+	SchemeWss WebsocketScheme = "wss"
 )
+
 // host is the url address of the signaling server.
-// 
+//
+// guests must provide password to join the room. An empty password lets anyone join.
+//
+// region, e.g. "eu-west", overrides the server's region for the room. An empty region uses the server's.
+//
+// Returns an *HTTPError if the server turns the host away, which errors.Is matches against
+// e.g. ErrServerUnavailable if it is at capacity, or ErrRoomIdTaken if another room has opts.RoomId.
+// Its RetryAfter says when to try again.
+//
+// Returns an error instead of dialing guests if the UDP socket for ICE can't be bound,
+// e.g. because the OS is out of sockets or UDP is not allowed.
+//
+// ctx bounds the dial to the server, e.g. a context with a timeout. It is not used after NewSignalingClientHost returns.
+//
 // a nil log will use slog.Default().
-func NewSignalingClientHost(host string, sceme WebsocketScheme, log *slog.Logger, opts websocket.DialOptions) (*signalingClientHost, error) {
+func NewSignalingClientHost(ctx context.Context, host string, sceme WebsocketScheme, password string, region string, log *slog.Logger, opts ClientOptions) (*HostClient, error) {
 	if log == nil {
 		log = slog.Default()
 	}
+	opts = opts.withDefaults()
+	networks, err := opts.networkTypes()
+	if err != nil {
+		return nil, err
+	}
+	stunURLs, err := parseSTUNServers(opts.STUNServers)
+	if err != nil {
+		return nil, err
+	}
+	turnURLs, err := parseTURNServers(opts.TURNServers)
+	if err != nil {
+		return nil, err
+	}
+	if opts.RelayOnly && len(turnURLs) == 0 && opts.TURNCredentials == nil {
+		return nil, errors.New("RelayOnly needs TURNServers or TURNCredentials")
+	}
 
+	// per write timeout of the connection.
 	const timeout = time.Second * 5
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
 	u := url.URL{
 		Host:   host,
 		Scheme: string(sceme),
 		Path:   "host",
 	}
-	hConn, _, err := websocket.Dial(ctx, u.String(), &opts)
+	// Listen sends heartbeats, so the server can tell a stuck host from a quiet one.
+	q := url.Values{"v": {strconv.Itoa(qp2p.ProtocolVersion)}, "heartbeat": {"true"}}
+	if password != "" {
+		q.Set("password", password)
+	}
+	if region != "" {
+		q.Set("region", region)
+	}
+	if opts.RoomId != "" {
+		q.Set("roomId", string(opts.RoomId))
+	}
+	u.RawQuery = q.Encode()
+	ws, resp, err := websocket.Dial(ctx, u.String(), opts.dialOptions())
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial %v %v", u.String(), err)
+		return nil, dialError(u, resp, err)
 	}
+	ws.SetReadLimit(opts.ReadLimit)
 
-	pconn, err := net.ListenPacket("udp4", "0.0.0.0:")
+	// the UDP socket ICE connections to guests share.
+	mux, ownsMux, err := opts.udpMux()
 	if err != nil {
-		panic(err)
-	}
-	return &signalingClientHost{
-		opts:   opts,
-		guests: hashtriemap.HashTrieMap[qp2p.GuestID, iceConn]{},
-		log:    log,
-		mux:    ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: pconn}),
-		hConn:  hConn,
-	}, nil
+		// the room would have no way to reach guests.
+		ws.CloseNow()
+		return nil, err
+	}
+	clientCtx, cancel := context.WithCancel(context.Background())
+	s := &HostClient{
+		opts:     opts,
+		guests:   hashtriemap.HashTrieMap[qp2p.GuestID, PeerConn]{},
+		log:      log,
+		mux:      mux,
+		ownsMux:  ownsMux,
+		networks: udpNetworkTypes(mux, networks),
+		stunURLs: stunURLs,
+		turnURLs: turnURLs,
+		ctx:      clientCtx,
+		cancel:   cancel,
+		host:     host,
+		sceme:    sceme,
+		created:  make(chan Msg, 1),
+		sealer:   roomSealer{secret: opts.RoomSecret},
+	}
+	s.hConn.Store(newHostConn(context.Background(), ws, clientWriteQueueDepth, timeout, nil, nil))
+	return s, nil
+}
+
+// A guest the host was told about in GuestJoined.
+type JoinedGuest struct {
+	Id qp2p.GuestID
+	// The room the guest joined, see CreateRoom.
+	RoomId qp2p.RoomId
+	// RoleSpectator if the guest joined with NewSignalingClientSpectator,
+	// so spectators can be sent a one-way stream.
+	Role Role
+	// Sent by the guest when joining, e.g. player name, avatar hash or client build.
+	Metadata []byte
+}
+
+// A guest of the host, see HostClient.Guests.
+type GuestInfo struct {
+	JoinedGuest
+	// When the connection to the guest opened. Zero while it is dialed.
+	ConnectedAt time.Time
+	State       PeerState
+}
+
+// Whether the host's connection to a guest is open, see GuestInfo.
+type PeerState uint8
+
+const (
+	// The host is dialing the guest.
+	PeerDialing PeerState = iota
+	// The connection to the guest is open, and was passed to Listen's onConnection.
+	PeerConnected
+)
+
+func (p PeerState) String() string {
+	if p == PeerConnected {
+		return "connected"
+	}
+	return "dialing"
 }
 
 // Listen blocks the thread
-func (s *signalingClientHost) Listen(onConnection func(qp2p.GuestID, iceConn)) {
-	const timeout = time.Second * 5
-	defer s.hConn.Close(websocket.StatusGoingAway, "disconnecting")
+//
+// onConnection is called with the guest's role and metadata once the connection to it is open.
+//
+// Returns ErrRoomExpired if the server closed the room for its age or for being idle,
+// ErrHostUnresponsive if it missed the heartbeats Listen sends, and nil once the server acknowledges CloseRoom.
+// Rooms created with CreateRoom closing don't stop Listen, see OnRoomClosed.
+//
+// Other close statuses the server sends are returned as their matching error, e.g. ErrReplaced,
+// and a connection closed without one, or broken, as an error wrapping ErrConnectionLost.
+// Unless ClientOptions.DisableReconnect is set, a broken connection is first dialed again to resume the room,
+// and ErrConnectionLost is only returned if the server won't, see ReconnectingEvent.
+// Messages that can't be decoded are logged and dropped.
+//
+// Cancelling ctx closes the client like Close, and Listen returns ctx.Err() once it is closed.
+// Listen returns nil if Close is called.
+func (s *HostClient) Listen(ctx context.Context, onConnection func(JoinedGuest, PeerConn)) error {
+	defer func() { s.hConn.Load().Close(websocket.StatusGoingAway, "disconnecting") }()
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+	// heartbeats stop with Listen, so the server closes the room if the application stops listening.
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	// candidates for guests whose GuestJoined hasn't been handled yet.
+	var early earlyCandidates
 	for {
-		// Read message
-		msg, err := ReadMsg(s.hConn, timeout)
+		// Read message. A quiet room is not a dead one, so there is no deadline: closing the
+		// connection cancels the read, and a broken one fails the heartbeat writes, which closes it.
+		hConn := s.hConn.Load()
+		msg, err := s.seqs.readMsg(hConn.ctx, hConn.Conn, s.log)
 		if err != nil {
-			// unmarshalling error
-			if !errors.Is(err, context.DeadlineExceeded) {
-				s.log.Error("Failed to unmarshal message", "error", err)
+			switch {
+			case ctx.Err() != nil:
+				s.Close()
+				return ctx.Err()
+			case s.closed.Load():
+				s.Close()
+				return nil
+			case errors.Is(err, ErrInvalidMessage) && websocket.CloseStatus(err) == -1:
+				s.log.Debug("Invalid message from server dropped", "error", err)
 				continue
+			case errors.Is(err, ErrMessageTooLarge):
+				s.log.Error("Message from server too large, disconnected", "error", err)
+				return err
+			case closeError(err) != nil:
+				return err
 			}
-			s.log.Error("Read timed out. Server offline.", "error", err)
-			return
+			// without a resume token the server closed the room with the connection.
+			if s.opts.DisableReconnect || s.resumeToken == "" {
+				s.log.Error("Connection to server lost", "error", err)
+				return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+			}
+			if err := s.reconnect(ctx, err); err != nil {
+				switch {
+				case ctx.Err() != nil:
+					s.Close()
+					return ctx.Err()
+				case s.closed.Load():
+					return nil
+				}
+				return err
+			}
+			continue
 		}
 		switch msg.Type {
+		case RoomCreated:
+			// the first RoomCreated is for the connection's own room, later ones answer CreateRoom.
+			if !s.roomId.CompareAndSwap(nil, &msg.RoomId) {
+				s.answerCreateRoom(msg)
+				continue
+			}
+			s.region.Store(&msg.Region)
+			s.resumeToken = msg.ResumeToken
+			if msg.HeartbeatInterval > 0 {
+				go s.sendHeartbeats(msg.HeartbeatInterval, stopHeartbeat)
+			}
+		case CreateRoom:
+			s.answerCreateRoom(msg)
 		case GuestJoined:
+			joined := PayloadOf(msg).(GuestJoinedMsg)
+			s.emit(GuestConnectingEvent{GuestId: joined.GuestId, RoomId: cmp.Or(joined.RoomId, s.RoomId())})
+			// before anything can fail, so the guest is kicked from its own room.
+			if s.isOtherRoom(joined.RoomId) {
+				s.guestRooms.Store(joined.GuestId, joined.RoomId)
+			}
+			// the guest sealed GuestAuth before it knew its GuestID.
+			remoteUfrag, remotePwd, err := s.sealer.openCredentials(qp2p.GuestID{}, sealedByGuest, joined.Ufrag, joined.Pwd)
+			if err != nil {
+				s.log.Error("Failed to open guest credentials", "guest", joined.GuestId, "error", err)
+				early.take(joined.GuestId)
+				s.rejectGuest(joined.GuestId, nil, "Room secret mismatch", err)
+				continue
+			}
 			// Guest has joined. Send Local credentials.
 			// ice agent is used to get ice local credentials.
-			agent, err := ice.NewAgentWithOptions(
-				ice.WithUDPMux(s.mux),
-				ice.WithNetworkTypes([]ice.NetworkType{ice.NetworkTypeUDP4}),
-			)
+			agent, err := s.newAgent()
 			if err != nil {
-				s.log.Error("Failed to create ice agent", "error", err)
-				return
+				s.log.Error("Failed to create ice agent", "guest", joined.GuestId, "error", err)
+				early.take(joined.GuestId)
+				s.rejectGuest(joined.GuestId, nil, "Connection failed", err)
+				continue
 			}
-			// set recieved remote credentials
-			err = agent.SetRemoteCredentials(msg.Ufrag, msg.Pwd)
+			// set received remote credentials
+			err = agent.SetRemoteCredentials(remoteUfrag, remotePwd)
 			if err != nil {
-				s.log.Error("Failed to set remote credentials", "error", err)
-				return
+				s.log.Error("Failed to set remote credentials", "guest", joined.GuestId, "error", err)
+				early.take(joined.GuestId)
+				s.rejectGuest(joined.GuestId, agent, "Connection failed", err)
+				continue
 			}
 			// generate local credentials.
 			localUfrag, localPwd, err := agent.GetLocalUserCredentials()
+			if err == nil {
+				// send local credentials to guest
+				localUfrag, localPwd, err = s.sealer.sealCredentials(joined.GuestId, sealedByHost, localUfrag, localPwd)
+			}
 			if err != nil {
-				s.log.Error("Failed to get local user credentials", "error", err)
+				s.log.Error("Failed to get local credentials", "guest", joined.GuestId, "error", err)
+				early.take(joined.GuestId)
+				s.rejectGuest(joined.GuestId, agent, "Connection failed", err)
+				continue
 			}
 			// send candidates to remote
-			err = agent.OnCandidate(s.OnCandidate(msg.GuestId))
+			err = agent.OnCandidate(s.OnCandidate(joined.GuestId))
 			if err != nil {
-				panic(err)
+				s.log.Error("Failed to set candidate handler", "guest", joined.GuestId, "error", err)
+				early.take(joined.GuestId)
+				s.rejectGuest(joined.GuestId, agent, "Connection failed", err)
+				continue
+			}
+			// queued before gathering starts, so no candidate reaches the server ahead of it.
+			if err := MsgHostAuth(s.ctx, s.conn(joined.GuestId), joined.GuestId, localUfrag, localPwd); err != nil {
+				s.log.Error("Failed to send host auth", "guest", joined.GuestId, "error", err)
 			}
-			// send local credentials to guest
-			go MsgHostAuth(s.hConn, timeout, msg.GuestId, localUfrag, localPwd)
 			err = agent.GatherCandidates()
 			if err != nil {
-				s.log.Error("failed to gather ice candidates", "erorr", err)
+				s.log.Error("Failed to gather ice candidates", "guest", joined.GuestId, "error", err)
 			}
 			// store guest connection
-			s.guests.Store(msg.GuestId, iceConn{Agent: agent})
+			guest := JoinedGuest{Id: joined.GuestId, RoomId: cmp.Or(joined.RoomId, s.RoomId()), Role: joined.Role, Metadata: joined.Metadata}
+			dialing := PeerConn{agent: agent, state: newPeerState(guest)}
+			s.guests.Store(joined.GuestId, dialing)
+			agent.OnSelectedCandidatePairChange(func(_, _ ice.Candidate) { dialing.state.selected() })
+			// a connection that fails once open is only noticed by the agent.
+			agent.OnConnectionStateChange(func(state ice.ConnectionState) {
+				if state == ice.ConnectionStateFailed {
+					s.connectionLost(joined.GuestId, agent)
+				}
+			})
+			s.addRemoteCandidates(joined.GuestId, agent, early.take(joined.GuestId))
 			// dial concurrently
 			go func() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+				// dialing stops if the connection to the server closes, or the agent is closed.
+				ctx, cancel := context.WithCancel(s.ctx)
 				defer cancel()
+				go s.dialAttempts(ctx, cancel, joined.GuestId, agent)
 
-				conn, err := agent.Dial(ctx, msg.Ufrag, msg.Pwd)
-				// dial failed. Kick guest from signaling server.
+				conn, err := agent.Dial(ctx, remoteUfrag, remotePwd)
+				// every attempt failed. Kick guest from signaling server.
 				if err != nil {
 					s.log.Error("failed to open conn", "error", err)
-					MsgKickGuest(s.hConn, timeout, msg.GuestId, "Connection failed")
-					s.guests.Delete(msg.GuestId)
+					s.emit(GuestConnectFailedEvent{GuestId: joined.GuestId, Err: err})
+					dialing.close()
+					// the guest left, or was kicked, while it was dialed.
+					if !s.guests.CompareAndDelete(joined.GuestId, dialing) {
+						return
+					}
+					MsgKickGuestCode(s.ctx, s.conn(joined.GuestId), joined.GuestId, KickConnectionFailed, "Connection failed")
+					s.guestRooms.Delete(joined.GuestId)
 					return
 				}
-				iceConnection := iceConn{conn, agent}
-				s.guests.Store(msg.GuestId, iceConnection)
-				onConnection(msg.GuestId, iceConnection)
+				iceConnection := dialing
+				iceConnection.conn = conn
+				dialing.state.connected()
+				s.guests.Store(joined.GuestId, iceConnection)
+				s.emit(GuestConnectedEvent{GuestId: joined.GuestId, Conn: iceConnection})
+				onConnection(guest, iceConnection)
 			}()
 		case IceCandidate:
+			// a single Candidate, or a batch in Candidates.
+			raws := append([]string{msg.Candidate}, msg.Candidates...)
 			iconn, ok := s.guests.Load(msg.GuestId)
 			if !ok {
-				s.log.Debug("invalid guest id for ice candidate", "id", msg.GuestId)
+				// e.g. it overtook the guest's GuestJoined, kept until that is handled.
+				s.log.Debug("ice candidate for unknown guest kept", "id", msg.GuestId)
+				early.add(msg.GuestId, raws)
 				continue
 			}
-			cand, err := ice.UnmarshalCandidate(msg.Candidate)
-			if err != nil {
-				s.log.Error("failed to unmarshall ice candidate", "error", err)
+			s.addRemoteCandidates(msg.GuestId, iconn.agent, raws)
+		case EndOfCandidates:
+			if shorten, ok := s.endOfCandidates.Load(msg.GuestId); ok {
+				shorten()
+			}
+		case IceRestart:
+			restart := PayloadOf(msg).(IceRestartMsg)
+			iconn, ok := s.guests.Load(restart.GuestId)
+			if !ok {
+				s.log.Debug("invalid guest id for ice restart", "id", restart.GuestId)
 				continue
 			}
-			err = iconn.AddRemoteCandidate(cand)
+			remoteUfrag, remotePwd, err := s.sealer.openCredentials(restart.GuestId, sealedByGuest, restart.Ufrag, restart.Pwd)
 			if err != nil {
-				s.log.Error("failed to add remote candidate", "error", err)
+				s.log.Error("Failed to open guest credentials", "guest", restart.GuestId, "error", err)
+				continue
+			}
+			// the guest answered the host's restart, or both started one at once. Otherwise it is the guest's, answer it.
+			if _, answer := s.restarting.LoadAndDelete(restart.GuestId); !answer {
+				if err := s.restartICE(restart.GuestId, iconn.agent); err != nil {
+					s.log.Error("Failed to restart ice agent", "guest", restart.GuestId, "error", err)
+					continue
+				}
+			}
+			// restarting clears the remote credentials, so they are set after.
+			if err := iconn.agent.SetRemoteCredentials(remoteUfrag, remotePwd); err != nil {
+				s.log.Error("Failed to set remote credentials", "error", err)
 			}
 		case GuestDisconnected:
-			iceConnection, existed := s.guests.LoadAndDelete(msg.GuestId)
+			left := PayloadOf(msg).(GuestDisconnectedMsg)
+			s.emit(GuestDisconnectedEvent{GuestId: left.GuestId, Reason: left.Reason})
+			early.take(left.GuestId)
+			iceConnection, existed := s.guests.LoadAndDelete(left.GuestId)
+			s.restarting.Delete(left.GuestId)
+			s.guestRooms.Delete(left.GuestId)
 			if !existed {
 				continue
 			}
-			if iceConnection.Conn != nil {
-				iceConnection.Conn.Close()
+			iceConnection.close()
+			if s.onGuestDisconnected != nil {
+				s.onGuestDisconnected(left.GuestId, left.Reason)
+			}
+		case Relay:
+			if s.onRelay != nil {
+				s.onRelay(msg.GuestId, msg.Payload)
+			}
+		case RoomExpired:
+			if s.isOtherRoom(msg.RoomId) {
+				s.roomClosed(msg.RoomId, msg.Reason)
+				continue
+			}
+			s.log.Info("Room expired", "reason", msg.Reason)
+			return ErrRoomExpired
+		case CloseRoom:
+			if s.isOtherRoom(msg.RoomId) {
+				s.roomClosed(msg.RoomId, msg.Reason)
+				continue
+			}
+			// the server acknowledged CloseRoom.
+			s.log.Info("Room closed")
+			return nil
+		case RoomStatus:
+			state := RoomState{RoomId: msg.RoomId, Guests: msg.GuestCount, MaxGuests: msg.MaxGuests, Locked: msg.Locked}
+			if !s.isOtherRoom(msg.RoomId) {
+				state.RoomId = s.RoomId()
+				s.status.Store(&state)
+				s.locked.Store(msg.Locked)
+			}
+			if s.onRoomStatus != nil {
+				s.onRoomStatus(state)
+			}
+		case CreateInvites:
+			if s.onInvites != nil {
+				s.onInvites(msg.Invites)
+			}
+		case QueuedGuests:
+			if s.onQueuedGuests != nil {
+				s.onQueuedGuests(msg.Queued)
+			}
+		case Error:
+			s.log.Debug("Error from server", "code", msg.Code, "detail", msg.Detail, "guest", msg.GuestId)
+			if s.onServerError != nil {
+				s.onServerError(serverError(msg))
+			}
+		case Pong:
+			s.pongs.deliver(msg)
+		default:
+			if !msg.Type.Valid() {
+				s.log.Debug("Message of unknown type dropped", "type", int(msg.Type))
 			}
 		}
 	}
 }
 
-func (s *signalingClientHost) SendIceCandidate(candidate string)
-func (s *signalingClientHost) OnCandidate(guestId qp2p.GuestID) func(c ice.Candidate) {
+// Reports whether roomId is a room created with CreateRoom, rather than the connection's own room.
+func (s *HostClient) isOtherRoom(roomId qp2p.RoomId) bool {
+	own := s.roomId.Load()
+	return roomId != "" && own != nil && roomId != *own
+}
+
+// Returns the connection to send guestId's messages on, tagged with its room if it was created with CreateRoom.
+func (s *HostClient) conn(guestId qp2p.GuestID) *HostConn {
+	if roomId, ok := s.guestRooms.Load(guestId); ok {
+		return s.hConn.Load().forRoom(roomId)
+	}
+	return s.hConn.Load()
+}
+
+// Passes the answer to CreateRoom on, if it is still waiting.
+func (s *HostClient) answerCreateRoom(msg Msg) {
+	select {
+	case s.created <- msg:
+	default:
+		s.log.Debug("Unexpected answer to CreateRoom", "type", msg.Type, "room", msg.RoomId)
+	}
+}
+
+// Closes the ICE agents of roomId's guests, and calls the function set with OnRoomClosed.
+func (s *HostClient) roomClosed(roomId qp2p.RoomId, reason string) {
+	s.log.Info("Room closed", "room", roomId, "reason", reason)
+	s.closeGuests(roomId)
+	if s.onRoomClosed != nil {
+		s.onRoomClosed(roomId, reason)
+	}
+}
+
+// Closes the ICE agents of the guests in roomId, a room created with CreateRoom.
+func (s *HostClient) closeGuests(roomId qp2p.RoomId) {
+	for guestId, id := range s.guestRooms.All() {
+		if id != roomId {
+			continue
+		}
+		s.guestRooms.Delete(guestId)
+		if iconn, ok := s.guests.LoadAndDelete(guestId); ok {
+			iconn.close()
+		}
+		s.emit(GuestDisconnectedEvent{GuestId: guestId, Reason: ReasonRoomClosed})
+	}
+}
+
+// Drops guestId once its open ICE connection on agent failed, and kicks it so the server lets it go.
+func (s *HostClient) connectionLost(guestId qp2p.GuestID, agent *ice.Agent) {
+	iconn, ok := s.guests.Load(guestId)
+	// still dialing, which reports its own failure, or already gone.
+	if !ok || iconn.agent != agent || iconn.conn == nil || !s.guests.CompareAndDelete(guestId, iconn) {
+		return
+	}
+	s.log.Info("Connection to guest lost", "guest", guestId)
+	iconn.close()
+	s.restarting.Delete(guestId)
+	s.emit(GuestDisconnectedEvent{GuestId: guestId, Reason: ReasonConnectionLost})
+	MsgKickGuestCode(s.ctx, s.conn(guestId), guestId, KickConnectionFailed, "Connection lost")
+	s.guestRooms.Delete(guestId)
+}
+
+// Calls the function set with OnEvent with ev, if it follows the events already sent for its guest.
+func (s *HostClient) emit(ev HostEvent) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if s.guestStates == nil {
+		s.guestStates = make(map[qp2p.GuestID]guestState)
+	}
+	guestId := ev.guestId()
+	state := s.guestStates[guestId]
+	switch ev.(type) {
+	case GuestConnectingEvent:
+		if state != guestNone {
+			return
+		}
+		s.guestStates[guestId] = guestConnecting
+	case GuestConnectedEvent:
+		if state != guestConnecting {
+			return
+		}
+		s.guestStates[guestId] = guestConnected
+	case GuestConnectFailedEvent:
+		if state != guestConnecting {
+			return
+		}
+		s.guestStates[guestId] = guestFailed
+	case GuestDisconnectedEvent:
+		if state == guestNone {
+			return
+		}
+		delete(s.guestStates, guestId)
+	}
+	if s.onEvent != nil {
+		s.onEvent(ev)
+	}
+}
+
+// The last event sent for a guest, see HostEvent.
+type guestState uint8
+
+const (
+	guestNone guestState = iota
+	guestConnecting
+	guestConnected
+	guestFailed
+)
+
+// Closes the connection to the signaling server, which closes the host's rooms, and the connections
+// to all guests, cancelling the dials still in progress. Listen returns nil once it is closed.
+//
+// Blocks until the connection is closed. Safe to call more than once.
+func (s *HostClient) Close() error {
+	s.closed.Store(true)
+	s.closeOnce.Do(func() {
+		s.cancel()
+		err := s.hConn.Load().Close(websocket.StatusGoingAway, "disconnecting")
+		if errors.Is(err, errConnClosed) {
+			err = nil
+		}
+		for guestId, iconn := range s.guests.All() {
+			s.guests.Delete(guestId)
+			iconn.close()
+			s.emit(GuestDisconnectedEvent{GuestId: guestId, Reason: ReasonRoomClosed})
+		}
+		if s.ownsMux {
+			err = errors.Join(err, s.mux.Close())
+		}
+		s.closeErr = err
+	})
+	return s.closeErr
+}
+
+// Closes the connection to the guest, if it was dialed, and its agent, freeing the agent's goroutines.
+// Only the first call does anything. Stats keeps returning the stats from just before.
+func (c PeerConn) close() {
+	c.state.closeOnce.Do(func() {
+		c.state.closed(c)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.agent.Close()
+	})
+}
+
+// Sends Heartbeat every interval until stop is closed.
+func (s *HostClient) sendHeartbeats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// while Listen reconnects this fails, and the next one goes on the resumed connection.
+			if err := MsgHeartbeat(s.ctx, s.hConn.Load()); err != nil {
+				s.log.Debug("Failed to send heartbeat", "error", err)
+			}
+		}
+	}
+}
+
+// Checks whether roomId exists with GET /room/{roomId}, without joining it.
+//
+// host is the url address of the signaling server.
+//
+// Returns an *HTTPError matching ErrRoomNotFound if the room does not exist,
+// and ErrRateLimited if the server turned the request away. Only public rooms report
+// more than RoomCheck.Exists.
+func CheckRoom(host string, sceme WebsocketScheme, roomId qp2p.RoomId) (RoomCheck, error) {
+	const timeout = time.Second * 5
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	u := url.URL{
+		Host:   host,
+		Scheme: "http",
+		Path:   "room/" + string(roomId),
+	}
+	if sceme == SchemeWss {
+		u.Scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return RoomCheck{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return RoomCheck{}, fmt.Errorf("failed to check room %v %v", u.String(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// errors.Is matches ErrRoomNotFound for 404, and ErrRateLimited for 429.
+		return RoomCheck{}, responseError(resp)
+	}
+	var check RoomCheck
+	if err := json.NewDecoder(resp.Body).Decode(&check); err != nil {
+		return RoomCheck{}, err
+	}
+	return check, nil
+}
+
+// Returns the error for a failed websocket.Dial of u.
+//
+// If the server responded before upgrading, e.g. 404 for a room that does not exist,
+// it is the *HTTPError in the response, which errors.Is matches against e.g. ErrRoomNotFound.
+func dialError(u url.URL, resp *http.Response, err error) error {
+	if resp != nil && resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+	return fmt.Errorf("failed to dial %v %v", u.String(), err)
+}
+
+// host is the url address of the signaling server.
+//
+// password is the room password set by the host, or empty.
+//
+// metadata introduces the guest to the host, e.g. player name, avatar hash or client build, and can be nil.
+// Returns ErrMetadataTooLong without dialing if it is longer than MaxGuestMetadataLen.
+//
+// Returns an *HTTPError if the server turns the guest away, which errors.Is matches against
+// ErrRoomNotFound if the room does not exist, ErrRoomLocked if the host locked it,
+// and ErrUnsupportedVersion if the server does not support qp2p.ProtocolVersion.
+//
+// a nil log will use slog.Default().
+func NewSignalingClientGuest(host string, sceme WebsocketScheme, roomId qp2p.RoomId, password string, metadata []byte, log *slog.Logger, opts ClientOptions) (*GuestClient, error) {
+	return newSignalingClientGuest(host, sceme, "join/"+string(roomId), password, metadata, RolePlayer, log, opts)
+}
+
+// Joins the room as a spectator, see NewSignalingClientGuest.
+//
+// The host is told the guest is a spectator, and spectators do not take a player slot.
+// Returns ErrRoomFull if the room has the server's maximum number of spectators.
+func NewSignalingClientSpectator(host string, sceme WebsocketScheme, roomId qp2p.RoomId, password string, metadata []byte, log *slog.Logger, opts ClientOptions) (*GuestClient, error) {
+	return newSignalingClientGuest(host, sceme, "spectate/"+string(roomId), password, metadata, RoleSpectator, log, opts)
+}
+
+// Joins the room with a one-time invite token from the host's CreateInvites, see NewSignalingClientGuest.
+//
+// No room password is needed. Returns ErrInviteNotFound if the server does not know the token,
+// and ErrInviteExpired if it was already used or has expired.
+func NewSignalingClientGuestInvite(host string, sceme WebsocketScheme, token string, metadata []byte, log *slog.Logger, opts ClientOptions) (*GuestClient, error) {
+	return newSignalingClientGuest(host, sceme, "join/token/"+url.PathEscape(token), "", metadata, RolePlayer, log, opts)
+}
+
+// Dials the signaling server at path, e.g. "join/{roomId}".
+func newSignalingClientGuest(host string, sceme WebsocketScheme, path string, password string, metadata []byte, role Role, log *slog.Logger, opts ClientOptions) (*GuestClient, error) {
+	if len(metadata) > MaxGuestMetadataLen {
+		return nil, ErrMetadataTooLong
+	}
+	if log == nil {
+		log = slog.Default()
+	}
+	opts = opts.withDefaults()
+
+	const timeout = time.Second * 5
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	u := url.URL{
+		Host:   host,
+		Scheme: string(sceme),
+		Path:   path,
+	}
+	q := url.Values{"v": {strconv.Itoa(qp2p.ProtocolVersion)}}
+	if password != "" {
+		q.Set("password", password)
+	}
+	if opts.Queue {
+		q.Set("queue", "true")
+	}
+	u.RawQuery = q.Encode()
+	ws, resp, err := websocket.Dial(ctx, u.String(), opts.dialOptions())
+	if err != nil {
+		return nil, dialError(u, resp, err)
+	}
+	ws.SetReadLimit(opts.ReadLimit)
+	return &GuestClient{
+		opts:     opts,
+		log:      log,
+		gConn:    newGuestConn(context.Background(), ws, clientWriteQueueDepth, timeout, nil, nil),
+		role:     role,
+		metadata: metadata,
+		joined:   make(chan struct{}),
+		done:     make(chan struct{}),
+		sealer:   roomSealer{secret: opts.RoomSecret},
+	}, nil
+}
+
+// Reports whether the guest joined as a player or a spectator.
+func (s *GuestClient) Role() Role {
+	return s.role
+}
+
+// Returns the room's region, once the server has sent RoomCreated.
+//
+// Empty if neither the server nor the host set one.
+func (s *HostClient) Region() string {
+	if region := s.region.Load(); region != nil {
+		return *region
+	}
+	return ""
+}
+
+// Returns the room's region, once the server has sent RoomInfo.
+func (s *GuestClient) Region() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.region
+}
+
+// Sets the function called with each guest's HostEvents, e.g. to show "connecting…" while the host dials it.
+//
+// Events are passed one at a time, in the order HostEvent describes, from Listen's goroutine or the
+// goroutine dialing the guest, so fn should return quickly.
+//
+// Must be called before Listen.
+func (s *HostClient) OnEvent(fn func(HostEvent)) {
+	s.onEvent = fn
+}
+
+// Sets the function called when a guest disconnects from the room.
+//
+// reason is the guest's own if it left with Leave, e.g. "quit to menu",
+// otherwise it is set by the server, one of the Reason constants like ReasonTimeout,
+// or e.g. "kicked by host".
+//
+// Must be called before Listen.
+func (s *HostClient) SetOnGuestDisconnected(fn func(guestId qp2p.GuestID, reason string)) {
+	s.onGuestDisconnected = fn
+}
+
+// Sends payload to the guest through the signaling server.
+//
+// Useful for lobby messages while the P2P connection is being set up.
+func (s *HostClient) SendRelay(guestId qp2p.GuestID, payload []byte) error {
+	return MsgRelay(s.ctx, s.conn(guestId), guestId, payload)
+}
+
+// Returns the guests the host has an open connection to, in no particular order,
+// and the ones it is still dialing if includeDialing is set.
+//
+// Safe to call concurrently with Listen. The slice is a snapshot, and a guest in it may have left since.
+func (s *HostClient) Guests(includeDialing bool) []GuestInfo {
+	var guests []GuestInfo
+	for _, iconn := range s.guests.All() {
+		if iconn.conn == nil && !includeDialing {
+			continue
+		}
+		guests = append(guests, iconn.state.info())
+	}
+	return guests
+}
+
+// Returns the open connection to guestId, the one passed to Listen's onConnection,
+// or false if the guest is still being dialed or is not connected.
+//
+// Safe to call concurrently with Listen.
+func (s *HostClient) Guest(guestId qp2p.GuestID) (PeerConn, bool) {
+	iconn, ok := s.guests.Load(guestId)
+	if !ok || iconn.conn == nil {
+		return PeerConn{}, false
+	}
+	return iconn, true
+}
+
+// Returns how many guests the host has an open connection to.
+//
+// Safe to call concurrently with Listen.
+func (s *HostClient) GuestCount() int {
+	n := 0
+	for _, iconn := range s.guests.All() {
+		if iconn.conn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Kicks the guest from the room with reason, and closes the connection to it, or stops dialing it.
+//
+// The guest is dropped right away: OnEvent's function is passed a GuestDisconnectedEvent with ReasonKickedByHost,
+// and the function set with SetOnGuestDisconnected is called with it, from the calling goroutine.
+// Returns ErrGuestNotConnected if the host has no agent for guestId, e.g. because it already left.
+func (s *HostClient) Kick(guestId qp2p.GuestID, reason string) error {
+	return s.eject(guestId, reason, false)
+}
+
+// Kicks the guest like Kick, and bans its IP address from rejoining the room until it closes.
+// The guest is sent KickBanned, and the host's notifications have ReasonBannedByHost.
+func (s *HostClient) Ban(guestId qp2p.GuestID, reason string) error {
+	return s.eject(guestId, reason, true)
+}
+
+func (s *HostClient) eject(guestId qp2p.GuestID, reason string, ban bool) error {
+	iconn, ok := s.guests.LoadAndDelete(guestId)
+	if !ok {
+		return ErrGuestNotConnected
+	}
+	var err error
+	left := ReasonKickedByHost
+	if ban {
+		err = MsgBanGuest(s.ctx, s.conn(guestId), guestId, reason)
+		left = ReasonBannedByHost
+	} else {
+		err = MsgKickGuest(s.ctx, s.conn(guestId), guestId, reason)
+	}
+	iconn.close()
+	s.restarting.Delete(guestId)
+	s.guestRooms.Delete(guestId)
+	s.emit(GuestDisconnectedEvent{GuestId: guestId, Reason: left})
+	if s.onGuestDisconnected != nil {
+		s.onGuestDisconnected(guestId, left)
+	}
+	return err
+}
+
+// Closes the room. The server kicks every guest with reason, and Listen returns nil once it acknowledges.
+//
+// The ICE agents of the room's guests are closed.
+func (s *HostClient) CloseRoom(reason string) error {
+	err := MsgCloseRoom(s.ctx, s.hConn.Load(), reason)
+	for guestId, iconn := range s.guests.All() {
+		s.guests.Delete(guestId)
+		iconn.close()
+		s.emit(GuestDisconnectedEvent{GuestId: guestId, Reason: ReasonRoomClosed})
+	}
+	return err
+}
+
+// Opens another room on the host's connection, returning its RoomId. Guests join it like
+// the connection's own room, and JoinedGuest.RoomId tells them apart in Listen's onConnection.
+//
+// The room has the settings of the connection's own room, with password. It can't be resumed,
+// and closes with the connection, or with CloseRoomId. Listen must be running.
+//
+// Returns an error matching ErrServerUnavailable if the server can't open the room,
+// and context.Canceled if the client closes first.
+func (s *HostClient) CreateRoom(password string) (qp2p.RoomId, error) {
+	const timeout = time.Second * 5
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	if err := MsgCreateRoom(ctx, s.hConn.Load(), password); err != nil {
+		return "", err
+	}
+	select {
+	case msg := <-s.created:
+		if msg.Type == CreateRoom {
+			return "", fmt.Errorf("%w: %s", ErrServerUnavailable, msg.Reason)
+		}
+		return msg.RoomId, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Closes roomId, a room created with CreateRoom. The server kicks its guests with reason,
+// and acknowledges by calling the function set with OnRoomClosed.
+//
+// The ICE agents of the room's guests are closed.
+func (s *HostClient) CloseRoomId(roomId qp2p.RoomId, reason string) error {
+	err := MsgCloseRoom(s.ctx, s.hConn.Load().forRoom(roomId), reason)
+	s.closeGuests(roomId)
+	return err
+}
+
+// Sets the function called when a room created with CreateRoom closes,
+// with CloseRoomId, or by the server, e.g. for its age.
+//
+// Must be called before Listen.
+func (s *HostClient) OnRoomClosed(fn func(roomId qp2p.RoomId, reason string)) {
+	s.onRoomClosed = fn
+}
+
+// Returns the RoomId of the connection's own room, from RoomCreated.
+func (s *HostClient) RoomId() qp2p.RoomId {
+	if roomId := s.roomId.Load(); roomId != nil {
+		return *roomId
+	}
+	return ""
+}
+
+// Stops new guests from joining the room. Guests already in the room are not affected.
+func (s *HostClient) LockRoom() error {
+	if err := MsgLockRoom(s.ctx, s.hConn.Load()); err != nil {
+		return err
+	}
+	s.locked.Store(true)
+	return nil
+}
+
+// Lets new guests join the room again after LockRoom.
+func (s *HostClient) UnlockRoom() error {
+	if err := MsgUnlockRoom(s.ctx, s.hConn.Load()); err != nil {
+		return err
+	}
+	s.locked.Store(false)
+	return nil
+}
+
+// Reports whether the room is locked with LockRoom.
+func (s *HostClient) Locked() bool {
+	return s.locked.Load()
+}
+
+// Returns the latest RoomStatus from the server.
+//
+// Returns false if none has been received yet.
+func (s *HostClient) Status() (RoomState, bool) {
+	if state := s.status.Load(); state != nil {
+		return *state, true
+	}
+	return RoomState{}, false
+}
+
+// Sets the function called with each RoomStatus from the server,
+// e.g. to show "3/8 players connected" in a lobby.
+//
+// Must be called before Listen.
+func (s *HostClient) OnRoomStatus(fn func(RoomState)) {
+	s.onRoomStatus = fn
+}
+
+// Asks the server for n one-time invite tokens. They are passed to the function set with OnInvites.
+//
+// Guests join with a token using NewSignalingClientGuestInvite, e.g. from an invite link.
+func (s *HostClient) CreateInvites(n int) error {
+	return MsgCreateInvites(s.ctx, s.hConn.Load(), n)
+}
+
+// Sets the function called with the invite tokens created for CreateInvites.
+// Fewer than asked for are passed if the room has the server's maximum number of invites.
+//
+// Must be called before Listen.
+func (s *HostClient) OnInvites(fn func(tokens []string)) {
+	s.onInvites = fn
+}
+
+// Asks the server for the guests waiting for a slot in the room, in a room created with queueing.
+// They are passed to the function set with OnQueuedGuests.
+func (s *HostClient) QueuedGuests() error {
+	return MsgQueuedGuests(s.ctx, s.hConn.Load())
+}
+
+// Sets the function called with the guests waiting for a slot, in join order, for QueuedGuests.
+//
+// Must be called before Listen.
+func (s *HostClient) OnQueuedGuests(fn func(guestIds []qp2p.GuestID)) {
+	s.onQueuedGuests = fn
+}
+
+// Turns away every guest waiting for a slot in the room. They are closed with reason and ErrRoomFull.
+func (s *HostClient) ClearQueue(reason string) error {
+	return MsgClearQueue(s.ctx, s.hConn.Load(), reason)
+}
+
+// Sets the function called with Relay payloads sent by guests.
+//
+// Must be called before Listen.
+func (s *HostClient) OnRelay(fn func(guestId qp2p.GuestID, payload []byte)) {
+	s.onRelay = fn
+}
+
+// Sets the function called with Error messages from the server, or forwarded from guests.
+// The server sends one right before it closes the connection, and when it drops a message,
+// e.g. a candidate that is too long. Use errors.Is to match known codes, e.g. ErrCandidateRejected.
+//
+// Must be called before Listen.
+func (s *HostClient) OnServerError(fn func(*ServerError)) {
+	s.onServerError = fn
+}
+
+// Sends guestId an Error with a recoverable code, e.g. one from ErrorCodeAppMin to ErrorCodeAppMax.
+func (s *HostClient) SendError(guestId qp2p.GuestID, code int, detail string) error {
+	return MsgError(s.ctx, s.conn(guestId), guestId, code, detail)
+}
+
+// Measures the round trip time to the signaling server with a Ping. Listen must be running.
+//
+// Safe to call concurrently. Returns ctx.Err() if ctx is done before the Pong arrives,
+// e.g. because the server dropped a Ping over its limit of about one per second.
+func (s *HostClient) MeasureRTT(ctx context.Context) (time.Duration, error) {
+	hConn := s.hConn.Load()
+	return s.pongs.measure(ctx, hConn.ctx, hConn)
+}
+
+// Returns how many duplicate messages from the server Listen dropped, see Msg.Seq.
+func (s *HostClient) DuplicatesDropped() uint64 {
+	return s.seqs.dropped.Load()
+}
+
+// Sends guestId a candidate gathered outside its ICE agent, e.g. by an application doing its own gathering.
+// It is sealed like the agent's candidates, see ClientOptions.RoomSecret.
+func (s *HostClient) SendIceCandidate(guestId qp2p.GuestID, candidate string) error {
+	if _, err := ice.UnmarshalCandidate(candidate); err != nil {
+		return fmt.Errorf("invalid candidate: %w", err)
+	}
+	sealed, err := s.sealer.seal(guestId, sealedByHost, "candidate", candidate)
+	if err != nil {
+		return err
+	}
+	return msgIceCandidate(s.ctx, s.conn(guestId), guestId, sealed)
+}
+
+// Restarts ICE with guestId, e.g. after the host's network changed and the connection to the guest
+// stopped getting through. The guest is sent fresh credentials in IceRestart, and answers with its own.
+// Candidates are then gathered and trickled again, and the connection passed to onConnection is kept.
+//
+// Listen must be running. Returns ErrGuestNotConnected if the host has no agent for guestId.
+func (s *HostClient) RestartICE(guestId qp2p.GuestID) error {
+	iconn, ok := s.guests.Load(guestId)
+	if !ok {
+		return ErrGuestNotConnected
+	}
+	s.restarting.Store(guestId, struct{}{})
+	if err := s.restartICE(guestId, iconn.agent); err != nil {
+		s.restarting.Delete(guestId)
+		return err
+	}
+	return nil
+}
+
+// Restarts guestId's agent with fresh local credentials, sends them to the guest, and gathers candidates again.
+func (s *HostClient) restartICE(guestId qp2p.GuestID, agent *ice.Agent) error {
+	if err := agent.Restart("", ""); err != nil {
+		return err
+	}
+	ufrag, pwd, err := agent.GetLocalUserCredentials()
+	if err != nil {
+		return err
+	}
+	ufrag, pwd, err = s.sealer.sealCredentials(guestId, sealedByHost, ufrag, pwd)
+	if err != nil {
+		return err
+	}
+	if err := MsgIceRestart(s.ctx, s.conn(guestId), guestId, ufrag, pwd); err != nil {
+		return err
+	}
+	// the agent's OnCandidate handler trickles them, like after GuestJoined.
+	return agent.GatherCandidates()
+}
+
+// Kicks guestId with KickConnectionFailed and reason after its connection couldn't be set up, closing
+// agent unless it is nil. The host and its other guests are unaffected.
+func (s *HostClient) rejectGuest(guestId qp2p.GuestID, agent *ice.Agent, reason string, err error) {
+	if agent != nil {
+		agent.Close()
+	}
+	s.emit(GuestConnectFailedEvent{GuestId: guestId, Err: err})
+	conn := s.conn(guestId)
+	s.guestRooms.Delete(guestId)
+	// queued inline, so it keeps its place among the host's messages.
+	if err := MsgKickGuestCode(s.ctx, conn, guestId, KickConnectionFailed, reason); err != nil {
+		s.log.Error("Failed to kick guest", "guest", guestId, "error", err)
+	}
+}
+
+// Opens guestId's candidates in raws and adds them to its agent. Empty ones are skipped.
+func (s *HostClient) addRemoteCandidates(guestId qp2p.GuestID, agent *ice.Agent, raws []string) {
+	for _, raw := range raws {
+		if raw == "" {
+			continue
+		}
+		raw, err := s.sealer.open(guestId, sealedByGuest, "candidate", raw)
+		if err != nil {
+			s.log.Error("Failed to open ice candidate", "guest", guestId, "error", err)
+			continue
+		}
+		cand, err := ice.UnmarshalCandidate(raw)
+		if err != nil {
+			s.log.Error("failed to unmarshall ice candidate", "error", err)
+			continue
+		}
+		if s.opts.CandidateFilter != nil && !s.opts.CandidateFilter(cand) {
+			s.log.Debug("Remote ice candidate dropped by CandidateFilter", "guest", guestId, "type", cand.Type())
+			continue
+		}
+		err = agent.AddRemoteCandidate(cand)
+		if err != nil {
+			s.log.Error("failed to add remote candidate", "error", err)
+		}
+	}
+}
+
+// Returns the OnCandidate handler for guestId's ice agent.
+//
+// Candidates gathered within candidateBatchDelay of each other are sent in one message.
+func (s *HostClient) OnCandidate(guestId qp2p.GuestID) func(c ice.Candidate) {
+	var (
+		mu      sync.Mutex
+		pending []string
+		types   []ice.CandidateType
+	)
+	flush := func() {
+		mu.Lock()
+		batch := pending
+		pending = nil
+		mu.Unlock()
+		if len(batch) > 0 {
+			s.sendOnline(func() { msgIceCandidates(s.ctx, s.conn(guestId), guestId, batch) })
+		}
+	}
 	return func(c ice.Candidate) {
-		const timeout = time.Second
+		// gathering is complete.
 		if c == nil {
+			flush()
+			s.sendOnline(func() { msgEndOfCandidates(s.ctx, s.conn(guestId), guestId) })
+			mu.Lock()
+			gathered := types
+			types = nil
+			mu.Unlock()
+			s.gathered(guestId, gathered)
+			return
+		}
+		// types are of the candidates gathered, including those the filter drops.
+		mu.Lock()
+		if !slices.Contains(types, c.Type()) {
+			types = append(types, c.Type())
+		}
+		mu.Unlock()
+		if s.opts.CandidateFilter != nil && !s.opts.CandidateFilter(c) {
+			s.log.Debug("Local ice candidate dropped by CandidateFilter", "guest", guestId, "type", c.Type())
 			return
 		}
-		msgIceCandidate(s.hConn, timeout, guestId, c.Marshal())
+		raw, err := s.sealer.seal(guestId, sealedByHost, "candidate", c.Marshal())
+		if err != nil {
+			s.log.Error("Failed to seal ice candidate", "error", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		pending = append(pending, raw)
+		// the first candidate of a batch starts the timer.
+		if len(pending) == 1 {
+			time.AfterFunc(candidateBatchDelay, flush)
+		}
+	}
+}
+
+// Calls send, or queues it until the room is resumed if Listen is reconnecting to the server.
+func (s *HostClient) sendOnline(send func()) {
+	s.offlineMu.Lock()
+	if s.reconnecting {
+		s.offline = append(s.offline, send)
+		s.offlineMu.Unlock()
+		return
+	}
+	s.offlineMu.Unlock()
+	send()
+}
+
+// Warns if STUN servers are set but no server-reflexive candidate was gathered for guestId,
+// and calls the function set with OnGathered.
+func (s *HostClient) gathered(guestId qp2p.GuestID, types []ice.CandidateType) {
+	if s.opts.RelayOnly && !slices.Contains(types, ice.CandidateTypeRelay) {
+		s.log.Warn("No relay candidate gathered, with RelayOnly guests can't connect", "guest", guestId)
+	} else if !s.opts.RelayOnly && len(s.stunURLs) > 0 && !slices.Contains(types, ice.CandidateTypeServerReflexive) {
+		s.log.Warn("No server-reflexive candidate gathered, guests on other networks will likely fail to connect",
+			"guest", guestId, "stunServers", s.opts.STUNServers)
+	}
+	if s.onGathered != nil {
+		s.onGathered(guestId, types)
+	}
+}
+
+// Sets the function called with the types of candidates gathered for a guest once gathering completes,
+// e.g. to warn that guests on other networks likely can't connect without ice.CandidateTypeServerReflexive.
+//
+// Must be called before Listen.
+func (s *HostClient) OnGathered(fn func(guestId qp2p.GuestID, types []ice.CandidateType)) {
+	s.onGathered = fn
+}
+
+// Leaves the room, telling the host reason, and closes the connection to the signaling server.
+func (s *GuestClient) Leave(reason string) error {
+	if err := MsgGuestLeave(s.gConn.ctx, s.gConn, reason); err != nil {
+		return err
+	}
+	s.gConn.Close(websocket.StatusNormalClosure, "leaving")
+	return nil
+}
+
+// Sends payload to the host through the signaling server.
+//
+// Useful for lobby messages while the P2P connection is being set up.
+func (s *GuestClient) SendRelay(payload []byte) error {
+	return MsgRelay(s.gConn.ctx, s.gConn.queuedConn, qp2p.GuestID{}, payload)
+}
+
+// Sets the function called with Relay payloads sent by the host.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnRelay(fn func(payload []byte)) {
+	s.onRelay = fn
+}
+
+// Sets the function called with Error messages from the server, or forwarded from the host.
+// The server sends one right before it closes the connection, and when it drops a message,
+// e.g. a candidate that is too long. Use errors.Is to match known codes, e.g. ErrKicked.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnServerError(fn func(*ServerError)) {
+	s.onServerError = fn
+}
+
+// Sends the host an Error with a recoverable code, e.g. one from ErrorCodeAppMin to ErrorCodeAppMax.
+func (s *GuestClient) SendError(code int, detail string) error {
+	return MsgError(s.gConn.ctx, s.gConn, qp2p.GuestID{}, code, detail)
+}
+
+// Measures the round trip time to the signaling server with a Ping. Listen must be running,
+// but the guest does not need to have sent GuestAuth yet.
+//
+// Safe to call concurrently. Returns ctx.Err() if ctx is done before the Pong arrives,
+// e.g. because the server dropped a Ping over its limit of about one per second.
+func (s *GuestClient) MeasureRTT(ctx context.Context) (time.Duration, error) {
+	return s.pongs.measure(ctx, s.gConn.ctx, s.gConn)
+}
+
+// Returns how many duplicate messages from the server Listen dropped, see Msg.Seq.
+func (s *GuestClient) DuplicatesDropped() uint64 {
+	return s.seqs.dropped.Load()
+}
+
+// Sends the host fresh ICE credentials, e.g. from the agent's Restart after the guest's network changed,
+// or to answer the host's IceRestart, see OnIceRestart. Candidates gathered after the restart are sent as usual.
+//
+// Returns an error wrapping ErrInvalidCredentials without sending if they are invalid.
+func (s *GuestClient) RestartICE(ufrag, pwd string) error {
+	guestId, _ := s.ResumeToken()
+	ufrag, pwd, err := s.sealer.sealCredentials(guestId, sealedByGuest, ufrag, pwd)
+	if err != nil {
+		return err
+	}
+	return MsgIceRestart(s.gConn.ctx, s.gConn, qp2p.GuestID{}, ufrag, pwd)
+}
+
+// Sets the function called with the host's fresh ICE credentials from IceRestart, to set as the agent's
+// remote credentials. Unless the guest started the restart with RestartICE, fn must first restart the agent,
+// and answer with its fresh credentials in RestartICE.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnIceRestart(fn func(ufrag, pwd string)) {
+	s.onIceRestart = fn
+}
+
+// Sets the function called with each RoomStatus from the server.
+// The server only sends RoomStatus to guests of public rooms.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnRoomStatus(fn func(RoomState)) {
+	s.onRoomStatus = fn
+}
+
+// Sets the function called with the guest's place in a full room's queue, 1 being next.
+// It is called every few seconds until the guest joins. See ClientOptions.Queue.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnQueuePosition(fn func(position int)) {
+	s.onQueuePosition = fn
+}
+
+// Blocks until the server sends Joined, e.g. once the guest leaves a full room's queue.
+// Listen must be running.
+//
+// Returns Listen's error if the connection closes first, e.g. one matching ErrRoomFull
+// if the guest was turned away from the queue, or ctx.Err() if ctx is done first.
+// The guest stays queued, and can Leave.
+func (s *GuestClient) WaitJoined(ctx context.Context) error {
+	select {
+	case <-s.joined:
+		return nil
+	case <-s.done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the guest's GuestID and the token to rejoin with if the connection drops.
+//
+// The token is empty until the server sends Joined, or if the server does not let guests rejoin.
+func (s *GuestClient) ResumeToken() (qp2p.GuestID, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.guestId, s.resumeToken
+}
+
+// Listen blocks the thread, handling messages from the signaling server until the connection closes.
+//
+// Returns a *KickError if the server kicked the guest, e.g. with KickHostOffline when the host left.
+func (s *GuestClient) Listen() (err error) {
+	// closing the connection cancels the read.
+	ctx := s.gConn.ctx
+	defer func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	}()
+	// set once the server sends KickGuest, and returned once it closes the connection.
+	var kicked *KickError
+	// the host's candidates that came before its HostAuth, passed on after it.
+	var early earlyCandidates
+	// a HostAuth that came before Joined, opened once the GuestID it is sealed with is known.
+	var earlyAuth *Msg
+	remoteAuth := false
+	for {
+		msg, err := s.seqs.readMsg(ctx, s.gConn.Conn, s.log)
+		if errors.Is(err, ErrInvalidMessage) {
+			s.log.Debug("Invalid message from server dropped", "error", err)
+			continue
+		} else if err != nil && kicked != nil {
+			kicked.err = err
+			return kicked
+		} else if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case KickGuest:
+			kick := PayloadOf(msg).(KickGuestMsg)
+			s.log.Info("Kicked from room", "code", kick.ReasonCode, "reason", kick.Reason)
+			kicked = &KickError{Code: kick.ReasonCode, Reason: kick.Reason}
+		case Joined:
+			s.mu.Lock()
+			s.guestId, s.resumeToken = msg.GuestId, msg.ResumeToken
+			s.mu.Unlock()
+			s.joinedOnce.Do(func() { close(s.joined) })
+			if earlyAuth != nil {
+				remoteAuth = s.hostAuth(*earlyAuth, &early) || remoteAuth
+				earlyAuth = nil
+			}
+		case QueuePosition:
+			if s.onQueuePosition != nil {
+				s.onQueuePosition(msg.Position)
+			}
+		case RoomInfo:
+			s.mu.Lock()
+			s.region = msg.Region
+			s.mu.Unlock()
+		case Relay:
+			if s.onRelay != nil {
+				s.onRelay(msg.Payload)
+			}
+		case RoomStatus:
+			if s.onRoomStatus != nil {
+				s.onRoomStatus(RoomState{Guests: msg.GuestCount, MaxGuests: msg.MaxGuests, Locked: msg.Locked})
+			}
+		case Error:
+			s.log.Debug("Error from server", "code", msg.Code, "detail", msg.Detail)
+			if s.onServerError != nil {
+				s.onServerError(serverError(msg))
+			}
+		case Pong:
+			s.pongs.deliver(msg)
+		case HostAuth:
+			s.mu.Lock()
+			joined := s.guestId != (qp2p.GuestID{})
+			s.mu.Unlock()
+			if !joined {
+				earlyAuth = &msg
+				continue
+			}
+			remoteAuth = s.hostAuth(msg, &early) || remoteAuth
+		case IceCandidate:
+			s.mu.Lock()
+			guestId := s.guestId
+			s.mu.Unlock()
+			// a single Candidate, or a batch in Candidates.
+			raws := append([]string{msg.Candidate}, msg.Candidates...)
+			if !remoteAuth {
+				early.add(qp2p.GuestID{}, raws)
+				continue
+			}
+			s.remoteCandidates(guestId, raws)
+		case IceRestart:
+			s.mu.Lock()
+			guestId := s.guestId
+			s.mu.Unlock()
+			ufrag, pwd, err := s.sealer.openCredentials(guestId, sealedByHost, msg.Ufrag, msg.Pwd)
+			if err != nil {
+				s.log.Error("Failed to open host credentials", "error", err)
+				continue
+			}
+			if s.onIceRestart != nil {
+				s.onIceRestart(ufrag, pwd)
+			}
+		default:
+			if !msg.Type.Valid() {
+				s.log.Debug("Message of unknown type dropped", "type", int(msg.Type))
+			}
+		}
+	}
+}
+
+// Opens the host's credentials in HostAuth msg and passes them to the function set with OnRemoteAuth,
+// then the host's candidates in early that came before it.
+//
+// Returns false if the credentials can't be opened.
+func (s *GuestClient) hostAuth(msg Msg, early *earlyCandidates) bool {
+	s.mu.Lock()
+	guestId := s.guestId
+	s.mu.Unlock()
+	ufrag, pwd, err := s.sealer.openCredentials(guestId, sealedByHost, msg.Ufrag, msg.Pwd)
+	if err != nil {
+		s.log.Error("Failed to open host credentials", "error", err)
+		return false
+	}
+	if s.onRemoteAuth != nil {
+		s.onRemoteAuth(ufrag, pwd)
+	}
+	// the application has the host's credentials, and an agent to add candidates to.
+	s.remoteCandidates(guestId, early.take(qp2p.GuestID{}))
+	return true
+}
+
+// Opens the host's candidates in raws and passes them to the function set with OnIceCandidate. Empty ones are skipped.
+func (s *GuestClient) remoteCandidates(guestId qp2p.GuestID, raws []string) {
+	for _, raw := range raws {
+		if raw == "" {
+			continue
+		}
+		raw, err := s.sealer.open(guestId, sealedByHost, "candidate", raw)
+		if err != nil {
+			s.log.Error("Failed to open ice candidate", "error", err)
+			continue
+		}
+		cand, err := ice.UnmarshalCandidate(raw)
+		if err != nil {
+			s.log.Error("Failed to unmarshal ice candidate", "error", err)
+			continue
+		}
+		if s.onIceCandidate != nil {
+			s.onIceCandidate(cand)
+		}
 	}
 }
 
-func (s *signalingClientGuest) SendAuth(ufrag, pwd string)
-func (s *signalingClientGuest) OnRemoteAuth(func(ufrag, pwd string))
-func (s *signalingClientGuest) SendIceCandidate(candidate string)
-func (s *signalingClientGuest) SetOnIceCandidateRecieve(func(c ice.Candidate))
+// Sends the guest's ICE credentials to the host in GuestAuth, with the metadata the client was created with.
+// The server adds the guest to the room once it has them, and the host answers with its own, see OnRemoteAuth.
+func (s *GuestClient) SendAuth(ufrag, pwd string) error {
+	if err := ValidateCredentials(ufrag, pwd); err != nil {
+		return err
+	}
+	// the guest does not know its GuestID until Joined.
+	ufrag, pwd, err := s.sealer.sealCredentials(qp2p.GuestID{}, sealedByGuest, ufrag, pwd)
+	if err != nil {
+		return err
+	}
+	return MsgGuestAuthMetadata(s.gConn.ctx, s.gConn, ufrag, pwd, s.metadata)
+}
+
+// Sets the function called with the host's ICE credentials from HostAuth, to set as the agent's remote credentials.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnRemoteAuth(fn func(ufrag, pwd string)) {
+	s.onRemoteAuth = fn
+}
+
+// Sends the host one of the guest's ICE candidates. It is sealed with the guest's GuestID,
+// so it returns ErrNotJoined before the server sends Joined, see WaitJoined.
+func (s *GuestClient) SendIceCandidate(candidate string) error {
+	if _, err := ice.UnmarshalCandidate(candidate); err != nil {
+		return fmt.Errorf("invalid candidate: %w", err)
+	}
+	s.mu.Lock()
+	guestId := s.guestId
+	s.mu.Unlock()
+	if guestId == (qp2p.GuestID{}) {
+		return ErrNotJoined
+	}
+	sealed, err := s.sealer.seal(guestId, sealedByGuest, "candidate", candidate)
+	if err != nil {
+		return err
+	}
+	return msgIceCandidate(s.gConn.ctx, s.gConn, qp2p.GuestID{}, sealed)
+}
+
+// Sets the function called with each of the host's ICE candidates, to add to the agent's remote candidates.
+// Candidates that arrive before the host's credentials are passed once the function set with OnRemoteAuth returns.
+//
+// Must be called before Listen.
+func (s *GuestClient) OnIceCandidate(fn func(c ice.Candidate)) {
+	s.onIceCandidate = fn
+}
@@ -0,0 +1,1181 @@
+package signaling_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+	"github.com/pion/ice/v4"
+)
+
+// What an application mocks the connection to a guest with.
+type peer interface {
+	Conn() *ice.Conn
+	Agent() *ice.Agent
+	Stats() (signaling.PeerStats, bool)
+}
+
+// An application's game state, holding the clients and connections in fields.
+type game struct {
+	host   *signaling.HostClient
+	guest  *signaling.GuestClient
+	peers  map[qp2p.GuestID]peer
+	joined []signaling.JoinedGuest
+}
+
+// The clients can be named, stored and mocked from outside the package. These fail to compile if the
+// constructors, Listen or OnCandidate return or take unexported types again.
+var (
+	_ peer = signaling.PeerConn{}
+	_ game = game{peers: map[qp2p.GuestID]peer{}}
+
+	_ func(context.Context, string, signaling.WebsocketScheme, string, string, *slog.Logger, signaling.ClientOptions) (*signaling.HostClient, error) = signaling.NewSignalingClientHost
+	_ func(string, signaling.WebsocketScheme, qp2p.RoomId, string, []byte, *slog.Logger, signaling.ClientOptions) (*signaling.GuestClient, error)    = signaling.NewSignalingClientGuest
+	_ func(string, signaling.WebsocketScheme, qp2p.RoomId, string, []byte, *slog.Logger, signaling.ClientOptions) (*signaling.GuestClient, error)    = signaling.NewSignalingClientSpectator
+	_ func(string, signaling.WebsocketScheme, string, []byte, *slog.Logger, signaling.ClientOptions) (*signaling.GuestClient, error)                 = signaling.NewSignalingClientGuestInvite
+
+	_ func(*signaling.HostClient, context.Context, func(signaling.JoinedGuest, signaling.PeerConn)) error = (*signaling.HostClient).Listen
+	_ func(*signaling.HostClient, qp2p.GuestID) func(ice.Candidate)                                       = (*signaling.HostClient).OnCandidate
+	_ func(*signaling.HostClient, qp2p.GuestID) (signaling.PeerConn, bool)                                = (*signaling.HostClient).Guest
+	_ func(*signaling.GuestClient) error                                                                  = (*signaling.GuestClient).Listen
+)
+
+// Starts a host client on srv and waits for its room. It is closed when the test ends.
+//
+// onConnection can be nil.
+func startHost(t *testing.T, srv *signalingtest.Server, opts signaling.ClientOptions, onConnection func(signaling.JoinedGuest, signaling.PeerConn)) *signaling.HostClient {
+	t.Helper()
+	return startHostAt(t, srv.Addr, opts, onConnection)
+}
+
+// Like startHost, with the server at addr, e.g. a proxy's.
+func startHostAt(t *testing.T, addr string, opts signaling.ClientOptions, onConnection func(signaling.JoinedGuest, signaling.PeerConn)) *signaling.HostClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := signaling.NewSignalingClientHost(ctx, addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler), opts)
+	if err != nil {
+		cancel()
+		t.Fatalf("NewSignalingClientHost: %v", err)
+	}
+	if onConnection == nil {
+		onConnection = func(signaling.JoinedGuest, signaling.PeerConn) {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Listen(ctx, onConnection)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		h.Close()
+		<-done
+	})
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for h.RoomId() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("host client never got its room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return h
+}
+
+// Cancelling Listen's context, or calling Close, makes Listen return promptly even while a guest is
+// still being dialed, and closes the room, leaving no goroutines behind.
+func TestHostClientListenStops(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(context.CancelFunc, *signaling.HostClient)
+		want error
+	}{
+		{"cancel", func(cancel context.CancelFunc, _ *signaling.HostClient) { cancel() }, context.Canceled},
+		{"Close", func(_ context.CancelFunc, h *signaling.HostClient) { h.Close() }, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := signalingtest.StartServer(t)
+			before := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			h, err := signaling.NewSignalingClientHost(ctx, srv.Addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+			if err != nil {
+				t.Fatalf("NewSignalingClientHost: %v", err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- h.Listen(ctx, func(signaling.JoinedGuest, signaling.PeerConn) {}) }()
+			e := waitEvent[signaling.RoomOpenedEvent](t, srv)
+
+			// the guest never sends candidates, so the host's agent.Dial waits.
+			g := srv.Join(t, e.RoomId, "")
+			g.Ignore = append(g.Ignore, signaling.IceCandidate, signaling.EndOfCandidates)
+			g.Auth()
+			g.Expect(signaling.Joined)
+			g.Expect(signaling.HostAuth)
+
+			tc.stop(cancel, h)
+			select {
+			case err := <-done:
+				if !errors.Is(err, tc.want) {
+					t.Fatalf("Listen returned %v, want %v", err, tc.want)
+				}
+			case <-time.After(signalingtest.Timeout):
+				t.Fatal("Listen didn't return")
+			}
+			waitEvent[signaling.RoomClosedEvent](t, srv)
+			g.Expect(signaling.KickGuest)
+			g.ExpectClosed(signaling.StatusHostOffline)
+			waitGoroutines(t, before)
+		})
+	}
+}
+
+// A UDP socket that can't be bound fails NewSignalingClientHost with an error naming the address,
+// and closes the connection to the server it had already opened.
+func TestHostClientBindFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts signaling.ClientOptions
+		want string
+	}{
+		// TEST-NET-1, which no interface has.
+		{"address not local", signaling.ClientOptions{BindAddress: "192.0.2.1"}, "192.0.2.1"},
+		{"invalid port", signaling.ClientOptions{Port: 70000}, "70000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a leaked connection isn't pinged, so only closing it closes the room.
+			srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{PingInterval: time.Hour})
+			before := runtime.NumGoroutine()
+			h, err := signaling.NewSignalingClientHost(context.Background(), srv.Addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler), tc.opts)
+			if err == nil {
+				h.Close()
+				t.Fatal("NewSignalingClientHost succeeded")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %q doesn't name %q", err, tc.want)
+			}
+			opened := waitEvent[signaling.RoomOpenedEvent](t, srv)
+			if closed := waitEvent[signaling.RoomClosedEvent](t, srv); closed.RoomId != opened.RoomId {
+				t.Fatalf("room %v closed, want %v", closed.RoomId, opened.RoomId)
+			}
+			waitGoroutines(t, before)
+		})
+	}
+}
+
+// Listen keeps running through a quiet spell longer than the client's write timeout, and returns
+// ErrConnectionLost promptly once the network to the server goes away.
+func TestHostClientListenErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out a quiet spell")
+	}
+	// the server only sends pings, which a quiet room gets none of.
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{PingInterval: time.Hour})
+	proxy := startRecordingProxy(t, srv.Addr)
+	h, err := signaling.NewSignalingClientHost(context.Background(), proxy.Addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler),
+		signaling.ClientOptions{DisableReconnect: true})
+	if err != nil {
+		t.Fatalf("NewSignalingClientHost: %v", err)
+	}
+	defer h.Close()
+	done := make(chan error, 1)
+	go func() { done <- h.Listen(context.Background(), func(signaling.JoinedGuest, signaling.PeerConn) {}) }()
+	waitEvent[signaling.RoomOpenedEvent](t, srv)
+
+	// longer than the 5 second write timeout, which a read deadline was once mistaken for.
+	select {
+	case err := <-done:
+		t.Fatalf("Listen returned %v while the server was quiet", err)
+	case <-time.After(6 * time.Second):
+	}
+
+	proxy.cut()
+	select {
+	case err := <-done:
+		if !errors.Is(err, signaling.ErrConnectionLost) {
+			t.Fatalf("Listen returned %v, want ErrConnectionLost", err)
+		}
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("Listen didn't return after the connection was cut")
+	}
+}
+
+// Passes h's HostEvents to the returned channel. Must be called before a guest joins.
+func hostEvents(h *signaling.HostClient) <-chan signaling.HostEvent {
+	events := make(chan signaling.HostEvent, 16)
+	h.OnEvent(func(e signaling.HostEvent) { events <- e })
+	return events
+}
+
+// Reads the next HostEvent, failing the test unless it is an E.
+func expectEvent[E signaling.HostEvent](t *testing.T, events <-chan signaling.HostEvent) E {
+	t.Helper()
+	select {
+	case e := <-events:
+		got, ok := e.(E)
+		if !ok {
+			var want E
+			t.Fatalf("got %T %+v, want %T", e, e, want)
+		}
+		return got
+	case <-time.After(signalingtest.Timeout):
+		var want E
+		t.Fatalf("no %T", want)
+		return want
+	}
+}
+
+// Each guest gets GuestConnectingEvent, then GuestConnectedEvent or GuestConnectFailedEvent, then
+// GuestDisconnectedEvent, whether the server, the ICE agent or the host itself noticed it is gone.
+func TestHostClientEvents(t *testing.T) {
+	// connects a guest on the loopback sockets, checking the events up to GuestConnectedEvent.
+	connect := func(t *testing.T, opts signaling.ClientOptions) (*signaling.HostClient, <-chan signaling.HostEvent, *signaling.GuestClient, *ice.Agent) {
+		t.Helper()
+		srv := signalingtest.StartServer(t)
+		hostMux, _ := loopbackMux(t)
+		opts.UDPMux = hostMux
+		opts.AgentOptions = append(opts.AgentOptions, loopbackAgent...)
+		connected := make(chan signaling.PeerConn, 1)
+		h := startHost(t, srv, opts, func(_ signaling.JoinedGuest, c signaling.PeerConn) { connected <- c })
+		events := hostEvents(h)
+		guestMux, _ := loopbackMux(t)
+		var agent *ice.Agent
+		g, _, hostConn := connectGuest(t, srv, h, connected, guestMux, func(_ *signaling.GuestClient, a *ice.Agent) { agent = a }, loopbackAgent...)
+
+		guestId, _ := g.ResumeToken()
+		if e := expectEvent[signaling.GuestConnectingEvent](t, events); e.GuestId != guestId || e.RoomId != h.RoomId() {
+			t.Fatalf("GuestConnectingEvent for %v in %v, want %v in %v", e.GuestId, e.RoomId, guestId, h.RoomId())
+		}
+		if e := expectEvent[signaling.GuestConnectedEvent](t, events); e.GuestId != guestId || e.Conn.Conn() != hostConn.Conn() {
+			t.Fatalf("GuestConnectedEvent for %v, want %v with the connection Listen passed on", e.GuestId, guestId)
+		}
+		return h, events, g, agent
+	}
+	disconnected := func(t *testing.T, events <-chan signaling.HostEvent, g *signaling.GuestClient, reason string) {
+		t.Helper()
+		guestId, _ := g.ResumeToken()
+		if e := expectEvent[signaling.GuestDisconnectedEvent](t, events); e.GuestId != guestId || e.Reason != reason {
+			t.Fatalf("GuestDisconnectedEvent for %v with %q, want %v with %q", e.GuestId, e.Reason, guestId, reason)
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("%T %+v after GuestDisconnectedEvent", e, e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Run("left", func(t *testing.T) {
+		_, events, g, _ := connect(t, signaling.ClientOptions{})
+		g.Leave("quit to menu")
+		disconnected(t, events, g, "quit to menu")
+	})
+	t.Run("kicked", func(t *testing.T) {
+		h, events, g, _ := connect(t, signaling.ClientOptions{})
+		guestId, _ := g.ResumeToken()
+		if err := h.Kick(guestId, "afk"); err != nil {
+			t.Fatal(err)
+		}
+		disconnected(t, events, g, signaling.ReasonKickedByHost)
+	})
+	t.Run("connection lost", func(t *testing.T) {
+		// the guest's agent goes away while its signaling connection stays up.
+		_, events, g, agent := connect(t, signaling.ClientOptions{AgentOptions: []ice.AgentOption{
+			ice.WithDisconnectedTimeout(100 * time.Millisecond),
+			ice.WithFailedTimeout(100 * time.Millisecond),
+			ice.WithKeepaliveInterval(20 * time.Millisecond),
+		}})
+		agent.Close()
+		disconnected(t, events, g, signaling.ReasonConnectionLost)
+	})
+	t.Run("room closed", func(t *testing.T) {
+		h, events, g, _ := connect(t, signaling.ClientOptions{})
+		h.Close()
+		disconnected(t, events, g, signaling.ReasonRoomClosed)
+	})
+	t.Run("connect failed", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		h := startHost(t, srv, signaling.ClientOptions{DialTimeout: 100 * time.Millisecond}, nil)
+		events := hostEvents(h)
+		// the guest never sends candidates.
+		g := srv.Join(t, h.RoomId(), "")
+		g.Auth()
+		guestId := g.Expect(signaling.Joined).GuestId
+		if e := expectEvent[signaling.GuestConnectingEvent](t, events); e.GuestId != guestId {
+			t.Fatalf("GuestConnectingEvent for %v, want %v", e.GuestId, guestId)
+		}
+		if e := expectEvent[signaling.GuestConnectFailedEvent](t, events); e.GuestId != guestId || e.Err == nil {
+			t.Fatalf("GuestConnectFailedEvent for %v with %v, want %v with an error", e.GuestId, e.Err, guestId)
+		}
+		// kicked with KickConnectionFailed, so the server reports the guest gone.
+		if e := expectEvent[signaling.GuestDisconnectedEvent](t, events); e.GuestId != guestId {
+			t.Fatalf("GuestDisconnectedEvent for %v, want %v", e.GuestId, guestId)
+		}
+	})
+}
+
+// Returns how many files the process has open, or -1 where /proc isn't available.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// Guests the host fails to dial leave nothing behind: their agents are closed with their sockets and goroutines.
+func TestHostClientFailedDialsDoNotLeak(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	h := startHost(t, srv, signaling.ClientOptions{DialTimeout: 20 * time.Millisecond}, nil)
+	cycle := func() {
+		// the guest never sends candidates.
+		g := srv.Join(t, h.RoomId(), "")
+		g.Ignore = append(g.Ignore, signaling.HostAuth, signaling.IceCandidate, signaling.EndOfCandidates)
+		g.Auth()
+		g.Expect(signaling.Joined)
+		kicked := signaling.PayloadOf(g.Expect(signaling.KickGuest)).(signaling.KickGuestMsg)
+		if kicked.ReasonCode != signaling.KickConnectionFailed {
+			t.Fatalf("guest kicked with %v, want %v", kicked.ReasonCode, signaling.KickConnectionFailed)
+		}
+		g.Close()
+	}
+	// the first dial starts goroutines that stay, e.g. the mux's.
+	cycle()
+	time.Sleep(100 * time.Millisecond)
+	goroutines, files := runtime.NumGoroutine(), openFiles()
+	for range 50 {
+		cycle()
+	}
+	waitGoroutines(t, goroutines)
+	if files >= 0 {
+		deadline := time.Now().Add(signalingtest.Timeout)
+		for openFiles() > files {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d files open, %d before", openFiles(), files)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// A guest whose ICE agent can't be set up is kicked, and the host goes on with the other guests.
+func TestHostClientRejectsGuestWhoseAgentFails(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	var agents atomic.Int32
+	failFirst := func(*ice.Agent) error {
+		if agents.Add(1) == 1 {
+			return errors.New("agent failed")
+		}
+		return nil
+	}
+	failed := make(chan signaling.GuestConnectFailedEvent, 1)
+	h := startHost(t, srv, signaling.ClientOptions{AgentOptions: []ice.AgentOption{failFirst}}, nil)
+	h.OnEvent(func(e signaling.HostEvent) {
+		if e, ok := e.(signaling.GuestConnectFailedEvent); ok {
+			failed <- e
+		}
+	})
+
+	first := srv.Join(t, h.RoomId(), "")
+	first.Auth()
+	joined := first.Expect(signaling.Joined)
+	kicked := signaling.PayloadOf(first.Expect(signaling.KickGuest)).(signaling.KickGuestMsg)
+	if kicked.ReasonCode != signaling.KickConnectionFailed {
+		t.Fatalf("first guest kicked with %v, want %v", kicked.ReasonCode, signaling.KickConnectionFailed)
+	}
+	select {
+	case e := <-failed:
+		if e.GuestId != joined.GuestId {
+			t.Fatalf("GuestConnectFailedEvent for %v, want %v", e.GuestId, joined.GuestId)
+		}
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("no GuestConnectFailedEvent")
+	}
+
+	second := srv.Join(t, h.RoomId(), "")
+	second.Auth()
+	second.Expect(signaling.Joined)
+	second.Expect(signaling.HostAuth)
+}
+
+// A HostAuth sealed with the room secret that arrives before Joined is opened once the guest knows its GuestID,
+// instead of failing to open with the zero GuestID's key and being dropped.
+func TestGuestClientHostAuthBeforeJoined(t *testing.T) {
+	const secret = "room secret"
+	guestId := signalingtest.GuestID(1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		ctx := r.Context()
+		if msg, err := signaling.ReadMsg(ctx, ws); err != nil || msg.Type != signaling.GuestAuth {
+			t.Errorf("fake server: expected GuestAuth, got %v: %v", msg.Type, err)
+			return
+		}
+		ufrag, pwd, err := signaling.SealHostCredentials(secret, guestId, signalingtest.Ufrag, signalingtest.Pwd)
+		if err != nil {
+			t.Errorf("fake server: seal: %v", err)
+			return
+		}
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.HostAuth, GuestId: guestId, Ufrag: ufrag, Pwd: pwd})
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.Joined, GuestId: guestId})
+		ws.Read(ctx)
+	}))
+	defer ts.Close()
+
+	g, err := signaling.NewSignalingClientGuest(strings.TrimPrefix(ts.URL, "http://"), signaling.SchemeWs, "ROOM01", "", nil,
+		slog.New(slog.DiscardHandler), signaling.ClientOptions{RoomSecret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Leave("")
+	type creds struct{ ufrag, pwd string }
+	auth := make(chan creds, 1)
+	g.OnRemoteAuth(func(ufrag, pwd string) { auth <- creds{ufrag, pwd} })
+	go g.Listen()
+	if err := g.SendAuth("guestUfrag", "guestPasswordGuestPassword"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-auth:
+		if c.ufrag != signalingtest.Ufrag || c.pwd != signalingtest.Pwd {
+			t.Fatalf("OnRemoteAuth got %q %q, want %q %q", c.ufrag, c.pwd, signalingtest.Ufrag, signalingtest.Pwd)
+		}
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("HostAuth that came before Joined was dropped")
+	}
+}
+
+// A guest's candidates that the server forwards before its GuestJoined are added to the host's agent
+// once it exists, instead of being dropped, and the host connects over them.
+func TestHostClientCandidatesBeforeGuestJoined(t *testing.T) {
+	guestId := signalingtest.GuestID(1)
+	guestMux, _ := loopbackMux(t)
+	guest, err := ice.NewAgentWithOptions(append([]ice.AgentOption{ice.WithUDPMux(guestMux)}, loopbackAgent...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+	gathered := make(chan []string, 1)
+	var candidates []string
+	guest.OnCandidate(func(c ice.Candidate) {
+		if c == nil {
+			gathered <- candidates
+			return
+		}
+		candidates = append(candidates, c.Marshal())
+	})
+	if err := guest.GatherCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case candidates = <-gathered:
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("guest never finished gathering")
+	}
+	guestUfrag, guestPwd, err := guest.GetLocalUserCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type creds struct{ ufrag, pwd string }
+	hostAuth := make(chan creds, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		ctx := r.Context()
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.RoomCreated, RoomId: "ROOM01"})
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidates: candidates})
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.GuestJoined, GuestId: guestId, Ufrag: guestUfrag, Pwd: guestPwd})
+		// relays the host's messages to the guest's agent.
+		for {
+			msg, err := signaling.ReadMsg(ctx, ws)
+			if err != nil {
+				return
+			}
+			switch msg.Type {
+			case signaling.HostAuth:
+				hostAuth <- creds{msg.Ufrag, msg.Pwd}
+			case signaling.IceCandidate:
+				for _, raw := range append([]string{msg.Candidate}, msg.Candidates...) {
+					if c, err := ice.UnmarshalCandidate(raw); err == nil {
+						guest.AddRemoteCandidate(c)
+					}
+				}
+			}
+		}
+	}))
+	defer ts.Close()
+
+	hostMux, _ := loopbackMux(t)
+	h, err := signaling.NewSignalingClientHost(context.Background(), strings.TrimPrefix(ts.URL, "http://"), signaling.SchemeWs, "", "",
+		slog.New(slog.DiscardHandler), signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	connected := make(chan signaling.PeerConn, 1)
+	go h.Listen(context.Background(), func(_ signaling.JoinedGuest, c signaling.PeerConn) { connected <- c })
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalingtest.Timeout)
+	defer cancel()
+	var remote creds
+	select {
+	case remote = <-hostAuth:
+	case <-ctx.Done():
+		t.Fatal("no HostAuth")
+	}
+	if _, err := guest.Accept(ctx, remote.ufrag, remote.pwd); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	var hostConn signaling.PeerConn
+	select {
+	case hostConn = <-connected:
+	case <-ctx.Done():
+		t.Fatal("host never connected")
+	}
+	// without the early candidates the host only learns the guest's address from its checks, as peer-reflexive.
+	remotes, err := hostConn.Agent().GetRemoteCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(remotes, func(c ice.Candidate) bool { return c.Type() == ice.CandidateTypeHost }) {
+		t.Fatalf("host's remote candidates %v, want the guest's early host candidate", remotes)
+	}
+}
+
+// The host queues each guest's HostAuth before gathering its candidates, so the server, which drops
+// a guest's candidates sent before its HostAuth, never gets one early.
+func TestHostClientSendsHostAuthBeforeCandidates(t *testing.T) {
+	const guests = 20
+	early := make(chan qp2p.GuestID, guests)
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		ctx := r.Context()
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.RoomCreated, RoomId: "ROOM01"})
+		for i := range guests {
+			signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.GuestJoined, GuestId: signalingtest.GuestID(i + 1),
+				Ufrag: signalingtest.Ufrag, Pwd: signalingtest.Pwd})
+		}
+		authed := make(map[qp2p.GuestID]bool)
+		candidates := make(map[qp2p.GuestID]bool)
+		for len(candidates) < guests {
+			msg, err := signaling.ReadMsg(ctx, ws)
+			if err != nil {
+				return
+			}
+			switch msg.Type {
+			case signaling.HostAuth:
+				authed[msg.GuestId] = true
+			case signaling.IceCandidate:
+				if !authed[msg.GuestId] {
+					early <- msg.GuestId
+				}
+				candidates[msg.GuestId] = true
+			}
+		}
+		close(done)
+		// reads until the host closes, answering its close frame.
+		for {
+			if _, err := signaling.ReadMsg(ctx, ws); err != nil {
+				return
+			}
+		}
+	}))
+	// registered before the host's cleanup, so the host disconnects before the server waits for its handler.
+	t.Cleanup(ts.Close)
+
+	hostMux, _ := loopbackMux(t)
+	startHostAt(t, strings.TrimPrefix(ts.URL, "http://"), signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent}, nil)
+	select {
+	case <-done:
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("not every guest got a candidate")
+	}
+	close(early)
+	for guestId := range early {
+		t.Errorf("candidate for %v sent before its HostAuth", guestId)
+	}
+}
+
+// The host's candidates that arrive before its HostAuth are passed to OnIceCandidate after OnRemoteAuth,
+// instead of being dropped.
+func TestGuestClientCandidatesBeforeHostAuth(t *testing.T) {
+	guestId := signalingtest.GuestID(1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		ctx := r.Context()
+		if msg, err := signaling.ReadMsg(ctx, ws); err != nil || msg.Type != signaling.GuestAuth {
+			t.Errorf("fake server: expected GuestAuth, got %v: %v", msg.Type, err)
+			return
+		}
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.Joined, GuestId: guestId})
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: signalingtest.Candidate(0)})
+		signaling.WriteMsg(ctx, ws, signaling.Msg{Type: signaling.HostAuth, GuestId: guestId, Ufrag: signalingtest.Ufrag, Pwd: signalingtest.Pwd})
+		ws.Read(ctx)
+	}))
+	defer ts.Close()
+
+	g, err := signaling.NewSignalingClientGuest(strings.TrimPrefix(ts.URL, "http://"), signaling.SchemeWs, "ROOM01", "", nil,
+		slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Leave("")
+	calls := make(chan string, 2)
+	g.OnRemoteAuth(func(string, string) { calls <- "OnRemoteAuth" })
+	g.OnIceCandidate(func(c ice.Candidate) { calls <- c.Marshal() })
+	go g.Listen()
+	if err := g.SendAuth("guestUfrag", "guestPasswordGuestPassword"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ice.UnmarshalCandidate(signalingtest.Candidate(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"OnRemoteAuth", want.Marshal()} {
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(signalingtest.Timeout):
+			t.Fatalf("no %q", want)
+		}
+	}
+}
+
+// The host's candidates the CandidateFilter drops are never sent to the server, and the guest's are never
+// added to the host's agent.
+func TestHostClientCandidateFilter(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		hostMux, _ := loopbackMux(t)
+		var mu sync.Mutex
+		var filtered []ice.CandidateType
+		h := startHostAt(t, srv.Addr, signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent,
+			CandidateFilter: func(c ice.Candidate) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				filtered = append(filtered, c.Type())
+				return signaling.NoHostCandidates(c)
+			}}, nil)
+
+		g := srv.Join(t, h.RoomId(), "")
+		g.Auth()
+		g.ExpectAll(signaling.Joined, signaling.HostAuth)
+		// the loopback socket only has host candidates, so gathering ends without any,
+		// and Expect fails if one is forwarded first.
+		g.Expect(signaling.EndOfCandidates)
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Contains(filtered, ice.CandidateTypeHost) {
+			t.Fatalf("CandidateFilter was called with %v, want a host candidate", filtered)
+		}
+		// nor did the server get one it dropped.
+		for drained := false; !drained; {
+			select {
+			case e := <-srv.Events():
+				if e, ok := e.(signaling.MessageRejectedEvent); ok {
+					t.Fatalf("server rejected a message from the host: %s", e.Reason)
+				}
+			default:
+				drained = true
+			}
+		}
+	})
+	t.Run("remote", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		hostMux, _ := loopbackMux(t)
+		guestMux, guestPort := loopbackMux(t)
+		connected := make(chan signaling.PeerConn, 1)
+		h := startHost(t, srv, signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent,
+			CandidateFilter: func(c ice.Candidate) bool { return c.Port() != guestPort }},
+			func(_ signaling.JoinedGuest, c signaling.PeerConn) { connected <- c })
+		_, _, hostConn := connectGuest(t, srv, h, connected, guestMux, nil, loopbackAgent...)
+
+		// the host only learns the guest's address from its connectivity checks, as peer-reflexive.
+		remotes, err := hostConn.Agent().GetRemoteCandidates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range remotes {
+			if c.Type() == ice.CandidateTypeHost {
+				t.Fatalf("the guest's host candidate %v was added, the filter dropped it", c)
+			}
+		}
+	})
+}
+
+// The host client reports the lock it set, and the server turns guests away while it is set.
+func TestHostClientLockRoom(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	h := startHost(t, srv, signaling.ClientOptions{}, nil)
+	join := func() error {
+		g, err := signaling.NewSignalingClientGuest(srv.Addr, signaling.SchemeWs, h.RoomId(), "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+		if err == nil {
+			g.Leave("")
+		}
+		return err
+	}
+
+	if err := join(); err != nil {
+		t.Fatalf("join before lock: %v", err)
+	}
+	if err := h.LockRoom(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Locked() {
+		t.Fatal("Locked is false after LockRoom")
+	}
+	// the lock is applied once the server reads it.
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for err := join(); !errors.Is(err, signaling.ErrRoomLocked); err = join() {
+		if time.Now().After(deadline) {
+			t.Fatalf("join while locked got %v, want ErrRoomLocked", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := h.UnlockRoom(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Locked() {
+		t.Fatal("Locked is true after UnlockRoom")
+	}
+	deadline = time.Now().Add(signalingtest.Timeout)
+	for err := join(); err != nil; err = join() {
+		if time.Now().After(deadline) {
+			t.Fatalf("join after unlock got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Returns the *HTTPError in err, and fails the test unless it has status and code and errors.Is matches it against want.
+func expectHTTPError(t *testing.T, err error, status int, code signaling.ErrorCode, want error) *signaling.HTTPError {
+	t.Helper()
+	var httpErr *signaling.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("got %v, want an *HTTPError", err)
+	}
+	if httpErr.Status != status || httpErr.Code != code {
+		t.Fatalf("got %d %s, want %d %s", httpErr.Status, httpErr.Code, status, code)
+	}
+	if !errors.Is(err, want) {
+		t.Fatalf("%v is not %v", err, want)
+	}
+	return httpErr
+}
+
+// A guest client turned away before the websocket upgrade gets the server's HTTPError,
+// which errors.Is matches against the Err value for its code.
+func TestGuestClientDialErrors(t *testing.T) {
+	join := func(srv *signalingtest.Server, roomId qp2p.RoomId) error {
+		g, err := signaling.NewSignalingClientGuest(srv.Addr, signaling.SchemeWs, roomId, "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+		if err == nil {
+			g.Leave("")
+		}
+		return err
+	}
+
+	t.Run("room not found", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		expectHTTPError(t, join(srv, "ABCDEF"), http.StatusNotFound, signaling.CodeRoomNotFound, signaling.ErrRoomNotFound)
+	})
+	t.Run("room locked", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		host := srv.Host(t)
+		host.Send(signaling.Msg{Type: signaling.LockRoom})
+		expectLocked(host, true)
+		expectHTTPError(t, join(srv, host.RoomId), http.StatusLocked, signaling.CodeRoomLocked, signaling.ErrRoomLocked)
+	})
+	t.Run("room full", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		host := srv.Host(t)
+		// the host's messages are handled in order, so the room is full once the guest has its HostAuth.
+		host.Send(signaling.Msg{Type: signaling.SetRoomInfo, MaxGuests: 1})
+		joinRoom(t, srv, host)
+		expectHTTPError(t, join(srv, host.RoomId), http.StatusForbidden, signaling.CodeRoomFull, signaling.ErrRoomFull)
+	})
+	t.Run("banned", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		host := srv.Host(t)
+		g, guestId := joinRoom(t, srv, host)
+		host.Send(signaling.Msg{Type: signaling.KickGuest, GuestId: guestId, Ban: true})
+		g.Expect(signaling.KickGuest)
+		expectHTTPError(t, join(srv, host.RoomId), http.StatusForbidden, signaling.CodeBanned, signaling.ErrBanned)
+		// the ban only covers the room the guest was banned from.
+		other := srv.Host(t)
+		if err := join(srv, other.RoomId); err != nil {
+			t.Fatalf("banned guest joining another room: %v", err)
+		}
+		joinRoom(t, srv, other)
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+			Authenticator: signaling.BearerTokenAuthenticator(map[string]string{"token": "alice"}),
+		})
+		expectHTTPError(t, join(srv, "ABCDEF"), http.StatusUnauthorized, signaling.CodeUnauthorized, signaling.ErrUnauthorized)
+	})
+}
+
+// A host client turned away before the websocket upgrade gets the server's HTTPError,
+// with how long to wait before retrying when the server is at capacity.
+func TestHostClientDialErrors(t *testing.T) {
+	create := func(srv *signalingtest.Server) error {
+		h, err := signaling.NewSignalingClientHost(context.Background(), srv.Addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+		if err == nil {
+			h.Close()
+		}
+		return err
+	}
+
+	t.Run("draining", func(t *testing.T) {
+		srv := signalingtest.StartServer(t)
+		srv.SetDraining(true)
+		expectHTTPError(t, create(srv), http.StatusServiceUnavailable, signaling.CodeDraining, signaling.ErrServerUnavailable)
+	})
+	t.Run("at capacity", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{MaxRooms: 1, MaxRoomsRetryAfter: 3 * time.Second})
+		srv.Host(t)
+		httpErr := expectHTTPError(t, create(srv), http.StatusServiceUnavailable, signaling.CodeAtCapacity, signaling.ErrServerUnavailable)
+		if httpErr.RetryAfter != 3 {
+			t.Fatalf("retryAfter %d, want 3", httpErr.RetryAfter)
+		}
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+			Authenticator: signaling.BearerTokenAuthenticator(map[string]string{"token": "alice"}),
+		})
+		expectHTTPError(t, create(srv), http.StatusUnauthorized, signaling.CodeUnauthorized, signaling.ErrUnauthorized)
+	})
+}
+
+// Listen sends heartbeats on its own, so a listening host's room outlives the heartbeats it may miss.
+func TestHostClientSendsHeartbeats(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{HostHeartbeatInterval: interval, HostHeartbeatMisses: 2})
+	h := startHost(t, srv, signaling.ClientOptions{}, nil)
+	time.Sleep(20 * interval)
+	srv.Join(t, h.RoomId(), "")
+}
+
+// The client offers permessage-deflate only when ClientOptions.CompressionMode asks for it.
+func TestClientCompressionOption(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	for _, mode := range []websocket.CompressionMode{websocket.CompressionDisabled, websocket.CompressionContextTakeover} {
+		proxy := startRecordingProxy(t, srv.Addr)
+		// the room does not exist, the handshake request is all that matters.
+		signaling.NewSignalingClientGuest(proxy.Addr, signaling.SchemeWs, "ABCDEF", "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{CompressionMode: mode})
+		offered := strings.Contains(proxy.sent(), "permessage-deflate")
+		if want := mode != websocket.CompressionDisabled; offered != want {
+			t.Fatalf("compression mode %v: offered permessage-deflate %v, want %v", mode, offered, want)
+		}
+	}
+}
+
+// A UDP mux whose socket can be swapped for another, like a host whose network changes.
+// Agents gather candidates on the current mux.
+type swappableMux struct {
+	mu   sync.Mutex
+	cur  ice.UDPMux
+	muxs []ice.UDPMux
+}
+
+func (m *swappableMux) current() ice.UDPMux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cur
+}
+
+// Makes mux the current one, agents keep the connections they have on the others.
+func (m *swappableMux) swap(mux ice.UDPMux) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cur = mux
+	m.muxs = append(m.muxs, mux)
+}
+
+func (m *swappableMux) GetConn(ufrag string, addr net.Addr) (net.PacketConn, error) {
+	return m.current().GetConn(ufrag, addr)
+}
+
+func (m *swappableMux) GetListenAddresses() []net.Addr {
+	return m.current().GetListenAddresses()
+}
+
+func (m *swappableMux) RemoveConnByUfrag(ufrag string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mux := range m.muxs {
+		mux.RemoveConnByUfrag(ufrag)
+	}
+}
+
+func (m *swappableMux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mux := range m.muxs {
+		mux.Close()
+	}
+	return nil
+}
+
+// Returns a UDP mux on a loopback socket, and the socket's port. It is closed when the test ends.
+func loopbackMux(t *testing.T) (ice.UDPMux, int) {
+	t.Helper()
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: pconn})
+	t.Cleanup(func() { mux.Close() })
+	return mux, pconn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Options for ICE agents that only use the loopback sockets of loopbackMux.
+var loopbackAgent = []ice.AgentOption{ice.WithIncludeLoopback(), ice.WithNetworkTypes([]ice.NetworkType{ice.NetworkTypeUDP4})}
+
+// Writes msg to w, and fails the test unless r reads it within signalingtest.Timeout.
+func expectDatagram(t *testing.T, w, r *ice.Conn, msg string) {
+	t.Helper()
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := r.Read(buf)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		read <- string(buf[:n])
+	}()
+	deadline := time.After(signalingtest.Timeout)
+	// datagrams sent while the new candidate pair is checked can be lost.
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("write %q: %v", msg, err)
+		}
+		select {
+		case got := <-read:
+			if got != msg {
+				t.Fatalf("read %q, want %q", got, msg)
+			}
+			return
+		case <-tick.C:
+		case <-deadline:
+			t.Fatalf("%q never arrived", msg)
+		}
+	}
+}
+
+// Joins the host's room as a guest whose agent gathers on mux with agentOpts, and returns the guest
+// with its connection to the host once both sides have it.
+//
+// setup, if not nil, is called before the guest listens, e.g. to set more callbacks.
+func connectGuest(t *testing.T, srv *signalingtest.Server, h *signaling.HostClient, connected <-chan signaling.PeerConn, mux ice.UDPMux, setup func(*signaling.GuestClient, *ice.Agent), agentOpts ...ice.AgentOption) (*signaling.GuestClient, *ice.Conn, signaling.PeerConn) {
+	t.Helper()
+	g, err := signaling.NewSignalingClientGuest(srv.Addr, signaling.SchemeWs, h.RoomId(), "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Leave("") })
+	agent, err := g.NewAgent(append([]ice.AgentOption{ice.WithUDPMux(mux)}, agentOpts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	agent.OnCandidate(func(c ice.Candidate) {
+		if c != nil {
+			g.SendIceCandidate(c.Marshal())
+		}
+	})
+	type creds struct{ ufrag, pwd string }
+	hostAuth := make(chan creds, 1)
+	g.OnRemoteAuth(func(ufrag, pwd string) { hostAuth <- creds{ufrag, pwd} })
+	g.OnIceCandidate(func(c ice.Candidate) { agent.AddRemoteCandidate(c) })
+	if setup != nil {
+		setup(g, agent)
+	}
+	go g.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalingtest.Timeout)
+	defer cancel()
+	localUfrag, localPwd, err := agent.GetLocalUserCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SendAuth(localUfrag, localPwd); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WaitJoined(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.GatherCandidates(); err != nil {
+		t.Fatal(err)
+	}
+	var remote creds
+	select {
+	case remote = <-hostAuth:
+	case <-ctx.Done():
+		t.Fatal("no HostAuth")
+	}
+	guestConn, err := agent.Accept(ctx, remote.ufrag, remote.pwd)
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	select {
+	case hostConn := <-connected:
+		return g, guestConn, hostConn
+	case <-ctx.Done():
+		t.Fatal("host never connected")
+		return nil, nil, signaling.PeerConn{}
+	}
+}
+
+// A guest that only has IPv6 connects to a host on udp6, and to one on the default dual-stack socket.
+// Skipped where IPv6 loopback can't be bound.
+func TestHostClientIPv6(t *testing.T) {
+	probe, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	probe.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts signaling.ClientOptions
+	}{
+		{"udp6", signaling.ClientOptions{BindAddress: "::1", NetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP6}}},
+		{"dual-stack", signaling.ClientOptions{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := signalingtest.StartServer(t)
+			connected := make(chan signaling.PeerConn, 1)
+			tc.opts.AgentOptions = []ice.AgentOption{ice.WithIncludeLoopback()}
+			h := startHost(t, srv, tc.opts, func(_ signaling.JoinedGuest, c signaling.PeerConn) {
+				connected <- c
+			})
+
+			pconn, err := net.ListenPacket("udp6", "[::1]:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			guestMux := ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: pconn})
+			defer guestMux.Close()
+			_, guestConn, hostConn := connectGuest(t, srv, h, connected, guestMux, nil,
+				ice.WithIncludeLoopback(), ice.WithNetworkTypes([]ice.NetworkType{ice.NetworkTypeUDP6}))
+			expectDatagram(t, guestConn, hostConn.Conn(), "ping")
+			expectDatagram(t, hostConn.Conn(), guestConn, "pong")
+
+			pair, err := hostConn.Agent().GetSelectedCandidatePair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pair.Local.NetworkType().IsIPv6() {
+				t.Fatalf("host connected over %v, want IPv6", pair.Local.NetworkType())
+			}
+		})
+	}
+}
+
+// After the host's socket goes away, RestartICE gets the host and guest talking again over a new one,
+// on the same connections.
+func TestRestartICEAfterNetworkChange(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	first, _ := loopbackMux(t)
+	second, secondPort := loopbackMux(t)
+	hostMux := &swappableMux{}
+	hostMux.swap(first)
+
+	connected := make(chan signaling.PeerConn, 1)
+	h := startHost(t, srv, signaling.ClientOptions{UDPMux: hostMux, AgentOptions: loopbackAgent}, func(_ signaling.JoinedGuest, c signaling.PeerConn) {
+		connected <- c
+	})
+
+	restarted := make(chan error, 1)
+	onIceRestart := func(g *signaling.GuestClient, agent *ice.Agent) {
+		g.OnIceRestart(func(ufrag, pwd string) {
+			restarted <- func() error {
+				if err := agent.Restart("", ""); err != nil {
+					return err
+				}
+				localUfrag, localPwd, err := agent.GetLocalUserCredentials()
+				if err != nil {
+					return err
+				}
+				if err := g.RestartICE(localUfrag, localPwd); err != nil {
+					return err
+				}
+				if err := agent.SetRemoteCredentials(ufrag, pwd); err != nil {
+					return err
+				}
+				return agent.GatherCandidates()
+			}()
+		})
+	}
+	guestMux, _ := loopbackMux(t)
+	g, guestConn, hostConn := connectGuest(t, srv, h, connected, guestMux, onIceRestart, loopbackAgent...)
+	expectDatagram(t, guestConn, hostConn.Conn(), "before")
+
+	// the host's network changes: new agents gather on the second socket, and the first is gone.
+	hostMux.swap(second)
+	first.Close()
+	guestId, _ := g.ResumeToken()
+	if err := h.RestartICE(guestId); err != nil {
+		t.Fatalf("RestartICE: %v", err)
+	}
+	select {
+	case err := <-restarted:
+		if err != nil {
+			t.Fatalf("guest restart: %v", err)
+		}
+	case <-time.After(signalingtest.Timeout):
+		t.Fatal("guest never got IceRestart")
+	}
+	expectDatagram(t, guestConn, hostConn.Conn(), "after")
+	expectDatagram(t, hostConn.Conn(), guestConn, "back")
+	// the pair is only selected once the restarted checks nominate it, which can be after datagrams flow.
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for {
+		pair, err := hostConn.Agent().GetSelectedCandidatePair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pair != nil && pair.Local.Port() == secondPort {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("host sends from %v, want the second socket's port %d", pair, secondPort)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,369 @@
+// Package signalingtest runs an in-process signaling server, and fake hosts and guests
+// that speak its wire protocol, for testing code that embeds the signaling clients.
+//
+// The fakes send and expect raw Msgs without any ICE, so a test can script the whole
+// message choreography, including malformed frames and late candidates:
+//
+//	srv := signalingtest.StartServer(t)
+//	host := srv.Host(t)
+//	guest := srv.Join(t, host.RoomId, "")
+//	guest.Auth()
+//	guest.Expect(signaling.Joined)
+//	joined := host.Expect(signaling.GuestJoined)
+//	host.Auth(joined.GuestId)
+//	guest.Expect(signaling.HostAuth)
+package signalingtest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/coder/websocket"
+)
+
+// Valid ICE credentials for GuestAuth and HostAuth.
+const (
+	Ufrag = "fakeUfrag"
+	Pwd   = "fakePasswordFakePassword"
+)
+
+// How long the fakes wait to write or read a message before failing the test.
+const Timeout = 5 * time.Second
+
+// Returns a valid host candidate on port 5000+i, so each i gives a distinct candidate.
+func Candidate(i int) string {
+	return fmt.Sprintf("candidate:%d 1 udp 2130706431 192.0.2.1 %d typ host", i+1, 5000+i)
+}
+
+// Returns the GuestID SequentialGuestIDs assigns to the nth guest, starting at 1.
+func GuestID(n int) qp2p.GuestID {
+	var id qp2p.GuestID
+	binary.BigEndian.PutUint64(id[8:], uint64(n))
+	return id
+}
+
+// Returns a ServerOptions.GuestIDAssigner that assigns GuestID(1), GuestID(2)... in join order,
+// so a test can predict the GuestIDs of its guests.
+func SequentialGuestIDs() func(*http.Request, signaling.Msg) (qp2p.GuestID, error) {
+	var n atomic.Int64
+	return func(*http.Request, signaling.Msg) (qp2p.GuestID, error) {
+		return GuestID(int(n.Add(1))), nil
+	}
+}
+
+// A running signaling server.
+type Server struct {
+	*signaling.WebsocketSignalingServer
+	// host:port the server listens on.
+	Addr string
+}
+
+// Starts a server with the default options on a random port. It is shut down when the test ends.
+func StartServer(t testing.TB) *Server {
+	return StartServerOptions(t, signaling.ServerOptions{})
+}
+
+// Starts a server with sopts on a random port. It is shut down when the test ends.
+func StartServerOptions(t testing.TB, sopts signaling.ServerOptions) *Server {
+	t.Helper()
+	s := signaling.NewWebsocketSignalingServer(nil, websocket.AcceptOptions{}, sopts)
+	ts := httptest.NewServer(s.Mux)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		defer cancel()
+		s.Shutdown(ctx)
+		ts.Close()
+	})
+	return &Server{WebsocketSignalingServer: s, Addr: strings.TrimPrefix(ts.URL, "http://")}
+}
+
+// Dials path on the server, e.g. "host" or "join/ABC123", with query appended.
+//
+// Fails the test if the websocket can't be opened.
+func (s *Server) Dial(t testing.TB, path string, query url.Values) *Conn {
+	t.Helper()
+	return s.DialOptions(t, path, query, nil)
+}
+
+// Dials path like Dial with opts, e.g. to send X-Forwarded-For or ask for a codec's subprotocol. opts can be nil.
+func (s *Server) DialOptions(t testing.TB, path string, query url.Values, opts *websocket.DialOptions) *Conn {
+	t.Helper()
+	if query == nil {
+		query = url.Values{}
+	}
+	if !query.Has("v") {
+		query.Set("v", fmt.Sprint(qp2p.ProtocolVersion))
+	}
+	u := url.URL{Scheme: "ws", Host: s.Addr, Path: path, RawQuery: query.Encode()}
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, u.String(), opts)
+	if err != nil {
+		t.Fatalf("signalingtest: dial %v: %v", u.String(), err)
+	}
+	c := &Conn{T: t, Ws: ws, Ignore: []signaling.MsgType{signaling.RoomStatus}, msgs: make(chan signaling.Msg, readAhead)}
+	go c.readLoop()
+	t.Cleanup(func() { ws.CloseNow() })
+	return c
+}
+
+// Creates a room with GET /host and waits for RoomCreated.
+//
+// query is added to the url, e.g. password, approval or joinWindow. It can be nil.
+func (s *Server) Host(t testing.TB, query ...url.Values) *FakeHost {
+	t.Helper()
+	c := s.Dial(t, "host", firstQuery(query))
+	created := c.Expect(signaling.RoomCreated)
+	return &FakeHost{Conn: c, RoomId: created.RoomId, ResumeToken: created.ResumeToken}
+}
+
+// Joins roomId with GET /join/{roomId} and waits for RoomInfo.
+//
+// The guest is not in the room until it sends Auth.
+func (s *Server) Join(t testing.TB, roomId qp2p.RoomId, password string) *FakeGuest {
+	t.Helper()
+	query := url.Values{}
+	if password != "" {
+		query.Set("password", password)
+	}
+	c := s.Dial(t, "join/"+string(roomId), query)
+	info := c.Expect(signaling.RoomInfo)
+	return &FakeGuest{Conn: c, Info: info}
+}
+
+func firstQuery(query []url.Values) url.Values {
+	if len(query) == 0 {
+		return nil
+	}
+	return query[0]
+}
+
+// Most messages a Conn reads ahead of the test.
+const readAhead = 1024
+
+// A fake client's websocket to the server. Every method fails the test on error.
+//
+// Messages are read in the background as they arrive, so the connection answers the server's pings
+// while the test is busy elsewhere, and are taken with Read or Expect. Ws must not be read from.
+type Conn struct {
+	T  testing.TB
+	Ws *websocket.Conn
+	// Message types Expect skips, RoomStatus by default as its timing depends on coalescing.
+	Ignore []signaling.MsgType
+	// messages read ahead, closed once the connection fails with err.
+	msgs chan signaling.Msg
+	err  error
+}
+
+// Reads messages into c.msgs until the connection fails.
+func (c *Conn) readLoop() {
+	defer close(c.msgs)
+	for {
+		msg, err := signaling.ReadMsg(context.Background(), c.Ws)
+		// a frame that can't be decoded, not a close with StatusInvalidMessage.
+		if errors.Is(err, signaling.ErrInvalidMessage) && websocket.CloseStatus(err) == -1 {
+			continue
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.msgs <- msg
+	}
+}
+
+// Returns the next message, or the error the connection failed with, waiting up to Timeout.
+// Ignored message types are returned too.
+func (c *Conn) Read() (signaling.Msg, error) {
+	t := time.NewTimer(Timeout)
+	defer t.Stop()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return signaling.Msg{}, c.err
+		}
+		return msg, nil
+	case <-t.C:
+		return signaling.Msg{}, fmt.Errorf("no message in %v", Timeout)
+	}
+}
+
+// Writes msg.
+func (c *Conn) Send(msg signaling.Msg) {
+	c.T.Helper()
+	if err := signaling.WriteMsgTimeout(c.Ws, msg, Timeout); err != nil {
+		c.T.Fatalf("signalingtest: send %v: %v", msg.Type, err)
+	}
+}
+
+// Writes msg after d without blocking, e.g. to deliver a candidate late.
+//
+// Errors are reported once the test ends instead of failing it.
+func (c *Conn) SendAfter(d time.Duration, msg signaling.Msg) {
+	time.AfterFunc(d, func() {
+		if err := signaling.WriteMsgTimeout(c.Ws, msg, Timeout); err != nil {
+			c.T.Logf("signalingtest: delayed send %v: %v", msg.Type, err)
+		}
+	})
+}
+
+// Writes msg with the connection's codec without validating it, e.g. one with fields too long,
+// which Send refuses to write.
+func (c *Conn) SendUnchecked(msg signaling.Msg) {
+	c.T.Helper()
+	codec := signaling.ConnCodec(c.Ws)
+	b, err := codec.Marshal(msg)
+	if err != nil {
+		c.T.Fatalf("signalingtest: marshal %v: %v", msg.Type, err)
+	}
+	c.SendRaw(codec.FrameType(), b)
+}
+
+// Writes a raw frame, e.g. a malformed message or one in the wrong frame type.
+func (c *Conn) SendRaw(typ websocket.MessageType, b []byte) {
+	c.T.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := c.Ws.Write(ctx, typ, b); err != nil {
+		c.T.Fatalf("signalingtest: send raw frame: %v", err)
+	}
+}
+
+// Reads the next message that is not ignored, failing the test unless it is of type typ.
+func (c *Conn) Expect(typ signaling.MsgType) signaling.Msg {
+	c.T.Helper()
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			c.T.Fatalf("signalingtest: expected %v: %v", typ, err)
+		}
+		if msg.Type != typ && slices.Contains(c.Ignore, msg.Type) {
+			continue
+		}
+		if msg.Type != typ {
+			c.T.Fatalf("signalingtest: expected %v, got %v", typ, msg.Type)
+		}
+		return msg
+	}
+}
+
+// Reads the next len(types) messages that are not ignored, failing the test unless they are of types
+// in any order, e.g. messages the server sends the guest and the host concurrently.
+func (c *Conn) ExpectAll(types ...signaling.MsgType) []signaling.Msg {
+	c.T.Helper()
+	want := slices.Clone(types)
+	var got []signaling.Msg
+	for len(want) > 0 {
+		msg, err := c.Read()
+		if err != nil {
+			c.T.Fatalf("signalingtest: expected %v: %v", want, err)
+		}
+		if slices.Contains(c.Ignore, msg.Type) && !slices.Contains(want, msg.Type) {
+			continue
+		}
+		i := slices.Index(want, msg.Type)
+		if i < 0 {
+			c.T.Fatalf("signalingtest: expected %v, got %v", want, msg.Type)
+		}
+		want = slices.Delete(want, i, i+1)
+		got = append(got, msg)
+	}
+	return got
+}
+
+// Fails the test if a message that is not ignored arrives within d.
+func (c *Conn) ExpectNothing(d time.Duration) {
+	c.T.Helper()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				c.T.Fatalf("signalingtest: expected nothing, connection failed: %v", c.err)
+			}
+			if slices.Contains(c.Ignore, msg.Type) {
+				continue
+			}
+			c.T.Fatalf("signalingtest: expected nothing, got %v", msg.Type)
+		case <-t.C:
+			return
+		}
+	}
+}
+
+// Reads until the server closes the connection, failing the test unless it closes with code.
+//
+// Error messages sent before the close are skipped.
+func (c *Conn) ExpectClosed(code websocket.StatusCode) {
+	c.T.Helper()
+	for {
+		msg, err := c.Read()
+		if err == nil {
+			if msg.Type == signaling.Error || slices.Contains(c.Ignore, msg.Type) {
+				continue
+			}
+			c.T.Fatalf("signalingtest: expected close %v, got %v", code, msg.Type)
+		}
+		if got := websocket.CloseStatus(err); got != code {
+			c.T.Fatalf("signalingtest: expected close %v, got %v: %v", code, got, err)
+		}
+		return
+	}
+}
+
+// Closes the connection normally.
+func (c *Conn) Close() {
+	c.Ws.Close(websocket.StatusNormalClosure, "")
+}
+
+// A host that owns a room.
+type FakeHost struct {
+	*Conn
+	RoomId qp2p.RoomId
+	// from RoomCreated, empty unless ServerOptions.HostGracePeriod is set.
+	ResumeToken string
+}
+
+// Answers guestId's GuestJoined with HostAuth using Ufrag and Pwd.
+func (h *FakeHost) Auth(guestId qp2p.GuestID) {
+	h.T.Helper()
+	h.Send(signaling.Msg{Type: signaling.HostAuth, GuestId: guestId, Ufrag: Ufrag, Pwd: Pwd})
+}
+
+// Sends guestId the candidate Candidate(i).
+func (h *FakeHost) SendCandidate(guestId qp2p.GuestID, i int) {
+	h.T.Helper()
+	h.Send(signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: Candidate(i)})
+}
+
+// A guest connected to a room.
+type FakeGuest struct {
+	*Conn
+	// sent by the server when the guest connected.
+	Info signaling.Msg
+}
+
+// Sends GuestAuth using Ufrag and Pwd.
+func (g *FakeGuest) Auth() {
+	g.T.Helper()
+	g.Send(signaling.Msg{Type: signaling.GuestAuth, Ufrag: Ufrag, Pwd: Pwd})
+}
+
+// Sends the host the candidate Candidate(i).
+func (g *FakeGuest) SendCandidate(i int) {
+	g.T.Helper()
+	g.Send(signaling.Msg{Type: signaling.IceCandidate, Candidate: Candidate(i)})
+}
@@ -0,0 +1,129 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/pion/ice/v4"
+)
+
+// Returns the UDP mux the host's ICE agents share, see ClientOptions.BindAddress.
+// Muxes made here also gather server-reflexive candidates, see ClientOptions.STUNServers.
+//
+// owned reports whether the mux was made here, and is closed with the client.
+func (o ClientOptions) udpMux() (mux ice.UDPMux, owned bool, err error) {
+	if o.UDPMux != nil {
+		return o.UDPMux, false, nil
+	}
+	if o.PacketConn != nil {
+		return ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: o.PacketConn}), false, nil
+	}
+	pconn, err := o.listenUDP()
+	if err != nil {
+		return nil, false, err
+	}
+	return ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: pconn}), true, nil
+}
+
+// Returns ClientOptions.NetworkTypes, or UDP4 and UDP6 if it is empty.
+func (o ClientOptions) networkTypes() ([]ice.NetworkType, error) {
+	if len(o.NetworkTypes) == 0 {
+		return []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6}, nil
+	}
+	for _, t := range o.NetworkTypes {
+		if t != ice.NetworkTypeUDP4 && t != ice.NetworkTypeUDP6 {
+			return nil, fmt.Errorf("unsupported network type %v, only udp4 and udp6 are", t)
+		}
+	}
+	return o.NetworkTypes, nil
+}
+
+// Binds a UDP socket to BindAddress, on Port or the first free port of PortRange.
+//
+// Without a BindAddress the socket is dual-stack if NetworkTypes has both UDP4 and UDP6.
+// If NetworkTypes is empty and IPv6 can't be bound, it falls back to IPv4 only.
+func (o ClientOptions) listenUDP() (net.PacketConn, error) {
+	types, err := o.networkTypes()
+	if err != nil {
+		return nil, err
+	}
+	v4, v6 := slices.Contains(types, ice.NetworkTypeUDP4), slices.Contains(types, ice.NetworkTypeUDP6)
+	network, host := "udp4", o.BindAddress
+	switch ip := net.ParseIP(host); {
+	case host != "" && ip != nil && ip.To4() == nil:
+		if !v6 {
+			return nil, fmt.Errorf("BindAddress %v is IPv6, but NetworkTypes has no udp6", host)
+		}
+		network = "udp6"
+	case host != "":
+		if !v4 {
+			return nil, fmt.Errorf("BindAddress %v is not IPv6, but NetworkTypes has no udp4", host)
+		}
+	case v4 && v6:
+		network, host = "udp", "::"
+	case v6:
+		network, host = "udp6", "::"
+	default:
+		host = "0.0.0.0"
+	}
+	pconn, err := o.bindPorts(network, host)
+	if err != nil && network == "udp" && len(o.NetworkTypes) == 0 {
+		// e.g. IPv6 is disabled.
+		pconn, err = o.bindPorts("udp4", "0.0.0.0")
+	}
+	return pconn, err
+}
+
+// Binds a UDP socket to host, on Port or the first free port of PortRange.
+func (o ClientOptions) bindPorts(network, host string) (net.PacketConn, error) {
+	lo, hi := o.PortRange[0], o.PortRange[1]
+	if o.Port != 0 || (lo == 0 && hi == 0) {
+		lo, hi = o.Port, o.Port
+	}
+	if lo < 0 || hi > 65535 || lo > hi {
+		return nil, fmt.Errorf("invalid PortRange %v-%v", lo, hi)
+	}
+	var err error
+	for port := lo; port <= hi; port++ {
+		var pconn net.PacketConn
+		pconn, err = net.ListenPacket(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return pconn, nil
+		}
+		// only a port in use is worth trying the next one for.
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+	}
+	if lo == hi {
+		return nil, fmt.Errorf("failed to bind %v %v: %w", network, net.JoinHostPort(host, strconv.Itoa(lo)), err)
+	}
+	return nil, fmt.Errorf("failed to bind %v %v on ports %v-%v: %w", network, host, lo, hi, err)
+}
+
+// Returns the network types of the addresses mux listens on that are in types.
+func udpNetworkTypes(mux ice.UDPMux, types []ice.NetworkType) []ice.NetworkType {
+	var listening []ice.NetworkType
+	for _, addr := range mux.GetListenAddresses() {
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		t := ice.NetworkTypeUDP4
+		if udp.IP.To4() == nil {
+			t = ice.NetworkTypeUDP6
+		}
+		if slices.Contains(types, t) && !slices.Contains(listening, t) {
+			listening = append(listening, t)
+		}
+	}
+	// an agent without network types would gather every type.
+	if len(listening) == 0 {
+		return types
+	}
+	return listening
+}
@@ -0,0 +1,116 @@
+package signaling
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pion/ice/v4"
+)
+
+// Longest ICE candidate forwarded between hosts and guests, before it is sealed.
+// Real candidates are around 100 bytes.
+const MaxCandidateLen = 512
+
+// Longest Reason forwarded between hosts and guests. Longer reasons are truncated, see Msg.Clamp.
+const MaxReasonLen = 256
+
+// Most candidates forwarded from one batched IceCandidate. The rest are dropped.
+const maxBatchCandidates = 32
+
+// ICE credential lengths allowed by RFC 8839 section 5.4.
+const (
+	minUfragLen = 4
+	MaxUfragLen = 256
+	minPwdLen   = 22
+	MaxPwdLen   = 256
+)
+
+// Checks a candidate before it is forwarded to the other peer.
+//
+// Returns the reason it is invalid, or "" if it is valid.
+func checkCandidate(candidate string) string {
+	// sealed candidates can only be opened by the peers, see ClientOptions.RoomSecret.
+	if candidateTooLong(candidate) {
+		return "too_long"
+	}
+	if b64, ok := strings.CutPrefix(candidate, sealedPrefix); ok {
+		if _, err := base64.RawStdEncoding.DecodeString(b64); err != nil {
+			return "invalid"
+		}
+		return ""
+	}
+	if _, err := ice.UnmarshalCandidate(candidate); err != nil {
+		return "invalid"
+	}
+	return ""
+}
+
+// Reports whether candidate is longer than MaxCandidateLen, or a sealed candidate of it.
+func candidateTooLong(candidate string) bool {
+	if strings.HasPrefix(candidate, sealedPrefix) {
+		return len(candidate) > maxSealedCandidateLen
+	}
+	return len(candidate) > MaxCandidateLen
+}
+
+// Returns reason without control characters or invalid UTF-8, so it can't move the cursor
+// or recolor a terminal it is printed to, cut to MaxReasonLen bytes on a rune boundary.
+func cleanReason(reason string) string {
+	reason = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, reason)
+	if len(reason) <= MaxReasonLen {
+		return reason
+	}
+	cut := MaxReasonLen
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut]
+}
+
+// ValidateCredentials checks an ICE ufrag and pwd before they are sent to the other peer.
+//
+// RFC 8445 requires a ufrag of at least 4 and a pwd of at least 22 ice-chars (letters, digits, '+' and '/').
+// Returns an error wrapping ErrInvalidCredentials if they are invalid.
+func ValidateCredentials(ufrag, pwd string) error {
+	if reason := checkCredentials(ufrag, pwd); reason != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidCredentials, reason)
+	}
+	return nil
+}
+
+// Returns the reason ufrag and pwd are invalid ICE credentials, or "" if they are valid.
+func checkCredentials(ufrag, pwd string) string {
+	switch {
+	case len(ufrag) < minUfragLen:
+		return "ufrag_too_short"
+	case len(ufrag) > MaxUfragLen:
+		return "ufrag_too_long"
+	case !iceChars(ufrag):
+		return "ufrag_invalid_char"
+	case len(pwd) < minPwdLen:
+		return "pwd_too_short"
+	case len(pwd) > MaxPwdLen:
+		return "pwd_too_long"
+	case !iceChars(pwd):
+		return "pwd_invalid_char"
+	}
+	return ""
+}
+
+// Reports whether s only has ice-chars: ALPHA / DIGIT / "+" / "/".
+func iceChars(s string) bool {
+	for _, c := range []byte(s) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '+' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package signaling_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+	"github.com/pion/ice/v4"
+)
+
+// Candidates the server must not forward.
+var malformedCandidates = []string{
+	"garbage",
+	"candidate:",
+	"candidate:1 1 udp",
+	"candidate:1 1 udp 2130706431 192.0.2.1 notaport typ host",
+	"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ nonsense",
+	"candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host" + strings.Repeat(" x", signaling.MaxCandidateLen),
+	"\x1b[2Jcandidate:1 1 udp 2130706431 192.0.2.1 5000 typ host",
+}
+
+// Malformed candidates from either peer are dropped, the peer that sent them gets ErrorCandidateRejected,
+// and the other peer only ever sees the valid candidates.
+func TestMalformedCandidatesAreNotForwarded(t *testing.T) {
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics})
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+
+	for i, c := range malformedCandidates {
+		g.SendUnchecked(signaling.Msg{Type: signaling.IceCandidate, Candidate: c})
+		g.Expect(signaling.Error)
+		host.SendUnchecked(signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: c})
+		host.Expect(signaling.Error)
+
+		// a batch only loses its malformed candidates, unless one is too long, which fails the whole message.
+		if len(c) > signaling.MaxCandidateLen {
+			continue
+		}
+		valid := signalingtest.Candidate(i)
+		g.Send(signaling.Msg{Type: signaling.IceCandidate, Candidates: []string{c, valid}})
+		host.Send(signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidates: []string{c, valid}})
+		for _, peer := range []*signalingtest.Conn{g.Conn, host.Conn} {
+			for _, got := range peer.ExpectAll(signaling.Error, signaling.IceCandidate) {
+				if got.Type == signaling.Error {
+					if e := signaling.PayloadOf(got).(signaling.ErrorMsg); e.Code != signaling.ErrorCandidateRejected {
+						t.Fatalf("%q rejected with code %d, want %d", c, e.Code, signaling.ErrorCandidateRejected)
+					}
+				} else if got.Candidate != "" || len(got.Candidates) != 1 || got.Candidates[0] != valid {
+					t.Fatalf("after %q, forwarded %q %q, want only %q", c, got.Candidate, got.Candidates, valid)
+				}
+			}
+		}
+	}
+	host.ExpectNothing(50 * time.Millisecond)
+	g.ExpectNothing(50 * time.Millisecond)
+	if n := metrics.Snapshot().Counters[signaling.MetricCandidatesDropped+"{reason=invalid}"]; n == 0 {
+		t.Fatal("dropped candidates not counted")
+	}
+}
+
+// ICE credentials longer than RFC 8839 allows close the connection that sent them with StatusPolicyViolation.
+func TestCredentialsTooLong(t *testing.T) {
+	long := strings.Repeat("a", signaling.MaxPwdLen+1)
+	srv := signalingtest.StartServer(t)
+
+	t.Run("GuestAuth", func(t *testing.T) {
+		host := srv.Host(t)
+		g := srv.Join(t, host.RoomId, "")
+		g.SendUnchecked(signaling.Msg{Type: signaling.GuestAuth, Ufrag: signalingtest.Ufrag, Pwd: long})
+		g.ExpectClosed(websocket.StatusPolicyViolation)
+	})
+	t.Run("HostAuth", func(t *testing.T) {
+		host := srv.Host(t)
+		g := srv.Join(t, host.RoomId, "")
+		g.Auth()
+		joined := host.Expect(signaling.GuestJoined)
+		host.SendUnchecked(signaling.Msg{Type: signaling.HostAuth, GuestId: joined.GuestId, Ufrag: long, Pwd: signalingtest.Pwd})
+		host.ExpectClosed(websocket.StatusPolicyViolation)
+		// the room closes with its host, and the credentials never reach the guest.
+		g.ExpectAll(signaling.Joined, signaling.KickGuest)
+	})
+}
+
+// The server only forwards candidates that parse, or that are sealed, and are not too long.
+func FuzzCheckCandidate(f *testing.F) {
+	for i := range 3 {
+		f.Add(signalingtest.Candidate(i))
+	}
+	for _, c := range malformedCandidates {
+		f.Add(c)
+	}
+	f.Fuzz(func(t *testing.T, c string) {
+		if signaling.CheckCandidate(c) != "" {
+			return
+		}
+		if strings.HasPrefix(c, signaling.SealedPrefix) {
+			return
+		}
+		if len(c) > signaling.MaxCandidateLen {
+			t.Fatalf("forwarded a %d byte candidate", len(c))
+		}
+		if _, err := ice.UnmarshalCandidate(c); err != nil {
+			t.Fatalf("forwarded %q that does not parse: %v", c, err)
+		}
+	})
+}
+
+// Clamp removes control characters, including NUL and escapes, and invalid UTF-8 from Reason,
+// and cuts it to MaxReasonLen on a rune boundary.
+func TestClampReason(t *testing.T) {
+	long := strings.Repeat("a", signaling.MaxReasonLen)
+	tests := []struct {
+		name, reason, want string
+	}{
+		{"plain", "left the game", "left the game"},
+		{"escape", "\x1b[2J\x1b[31mbye", "[2J[31mbye"},
+		{"NUL", "a\x00b", "ab"},
+		{"newlines", "line\r\nbreak", "linebreak"},
+		{"C1 control", "a\u009bb", "ab"},
+		{"invalid UTF-8", "a\xffb\xc3", "ab"},
+		{"unicode", "au revoir 👋", "au revoir 👋"},
+		{"at limit", long, long},
+		{"over limit", long + "b", long},
+		{"cut rune", long[1:] + "é", long[1:]},
+		{"control over limit", "\x00" + long, long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := signaling.Msg{Type: signaling.KickGuest, GuestId: signalingtest.GuestID(1), Reason: tt.reason}.Clamp()
+			if msg.Reason != tt.want {
+				t.Fatalf("Clamp(%q) = %q, want %q", tt.reason, msg.Reason, tt.want)
+			}
+			if err := msg.Validate(); err != nil {
+				t.Fatalf("clamped message invalid: %v", err)
+			}
+		})
+	}
+}
+
+// Validate accepts every field at its limit and rejects it one byte over.
+func TestValidateLimits(t *testing.T) {
+	guestId := signalingtest.GuestID(1)
+	at := func(n int) string { return strings.Repeat("a", n) }
+	// a parseable candidate padded with extensions to n bytes.
+	candidate := func(n int) string {
+		c := signalingtest.Candidate(0) + " generation 0"
+		return c + strings.Repeat("0", n-len(c))
+	}
+	tests := []struct {
+		name string
+		msg  func(n int) signaling.Msg
+		max  int
+	}{
+		{"Reason", func(n int) signaling.Msg {
+			return signaling.Msg{Type: signaling.KickGuest, GuestId: guestId, Reason: at(n)}
+		}, signaling.MaxReasonLen},
+		{"Ufrag", func(n int) signaling.Msg {
+			return signaling.Msg{Type: signaling.HostAuth, GuestId: guestId, Ufrag: at(n), Pwd: signalingtest.Pwd}
+		}, signaling.MaxUfragLen},
+		{"Pwd", func(n int) signaling.Msg {
+			return signaling.Msg{Type: signaling.HostAuth, GuestId: guestId, Ufrag: signalingtest.Ufrag, Pwd: at(n)}
+		}, signaling.MaxPwdLen},
+		{"Candidate", func(n int) signaling.Msg {
+			return signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: candidate(n)}
+		}, signaling.MaxCandidateLen},
+		{"Candidates", func(n int) signaling.Msg {
+			return signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidates: []string{signalingtest.Candidate(1), candidate(n)}}
+		}, signaling.MaxCandidateLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.msg(tt.max).Validate(); err != nil {
+				t.Fatalf("%d bytes rejected: %v", tt.max, err)
+			}
+			if err := tt.msg(tt.max + 1).Validate(); !errors.Is(err, signaling.ErrInvalidMessage) {
+				t.Fatalf("%d bytes: got %v, want ErrInvalidMessage", tt.max+1, err)
+			}
+		})
+	}
+	if signaling.CheckCandidate(candidate(signaling.MaxCandidateLen)) != "" {
+		t.Fatal("candidate at MaxCandidateLen does not parse")
+	}
+}
+
+// WriteMsg rejects an invalid message locally without writing it.
+func TestWriteMsgValidates(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	long := signalingtest.Candidate(0) + strings.Repeat(" x", signaling.MaxCandidateLen)
+	err := signaling.WriteMsgTimeout(host.Ws, signaling.Msg{Type: signaling.IceCandidate, GuestId: guestId, Candidate: long}, signalingtest.Timeout)
+	if !errors.Is(err, signaling.ErrInvalidMessage) {
+		t.Fatalf("got %v, want ErrInvalidMessage", err)
+	}
+	host.ExpectNothing(50 * time.Millisecond)
+	g.ExpectNothing(0)
+}
+
+// The server cleans a hostile Reason before it reaches the other peer, even from a peer that skips Clamp.
+func TestServerClampsForwardedReason(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	host.SendUnchecked(signaling.Msg{Type: signaling.KickGuest, GuestId: guestId, Reason: "\x1b[2J\x00bye" + strings.Repeat("!", signaling.MaxReasonLen)})
+	kick := signaling.PayloadOf(g.Expect(signaling.KickGuest)).(signaling.KickGuestMsg)
+	if want := ("[2Jbye" + strings.Repeat("!", signaling.MaxReasonLen))[:signaling.MaxReasonLen]; kick.Reason != want {
+		t.Fatalf("guest got reason %q, want %q", kick.Reason, want)
+	}
+}
@@ -0,0 +1,51 @@
+package signaling
+
+import (
+	"cmp"
+	"net/http"
+	"strings"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/internal"
+)
+
+// Length of room IDs hosts pick with /host?roomId=.
+const (
+	minVanityRoomIdLen = 4
+	maxVanityRoomIdLen = 16
+)
+
+// Characters of room IDs hosts pick with /host?roomId=, once uppercased.
+const vanityRoomIdChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+
+// Checks the room ID a host asked for with /host?roomId=, responding with an HTTPError if it can't have it.
+//
+// Returns the ID in its canonical form, and false if the request must not be accepted.
+func (s *WebsocketSignalingServer) vanityRoomId(w http.ResponseWriter, r *http.Request, identity string) (qp2p.RoomId, bool) {
+	id := internal.NormalizeRoomID(qp2p.RoomId(r.URL.Query().Get("roomId")))
+	if !s.sopts.VanityRoomIds {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRoomId, "room ids can't be picked on this server")
+		return "", false
+	}
+	if len(id) < minVanityRoomIdLen || len(id) > maxVanityRoomIdLen {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRoomId, "room id must be 4 to 16 characters")
+		return "", false
+	}
+	if strings.Trim(string(id), vanityRoomIdChars) != "" {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRoomId, "room id can only have letters, digits and dashes")
+		return "", false
+	}
+	if s.sopts.RoomIdFilter != nil {
+		if err := s.sopts.RoomIdFilter(id); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, CodeInvalidRoomId, err.Error())
+			return "", false
+		}
+	}
+	// hosts with an identity are limited by it, so they can't squat IDs from many addresses.
+	if !s.vanityLim.allow(cmp.Or(identity, s.remoteIP(r))) {
+		writeRetryAfter(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit", time.Duration(float64(time.Second)/float64(s.sopts.VanityRoomRate)))
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,44 @@
+package signaling
+
+import (
+	"net/http"
+	"strconv"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// Oldest protocol version the server accepts. The newest is qp2p.ProtocolVersion.
+//
+// Clients that do not send ?v= are treated as version 1.
+const MinProtocolVersion = 1
+
+// Checks the ?v= protocol version of r.
+//
+// Responds 426 Upgrade Required with the supported range and returns false
+// if the server does not support it.
+func checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	v, err := requestVersion(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid protocol version")
+		return false
+	}
+	if v >= MinProtocolVersion && v <= qp2p.ProtocolVersion {
+		return true
+	}
+	writeHTTPErrorBody(w, http.StatusUpgradeRequired, HTTPError{
+		Code:       CodeUnsupportedVersion,
+		Message:    "unsupported protocol version",
+		MinVersion: MinProtocolVersion,
+		MaxVersion: qp2p.ProtocolVersion,
+	})
+	return false
+}
+
+// Returns the ?v= protocol version of r, 1 if it is not set.
+func requestVersion(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("v")
+	if raw == "" {
+		return 1, nil
+	}
+	return strconv.Atoi(raw)
+}
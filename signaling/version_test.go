@@ -0,0 +1,103 @@
+package signaling_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+)
+
+// Clients on an older supported version, including ones that send no version, still host and join,
+// and clients on a version the server does not support are turned away before the upgrade with the supported range.
+func TestOldClientNewServer(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	// no ?v= is version 1.
+	host := &signalingtest.FakeHost{Conn: srv.Dial(t, "host", url.Values{"v": {""}})}
+	host.RoomId = host.Expect(signaling.RoomCreated).RoomId
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+
+	for _, v := range []string{"0", "-1", "99"} {
+		status, body := getError(t, srv, "host", url.Values{"v": {v}})
+		if status != http.StatusUpgradeRequired || body.Code != signaling.CodeUnsupportedVersion {
+			t.Fatalf("v=%s got %d %q, want %d %q", v, status, body.Code, http.StatusUpgradeRequired, signaling.CodeUnsupportedVersion)
+		}
+		if body.MinVersion != signaling.MinProtocolVersion || body.MaxVersion != qp2p.ProtocolVersion {
+			t.Fatalf("v=%s got range %d-%d, want %d-%d", v, body.MinVersion, body.MaxVersion, signaling.MinProtocolVersion, qp2p.ProtocolVersion)
+		}
+		if status, _ := getError(t, srv, "join/"+string(host.RoomId), url.Values{"v": {v}}); status != http.StatusUpgradeRequired {
+			t.Fatalf("join with v=%s got %d, want %d", v, status, http.StatusUpgradeRequired)
+		}
+	}
+	if status, _ := getError(t, srv, "host", url.Values{"v": {"two"}}); status != http.StatusBadRequest {
+		t.Fatalf("v=two got %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+// A client newer than the server gets an error matching ErrUnsupportedVersion, with the server's range.
+func TestNewClientOldServer(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		max     int
+	}{
+		{"old server", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUpgradeRequired)
+			w.Write([]byte(`{"code":"unsupported_version","message":"unsupported protocol version","minVersion":1,"maxVersion":1}`))
+		}, 1},
+		// e.g. a proxy in front of the server, which sends no body.
+		{"no body", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUpgradeRequired)
+		}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotVersion string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotVersion = r.URL.Query().Get("v")
+				tc.handler(w, r)
+			}))
+			defer ts.Close()
+			addr := strings.TrimPrefix(ts.URL, "http://")
+
+			_, err := signaling.NewSignalingClientHost(context.Background(), addr, signaling.SchemeWs, "", "", slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+			if !errors.Is(err, signaling.ErrUnsupportedVersion) {
+				t.Fatalf("host got %v, want ErrUnsupportedVersion", err)
+			}
+			var httpErr *signaling.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.MaxVersion != tc.max {
+				t.Fatalf("host got %v, want an HTTPError with MaxVersion %d", err, tc.max)
+			}
+			if gotVersion != fmt.Sprint(qp2p.ProtocolVersion) {
+				t.Fatalf("client sent v=%q, want %d", gotVersion, qp2p.ProtocolVersion)
+			}
+			_, err = signaling.NewSignalingClientGuest(addr, signaling.SchemeWs, "ROOM01", "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+			if !errors.Is(err, signaling.ErrUnsupportedVersion) {
+				t.Fatalf("guest got %v, want ErrUnsupportedVersion", err)
+			}
+		})
+	}
+}
+
+// Messages with the reserved Version field set are handled as if it were zero.
+func TestMsgVersionIsIgnored(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	g.Send(signaling.Msg{Type: signaling.IceCandidate, Candidate: signalingtest.Candidate(0), Version: 7})
+	if c := host.Expect(signaling.IceCandidate); c.GuestId != guestId || c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q from %v", c.Candidate, c.GuestId)
+	}
+}
@@ -0,0 +1,149 @@
+package signaling
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+)
+
+// Header of webhook requests carrying "sha256=" and the hex HMAC-SHA256 of the body,
+// keyed with ServerOptions.WebhookSecret.
+const WebhookSignatureHeader = "X-QP2P-Signature"
+
+// Body of the POST requests sent to ServerOptions.WebhookURL.
+type WebhookPayload struct {
+	// One of "room_opened", "room_closed", "guest_joined" or "guest_left".
+	Event   string       `json:"event"`
+	RoomId  qp2p.RoomId  `json:"roomId"`
+	GuestId qp2p.GuestID `json:"guestId,omitzero"`
+	Reason  string       `json:"reason,omitempty"`
+	// When the server emitted the event.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Returns the webhook payload for ev, or false if ev is not sent to webhooks.
+func webhookPayload(ev ServerEvent) (WebhookPayload, bool) {
+	p := WebhookPayload{Timestamp: time.Now().UTC()}
+	switch ev := ev.(type) {
+	case RoomOpenedEvent:
+		p.Event, p.RoomId = "room_opened", ev.RoomId
+	case RoomClosedEvent:
+		p.Event, p.RoomId, p.Reason = "room_closed", ev.RoomId, ev.Reason
+	case GuestJoinedEvent:
+		p.Event, p.RoomId, p.GuestId = "guest_joined", ev.RoomId, ev.GuestId
+	case GuestLeftEvent:
+		p.Event, p.RoomId, p.GuestId, p.Reason = "guest_left", ev.RoomId, ev.GuestId, ev.Reason
+	default:
+		return WebhookPayload{}, false
+	}
+	return p, true
+}
+
+// Posts webhook payloads from a pool of workers, so slow webhooks never block the server.
+type webhookSender struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+	queue   chan WebhookPayload
+	log     *slog.Logger
+	metrics Metrics
+}
+
+// Starts workers goroutines posting to url. queueSize payloads can wait for a worker.
+func newWebhookSender(url, secret string, workers, queueSize, retries int, log *slog.Logger, metrics Metrics) *webhookSender {
+	w := &webhookSender{
+		url:     url,
+		secret:  []byte(secret),
+		retries: retries,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan WebhookPayload, queueSize),
+		log:     log,
+		metrics: metrics,
+	}
+	for range workers {
+		go w.work()
+	}
+	return w
+}
+
+// Queues ev to be posted. Dropped if the queue is full.
+//
+// Must not be called after close.
+func (w *webhookSender) send(ev ServerEvent) {
+	p, ok := webhookPayload(ev)
+	if !ok {
+		return
+	}
+	select {
+	case w.queue <- p:
+	default:
+		w.log.Warn("Webhook dropped, queue full", "event", p.Event, "id", p.RoomId)
+		w.metrics.Add(MetricWebhooksDropped, 1)
+	}
+}
+
+// Stops the workers once the queued payloads are posted.
+func (w *webhookSender) close() {
+	close(w.queue)
+}
+
+func (w *webhookSender) work() {
+	for p := range w.queue {
+		w.post(p)
+	}
+}
+
+// Posts p, retrying with exponential backoff up to w.retries times.
+func (w *webhookSender) post(p WebhookPayload) {
+	const firstBackoff = 500 * time.Millisecond
+	body, err := json.Marshal(p)
+	if err != nil {
+		w.log.Error("Failed to marshal webhook payload", "error", err)
+		return
+	}
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := firstBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.postOnce(body, signature)
+		if err == nil {
+			return
+		}
+		if attempt == w.retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	w.log.Warn("Webhook failed", "event", p.Event, "id", p.RoomId, "error", err)
+	w.metrics.Add(MetricWebhookFailures, 1)
+}
+
+func (w *webhookSender) postOnce(body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}
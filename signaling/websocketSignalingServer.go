@@ -1,10 +1,18 @@
 package signaling
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	qp2p "github.com/BrownNPC/QuicP2P"
@@ -15,210 +23,2154 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// How many random room IDs a new host tries before giving up.
+const roomIdAttempts = 100
+
+// Longest region a host can set with /host?region=.
+const maxRegionLen = 64
+
+// How long the host's messages for a guest admitted to its room wait for the guest to be registered, see parkedMsgs.
+const guestLookupWindow = 300 * time.Millisecond
+
+// Least time between two RoomStatus messages of a room.
+const roomStatusInterval = 250 * time.Millisecond
+
+// How often guests queued in a room's join window are sent WaitingForHost.
+const waitingInterval = 5 * time.Second
+
 // Serverside implementation of the Websocket Signaling Server that supports Trickle ICE.
-type guestConn = *websocket.Conn
-type hostConn = *websocket.Conn
 type WebsocketSignalingServer struct {
-	opts websocket.AcceptOptions
-	// map Room Id to host connection. Allowing guests to send messages.
-	hosts hashtriemap.HashTrieMap[qp2p.RoomId, hostConn]
-	// Map from Guest's ID to connection. Allowing Host to lookup.
-	guests hashtriemap.HashTrieMap[qp2p.GuestID, guestConn]
-	Mux    *http.ServeMux
-	log    *slog.Logger
+	opts  websocket.AcceptOptions
+	sopts ServerOptions
+	// map Room Id to room. Allowing guests to send messages to the host.
+	rooms hashtriemap.HashTrieMap[qp2p.RoomId, *room]
+	// Map from Guest's ID to guest. Allowing Host to lookup.
+	guests hashtriemap.HashTrieMap[qp2p.GuestID, *guest]
+	// map invite token to the room it was created for.
+	invites hashtriemap.HashTrieMap[string, *room]
+	// rate limits GET /rooms per IP address.
+	listLim *ipRateLimiter
+	// rate limits GET /room/{roomId} per IP address.
+	checkLim *ipRateLimiter
+	// limits rooms created with /host?roomId= per identity or IP address.
+	vanityLim *ipRateLimiter
+	Mux       *http.ServeMux
+	log       *slog.Logger
+
+	events       chan ServerEvent
+	eventsMu     sync.Mutex
+	eventsClosed bool
+	// posts events to ServerOptions.WebhookURL. nil if it is not set.
+	webhooks *webhookSender
+	// set by Shutdown. New hosts and guests are turned away.
+	shuttingDown atomic.Bool
+	// rooms open or being opened, capped by ServerOptions.MaxRooms.
+	roomCount atomic.Int64
+	// set with SetDraining. New hosts are turned away.
+	draining atomic.Bool
+	drainMu  sync.Mutex
+	// closed once the server is draining and roomCount is 0.
+	drained chan struct{}
+	// summaries of the rooms that closed last.
+	closedRooms *roomHistory
+	// parent of every connection's context. Cancelled if Shutdown gives up waiting for rooms to close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// the Registry, if it is a RoomRelay this node is subscribed to. nil otherwise.
+	relay       RoomRelay
+	unsubscribe func()
+	// connections relayed to or from other nodes, by session ID.
+	relays hashtriemap.HashTrieMap[string, *relaySession]
+	// serves the connections relayed to this node.
+	relayListener *pipeListener
+}
+
+// ServerOptions configures the WebsocketSignalingServer.
+//
+// Zero values use the defaults.
+type ServerOptions struct {
+	// Longest room password accepted from hosts and guests.
+	//
+	// Default is 64 bytes.
+	MaxPasswordLen int
+	// How long a room stays open after its host disconnects.
+	//
+	// The host can resume the room within this period with GET /host/resume/{roomId}
+	// and the resume token from RoomCreated. Guests are kicked when it expires.
+	//
+	// Default is 0, the room closes as soon as the host disconnects.
+	HostGracePeriod time.Duration
+	// How many messages for the host, like GuestJoined and IceCandidate, a room queues
+	// while the host is away, to write once it resumes.
+	// When the queue is full, the oldest queued IceCandidate is dropped to make room,
+	// or the new message if none is queued, and counted in MetricHostQueueDropped.
+	//
+	// Default is 256.
+	HostQueueLimit int
+	// How many of the queued messages for an away host can be from one guest,
+	// so a guest trickling candidates can't crowd out new guests.
+	//
+	// Default is 32.
+	HostQueuePerGuest int
+	// How long a guest keeps its GuestID after its websocket drops.
+	//
+	// The guest can rejoin within this period with GET /rejoin/{roomId}?guest=GuestId&token=
+	// and the resume token from Joined. The host is only sent GuestDisconnected when it expires,
+	// and messages for the guest are queued until it rejoins.
+	//
+	// Default is 0, the guest is removed as soon as its websocket drops.
+	GuestGracePeriod time.Duration
+	// How long a room can stay open. The host is sent RoomExpired and guests are kicked when it expires.
+	//
+	// Default is 0, rooms stay open until the host leaves.
+	MaxRoomAge time.Duration
+	// How long a room can stay open without guests. The host is sent RoomExpired when it expires.
+	//
+	// Default is 0, rooms without guests stay open.
+	IdleRoomTimeout time.Duration
+
+	// Largest message a host or guest can send. Connections that send more are
+	// closed with StatusMessageTooBig.
+	//
+	// Default is 4096 bytes.
+	MaxMessageSize int64
+	// permessage-deflate mode offered to hosts and guests that ask for it.
+	// Batched IceCandidate messages compress well, which helps over slow links.
+	//
+	// Overrides the CompressionMode of the AcceptOptions passed to NewWebsocketSignalingServer
+	// if set. Default is websocket.CompressionDisabled.
+	CompressionMode websocket.CompressionMode
+	// Smallest message that is compressed.
+	//
+	// Overrides the CompressionThreshold of the AcceptOptions if set. Default is websocket's,
+	// 128 bytes for CompressionContextTakeover and 512 for CompressionNoContextTakeover.
+	CompressionThreshold int
+
+	// Close the connection if a write takes longer than this.
+	//
+	// Default is 2 seconds.
+	WriteTimeout time.Duration
+	// Close the connection if the guest takes longer than this to send GuestAuth.
+	//
+	// Once connected, hosts and guests can stay quiet for as long as they answer pings.
+	//
+	// Default is 2 seconds.
+	ReadTimeout time.Duration
+	// Close the guest connection if the host does not answer its JoinRequest within this long,
+	// in rooms that need approval.
+	//
+	// Default is 60 seconds.
+	ApprovalTimeout time.Duration
+	// Close the guest connection if the host does not send HostAuth within this
+	// long of GuestJoined.
+	//
+	// Default is 10 seconds.
+	HandshakeTimeout time.Duration
+	// How often hosts and guests are pinged. A connection that fails a ping is closed.
+	//
+	// Default is 500 milliseconds.
+	PingInterval time.Duration
+
+	// Longest room name a host can set with SetRoomInfo.
+	//
+	// Default is 64 bytes.
+	MaxRoomNameLen int
+	// Largest room metadata a host can set with SetRoomInfo.
+	//
+	// Default is 1024 bytes.
+	MaxRoomMetadataLen int
+	// Largest Relay payload forwarded between hosts and guests.
+	//
+	// Default is 1024 bytes.
+	MaxRelayPayloadLen int
+	// Requests per second an IP address can make to GET /rooms.
+	//
+	// Default is 1.
+	ListRoomsRate rate.Limit
+	// Requests an IP address can make to GET /rooms in a burst.
+	//
+	// Default is 5.
+	ListRoomsBurst int
+	// Requests per second an IP address can make to GET /room/{roomId}.
+	// Kept low so room IDs can't be enumerated.
+	//
+	// Default is 0.5.
+	CheckRoomRate rate.Limit
+	// Requests an IP address can make to GET /room/{roomId} in a burst.
+	//
+	// Default is 3.
+	CheckRoomBurst int
+	// Lets hosts pick their room's ID with /host?roomId=, e.g. "FINALS" for a tournament.
+	// IDs are 4 to 16 letters, digits and dashes, and are uppercased. Hosts get 409 if the ID is taken.
+	//
+	// Default is false, hosts that ask for an ID get 400.
+	VanityRoomIds bool
+	// Checks the IDs hosts pick with /host?roomId=, e.g. against a list of offensive words.
+	// Hosts get 400 with the error as the message if it returns one.
+	//
+	// Must be safe for concurrent use. Default is nil, every ID is allowed.
+	RoomIdFilter func(roomId qp2p.RoomId) error
+	// Rooms per second a host can create with /host?roomId=, so IDs can't be squatted.
+	// Hosts are limited by their identity from the Authenticator, or by IP address without one.
+	//
+	// Default is 1 per minute.
+	VanityRoomRate rate.Limit
+	// Rooms a host can create with /host?roomId= in a burst.
+	//
+	// Default is 3.
+	VanityRoomBurst int
+
+	// How many rooms the server hosts at once. New hosts get 503 when it is reached.
+	//
+	// Default is 0, no limit.
+	MaxRooms int
+	// Retry-After sent to hosts turned away by MaxRooms.
+	//
+	// Default is 5 seconds.
+	MaxRoomsRetryAfter time.Duration
+
+	// How many IP addresses a host can ban from its room.
+	//
+	// Default is 256.
+	MaxBansPerRoom int
+	// How many spectators can join a room with GET /spectate/{roomId}.
+	// Spectators do not count toward the room's MaxGuests. Set to -1 to turn spectators away.
+	//
+	// Default is 16.
+	MaxSpectatorsPerRoom int
+	// How many guests can wait in a full room's queue, in rooms created with GET /host?queue=true.
+	// Guests that join with ?queue=true once the queue is full are turned away with StatusRoomFull.
+	//
+	// Default is 16.
+	MaxQueuedGuests int
+	// How many unexpired invite tokens a room can have, used or not. See CreateInvites.
+	//
+	// Default is 64.
+	MaxInvitesPerRoom int
+	// How long invite tokens can be used for.
+	//
+	// Default is 1 hour.
+	InviteTTL time.Duration
+
+	// Checks GET /host and GET /join requests before the websocket is accepted.
+	// See BearerTokenAuthenticator and HMACTicketAuthenticator.
+	//
+	// Default is nil, anyone can create and join rooms.
+	Authenticator Authenticator
+
+	// Bearer token for the /admin endpoints.
+	//
+	// Default is empty, the /admin endpoints are not registered.
+	AdminToken string
+	// How many summaries of closed rooms are kept for ClosedRooms and GET /admin/rooms/closed.
+	//
+	// Default is 64.
+	ClosedRoomHistory int
+
+	// Records which node hosts each room, shared by every node behind a load balancer.
+	// If it is a RoomRelay, e.g. one backed by Redis, guests and hosts that reach another node
+	// for a room on this one are relayed here through that node.
+	//
+	// Default is a new MemoryRegistry, for a single node.
+	Registry RoomRegistry
+	// Base URL of this node, e.g. "wss://node1.example.com". Guests and hosts that reach
+	// another node for a room on this one are redirected here, unless the Registry relays them.
+	// It must be unique among the nodes sharing the Registry.
+	//
+	// Default is empty, for a single node.
+	NodeURL string
+	// How often two nodes relaying a connection tell each other it is still open. If nothing
+	// arrives from the other node for three intervals, e.g. as it crashed, the connection is closed.
+	//
+	// Default is 5 seconds.
+	RelayKeepalive time.Duration
+	// Region the server runs in, e.g. "eu-west", sent to hosts in RoomCreated, to guests in RoomInfo,
+	// and listed by GET /rooms, so guests can estimate latency or pick a server.
+	// Hosts can set their own hint with /host?region=.
+	//
+	// Default is empty.
+	Region string
+	// Reverse proxies, e.g. nginx or Caddy, whose X-Forwarded-For and Forwarded headers are trusted
+	// for the client's address. Bans, per-IP rate limits, logs and events use that address.
+	//
+	// Default is empty, the headers are ignored and the address of the direct peer is used.
+	TrustedProxies []netip.Prefix
+	// Generates IDs for new rooms, e.g. 4 digit PINs for LAN parties or word pairs like "blue-falcon".
+	//
+	// Must be safe for concurrent use. IDs are uppercased, so guests can type them in any case.
+	// IDs that are taken are retried, and hosts get 503 if no free ID is generated in 100 attempts.
+	//
+	// Default is 6 random uppercase letters and digits, without the easily confused 0, O, 1 and I.
+	RoomIdGenerator func() qp2p.RoomId
+	// Assigns the GuestID of a guest once it sends auth, its GuestAuth. It can derive the ID from
+	// the account the Authenticator checked, see Identity, so a player keeps its GuestID across
+	// sessions, e.g. with uuid.NewSHA1, or return sequenced IDs in tests.
+	//
+	// Must be safe for concurrent use. Guests it returns an error for are closed with
+	// StatusJoinRejected and the error.
+	//
+	// Default is a random uuid.New().
+	GuestIDAssigner func(r *http.Request, auth Msg) (qp2p.GuestID, error)
+	// What happens to a guest assigned a GuestID that another guest on the server is using.
+	//
+	// Default is RejectDuplicateGuest.
+	DuplicateGuests DuplicateGuestPolicy
+
+	// URL the server POSTs a WebhookPayload to when a room opens or closes, and when a guest joins or leaves.
+	//
+	// Requests are signed with WebhookSecret in the WebhookSignatureHeader header.
+	// Failed requests are retried with backoff, then logged and counted in MetricWebhookFailures.
+	//
+	// Default is empty, no webhooks are sent.
+	WebhookURL string
+	// Key of the HMAC-SHA256 signature of webhook requests.
+	WebhookSecret string
+	// How many webhook requests are sent at once.
+	//
+	// Default is 4.
+	WebhookWorkers int
+	// How many webhooks can wait for a worker before new ones are dropped.
+	//
+	// Default is 256.
+	WebhookQueueSize int
+	// How many times a failed webhook request is retried.
+	//
+	// Default is 3.
+	WebhookRetries int
+
+	// Receives the server's counters and latencies.
+	//
+	// Default is a new MemoryMetrics.
+	Metrics Metrics
+
+	// How many events the Events channel buffers before dropping the oldest.
+	//
+	// Default is 64.
+	EventBufferSize int
+
+	// Answer messages of a type the server does not know, e.g. from a newer client, with an
+	// Error with ErrorUnknownMessageType. They are dropped and counted in MetricUnknownMessages either way.
+	//
+	// Default is false, they are dropped silently.
+	ReplyUnknownTypes bool
+
+	// How many messages can wait to be written to a connection.
+	// When the queue is full, an ICE candidate replaces the oldest queued candidate
+	// and is counted in MetricCandidatesDropped. Other messages wait up to
+	// WriteTimeout and then close the connection.
+	//
+	// Default is 64.
+	WriteQueueDepth int
+
+	// Messages per second a guest can send.
+	//
+	// Default is 10.
+	GuestMsgRate rate.Limit
+	// Messages a guest can send in a burst.
+	//
+	// Default is 20.
+	GuestMsgBurst int
+	// Messages per second a host can send across all guests.
+	// Hosts that go over are disconnected.
+	//
+	// Default is 50.
+	HostMsgRate rate.Limit
+	// Messages a host can send in a burst across all guests.
+	//
+	// Default is 100.
+	HostMsgBurst int
+	// ICE candidates per second a host can send to each connected guest.
+	// Candidates over the limit are dropped.
+	//
+	// Default is 5.
+	HostMsgRatePerGuest rate.Limit
+	// ICE candidates a host can send to each connected guest in a burst.
+	//
+	// Default is 20.
+	HostMsgBurstPerGuest int
+	// Extra messages a guest, and the host to that guest, can send in a burst
+	// during HandshakeWindow after the guest's GuestAuth, on top of GuestMsgBurst and HostMsgBurstPerGuest,
+	// so candidates trickled right after connecting are not rate limited.
+	// The host's messages to guests in their window are not counted against HostMsgRate,
+	// so a wave of joins does not close the host.
+	//
+	// Default is 30. -1 means no extra burst.
+	HandshakeBurst int
+	// How long after GuestAuth the HandshakeBurst lasts.
+	//
+	// Default is 10 seconds.
+	HandshakeWindow time.Duration
+
+	// How often hosts that created their room with GET /host?heartbeat=true must send Heartbeat.
+	// Heartbeats show the host application is still running, where websocket pings only show its connection is.
+	//
+	// Default is 5 seconds.
+	HostHeartbeatInterval time.Duration
+	// How many heartbeats in a row a host can miss before its room is closed
+	// and its guests are kicked with StatusHostUnresponsive.
+	//
+	// Default is 3.
+	HostHeartbeatMisses int
+}
+
+// What the server does with a guest assigned a GuestID that another guest is using,
+// see ServerOptions.GuestIDAssigner.
+type DuplicateGuestPolicy int
+
+const (
+	// The new guest is closed with StatusDuplicateGuest, and the guest using the GuestID stays.
+	RejectDuplicateGuest DuplicateGuestPolicy = iota
+	// The guest using the GuestID is removed and closed with StatusReplaced, e.g. when a player
+	// reconnects from another device, and the host is sent GuestDisconnected with ReasonReplaced.
+	ReplaceDuplicateGuest
+)
+
+// Returns a copy of o with zero values replaced by the defaults.
+func (o ServerOptions) withDefaults() ServerOptions {
+	if o.MaxPasswordLen == 0 {
+		o.MaxPasswordLen = 64
+	}
+	if o.WriteTimeout == 0 {
+		o.WriteTimeout = time.Second * 2
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = time.Second * 2
+	}
+	if o.PingInterval == 0 {
+		o.PingInterval = time.Second / 2
+	}
+	if o.MaxMessageSize == 0 {
+		o.MaxMessageSize = 4096
+	}
+	if o.ApprovalTimeout == 0 {
+		o.ApprovalTimeout = 60 * time.Second
+	}
+	if o.HandshakeTimeout == 0 {
+		o.HandshakeTimeout = 10 * time.Second
+	}
+	if o.MaxRoomNameLen == 0 {
+		o.MaxRoomNameLen = 64
+	}
+	if o.MaxRoomMetadataLen == 0 {
+		o.MaxRoomMetadataLen = 1024
+	}
+	if o.MaxRelayPayloadLen == 0 {
+		o.MaxRelayPayloadLen = 1024
+	}
+	if o.ListRoomsRate == 0 {
+		o.ListRoomsRate = 1
+	}
+	if o.ListRoomsBurst == 0 {
+		o.ListRoomsBurst = 5
+	}
+	if o.CheckRoomRate == 0 {
+		o.CheckRoomRate = 0.5
+	}
+	if o.CheckRoomBurst == 0 {
+		o.CheckRoomBurst = 3
+	}
+	if o.VanityRoomRate == 0 {
+		o.VanityRoomRate = rate.Every(time.Minute)
+	}
+	if o.VanityRoomBurst == 0 {
+		o.VanityRoomBurst = 3
+	}
+	if o.MaxRoomsRetryAfter == 0 {
+		o.MaxRoomsRetryAfter = 5 * time.Second
+	}
+	if o.MaxBansPerRoom == 0 {
+		o.MaxBansPerRoom = 256
+	}
+	if o.Registry == nil {
+		o.Registry = NewMemoryRegistry()
+	}
+	if o.RelayKeepalive == 0 {
+		o.RelayKeepalive = 5 * time.Second
+	}
+	if o.GuestIDAssigner == nil {
+		o.GuestIDAssigner = func(*http.Request, Msg) (qp2p.GuestID, error) { return uuid.New(), nil }
+	}
+	if o.RoomIdGenerator == nil {
+		o.RoomIdGenerator = internal.SixCharRoomID
+	}
+	if o.WebhookWorkers == 0 {
+		o.WebhookWorkers = 4
+	}
+	if o.WebhookQueueSize == 0 {
+		o.WebhookQueueSize = 256
+	}
+	if o.WebhookRetries == 0 {
+		o.WebhookRetries = 3
+	}
+	if o.Metrics == nil {
+		o.Metrics = NewMemoryMetrics()
+	}
+	if o.EventBufferSize == 0 {
+		o.EventBufferSize = 64
+	}
+	if o.MaxSpectatorsPerRoom == 0 {
+		o.MaxSpectatorsPerRoom = 16
+	}
+	if o.MaxQueuedGuests == 0 {
+		o.MaxQueuedGuests = 16
+	}
+	if o.MaxInvitesPerRoom == 0 {
+		o.MaxInvitesPerRoom = 64
+	}
+	if o.InviteTTL == 0 {
+		o.InviteTTL = time.Hour
+	}
+	if o.ClosedRoomHistory == 0 {
+		o.ClosedRoomHistory = 64
+	}
+	if o.WriteQueueDepth == 0 {
+		o.WriteQueueDepth = 64
+	}
+	if o.HostQueueLimit == 0 {
+		o.HostQueueLimit = 256
+	}
+	if o.HostQueuePerGuest == 0 {
+		o.HostQueuePerGuest = 32
+	}
+	if o.GuestMsgRate == 0 {
+		o.GuestMsgRate = 10
+	}
+	if o.GuestMsgBurst == 0 {
+		o.GuestMsgBurst = 20
+	}
+	if o.HostMsgRate == 0 {
+		o.HostMsgRate = 50
+	}
+	if o.HostMsgBurst == 0 {
+		o.HostMsgBurst = 100
+	}
+	if o.HostMsgRatePerGuest == 0 {
+		o.HostMsgRatePerGuest = 5
+	}
+	if o.HostMsgBurstPerGuest == 0 {
+		o.HostMsgBurstPerGuest = 20
+	}
+	if o.HandshakeBurst == 0 {
+		o.HandshakeBurst = 30
+	}
+	if o.HandshakeWindow == 0 {
+		o.HandshakeWindow = 10 * time.Second
+	}
+	if o.HostHeartbeatInterval == 0 {
+		o.HostHeartbeatInterval = 5 * time.Second
+	}
+	if o.HostHeartbeatMisses == 0 {
+		o.HostHeartbeatMisses = 3
+	}
+	return o
 }
 
 // Uses Default logger if logger is nil.
-// RoomIdGen can be nil. It will use the default Id generator.
-func NewWebsocketSignalingServer(log *slog.Logger, opts websocket.AcceptOptions) *WebsocketSignalingServer {
+// sopts.RoomIdGenerator can be nil. It will use the default Id generator.
+func NewWebsocketSignalingServer(log *slog.Logger, opts websocket.AcceptOptions, sopts ServerOptions) *WebsocketSignalingServer {
 	if log == nil {
 		log = slog.Default()
 	}
 	s := new(WebsocketSignalingServer)
 	s.log = log
 	s.opts = opts
+	s.sopts = sopts.withDefaults()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.listLim = newIPRateLimiter(s.sopts.ListRoomsRate, s.sopts.ListRoomsBurst)
+	s.checkLim = newIPRateLimiter(s.sopts.CheckRoomRate, s.sopts.CheckRoomBurst)
+	s.vanityLim = newIPRateLimiter(s.sopts.VanityRoomRate, s.sopts.VanityRoomBurst)
+	s.events = make(chan ServerEvent, s.sopts.EventBufferSize)
+	s.drained = make(chan struct{})
+	s.closedRooms = newRoomHistory(s.sopts.ClosedRoomHistory)
+	if s.sopts.WebhookURL != "" {
+		s.webhooks = newWebhookSender(s.sopts.WebhookURL, s.sopts.WebhookSecret, s.sopts.WebhookWorkers,
+			s.sopts.WebhookQueueSize, s.sopts.WebhookRetries, s.log, s.sopts.Metrics)
+	}
 	s.Mux = new(http.ServeMux)
-	s.Mux.HandleFunc("POST /host", s.host)
-	s.Mux.HandleFunc("POST /join/{roomId}", s.join)
+	s.Mux.HandleFunc("GET /host", s.host)
+	s.Mux.HandleFunc("GET /host/resume/{roomId}", s.resume)
+	s.Mux.HandleFunc("GET /join/{roomId}", s.join)
+	s.Mux.HandleFunc("GET /join/token/{token}", s.joinInvite)
+	s.Mux.HandleFunc("GET /spectate/{roomId}", s.spectate)
+	s.Mux.HandleFunc("GET /rejoin/{roomId}", s.rejoin)
+	s.Mux.HandleFunc("GET /rooms", s.listRooms)
+	s.Mux.HandleFunc("GET /room/{roomId}", s.checkRoom)
+	if s.sopts.AdminToken != "" {
+		s.Mux.HandleFunc("GET /admin/rooms", s.admin(s.adminListRooms))
+		s.Mux.HandleFunc("GET /admin/rooms/closed", s.admin(s.adminClosedRooms))
+		s.Mux.HandleFunc("GET /admin/rooms/{roomId}", s.admin(s.adminGetRoom))
+		s.Mux.HandleFunc("DELETE /admin/rooms/{roomId}", s.admin(s.adminCloseRoom))
+		s.Mux.HandleFunc("DELETE /admin/rooms/{roomId}/guests/{guestId}", s.admin(s.adminKickGuest))
+	}
+	if relay, ok := s.sopts.Registry.(RoomRelay); ok && s.sopts.NodeURL != "" {
+		s.startRelay(relay)
+	}
 	return s
 }
 
-// POST /join/{roomId}
+// GET /join/{roomId}
 func (s *WebsocketSignalingServer) join(w http.ResponseWriter, r *http.Request) {
-	const timeout = time.Second * 2 // Close if writes take longer than this
+	s.joinAs(w, r, RolePlayer, "")
+}
 
-	// roomId is passed from path /join/{roomId}
-	roomId := qp2p.RoomId(r.PathValue("roomId"))
-	// close connection if room does not exist.
-	hConn, ok := s.hosts.Load(roomId)
+// GET /spectate/{roomId}
+//
+// Joins the room like GET /join/{roomId}, but the host is told the guest is a spectator
+// in GuestJoined, and the guest counts toward MaxSpectatorsPerRoom instead of MaxGuests.
+func (s *WebsocketSignalingServer) spectate(w http.ResponseWriter, r *http.Request) {
+	s.joinAs(w, r, RoleSpectator, "")
+}
+
+// Joins the room in the request path, or the room of the invite token if it is set.
+func (s *WebsocketSignalingServer) joinAs(w http.ResponseWriter, r *http.Request, role Role, invite string) {
+	timeout := s.sopts.WriteTimeout // Close if writes take longer than this
+	log := s.connLogger(w, r)
+
+	if s.shuttingDown.Load() {
+		s.joinRejected("shutting_down")
+		writeHTTPError(w, http.StatusServiceUnavailable, CodeShuttingDown, "server shutting down")
+		return
+	}
+	if !checkVersion(w, r) {
+		s.joinRejected("unsupported_version")
+		return
+	}
+	identity, ok := s.authenticate(w, r, qp2p.ClientTypeGuest)
 	if !ok {
-		s.log.Debug("Guest join room, room does not exist", "id", roomId)
+		s.joinRejected("unauthenticated")
+		return
+	}
+	// roomId is passed from path /join/{roomId} or /spectate/{roomId}
+	roomId := pathRoomId(r)
+	if invite != "" {
+		id, err := s.useInvite(invite)
+		if err != nil {
+			log.Debug("Guest join room, invalid invite", "error", err)
+			s.joinRejected("invalid_invite")
+			if err == ErrInviteExpired {
+				writeHTTPError(w, http.StatusGone, CodeInviteExpired, "invite used or expired")
+			} else {
+				writeHTTPError(w, http.StatusNotFound, CodeInviteNotFound, "invite not found")
+			}
+			return
+		}
+		roomId = id
+	}
+	log = log.With("room", roomId, "role", role)
+	// password can be passed as /join/{roomId}?password= or in the GuestAuth message.
+	password := r.URL.Query().Get("password")
+	if len(password) > s.sopts.MaxPasswordLen {
+		s.joinRejected("password_too_long")
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "password too long")
+		return
+	}
+	// close connection if room does not exist.
+	rm, ok := s.rooms.Load(roomId)
+	if !ok && s.routeToNode(w, r, roomId) {
+		return
+	} else if !ok {
+		log.Debug("Guest join room, room does not exist")
+		s.joinRejected("not_found")
+		writeHTTPError(w, http.StatusNotFound, CodeRoomNotFound, "room not found")
+		return
+	}
+	ip := s.remoteIP(r)
+	if rm.isBanned(ip) {
+		log.Debug("Guest join room, guest is banned", "ip", ip)
+		s.joinRejected("banned")
+		writeHTTPError(w, http.StatusForbidden, CodeBanned, "banned")
+		return
+	}
+	if rm.isLocked() {
+		log.Debug("Guest join room, room is locked")
+		s.joinRejected("locked")
+		writeHTTPError(w, http.StatusLocked, CodeRoomLocked, "room locked")
+		return
+	}
+	// guests that ask to can wait for a slot, if the host lets them.
+	queue, _ := strconv.ParseBool(r.URL.Query().Get("queue"))
+	queue = queue && rm.queueLimit > 0
+	if !queue && rm.isFull(role) {
+		log.Debug("Guest join room, room is full")
+		s.joinRejected("room_full")
+		writeHTTPError(w, http.StatusForbidden, CodeRoomFull, "room full")
 		return
 	}
 
 	// accept guest websocket.
-	gConn, err := websocket.Accept(w, r, &s.opts)
+	ws, err := s.accept(w, r)
 	if err != nil {
-		s.log.Debug("Failed to accept host", "error", err)
+		log.Debug("Failed to accept guest", "error", err)
 		return
 	}
+	gConn := newGuestConn(s.ctx, ws, s.sopts.WriteQueueDepth, timeout, s.writeFailed, s.queueDropped)
 	// incase it leaks somehow
 	defer gConn.CloseNow()
 
-	// randomly generated guest id
-	var guestId qp2p.GuestID = uuid.New()
+	// the host may have left while the websocket was being accepted.
+	if current, ok := s.rooms.Load(roomId); !ok || current != rm {
+		gConn.Close(StatusRoomClosed, closeReason(StatusRoomClosed, ""))
+		log.Debug("Guest join room, room closed during accept")
+		s.joinRejected("not_found")
+		return
+	}
+	// let the guest check the room before it sends its credentials.
+	if err := msgRoomInfo(gConn.ctx, gConn, rm.getInfo(), rm.region); err != nil {
+		log.Debug("Failed to write Msg RoomInfo", "error", err)
+		return
+	}
+
 	// loaded from GuestAuth message.
 	var guestUfrag, guestPwd string
 
 	// expect guest to send GuestAuth message right after it connects.
-	authMsg, err := ReadMsg(gConn, timeout)
+	readCtx, cancel := context.WithTimeout(gConn.ctx, s.sopts.ReadTimeout)
+	pings := newPingLimiter()
+	authMsg, err := ReadMsg(readCtx, gConn.Conn)
+	// pings are answered before GuestAuth, so a guest can measure its latency before joining.
+	// Types the server does not know are skipped, they may be from a newer client.
+	for err == nil && (authMsg.Type == Ping || !authMsg.Type.Valid()) {
+		if authMsg.Type == Ping {
+			s.pong(readCtx, gConn, roomId, authMsg, pings)
+		} else {
+			s.unknownType(readCtx, gConn, roomId, authMsg, "guest", log)
+		}
+		authMsg, err = ReadMsg(readCtx, gConn.Conn)
+	}
+	cancel()
+	authAt := time.Now()
 
 	// check for errors before reading message.
-	if err != nil { // error while reading message.
-		gConn.Close(websocket.StatusInvalidFramePayloadData, "failed to read message")
-		s.log.Debug("join: Failed to read GuestAuth message", "error", err)
+	if errors.Is(err, ErrMessageTooLarge) {
+		gConn.Close(websocket.StatusMessageTooBig, "message too large")
+		log.Debug("join: GuestAuth message too large", "error", err)
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "message too large"})
+		return
+	} else if err != nil { // error while reading message.
+		gConn.Close(StatusInvalidMessage, closeReason(StatusInvalidMessage, "failed to read GuestAuth"))
+		log.Debug("join: Failed to read GuestAuth message", "error", err)
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "failed to read GuestAuth"})
 		return
 		//if invalid message type
 	} else if authMsg.Type != GuestAuth {
-		gConn.Close(websocket.StatusPolicyViolation, fmt.Sprintf("Expected GuestAuth message. Got %s", authMsg.Type))
-		s.log.Debug("GuestAuth message expected, but got something else, closing", "got", authMsg.Type.String())
+		gConn.Close(StatusInvalidMessage, closeReason(StatusInvalidMessage, fmt.Sprintf("expected GuestAuth, got %s", authMsg.Type)))
+		log.Debug("GuestAuth message expected, but got something else, closing", "got", authMsg.Type.String())
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "expected GuestAuth"})
+		return
+	}
+
+	auth := PayloadOf(authMsg).(GuestAuthMsg)
+	// password in GuestAuth takes priority over the one in the url.
+	if auth.Password != "" {
+		password = auth.Password
+	}
+	// the invite token stands in for the password.
+	if invite == "" && (len(password) > s.sopts.MaxPasswordLen || !rm.checkPassword(password)) {
+		gConn.Close(StatusWrongPassword, closeReason(StatusWrongPassword, ""))
+		log.Debug("Guest join room, wrong password")
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "wrong password"})
+		s.joinRejected("wrong_password")
 		return
 	}
 
 	// Load ufrag and pwd from GuestAuth msg.
-	guestUfrag = authMsg.Ufrag
-	guestPwd = authMsg.Pwd
+	guestUfrag = auth.Ufrag
+	guestPwd = auth.Pwd
+	if reason := checkCredentials(guestUfrag, guestPwd); reason != "" {
+		gConn.Close(websocket.StatusPolicyViolation, closeReason(websocket.StatusPolicyViolation, reason))
+		log.Debug("GuestAuth message invalid ICE credentials, closing", "reason", reason)
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "GuestAuth invalid credentials"})
+		s.credentialsRejected(reason)
+		s.joinRejected("invalid_credentials")
+		return
+	}
+
+	// clients check the length before sending, so longer metadata is from a broken client.
+	if len(auth.Metadata) > MaxGuestMetadataLen {
+		gConn.Close(StatusInvalidMessage, closeReason(StatusInvalidMessage, "metadata too long"))
+		log.Debug("GuestAuth message metadata too long, closing", "len", len(auth.Metadata))
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "GuestAuth metadata too long"})
+		s.joinRejected("metadata_too_long")
+		return
+	}
 
-	// Tell the host that a guest has joined.
-	err = msgGuestJoined(hConn, timeout, guestId, guestUfrag, guestPwd)
+	// randomly generated, or from the GuestIDAssigner.
+	guestId, err := s.sopts.GuestIDAssigner(withIdentity(r, identity), authMsg)
 	if err != nil {
-		s.log.Debug("Failed to write Msg Guest Joined", "error", err)
-		gConn.Close(websocket.StatusInternalError, "failed to write message")
+		gConn.Close(StatusJoinRejected, closeReason(StatusJoinRejected, err.Error()))
+		log.Debug("Guest join room, GuestIDAssigner rejected guest", "error", err)
+		s.joinRejected("guest_id")
 		return
 	}
-	// Ping loop
-	go func() {
-		for {
-			time.Sleep(time.Second / 2)
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			err := gConn.Ping(ctx)
-			cancel()
-			if err != nil {
-				s.log.Debug("guest shutting down ping loop", "error", err)
-				return
-			}
+	log = log.With("guest", guestId)
+	if !s.claimGuestId(guestId) {
+		gConn.Close(StatusDuplicateGuest, closeReason(StatusDuplicateGuest, ""))
+		log.Debug("Guest join room, guest id already in use")
+		s.joinRejected("duplicate_guest")
+		return
+	}
+
+	g := &guest{id: guestId, room: rm, gConn: gConn, ip: ip, role: role, metadata: auth.Metadata, identity: identity, authAt: authAt, log: log}
+	// other guests may have filled or locked the room since the websocket was accepted.
+	err = rm.admit(g)
+	if err == ErrRoomFull && queue {
+		if a := s.awaitSlot(rm, g, gConn); !a.accepted {
+			gConn.Close(a.code, closeReason(a.code, a.reason))
+			log.Debug("Guest join room, not admitted from queue", "reason", a.reason)
+			s.joinRejected("room_full")
+			return
 		}
-	}()
+		err = nil
+	}
+	if err != nil {
+		switch err {
+		case ErrRoomLocked:
+			gConn.Close(StatusRoomLocked, closeReason(StatusRoomLocked, ""))
+			s.joinRejected("locked")
+		case ErrRoomFull:
+			gConn.Close(StatusRoomFull, closeReason(StatusRoomFull, ""))
+			s.joinRejected("room_full")
+		case ErrDuplicateGuest:
+			gConn.Close(StatusDuplicateGuest, closeReason(StatusDuplicateGuest, ""))
+			s.joinRejected("duplicate_guest")
+		default:
+			gConn.Close(StatusRoomClosed, closeReason(StatusRoomClosed, ""))
+			s.joinRejected("not_found")
+		}
+		log.Debug("Guest join room, not admitted", "error", err)
+		return
+	}
+	// wait for the host to accept the guest.
+	if rm.approval {
+		if a := s.awaitApproval(rm, guestId, auth.Metadata, role); !a.accepted {
+			rm.removeGuest(guestId)
+			gConn.Close(a.code, closeReason(a.code, a.reason))
+			log.Debug("Guest join room, rejected", "reason", a.reason)
+			s.joinRejected("rejected")
+			return
+		}
+	}
+
+	// guests can only rejoin if there is a grace period.
+	if s.sopts.GuestGracePeriod > 0 {
+		g.resumeToken = rand.Text()
+	}
+	// close the guest if the host ignores it.
+	// candidates from the guest do not reset the timer.
+	g.handshake = time.AfterFunc(s.sopts.HandshakeTimeout, func() {
+		if s.removeGuest(g, "host did not respond") {
+			rm.handshakeFailed()
+			log.Debug("Guest closed, host did not send HostAuth")
+			g.closeConn(StatusHostTimeout, closeReason(StatusHostTimeout, ""))
+		}
+	})
 	// connected to room. map guest id to connetion. So host can access.
-	s.guests.Store(guestId, gConn)
-	defer s.guests.Delete(guestId)
-	// tell the host that the guest has disconnected from the signaling server.
-	defer msgGuestDisconnected(hConn, timeout, guestId)
-	lim := rate.NewLimiter(10, 20)
+	// stored before GuestJoined, so the host's answer always finds the guest.
+	if _, loaded := s.guests.LoadOrStore(guestId, g); loaded {
+		// another guest with the same GuestID got here first.
+		g.handshake.Stop()
+		rm.removeGuest(guestId)
+		gConn.Close(StatusDuplicateGuest, closeReason(StatusDuplicateGuest, ""))
+		log.Debug("Guest join room, guest id already in use")
+		s.joinRejected("duplicate_guest")
+		return
+	}
+	s.sopts.Metrics.Add(MetricActiveGuests, 1)
+	// before GuestJoined, so the guest knows its GuestID, which the host seals HostAuth with, before HostAuth.
+	msgJoined(gConn.ctx, gConn, guestId, g.resumeToken)
+
+	// Tell the host that a guest has joined, or wait for room in its join window.
+	if !rm.announce(g, guestUfrag, guestPwd) {
+		// the host can't time out a guest it was not told about yet.
+		g.handshake.Stop()
+		log.Debug("Guest queued, host join window full")
+		s.waitForHost(rm, g)
+	} else if err = msgGuestJoined(gConn.ctx, rm, guestId, guestUfrag, guestPwd, role, g.metadata); err != nil {
+		log.Debug("Failed to write Msg Guest Joined", "error", err)
+		g.handshake.Stop()
+		if s.guests.CompareAndDelete(guestId, g) {
+			s.sopts.Metrics.Add(MetricActiveGuests, -1)
+		}
+		rm.removeGuest(guestId)
+		s.releaseJoins(rm, guestId)
+		gConn.Close(websocket.StatusInternalError, "failed to write message")
+		return
+	}
+	s.roomStatusChanged(rm)
+	log.Debug("Guest joined room", "identity", identity)
+	s.emit(GuestJoinedEvent{RoomId: roomId, GuestId: guestId, RemoteAddr: s.remoteAddr(r), Identity: identity})
+	s.serveGuest(g, gConn, log)
+}
+
+// GET /rejoin/{roomId}?guest=&token=
+//
+// Re-attaches a guest to its GuestID during the grace period, using the resume token from Joined.
+func (s *WebsocketSignalingServer) rejoin(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	log := s.connLogger(w, r)
+	roomId := pathRoomId(r)
+	guestId, err := uuid.Parse(r.URL.Query().Get("guest"))
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid guest id")
+		return
+	}
+	log = log.With("room", roomId, "guest", guestId)
+	g, ok := s.guests.Load(guestId)
+	if !ok && s.routeToNode(w, r, roomId) {
+		return
+	} else if !ok || g.room.id != roomId {
+		log.Debug("Guest rejoin room, guest not found")
+		writeHTTPError(w, http.StatusNotFound, CodeGuestNotFound, "guest not found")
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if !g.checkResumeToken(token) {
+		log.Debug("Guest rejoin room, invalid resume token")
+		writeHTTPError(w, http.StatusForbidden, CodeInvalidResumeToken, "invalid resume token")
+		return
+	}
+
+	ws, err := s.accept(w, r)
+	if err != nil {
+		log.Debug("Failed to accept guest", "error", err)
+		return
+	}
+	gConn := newGuestConn(s.ctx, ws, s.sopts.WriteQueueDepth, s.sopts.WriteTimeout, s.writeFailed, s.queueDropped)
+	defer gConn.CloseNow()
+	// Joined is sent before the queued messages, so the guest learns its next token first.
+	newToken := rand.Text()
+	msgJoined(gConn.ctx, gConn, guestId, newToken)
+	// the grace period may have ended, or the token been used, while the websocket was being accepted.
+	old, ok := g.resume(gConn, token, newToken)
+	if !ok {
+		gConn.Close(StatusRoomClosed, closeReason(StatusRoomClosed, "guest not found"))
+		return
+	}
+	if old != nil {
+		old.Close(StatusReplaced, closeReason(StatusReplaced, "guest rejoined"))
+	}
+	log.Debug("Guest rejoined")
+	s.serveGuest(g, gConn, log)
+}
+
+// Forwards messages from the guest's connection gConn to its host, until gConn closes.
+func (s *WebsocketSignalingServer) serveGuest(g *guest, gConn *GuestConn, log *slog.Logger) {
+	rm, roomId, guestId := g.room, g.room.id, g.id
+
+	// tell the host that the guest has disconnected, and why, unless it rejoins.
+	reason := ReasonDisconnected
+	defer func() { s.guestLeft(g, gConn, reason) }()
+	// the connection stays open as long as it answers pings.
+	// reads wait on ctx instead of a deadline, so quiet connections are not dropped.
+	ctx, cancel := context.WithCancelCause(gConn.ctx)
+	defer cancel(nil)
+	go s.pingLoop(ctx, cancel, gConn.Conn, log)
+	go s.watchRoom(ctx, g)
+	lim := newHandshakeLimiter(s.sopts.GuestMsgRate, s.sopts.GuestMsgBurst, s.sopts.HandshakeBurst, s.handshakeEnd(g))
+	pings := newPingLimiter()
+	in := new(Msg)
 	for {
+		err := ReadMsgInto(ctx, gConn.Conn, in)
+		msg := *in
+		// pings have their own limit.
+		if err == nil && msg.Type == Ping {
+			s.pong(ctx, gConn, roomId, msg, pings)
+			continue
+		}
 		if !lim.Allow() {
-			gConn.Close(websocket.StatusPolicyViolation, "rate limit")
-			s.log.Debug("Guest conn closed for ratelimit hit")
+			gConn.Close(StatusRateLimited, closeReason(StatusRateLimited, ""))
+			log.Debug("Guest conn closed for ratelimit hit")
+			s.joinRejected("rate_limit")
+			s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "guest rate limit"})
+			reason = ReasonRateLimited
 			return
 		}
-		msg, err := ReadMsg(gConn, timeout)
 		if err != nil {
-			s.log.Debug("Guest shutting down", "error", err)
+			// the connection was already closed with StatusMessageTooBig.
+			if errors.Is(err, ErrMessageTooLarge) {
+				s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "message too large"})
+			}
+			if errors.Is(err, ErrInvalidMessage) {
+				log.Debug("Invalid message from guest dropped", "error", err)
+				s.reject(ctx, gConn, roomId, ErrorMsg{Code: ErrorMessageRejected, Detail: "invalid message"})
+				continue
+			}
+			reason = s.disconnectReason(ctx, err)
+			log.Debug("Guest shutting down", "error", err, "reason", reason)
 			return
 		}
+		if !msg.Type.Valid() {
+			s.unknownType(ctx, gConn, roomId, msg, "guest", log)
+			continue
+		}
+		// v1 codecs don't validate payloads when they are read.
+		msg = msg.Clamp()
+		if err := msg.Validate(); err != nil {
+			log.Debug("Invalid message from guest dropped", "error", err)
+			s.reject(ctx, gConn, roomId, ErrorMsg{Code: ErrorMessageRejected, Detail: "invalid message"})
+			continue
+		}
 		if msg.Type == IceCandidate {
-			msgIceCandidate(hConn, timeout, guestId, msg.Candidate)
+			msg.GuestId = guestId
+			out, ok := s.validCandidates(ctx, rm, gConn, msg)
+			if !ok {
+				continue
+			}
+			rm.writeHost(ctx, out)
+			s.forwarded(IceCandidate)
+		} else if msg.Type == EndOfCandidates {
+			rm.writeHost(ctx, Msg{Type: EndOfCandidates, GuestId: guestId})
+			s.forwarded(EndOfCandidates)
+		} else if msg.Type == GuestLeave {
+			if s.removeGuest(g, cmp.Or(msg.Reason, ReasonLeft)) {
+				s.forwarded(GuestLeave)
+			}
+			gConn.Close(websocket.StatusNormalClosure, "left room")
+			return
+		} else if msg.Type == GuestAuth {
+			// the handshake already read the guest's only GuestAuth.
+			log.Debug("GuestAuth message ignored, already sent")
+			s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "duplicate GuestAuth"})
+		} else if msg.Type == Relay {
+			if len(msg.Payload) > s.sopts.MaxRelayPayloadLen {
+				log.Debug("Relay message dropped, payload too large")
+				s.reject(ctx, gConn, roomId, ErrorMsg{Code: ErrorRelayTooLarge, Detail: "Relay too large"})
+				continue
+			}
+			rm.writeHost(ctx, Msg{Type: Relay, GuestId: guestId, Payload: msg.Payload})
+			s.forwarded(Relay)
+		} else if msg.Type == IceRestart {
+			// there is nothing to restart before the host sent HostAuth.
+			if _, authed := rm.hostLimiter(guestId); !authed {
+				log.Debug("IceRestart message dropped, host has not sent HostAuth")
+				s.reject(ctx, gConn, roomId, ErrorMsg{Code: ErrorMessageRejected, Detail: "IceRestart before HostAuth"})
+				continue
+			}
+			if reason := checkCredentials(msg.Ufrag, msg.Pwd); reason != "" {
+				log.Debug("IceRestart message dropped, invalid ICE credentials", "reason", reason)
+				s.reject(ctx, gConn, roomId, ErrorMsg{Code: ErrorMessageRejected, Detail: "IceRestart invalid credentials"})
+				s.credentialsRejected(reason)
+				continue
+			}
+			rm.writeHost(ctx, IceRestartMsg{GuestId: guestId, Ufrag: msg.Ufrag, Pwd: msg.Pwd}.AsMsg())
+			s.forwarded(IceRestart)
+		} else if msg.Type == Error {
+			e := PayloadOf(msg).(ErrorMsg)
+			if e.Validate() != nil || !recoverable(e.Code) {
+				log.Debug("Error message dropped, invalid code or detail", "code", e.Code)
+				s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "invalid Error"})
+				continue
+			}
+			rm.writeHost(ctx, ErrorMsg{GuestId: guestId, Code: e.Code, Detail: e.Detail}.AsMsg())
+			s.forwarded(Error)
 		}
 	}
 }
 
-// POST /host
+// Kicks g like closeRoom kicks the guests that received HostAuth, if its room closes without kicking it,
+// e.g. because the host left mid-handshake. Otherwise its loop would keep forwarding to the closed room.
+//
+// Returns once ctx, the guest loop's context, is done.
+func (s *WebsocketSignalingServer) watchRoom(ctx context.Context, g *guest) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-g.room.done:
+	}
+	if g.stopped() {
+		return
+	}
+	g.stop()
+	g.log.Debug("Guest orphaned, room closed before HostAuth", "reason", g.room.closeReason)
+	s.sopts.Metrics.Add(MetricOrphanedGuests, 1)
+	code, reason := g.room.closeCode, g.room.closeReason
+	kickCtx, cancel := context.WithTimeout(s.ctx, s.sopts.WriteTimeout/5)
+	defer cancel()
+	g.send(kickCtx, KickGuestMsg{GuestId: g.id, Reason: reason, ReasonCode: s.kickCode(code)}.AsMsg())
+	g.closeConn(code, closeReason(code, reason))
+}
+
+// Returns the GuestDisconnected reason for a guest loop that stopped with the read error err.
+//
+// ctx is the guest loop's context, canceled with errPingFailed if the guest stopped answering pings.
+func (s *WebsocketSignalingServer) disconnectReason(ctx context.Context, err error) string {
+	switch {
+	case s.shuttingDown.Load():
+		return ReasonShutdown
+	case errors.Is(err, ErrMessageTooLarge):
+		return ReasonMessageTooLarge
+	case context.Cause(ctx) == errPingFailed:
+		return ReasonTimeout
+	}
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+		return ReasonClosed
+	}
+	return ReasonDisconnected
+}
+
+// Called with reason when the guest connection gConn of g closes.
+//
+// The guest is kept for the grace period so it can rejoin, otherwise it is removed.
+func (s *WebsocketSignalingServer) guestLeft(g *guest, gConn *GuestConn, reason string) {
+	if s.sopts.GuestGracePeriod <= 0 {
+		s.removeGuest(g, reason)
+		return
+	}
+	if g.away(gConn, s.sopts.GuestGracePeriod, func() { s.removeGuest(g, reason) }) {
+		g.log.Debug("guest away, waiting for rejoin", "grace", s.sopts.GuestGracePeriod)
+	}
+}
+
+// GET /host
 func (s *WebsocketSignalingServer) host(w http.ResponseWriter, r *http.Request) {
-	const timeout = time.Second * 2 // Close if writes take longer than this
+	timeout := s.sopts.WriteTimeout // Close if writes take longer than this
+	log := s.connLogger(w, r)
 
-	hConn, err := websocket.Accept(w, r, &s.opts)
-	if err != nil {
-		s.log.Debug("Failed to accept host", "error", err)
+	if s.shuttingDown.Load() {
+		writeHTTPError(w, http.StatusServiceUnavailable, CodeShuttingDown, "server shutting down")
+		return
+	}
+	if s.draining.Load() {
+		w.Header().Set(DrainingHeader, "true")
+		writeHTTPError(w, http.StatusServiceUnavailable, CodeDraining, "server draining")
+		return
+	}
+	if !checkVersion(w, r) {
 		return
 	}
+	identity, ok := s.authenticate(w, r, qp2p.ClientTypeHost)
+	if !ok {
+		return
+	}
+	// password can be set with /host?password=
+	password := r.URL.Query().Get("password")
+	if len(password) > s.sopts.MaxPasswordLen {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "password too long")
+		return
+	}
+	// the host can override the server's region with /host?region=
+	region := cmp.Or(r.URL.Query().Get("region"), s.sopts.Region)
+	if len(region) > maxRegionLen {
+		writeHTTPError(w, http.StatusBadRequest, CodeInvalidRequest, "region too long")
+		return
+	}
+	// the host can pick the room's ID with /host?roomId=
+	var roomId qp2p.RoomId
+	if r.URL.Query().Has("roomId") {
+		if roomId, ok = s.vanityRoomId(w, r, identity); !ok {
+			log.Debug("Host rejected, room id not allowed", "roomId", r.URL.Query().Get("roomId"))
+			return
+		}
+	}
+	if !s.reserveRoom() {
+		log.Debug("Host rejected, server at capacity", "max_rooms", s.sopts.MaxRooms)
+		s.sopts.Metrics.Add(MetricHostsRejected, 1)
+		writeRetryAfter(w, http.StatusServiceUnavailable, CodeAtCapacity, "server at capacity", s.sopts.MaxRoomsRetryAfter)
+		return
+	}
+	// once the room is stored, closeRoom releases the slot.
+	stored := false
+	defer func() {
+		if !stored {
+			s.releaseRoom()
+		}
+	}()
+	// SetDraining may have been called since the check above.
+	if s.draining.Load() {
+		w.Header().Set(DrainingHeader, "true")
+		writeHTTPError(w, http.StatusServiceUnavailable, CodeDraining, "server draining")
+		return
+	}
+
+	// the host is attached once its websocket is accepted.
+	set := roomSettings{roomId: roomId, password: password, region: region, identity: identity, hostAddr: s.remoteAddr(r)}
+	// guests wait for approval if the host created the room with /host?approval=true
+	set.approval, _ = strconv.ParseBool(r.URL.Query().Get("approval"))
+	// at most N unanswered GuestJoined at a time if the host created the room with /host?joinWindow=N
+	set.joinWindow, _ = strconv.Atoi(r.URL.Query().Get("joinWindow"))
+	// the host sends Heartbeat if it created the room with /host?heartbeat=true
+	set.heartbeat, _ = strconv.ParseBool(r.URL.Query().Get("heartbeat"))
+	// guests can wait for a slot in a full room if the host created it with /host?queue=true
+	set.queue, _ = strconv.ParseBool(r.URL.Query().Get("queue"))
+	// hosts can only resume if there is a grace period.
+	set.resumable = s.sopts.HostGracePeriod > 0
+	// reserved before accepting, so generators that keep colliding get a 503.
+	rm, ok := s.openRoom(r.Context(), log, set)
+	if !ok && roomId != "" {
+		log.Debug("Host rejected, room id taken", "roomId", roomId)
+		writeHTTPError(w, http.StatusConflict, CodeRoomIdTaken, "room id taken")
+		return
+	} else if !ok {
+		writeHTTPError(w, http.StatusServiceUnavailable, CodeAtCapacity, "no free room id")
+		return
+	}
+	stored = true
+	log = rm.log
+	roomId = rm.id
 
-	roomId := internal.GenerateUniqueRoomID(s.isUnique)
-	s.hosts.Store(roomId, hConn)
+	ws, err := s.accept(w, r)
+	if err != nil {
+		log.Debug("Failed to accept host", "error", err)
+		s.closeRoom(rm, StatusHostOffline, "Host is offline.")
+		return
+	}
+	hConn := newHostConn(s.ctx, ws, s.sopts.WriteQueueDepth, timeout, s.writeFailed, s.queueDropped)
 
 	// Tell the host that room has been created.
-	if err = msgRoomCreated(hConn, timeout, roomId); err != nil {
+	if err = msgRoomCreated(hConn.ctx, hConn, roomId, rm.resumeToken, rm.region, rm.heartbeatInterval); err != nil {
 		hConn.Close(websocket.StatusInternalError, "Failed to write RoomCreated message")
-		s.log.Debug("failed to send msg RoomCreated", "error", err)
+		log.Debug("failed to send msg RoomCreated", "error", err)
+		s.closeRoom(rm, StatusHostOffline, "Host is offline.")
 		return
 	}
+	// attach after RoomCreated, so messages queued for the host are written after it.
+	if _, ok := rm.resume(hConn, s.remoteAddr(r)); !ok {
+		hConn.Close(StatusRoomClosed, closeReason(StatusRoomClosed, ""))
+		log.Debug("Room closed during accept")
+		return
+	}
+	s.serveHost(rm, hConn, log)
+}
 
-	// TODO: disconnect guests.
-	defer s.hosts.Delete(roomId) // delete after connection closed.
+// Settings a host creates a room with, from GET /host or CreateRoom.
+type roomSettings struct {
+	// picked by the host with /host?roomId=. Empty to generate one.
+	roomId             qp2p.RoomId
+	password, region   string
+	identity, hostAddr string
+	approval           bool
+	joinWindow         int
+	heartbeat          bool
+	queue              bool
+	// the room gets a resume token.
+	resumable bool
+}
 
-	// Ping loop
-	go func() {
-		for {
-			time.Sleep(time.Second / 2) // 2/5 of timeout
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			err := hConn.Ping(ctx)
-			cancel()
-			if err != nil {
-				s.log.Debug("host shutting down ping loop", "error", err)
+// Stores a new room for a host with a unique room ID, reserved in the Registry.
+//
+// The room has no host connection until resume attaches one.
+// The caller reserves the room's MaxRooms slot. Returns false if no free room ID was found.
+func (s *WebsocketSignalingServer) openRoom(ctx context.Context, log *slog.Logger, set roomSettings) (*room, bool) {
+	rm := &room{password: set.password, hostIdentity: set.identity, hostAddr: set.hostAddr, createdAt: time.Now(), done: make(chan struct{})}
+	rm.approval = set.approval
+	rm.joinWindow = set.joinWindow
+	rm.maxSpectators = s.sopts.MaxSpectatorsPerRoom
+	if set.queue {
+		rm.queueLimit = s.sopts.MaxQueuedGuests
+	}
+	if set.heartbeat {
+		rm.heartbeatInterval = s.sopts.HostHeartbeatInterval
+	}
+	rm.region = set.region
+	rm.pendingLimit, rm.pendingPerGuest = s.sopts.HostQueueLimit, s.sopts.HostQueuePerGuest
+	rm.onPendingDrop = s.hostQueueDropped
+	if set.resumable {
+		rm.resumeToken = rand.Text()
+	}
+	gen := func() qp2p.RoomId { return internal.NormalizeRoomID(s.sopts.RoomIdGenerator()) }
+	attempts := roomIdAttempts
+	// a picked ID is only tried once.
+	if set.roomId != "" {
+		gen, attempts = func() qp2p.RoomId { return set.roomId }, 1
+	}
+	_, err := internal.GenerateUniqueRoomID(gen, func(id qp2p.RoomId) bool {
+		// the registry keeps IDs unique across nodes.
+		reserved, err := s.sopts.Registry.ReserveRoom(ctx, id, s.sopts.NodeURL)
+		if err != nil {
+			log.Error("Failed to reserve room id", "id", id, "error", err)
+			return false
+		}
+		if !reserved {
+			return false
+		}
+		rm.id = id
+		rm.log = log.With("room", id)
+		if _, loaded := s.rooms.LoadOrStore(id, rm); loaded {
+			s.sopts.Registry.ReleaseRoom(ctx, id)
+			return false
+		}
+		return true
+	}, attempts)
+	if err != nil && set.roomId != "" {
+		log.Debug("Room id taken", "roomId", set.roomId)
+		return nil, false
+	} else if err != nil {
+		log.Error("Failed to generate room id", "error", err)
+		return nil, false
+	}
+	rm.startExpiry(s.sopts.MaxRoomAge, s.sopts.IdleRoomTimeout, func(reason string) { s.expireRoom(rm, reason) })
+	if rm.heartbeatInterval > 0 {
+		rm.startHeartbeat(rm.heartbeatInterval*time.Duration(s.sopts.HostHeartbeatMisses), func() {
+			rm.log.Debug("Host missed heartbeats, closing room", "misses", s.sopts.HostHeartbeatMisses)
+			s.closeRoom(rm, StatusHostUnresponsive, "host unresponsive")
+		})
+	}
+	rm.log.Debug("Room opened", "identity", set.identity)
+	s.emit(RoomOpenedEvent{RoomId: rm.id, Identity: set.identity})
+	s.sopts.Metrics.Add(MetricRoomsCreated, 1)
+	s.sopts.Metrics.Add(MetricActiveRooms, 1)
+	return rm, true
+}
+
+// Creates another room on the connection hConn of the host's first room rm, for CreateRoom.
+//
+// The room copies rm's settings, with msg's password. It is stored in rooms, and answered
+// with RoomCreated, or CreateRoom and the reason it could not be created.
+//
+// ctx is the host loop's context.
+func (s *WebsocketSignalingServer) createRoom(ctx context.Context, rm *room, hConn *HostConn, msg Msg, rooms map[qp2p.RoomId]*room) {
+	fail := func(reason string) {
+		rm.log.Debug("CreateRoom failed", "reason", reason)
+		if err := msgCreateRoomFailed(ctx, hConn, reason); err != nil {
+			rm.log.Debug("Failed to write Msg CreateRoom", "error", err)
+		}
+	}
+	switch {
+	case s.shuttingDown.Load():
+		fail("server shutting down")
+		return
+	case s.draining.Load():
+		fail("server draining")
+		return
+	case len(msg.Password) > s.sopts.MaxPasswordLen:
+		fail("password too long")
+		return
+	case !s.reserveRoom():
+		s.sopts.Metrics.Add(MetricHostsRejected, 1)
+		fail("server at capacity")
+		return
+	}
+	rm.mu.Lock()
+	hostAddr := rm.hostAddr
+	rm.mu.Unlock()
+	set := roomSettings{
+		password:   msg.Password,
+		region:     rm.region,
+		identity:   rm.hostIdentity,
+		hostAddr:   hostAddr,
+		approval:   rm.approval,
+		joinWindow: rm.joinWindow,
+		heartbeat:  rm.heartbeatInterval > 0,
+		queue:      rm.queueLimit > 0,
+	}
+	created, ok := s.openRoom(ctx, rm.log, set)
+	if !ok {
+		s.releaseRoom()
+		fail("no free room id")
+		return
+	}
+	conn := hConn.forRoom(created.id)
+	if err := msgRoomCreated(ctx, conn, created.id, "", created.region, created.heartbeatInterval); err != nil {
+		created.log.Debug("failed to send msg RoomCreated", "error", err)
+		s.closeRoom(created, StatusHostOffline, "Host is offline.")
+		return
+	}
+	created.resume(conn, set.hostAddr)
+	rooms[created.id] = created
+}
+
+// GET /host/resume/{roomId}?token=
+//
+// Re-attaches a host to its room during the grace period, using the resume token from RoomCreated.
+func (s *WebsocketSignalingServer) resume(w http.ResponseWriter, r *http.Request) {
+	if !checkVersion(w, r) {
+		return
+	}
+	roomId := pathRoomId(r)
+	log := s.connLogger(w, r).With("room", roomId)
+	rm, ok := s.rooms.Load(roomId)
+	if !ok && s.routeToNode(w, r, roomId) {
+		return
+	} else if !ok {
+		log.Debug("Host resume room, room does not exist")
+		writeHTTPError(w, http.StatusNotFound, CodeRoomNotFound, "room not found")
+		return
+	}
+	if !rm.checkResumeToken(r.URL.Query().Get("token")) {
+		log.Debug("Host resume room, invalid resume token")
+		writeHTTPError(w, http.StatusForbidden, CodeInvalidResumeToken, "invalid resume token")
+		return
+	}
+
+	ws, err := s.accept(w, r)
+	if err != nil {
+		log.Debug("Failed to accept host", "error", err)
+		return
+	}
+	hConn := newHostConn(s.ctx, ws, s.sopts.WriteQueueDepth, s.sopts.WriteTimeout, s.writeFailed, s.queueDropped)
+	// the grace period may have ended while the websocket was being accepted.
+	old, ok := rm.resume(hConn, s.remoteAddr(r))
+	if !ok {
+		hConn.Close(StatusRoomClosed, closeReason(StatusRoomClosed, ""))
+		log.Debug("Host resume room, room closed during accept")
+		return
+	}
+	// the old connection may not have noticed that it dropped yet.
+	if old != nil {
+		old.Close(StatusReplaced, closeReason(StatusReplaced, "host resumed"))
+	}
+	s.serveHost(rm, hConn, log)
+}
+
+// Reads messages from the host of rm until the connection closes.
+func (s *WebsocketSignalingServer) serveHost(rm *room, hConn *HostConn, log *slog.Logger) {
+	// keep the room alive for the grace period, or close it.
+	defer s.hostLeft(rm, hConn)
+	defer hConn.CloseNow()
+	// rooms created with CreateRoom share the connection, and close with it.
+	rooms := make(map[qp2p.RoomId]*room)
+	defer func() {
+		for _, other := range rooms {
+			s.closeRoom(other, StatusHostOffline, "Host is offline.")
+		}
+	}()
+
+	// the connection stays open as long as it answers pings.
+	// reads wait on ctx instead of a deadline, so quiet connections are not dropped.
+	ctx, cancel := context.WithCancelCause(hConn.ctx)
+	defer cancel(nil)
+	go s.pingLoop(ctx, cancel, hConn.Conn, log)
+	lim := rate.NewLimiter(s.sopts.HostMsgRate, s.sopts.HostMsgBurst)
+	pings := newPingLimiter()
+	parked := newParkedMsgs()
+	in := new(Msg)
+	for {
+		err := ReadMsgInto(ctx, hConn.Conn, in)
+		msg := *in
+		if err != nil {
+			// the connection was already closed with StatusMessageTooBig.
+			if errors.Is(err, ErrMessageTooLarge) {
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "message too large"})
+			}
+			if errors.Is(err, ErrInvalidMessage) {
+				log.Debug("Invalid message from host dropped", "error", err)
+				s.reject(ctx, hConn, rm.id, ErrorMsg{Code: ErrorMessageRejected, Detail: "invalid message"})
+				continue
+			}
+			log.Debug("host failed to read message", "error", err)
+			return
+		}
+		// pings are for the connection, and have their own limit.
+		if msg.Type == Ping {
+			s.pong(ctx, hConn, rm.id, msg, pings)
+			continue
+		}
+		if msg.Type == Heartbeat {
+			// heartbeats are for the connection, so every room on it.
+			for _, other := range rooms {
+				other.heartbeat()
+			}
+		}
+		// messages for a room created with CreateRoom carry its RoomId,
+		// and are handled with that room and its HostConn in place of the first room's.
+		rm, hConn, log := rm, hConn, log
+		if msg.RoomId != "" && msg.RoomId != rm.id {
+			other, ok := rooms[msg.RoomId]
+			if current, stored := s.rooms.Load(msg.RoomId); !ok || !stored || current != other {
+				delete(rooms, msg.RoomId)
+				log.Debug("Message for a room not on this connection dropped", "type", msg.Type, "roomId", msg.RoomId)
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: msg.Type.String() + " for room not on connection"})
+				continue
+			}
+			rm, hConn, log = other, hConn.forRoom(other.id), other.log
+		}
+		if !s.inHandshake(rm, msg) && !lim.Allow() {
+			hConn.Close(StatusRateLimited, closeReason(StatusRateLimited, ""))
+			s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "host rate limit"})
+			return
+		}
+		if !msg.Type.Valid() {
+			s.unknownType(ctx, hConn, rm.id, msg, "host", log)
+			continue
+		}
+		msg = msg.Clamp()
+		// credentials too long for Validate break the RFC as much as ones checkCredentials rejects.
+		if msg.Type == HostAuth {
+			if reason := checkCredentials(msg.Ufrag, msg.Pwd); reason != "" {
+				s.rejectHostCredentials(rm, hConn, reason, log)
 				return
 			}
 		}
-	}()
-	connectedGuests := make([]qp2p.GuestID, 0)
-	defer func() { // kick connected guests.
-		for _, guestId := range connectedGuests {
-			gConn, ok := s.guests.Load(guestId)
+		if err := msg.Validate(); err != nil {
+			log.Debug("Invalid message from host dropped", "error", err)
+			s.reject(ctx, hConn, rm.id, ErrorMsg{Code: ErrorMessageRejected, Detail: "invalid message"})
+			continue
+		}
+		if msg.Type == CreateRoom {
+			s.createRoom(ctx, rm, hConn, msg, rooms)
+			continue
+		}
+		// forward to guest
+		if msg.Type == HostAuth || msg.Type == IceCandidate || msg.Type == EndOfCandidates {
+			g, ok := s.guests.Load(msg.GuestId)
+			// a guest admitted to the room but not registered yet is waited for off the read loop.
+			if park, first := parked.park(rm, ok, parkedMsg{msg: msg, rm: rm, hConn: hConn, log: log}); park {
+				if first {
+					go s.deliverParked(ctx, parked, msg.GuestId)
+				}
+				continue
+			}
 			if !ok {
+				s.unknownGuest(ctx, rm, hConn, msg, log)
+				continue
+			}
+			if !s.forwardToGuest(ctx, rm, hConn, g, msg, log) {
+				return
+			}
+		} else if msg.Type == IceRestart {
+			restart := PayloadOf(msg).(IceRestartMsg)
+			g, ok := s.guests.Load(restart.GuestId)
+			if ok && s.crossRoom(rm, g, IceRestart) {
+				continue
+			}
+			// only guests the host sent HostAuth to have a limiter.
+			guestLim, authed := rm.hostLimiter(restart.GuestId)
+			if !ok || !authed {
+				log.Debug("IceRestart message dropped, guest not connected to host", "guest", restart.GuestId)
+				s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: restart.GuestId, Code: ErrorMessageRejected, Detail: "IceRestart for unknown guest"})
+				continue
+			}
+			if !guestLim.Allow() {
+				log.Debug("IceRestart message dropped, guest rate limit", "guest", restart.GuestId)
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "host rate limit for guest"})
+				continue
+			}
+			if reason := checkCredentials(restart.Ufrag, restart.Pwd); reason != "" {
+				log.Debug("IceRestart message dropped, invalid ICE credentials", "reason", reason)
+				s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: restart.GuestId, Code: ErrorMessageRejected, Detail: "IceRestart invalid credentials"})
+				s.credentialsRejected(reason)
+				continue
+			}
+			g.send(ctx, restart.AsMsg())
+			s.forwarded(IceRestart)
+			// kick guest from the room
+		} else if msg.Type == KickGuest {
+			kick := PayloadOf(msg).(KickGuestMsg)
+			g, ok := s.guests.Load(kick.GuestId)
+			// hosts can only kick guests from their own room.
+			if ok && s.crossRoom(rm, g, KickGuest) {
+				continue
+			} else if !ok {
+				log.Debug("KickGuest message invalid guest id, guest not in room", "guest", kick.GuestId)
+				s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: kick.GuestId, Code: ErrorMessageRejected, Detail: "KickGuest for guest not in room"})
+				continue
+			}
+			if kick.Ban && !rm.ban(g.ip, s.sopts.MaxBansPerRoom) {
+				log.Debug("KickGuest ban ignored, room has too many bans")
+			}
+			// the host's code is passed on, e.g. KickConnectionFailed.
+			code := cmp.Or(kick.ReasonCode, KickByHost)
+			if kick.Ban {
+				code = KickBanned
+			}
+			if s.kickGuest(g, "host", code, kick.Reason) {
+				s.forwarded(KickGuest)
+			}
+		} else if msg.Type == SetRoomInfo {
+			if len(msg.Name) > s.sopts.MaxRoomNameLen || len(msg.Metadata) > s.sopts.MaxRoomMetadataLen {
+				log.Debug("SetRoomInfo message ignored, name or metadata too long")
+				s.reject(ctx, hConn, rm.id, ErrorMsg{Code: ErrorMessageRejected, Detail: "SetRoomInfo too long"})
+				continue
+			}
+			info := roomInfo{
+				Name:      msg.Name,
+				Public:    msg.Public,
+				MaxGuests: msg.MaxGuests,
+				Metadata:  msg.Metadata,
+			}
+			// push the update to guests already in the room.
+			for _, g := range rm.setInfo(info) {
+				g.send(ctx, Msg{Type: RoomInfo, Name: info.Name, MaxGuests: info.MaxGuests, Metadata: info.Metadata, Region: rm.region})
+			}
+			s.roomStatusChanged(rm)
+		} else if msg.Type == LockRoom || msg.Type == UnlockRoom {
+			rm.setLocked(msg.Type == LockRoom)
+			s.roomStatusChanged(rm)
+		} else if msg.Type == QueuedGuests {
+			if err := msgQueuedGuests(ctx, hConn, rm.queued()); err != nil {
+				log.Debug("Failed to write Msg QueuedGuests", "error", err)
+			}
+		} else if msg.Type == ClearQueue {
+			n := rm.clearQueue(approval{code: StatusRoomFull, reason: cmp.Or(msg.Reason, "Queue cleared by host.")})
+			log.Debug("Host cleared queue", "guests", n)
+		} else if msg.Type == CreateInvites {
+			tokens := rm.createInvites(msg.InviteCount, s.sopts.MaxInvitesPerRoom, s.sopts.InviteTTL,
+				func(token string) { s.invites.Store(token, rm) },
+				func(token string) { s.invites.Delete(token) })
+			if len(tokens) < msg.InviteCount {
+				log.Debug("CreateInvites limited, room has max invites", "asked", msg.InviteCount, "created", len(tokens))
+			}
+			if err := msgInvites(ctx, hConn, tokens); err != nil {
+				log.Debug("Failed to write Msg CreateInvites", "error", err)
+			}
+		} else if msg.Type == Heartbeat {
+			rm.heartbeat()
+		} else if msg.Type == CloseRoom {
+			reason := msg.Reason
+			log.Debug("Host closed room", "reason", reason)
+			// rooms created with CreateRoom are acknowledged by closeRoom, and leave the connection open.
+			if hConn.roomId != "" {
+				s.closeRoom(rm, websocket.StatusNormalClosure, cmp.Or(reason, "Room closed by host."))
+				continue
+			}
+			// queued before closeRoom closes the connection, so the host reads it first.
+			if err := msgCloseRoomAck(ctx, hConn); err != nil {
+				log.Debug("Failed to write Msg CloseRoom", "error", err)
+			}
+			s.closeRoom(rm, websocket.StatusNormalClosure, cmp.Or(reason, "Room closed by host."))
+			return
+		} else if msg.Type == AcceptGuest || msg.Type == RejectGuest {
+			a := approval{accepted: msg.Type == AcceptGuest, code: StatusJoinRejected, reason: cmp.Or(msg.Reason, "Rejected by host.")}
+			if !rm.decide(msg.GuestId, a) {
+				log.Debug("Approval message ignored, guest not waiting", "guest", msg.GuestId)
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: msg.Type.String() + " for guest not waiting"})
+			}
+		} else if msg.Type == Relay {
+			g, ok := s.guests.Load(msg.GuestId)
+			// hosts can only relay to guests in their own room.
+			if ok && s.crossRoom(rm, g, Relay) {
+				continue
+			} else if !ok {
+				log.Debug("Relay message dropped, guest not in room", "guest", msg.GuestId)
+				s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: msg.GuestId, Code: ErrorMessageRejected, Detail: "Relay for guest not in room"})
+				continue
+			}
+			if len(msg.Payload) > s.sopts.MaxRelayPayloadLen {
+				log.Debug("Relay message dropped, payload too large")
+				s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: msg.GuestId, Code: ErrorRelayTooLarge, Detail: "Relay too large"})
+				continue
+			}
+			g.send(ctx, Msg{Type: Relay, GuestId: msg.GuestId, Payload: msg.Payload})
+			s.forwarded(Relay)
+		} else if msg.Type == Error {
+			e := PayloadOf(msg).(ErrorMsg)
+			g, ok := s.guests.Load(e.GuestId)
+			if ok && s.crossRoom(rm, g, Error) {
+				continue
+			} else if !ok {
+				log.Debug("Error message dropped, guest not in room", "guest", e.GuestId)
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "Error for guest not in room"})
+				continue
+			}
+			if e.Validate() != nil || !recoverable(e.Code) {
+				log.Debug("Error message dropped, invalid code or detail", "code", e.Code)
+				s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "invalid Error"})
 				continue
 			}
-			MsgKickGuest(gConn, timeout/5, guestId, "Host is offline.")
-			gConn.Close(websocket.StatusGoingAway, "Host is offline")
+			g.send(ctx, ErrorMsg{GuestId: e.GuestId, Code: e.Code, Detail: e.Detail}.AsMsg())
+			s.forwarded(Error)
 		}
-	}()
-	lim := rate.NewLimiter(5, 20)
+	}
+}
+
+// Pings conn every PingInterval until ctx is done.
+//
+// ctx is cancelled by the connection's handler when it returns, or here with errPingFailed when a ping fails.
+func (s *WebsocketSignalingServer) pingLoop(ctx context.Context, cancel context.CancelCauseFunc, conn *websocket.Conn, log *slog.Logger) {
+	t := time.NewTicker(s.sopts.PingInterval)
+	defer t.Stop()
 	for {
-		if !lim.Allow() {
-			hConn.Close(websocket.StatusPolicyViolation, "rate limit")
+		select {
+		case <-ctx.Done():
 			return
+		case <-t.C:
 		}
-		msg, err := ReadMsg(hConn, timeout)
+		pingCtx, pingCancel := context.WithTimeout(ctx, s.sopts.WriteTimeout)
+		err := conn.Ping(pingCtx)
+		pingCancel()
 		if err != nil {
-			s.log.Debug("host failed to read message", "error", err)
+			log.Debug("Ping failed, shutting down ping loop", "error", err)
+			cancel(errPingFailed)
 			return
 		}
-		// forward to guest
-		if msg.Type == HostAuth {
-			gConn, ok := s.guests.Load(msg.GuestId)
+	}
+}
+
+// Called when the host connection hConn of rm closes.
+//
+// The room is kept alive for the grace period so the host can resume, otherwise it is closed.
+func (s *WebsocketSignalingServer) hostLeft(rm *room, hConn *HostConn) {
+	if s.sopts.HostGracePeriod <= 0 {
+		s.closeRoom(rm, StatusHostOffline, "Host is offline.")
+		return
+	}
+	if rm.hostAway(hConn, s.sopts.HostGracePeriod, func() { s.closeRoom(rm, StatusHostOffline, "Host is offline.") }) {
+		rm.log.Debug("host away, waiting for resume", "grace", s.sopts.HostGracePeriod)
+	}
+}
+
+// Removes rm from the server, kicks its guests with reason, and closes the host connection.
+//
+// Every way a room ends goes through here: the host leaving, CloseRoom, expiry, the admin API and Shutdown.
+// Safe to call more than once.
+func (s *WebsocketSignalingServer) closeRoom(rm *room, code websocket.StatusCode, reason string) {
+	timeout := s.sopts.WriteTimeout
+
+	hConn, guests, ok := rm.close()
+	if !ok {
+		return
+	}
+	s.rooms.CompareAndDelete(rm.id, rm)
+	if err := s.sopts.Registry.ReleaseRoom(context.Background(), rm.id); err != nil {
+		rm.log.Error("Failed to release room id", "error", err)
+	}
+	s.releaseRoom()
+	s.closedRooms.add(rm.summary(reason))
+	for _, token := range rm.takeInvites() {
+		s.invites.Delete(token)
+	}
+	s.emit(RoomClosedEvent{RoomId: rm.id, Reason: reason})
+	s.sopts.Metrics.Add(MetricActiveRooms, -1)
+	// kick connected guests.
+	for _, guestId := range guests {
+		g, ok := s.guests.Load(guestId)
+		if !ok {
+			continue
+		}
+		g.stop() // away guests can't rejoin a closed room.
+		kickCtx, cancel := context.WithTimeout(s.ctx, timeout/5)
+		g.send(kickCtx, KickGuestMsg{GuestId: guestId, Reason: reason, ReasonCode: s.kickCode(code)}.AsMsg())
+		cancel()
+		g.closeConn(code, closeReason(code, reason))
+	}
+	if hConn != nil && hConn.roomId != "" {
+		// a room created with CreateRoom shares the host's connection, so only the room is closed.
+		hConn.send(s.ctx, Msg{Type: CloseRoom, Reason: reason})
+	} else if hConn != nil {
+		hostCode := StatusRoomClosed
+		if code == StatusRoomExpired || code == StatusHostUnresponsive || code == websocket.StatusNormalClosure {
+			hostCode = code
+		}
+		hConn.Close(hostCode, closeReason(hostCode, reason))
+	}
+	rm.closeCode, rm.closeReason = code, reason
+	close(rm.done)
+}
+
+// Tells the host that rm expired, and closes it.
+func (s *WebsocketSignalingServer) expireRoom(rm *room, reason string) {
+	rm.log.Debug("Room expired", "reason", reason)
+	// queued before the close, so the host reads it first.
+	if err := msgRoomExpired(s.ctx, rm, reason); err != nil {
+		rm.log.Debug("Failed to write Msg RoomExpired", "error", err)
+	}
+	s.closeRoom(rm, StatusRoomExpired, reason)
+}
+
+// Forwards the host's HostAuth, IceCandidate or EndOfCandidates msg to its guest g.
+//
+// Returns false if hConn was closed for it.
+func (s *WebsocketSignalingServer) forwardToGuest(ctx context.Context, rm *room, hConn *HostConn, g *guest, msg Msg, log *slog.Logger) bool {
+	if s.crossRoom(rm, g, msg.Type) {
+		return true
+	}
+	switch msg.Type {
+	case HostAuth:
+		auth := PayloadOf(msg).(HostAuthMsg)
+		if reason := checkCredentials(auth.Ufrag, auth.Pwd); reason != "" {
+			s.rejectHostCredentials(rm, hConn, reason, log)
+			return false
+		}
+		guestLim := newHandshakeLimiter(s.sopts.HostMsgRatePerGuest, s.sopts.HostMsgBurstPerGuest, s.sopts.HandshakeBurst, s.handshakeEnd(g))
+		if !rm.addGuest(auth.GuestId, guestLim) {
+			log.Debug("HostAuth message ignored, guest already received HostAuth", "guest", auth.GuestId)
+			s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "duplicate HostAuth"})
+			return true
+		}
+		g.handshake.Stop()
+		s.releaseJoins(rm, auth.GuestId)
+
+		// HostAuthMsg has no Password, so the room password is never forwarded.
+		g.send(ctx, auth.AsMsg())
+		s.forwarded(HostAuth)
+		s.sopts.Metrics.Observe(MetricHandshakeLatency, time.Since(g.authAt))
+	case IceCandidate:
+		guestLim, ok := rm.hostLimiter(msg.GuestId)
+		if !ok {
+			log.Debug("IceCandidate message dropped, guest not connected to host", "guest", msg.GuestId)
+			s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "IceCandidate before HostAuth"})
+			return true
+		}
+		if !guestLim.Allow() {
+			log.Debug("IceCandidate message dropped, guest rate limit", "guest", msg.GuestId)
+			s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "host rate limit for guest"})
+			return true
+		}
+		out, ok := s.validCandidates(ctx, rm, hConn, msg)
+		if !ok {
+			return true
+		}
+		g.send(ctx, out)
+		s.forwarded(IceCandidate)
+	case EndOfCandidates:
+		// only guests the host sent HostAuth to have a limiter.
+		if _, authed := rm.hostLimiter(msg.GuestId); !authed {
+			log.Debug("EndOfCandidates message dropped, guest not connected to host", "guest", msg.GuestId)
+			s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: msg.GuestId, Code: ErrorMessageRejected, Detail: "EndOfCandidates for unknown guest"})
+			return true
+		}
+		g.send(ctx, Msg{Type: EndOfCandidates, GuestId: msg.GuestId})
+		s.forwarded(EndOfCandidates)
+	}
+	return true
+}
+
+// Closes hConn for sending a HostAuth with invalid ICE credentials.
+func (s *WebsocketSignalingServer) rejectHostCredentials(rm *room, hConn *HostConn, reason string, log *slog.Logger) {
+	hConn.Close(websocket.StatusPolicyViolation, closeReason(websocket.StatusPolicyViolation, reason))
+	log.Debug("HostAuth message invalid ICE credentials, closing", "reason", reason)
+	s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: "HostAuth invalid credentials"})
+	s.credentialsRejected(reason)
+}
+
+// Drops the host's msg for a guest that is not registered, and tells the host.
+func (s *WebsocketSignalingServer) unknownGuest(ctx context.Context, rm *room, hConn *HostConn, msg Msg, log *slog.Logger) {
+	log.Debug(msg.Type.String()+" message invalid guest id, guest not found", "guest", msg.GuestId)
+	s.reject(ctx, hConn, rm.id, ErrorMsg{GuestId: msg.GuestId, Code: ErrorMessageRejected, Detail: msg.Type.String() + " for unknown guest"})
+}
+
+// Delivers the messages parked for guestId once it is registered, in the order the host sent them,
+// or drops them if it isn't within guestLookupWindow.
+func (s *WebsocketSignalingServer) deliverParked(ctx context.Context, p *parkedMsgs, guestId qp2p.GuestID) {
+	deadline := time.NewTimer(guestLookupWindow)
+	defer deadline.Stop()
+	tick := time.NewTicker(guestLookupWindow / 20)
+	defer tick.Stop()
+	g, ok := s.guests.Load(guestId)
+wait:
+	for !ok {
+		select {
+		case <-ctx.Done():
+			p.take(guestId, true)
+			return
+		case <-deadline.C:
+			break wait
+		case <-tick.C:
+			g, ok = s.guests.Load(guestId)
+		}
+	}
+	for {
+		// messages parked while these are delivered are taken next, so the order is kept.
+		msgs := p.take(guestId, false)
+		if len(msgs) == 0 {
+			return
+		}
+		for _, m := range msgs {
 			if !ok {
-				s.log.Debug("HostAuth message invalid guest id, guest not found", "id", msg.GuestId)
+				s.unknownGuest(ctx, m.rm, m.hConn, m.msg, m.log)
 				continue
 			}
-			connectedGuests = append(connectedGuests, msg.GuestId)
-			// 5 messages per second per guest
-			lim.SetLimit(rate.Limit(len(connectedGuests) * 5))
-			lim.SetBurst(int(lim.Limit()) * 2)
+			// the host connection was closed, so the rest can't be delivered.
+			if !s.forwardToGuest(ctx, m.rm, m.hConn, g, m.msg, m.log) {
+				p.take(guestId, true)
+				return
+			}
+		}
+	}
+}
 
-			go WriteMsg(gConn, msg, timeout)
-			// forward ICE candidate to Guest
-		} else if msg.Type == IceCandidate {
-			gConn, ok := s.guests.Load(msg.GuestId)
-			if !ok {
-				s.log.Debug("IceCandidate message invalid guest id, guest not found", "id", msg.GuestId)
-				continue
+// Reports whether g is in another room than rm, whose host sent it a typ message.
+//
+// Hosts can only message guests in their own room, so the message must be dropped.
+// It is logged as a policy violation and counted in MetricCrossRoomRejected.
+func (s *WebsocketSignalingServer) crossRoom(rm *room, g *guest, typ MsgType) bool {
+	if g.room == rm {
+		return false
+	}
+	rm.log.Warn("Host sent a message to a guest in another room, dropped", "type", typ, "guest", g.id, "guestRoom", g.room.id)
+	s.sopts.Metrics.Add(labeled(MetricCrossRoomRejected, "type", typ.String()), 1)
+	s.emit(MessageRejectedEvent{RoomId: rm.id, Reason: typ.String() + " for guest in another room"})
+	return true
+}
+
+// Drops a message from a host or guest: emits MessageRejectedEvent with e.Detail as the reason,
+// and tells the sender with e.
+func (s *WebsocketSignalingServer) reject(ctx context.Context, from msgSender, roomId qp2p.RoomId, e ErrorMsg) {
+	s.emit(MessageRejectedEvent{RoomId: roomId, Reason: e.Detail})
+	from.send(ctx, e.AsMsg())
+}
+
+// Drops msg, of a type the server does not know, sent by sender, "host" or "guest".
+// from is sent an Error with ErrorUnknownMessageType if ServerOptions.ReplyUnknownTypes is set.
+func (s *WebsocketSignalingServer) unknownType(ctx context.Context, from msgSender, roomId qp2p.RoomId, msg Msg, sender string, log *slog.Logger) {
+	log.Debug("Message of unknown type dropped", "type", int(msg.Type), "from", sender)
+	s.sopts.Metrics.Add(labeled(MetricUnknownMessages, "from", sender), 1)
+	if !s.sopts.ReplyUnknownTypes {
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "unknown message type"})
+		return
+	}
+	s.reject(ctx, from, roomId, ErrorMsg{GuestId: msg.GuestId, Code: ErrorUnknownMessageType, Detail: fmt.Sprintf("unknown message type %d", int(msg.Type))})
+}
+
+// How many Pings a connection can send per second, outside its message rate limit.
+const (
+	pingRate  = 1
+	pingBurst = 5
+)
+
+func newPingLimiter() *rate.Limiter {
+	return rate.NewLimiter(pingRate, pingBurst)
+}
+
+// Answers a Ping with a Pong, or drops it if the connection is over its ping limit lim.
+func (s *WebsocketSignalingServer) pong(ctx context.Context, conn msgSender, roomId qp2p.RoomId, msg Msg, lim *rate.Limiter) {
+	if !lim.Allow() {
+		s.emit(MessageRejectedEvent{RoomId: roomId, Reason: "ping rate limit"})
+		return
+	}
+	msgPong(ctx, conn, msg.Nonce)
+}
+
+// Frees the join window slot of guestId in rm, and sends the host GuestJoined
+// for the queued guests that fit in it.
+func (s *WebsocketSignalingServer) releaseJoins(rm *room, guestId qp2p.GuestID) {
+	for _, j := range rm.answered(guestId) {
+		if err := msgGuestJoined(s.ctx, rm, j.g.id, j.ufrag, j.pwd, j.g.role, j.g.metadata); err != nil {
+			j.g.log.Debug("Failed to write Msg Guest Joined", "error", err)
+		}
+		j.g.handshake.Reset(s.sopts.HandshakeTimeout)
+	}
+}
+
+// Sends g WaitingForHost every waitingInterval while it is queued in rm's join window,
+// so its socket does not look idle.
+func (s *WebsocketSignalingServer) waitForHost(rm *room, g *guest) {
+	if !rm.isQueued(g) {
+		return
+	}
+	g.send(s.ctx, Msg{Type: WaitingForHost, Reason: "waiting for host"})
+	time.AfterFunc(waitingInterval, func() { s.waitForHost(rm, g) })
+}
+
+// Sends RoomStatus to the host of rm, and to its guests if rm is public.
+//
+// Bursts of changes are sent as one RoomStatus, at most once per roomStatusInterval.
+func (s *WebsocketSignalingServer) roomStatusChanged(rm *room) {
+	rm.statusChanged(roomStatusInterval, func() {
+		guestCount, maxGuests, locked, guests := rm.status()
+		msgRoomStatus(s.ctx, rm, guestCount, maxGuests, locked, guests)
+	})
+}
+
+// Takes a room slot. Returns false if the server already hosts MaxRooms rooms.
+func (s *WebsocketSignalingServer) reserveRoom() bool {
+	if s.roomCount.Add(1) > int64(s.sopts.MaxRooms) && s.sopts.MaxRooms > 0 {
+		s.roomCount.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Removes the guest from the server and its room, and tells the host that it disconnected.
+//
+// Returns false if the guest was already removed.
+func (s *WebsocketSignalingServer) removeGuest(g *guest, reason string) bool {
+	if !s.guests.CompareAndDelete(g.id, g) {
+		return false
+	}
+	g.stop()
+	g.room.removeGuest(g.id)
+	s.sopts.Metrics.Add(MetricActiveGuests, -1)
+	// the host is being closed too, don't wait on its write queue.
+	if !s.shuttingDown.Load() {
+		err := msgGuestDisconnected(s.ctx, g.room, g.id, reason)
+		// the host may have left already.
+		if err != nil && !errors.Is(err, errConnClosed) {
+			g.log.Debug("Failed to write Msg GuestDisconnected", "error", err)
+		}
+	}
+	s.releaseJoins(g.room, g.id)
+	s.roomStatusChanged(g.room)
+	s.emit(GuestLeftEvent{RoomId: g.room.id, GuestId: g.id, Reason: reason})
+	return true
+}
+
+// Sends the host a JoinRequest for guestId, and waits for its answer.
+//
+// The guest is rejected if the host does not answer within ApprovalTimeout.
+func (s *WebsocketSignalingServer) awaitApproval(rm *room, guestId qp2p.GuestID, metadata []byte, role Role) approval {
+	ch := rm.park(guestId)
+	if err := msgJoinRequest(s.ctx, rm, guestId, metadata, role); err != nil {
+		rm.log.Debug("Failed to write Msg JoinRequest", "error", err)
+		rm.removeGuest(guestId)
+		return approval{code: StatusHostOffline, reason: "Host is offline."}
+	}
+	t := time.NewTimer(s.sopts.ApprovalTimeout)
+	defer t.Stop()
+	select {
+	case a := <-ch:
+		return a
+	case <-t.C:
+		// the host may have answered just as the timer fired.
+		rm.decide(guestId, approval{code: StatusHostTimeout, reason: "Host did not respond."})
+		return <-ch
+	}
+}
+
+// Checks that no other guest on the server uses guestId, per ServerOptions.DuplicateGuests.
+//
+// Returns false if the new guest must be turned away.
+func (s *WebsocketSignalingServer) claimGuestId(guestId qp2p.GuestID) bool {
+	old, ok := s.guests.Load(guestId)
+	if !ok {
+		return true
+	}
+	if s.sopts.DuplicateGuests != ReplaceDuplicateGuest {
+		return false
+	}
+	if s.removeGuest(old, ReasonReplaced) {
+		old.log.Debug("Guest replaced by a new guest with its id")
+		old.closeConn(StatusReplaced, closeReason(StatusReplaced, "guest id reused"))
+	}
+	return true
+}
+
+// Queues g until a slot frees up in the full room rm, sending it QueuePosition every waitingInterval.
+//
+// Returns an accepted approval once g is admitted. g is rejected if the queue is full,
+// the host clears it, the room closes, or gConn closes.
+func (s *WebsocketSignalingServer) awaitSlot(rm *room, g *guest, gConn *GuestConn) approval {
+	ch, ok := rm.enqueue(g)
+	if !ok {
+		return approval{code: StatusRoomFull, reason: "queue full"}
+	}
+	g.log.Debug("Guest queued, room full")
+	t := time.NewTicker(waitingInterval)
+	defer t.Stop()
+	for {
+		if position := rm.queuePosition(g.id); position > 0 {
+			msgQueuePosition(gConn.ctx, gConn, position)
+		}
+		select {
+		case a := <-ch:
+			return a
+		case <-gConn.done:
+			// queued guests are not read from, so a failed QueuePosition write is how a
+			// disconnect is noticed. The guest may have been admitted just before.
+			if !rm.dequeue(g.id) {
+				if a := <-ch; a.accepted {
+					rm.removeGuest(g.id)
+				}
 			}
-			go msgIceCandidate(gConn, timeout, msg.GuestId, msg.Candidate)
+			return approval{code: websocket.StatusGoingAway, reason: "disconnected"}
+		case <-t.C:
 		}
 	}
 }
 
-// Returns false if host with roomId exists.
-func (s *WebsocketSignalingServer) isUnique(roomId qp2p.RoomId) bool {
-	if _, ok := s.hosts.Load(roomId); ok { // roomId is used?
-		return false // not unique.
+// Kicks the guest from its room with code and reason. kickedBy is "host" or "admin".
+//
+// Removing the guest sends GuestDisconnected to the host as confirmation.
+//
+// Returns false if the guest already left.
+func (s *WebsocketSignalingServer) kickGuest(g *guest, kickedBy string, code KickCode, reason string) bool {
+	if !s.removeGuest(g, "kicked by "+kickedBy) {
+		return false
+	}
+	if gConn := g.conn(); gConn != nil {
+		msgKicked(s.ctx, gConn, g.id, code, reason)
+		go gConn.Close(StatusKicked, closeReason(StatusKicked, "by "+kickedBy))
+	}
+	return true
+}
+
+// Shutdown closes every room, kicking its guests, and closes the Events channel.
+// New hosts and guests are turned away with 503.
+//
+// Returns ctx.Err() if ctx is done before every room is closed,
+// closing the connections still open without waiting on their writes.
+//
+// It does not stop the http.Server serving Mux. Call http.Server.Shutdown after Shutdown for that.
+func (s *WebsocketSignalingServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	defer s.closeEvents()
+	defer s.stopRelay()
+
+	var wg sync.WaitGroup
+	for _, rm := range s.rooms.All() {
+		wg.Go(func() { s.closeRoom(rm, StatusRoomClosed, "Server is shutting down.") })
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// stop waiting on stuck writes, every connection is closed.
+		s.cancel()
+		return ctx.Err()
+	}
+}
+
+// Returns when g's handshake burst ends, HandshakeWindow after its GuestAuth.
+func (s *WebsocketSignalingServer) handshakeEnd(g *guest) time.Time {
+	return g.authAt.Add(s.sopts.HandshakeWindow)
+}
+
+// Reports whether msg is the host's first HostAuth, or an IceCandidate after it,
+// for a guest still in its handshake window.
+// The host-wide limiter does not count them, candidates are counted by the guest's own limiter.
+func (s *WebsocketSignalingServer) inHandshake(rm *room, msg Msg) bool {
+	if s.sopts.HandshakeBurst <= 0 || msg.Type != HostAuth && msg.Type != IceCandidate {
+		return false
+	}
+	g, ok := s.guests.Load(msg.GuestId)
+	if !ok || g.room != rm || !time.Now().Before(s.handshakeEnd(g)) {
+		return false
+	}
+	_, authed := rm.hostLimiter(msg.GuestId)
+	return authed == (msg.Type == IceCandidate)
+}
+
+// Accepts the websocket, limiting the size of messages read from it,
+// and negotiating its codec and compression with the client.
+func (s *WebsocketSignalingServer) accept(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	// browser clients can ask for JSON text frames, constrained clients for CBOR, and version 2 clients for envelopes, see ConnCodec.
+	v, _ := requestVersion(r)
+	return s.acceptWith(w, r, append(slices.Clone(s.opts.Subprotocols), subprotocols(v)...))
+}
+
+// Accepts the websocket like accept, offering only subprotocols, e.g. the one the node hosting a relayed room chose.
+func (s *WebsocketSignalingServer) acceptWith(w http.ResponseWriter, r *http.Request, subprotocols []string) (*websocket.Conn, error) {
+	opts := s.opts
+	opts.Subprotocols = subprotocols
+	if s.sopts.CompressionMode != websocket.CompressionDisabled {
+		opts.CompressionMode = s.sopts.CompressionMode
+	}
+	if s.sopts.CompressionThreshold != 0 {
+		opts.CompressionThreshold = s.sopts.CompressionThreshold
 	}
-	return true // is unique.
+	ws, err := websocket.Accept(w, r, &opts)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(s.sopts.MaxMessageSize)
+	return ws, nil
+}
+
+// Returns the {roomId} path value in its canonical form.
+func pathRoomId(r *http.Request) qp2p.RoomId {
+	return internal.NormalizeRoomID(qp2p.RoomId(r.PathValue("roomId")))
+}
+
+// Response header with the connection ID that the server's log lines
+// for a host or guest connection carry as "conn".
+const ConnectionIDHeader = "X-Connection-Id"
+
+// Returns the logger for the host or guest connection of r, with a new connection ID
+// and the remote address.
+//
+// The connection ID is also sent in the ConnectionIDHeader header,
+// so the HTTP request can be matched with later websocket logs.
+func (s *WebsocketSignalingServer) connLogger(w http.ResponseWriter, r *http.Request) *slog.Logger {
+	connId := rand.Text()[:10]
+	w.Header().Set(ConnectionIDHeader, connId)
+	return s.log.With("conn", connId, "remote", s.remoteAddr(r))
 }
@@ -0,0 +1,1145 @@
+package signaling_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qp2p "github.com/BrownNPC/QuicP2P"
+	"github.com/BrownNPC/QuicP2P/signaling"
+	"github.com/BrownNPC/QuicP2P/signaling/signalingtest"
+	"github.com/coder/websocket"
+)
+
+// A HostAuth for a guest that is admitted but not registered yet waits off the host's read loop,
+// so the host's messages to its other guests aren't held up, and is delivered once the guest is registered.
+func TestHostAuthForUnregisteredGuestIsParked(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t, url.Values{"approval": {"true"}})
+
+	a := srv.Join(t, host.RoomId, "")
+	a.Auth()
+	reqA := host.Expect(signaling.JoinRequest)
+	host.Send(signaling.Msg{Type: signaling.AcceptGuest, GuestId: reqA.GuestId})
+	host.Expect(signaling.GuestJoined)
+	a.Expect(signaling.Joined)
+
+	// b waits for approval, so it is admitted but not registered.
+	b := srv.Join(t, host.RoomId, "")
+	b.Auth()
+	reqB := host.Expect(signaling.JoinRequest)
+	host.Auth(reqB.GuestId)
+	start := time.Now()
+	host.Auth(reqA.GuestId)
+	a.Expect(signaling.HostAuth)
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("HostAuth for a registered guest took %v behind one for an unregistered guest", d)
+	}
+
+	host.Send(signaling.Msg{Type: signaling.AcceptGuest, GuestId: reqB.GuestId})
+	host.Expect(signaling.GuestJoined)
+	b.ExpectAll(signaling.Joined, signaling.HostAuth)
+}
+
+// Starts a server logging to log, with its mux wrapped by wrap if it is not nil.
+func startServer(t *testing.T, log *slog.Logger, sopts signaling.ServerOptions, wrap func(http.Handler) http.Handler) *signalingtest.Server {
+	t.Helper()
+	s := signaling.NewWebsocketSignalingServer(log, websocket.AcceptOptions{}, sopts)
+	var h http.Handler = s.Mux
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &signalingtest.Server{WebsocketSignalingServer: s, Addr: strings.TrimPrefix(ts.URL, "http://")}
+}
+
+// Calls hook on the server's goroutine when it logs msg, to wait for the server or to widen a race.
+type hookHandler struct {
+	msg  string
+	hook func()
+}
+
+func (h hookHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h hookHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h hookHandler) WithGroup(string) slog.Handler            { return h }
+func (h hookHandler) Handle(_ context.Context, r slog.Record) error {
+	if r.Message == h.msg {
+		h.hook()
+	}
+	return nil
+}
+
+// Returns a logger and a channel that receives each time the server logs msg.
+func logHook(msg string) (*slog.Logger, <-chan struct{}) {
+	ch := make(chan struct{}, 16)
+	return slog.New(hookHandler{msg, func() { ch <- struct{}{} }}), ch
+}
+
+// Waits for a receive on ch, failing the test with what after Timeout.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(signalingtest.Timeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// Sends a GET for path, which must fail before the websocket upgrade, and returns the status and error body.
+//
+// The protocol version is set unless query has one.
+func getError(t *testing.T, srv *signalingtest.Server, path string, query url.Values) (int, signaling.HTTPError) {
+	t.Helper()
+	if query == nil {
+		query = url.Values{}
+	}
+	if !query.Has("v") {
+		query.Set("v", fmt.Sprint(qp2p.ProtocolVersion))
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/%s?%s", srv.Addr, path, query.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body signaling.HTTPError
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("GET %s: decode body: %v", path, err)
+	}
+	return resp.StatusCode, body
+}
+
+// The guest is sent Joined before the host is sent GuestJoined, so the host's answer can't reach
+// the guest before it knows the GuestID the answer is sealed with.
+func TestJoinedBeforeHostAuth(t *testing.T) {
+	// the server logs "Guest joined room" once it has told the host, stalling there gives the host time to answer.
+	slow := hookHandler{"Guest joined room", func() { time.Sleep(200 * time.Millisecond) }}
+	srv := startServer(t, slog.New(slow), signaling.ServerOptions{}, nil)
+
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.Expect(signaling.Joined)
+	g.Expect(signaling.HostAuth)
+}
+
+// The full message choreography between a host and a guest.
+func TestHostGuestChoreography(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	if joined.Ufrag != signalingtest.Ufrag || joined.Pwd != signalingtest.Pwd {
+		t.Fatalf("GuestJoined has credentials %q %q, want the guest's", joined.Ufrag, joined.Pwd)
+	}
+	host.Auth(joined.GuestId)
+	if got := g.Expect(signaling.Joined).GuestId; got != joined.GuestId {
+		t.Fatalf("guest joined as %v, host was told %v", got, joined.GuestId)
+	}
+	g.Expect(signaling.HostAuth)
+
+	g.SendCandidate(0)
+	if c := host.Expect(signaling.IceCandidate); c.GuestId != joined.GuestId || c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q from %v", c.Candidate, c.GuestId)
+	}
+	host.SendCandidate(joined.GuestId, 1)
+	if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q", c.Candidate)
+	}
+	g.Send(signaling.Msg{Type: signaling.EndOfCandidates})
+	host.Expect(signaling.EndOfCandidates)
+	host.Send(signaling.Msg{Type: signaling.EndOfCandidates, GuestId: joined.GuestId})
+	g.Expect(signaling.EndOfCandidates)
+}
+
+// A malformed frame from a joined guest is answered with an error, and the guest stays connected.
+func TestMalformedFrameIsRejected(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	host.Expect(signaling.GuestJoined)
+	g.Expect(signaling.Joined)
+
+	g.SendRaw(websocket.MessageBinary, []byte{0xc1})
+	if e := signaling.PayloadOf(g.Expect(signaling.Error)).(signaling.ErrorMsg); e.Code != signaling.ErrorMessageRejected {
+		t.Fatalf("malformed frame rejected with %v, want %v", e.Code, signaling.ErrorMessageRejected)
+	}
+	g.SendCandidate(0)
+	host.Expect(signaling.IceCandidate)
+}
+
+// A malformed frame in place of GuestAuth closes the guest's connection.
+func TestMalformedGuestAuthClosesConn(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+	g.SendRaw(websocket.MessageBinary, []byte{0xc1})
+	g.ExpectClosed(signaling.StatusInvalidMessage)
+}
+
+// Candidates that arrive after the handshake are still forwarded.
+func TestLateCandidatesAreForwarded(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+
+	g.SendAfter(300*time.Millisecond, signaling.Msg{Type: signaling.IceCandidate, Candidate: signalingtest.Candidate(0)})
+	host.ExpectNothing(100 * time.Millisecond)
+	if c := host.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(0) {
+		t.Fatalf("host got candidate %q", c.Candidate)
+	}
+}
+
+// Fake connections answer the server's pings while the test is idle, so an idle host isn't dropped.
+func TestIdleFakesStayConnected(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	time.Sleep(3 * time.Second)
+
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+}
+
+// Guests that dial /join/{roomId} join the host's room instead of opening rooms of their own,
+// and go through the whole exchange with the host.
+func TestJoinRouteJoinsHostsRoom(t *testing.T) {
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics})
+	host := srv.Host(t)
+
+	for i := range 2 {
+		g := srv.Join(t, host.RoomId, "")
+		g.Auth()
+		joined := host.Expect(signaling.GuestJoined)
+		host.Auth(joined.GuestId)
+		g.ExpectAll(signaling.Joined, signaling.HostAuth)
+
+		g.Send(signaling.Msg{Type: signaling.IceCandidate, Candidates: []string{signalingtest.Candidate(2 * i), signalingtest.Candidate(2*i + 1)}})
+		if c := host.Expect(signaling.IceCandidate); c.GuestId != joined.GuestId || len(c.Candidates) != 2 {
+			t.Fatalf("host got %d candidates from %v, want 2 from %v", len(c.Candidates), c.GuestId, joined.GuestId)
+		}
+		host.SendCandidate(joined.GuestId, i)
+		if c := g.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(i) {
+			t.Fatalf("guest got candidate %q, want %q", c.Candidate, signalingtest.Candidate(i))
+		}
+	}
+	if n := metrics.Snapshot().Counters[signaling.MetricActiveRooms]; n != 1 {
+		t.Fatalf("%d rooms open, want only the host's", n)
+	}
+}
+
+// Joining a room that does not exist fails with a 404 before the websocket is accepted,
+// which the guest client returns as ErrRoomNotFound.
+func TestJoinUnknownRoomIsNotFound(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	if status, body := getError(t, srv, "join/NOROOM", nil); status != http.StatusNotFound || body.Code != signaling.CodeRoomNotFound {
+		t.Fatalf("got %d %q, want %d %q", status, body.Code, http.StatusNotFound, signaling.CodeRoomNotFound)
+	}
+
+	_, err := signaling.NewSignalingClientGuest(srv.Addr, signaling.SchemeWs, "NOROOM", "", nil, slog.New(slog.DiscardHandler), signaling.ClientOptions{})
+	if !errors.Is(err, signaling.ErrRoomNotFound) {
+		t.Fatalf("guest client got %v, want ErrRoomNotFound", err)
+	}
+}
+
+// Runs before the connection is hijacked, after the handler has decided to accept the websocket.
+type hijackHook struct {
+	http.ResponseWriter
+	before func()
+}
+
+func (w hijackHook) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.before()
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// A room that closes while a guest's websocket is being accepted closes the guest with StatusRoomClosed,
+// which the guest reads as ErrRoomNotFound.
+func TestJoinRoomClosedDuringAccept(t *testing.T) {
+	var srv *signalingtest.Server
+	var host *signalingtest.FakeHost
+	// the host leaves after the guest's room was looked up, before its websocket is accepted.
+	closeHost := func() {
+		host.Close()
+		timeout := time.After(signalingtest.Timeout)
+		for {
+			select {
+			case e := <-srv.Events():
+				if e, ok := e.(signaling.RoomClosedEvent); ok && e.RoomId == host.RoomId {
+					return
+				}
+			case <-timeout:
+				t.Error("room never closed")
+				return
+			}
+		}
+	}
+	srv = startServer(t, nil, signaling.ServerOptions{}, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/join/") {
+				w = hijackHook{w, closeHost}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	host = srv.Host(t)
+
+	g := srv.Dial(t, "join/"+string(host.RoomId), nil)
+	// the close may follow an Error.
+	_, err := g.Read()
+	for err == nil {
+		_, err = g.Read()
+	}
+	if code := websocket.CloseStatus(err); code != signaling.StatusRoomClosed {
+		t.Fatalf("guest closed with %v, want %v: %v", code, signaling.StatusRoomClosed, err)
+	}
+	if !errors.Is(err, signaling.ErrRoomNotFound) {
+		t.Fatalf("guest got %v, want ErrRoomNotFound", err)
+	}
+}
+
+// Guests must send the room's password, in the url or in GuestAuth, and it is never forwarded to the host.
+func TestRoomPassword(t *testing.T) {
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics, MaxPasswordLen: 8})
+	host := srv.Host(t, url.Values{"password": {"secret"}})
+
+	join := func(urlPassword, authPassword string) *signalingtest.FakeGuest {
+		g := srv.Join(t, host.RoomId, urlPassword)
+		g.Send(signaling.Msg{Type: signaling.GuestAuth, Ufrag: signalingtest.Ufrag, Pwd: signalingtest.Pwd, Password: authPassword})
+		return g
+	}
+	for _, tc := range []struct{ name, url, auth string }{
+		{"in url", "secret", ""},
+		{"in GuestAuth", "", "secret"},
+		{"GuestAuth over url", "wrong", "secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			join(tc.url, tc.auth).Expect(signaling.Joined)
+			if joined := host.Expect(signaling.GuestJoined); joined.Password != "" {
+				t.Fatalf("password forwarded to the host in GuestJoined: %q", joined.Password)
+			}
+		})
+	}
+	for _, tc := range []struct{ name, url, auth string }{
+		{"missing", "", ""},
+		{"wrong", "wrong", ""},
+		{"wrong in GuestAuth", "secret", "wrong"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			join(tc.url, tc.auth).ExpectClosed(signaling.StatusWrongPassword)
+		})
+	}
+	waitCounter(t, metrics, signaling.MetricJoinsRejected+"{reason=wrong_password}", 3)
+
+	// longer than MaxPasswordLen is turned away before the websocket is accepted.
+	if status, _ := getError(t, srv, "join/"+string(host.RoomId), url.Values{"password": {"toolongpassword"}}); status != http.StatusBadRequest {
+		t.Fatalf("too long password got %d, want %d", status, http.StatusBadRequest)
+	}
+	waitCounter(t, metrics, signaling.MetricJoinsRejected+"{reason=password_too_long}", 1)
+}
+
+// Waits for the counter name to reach want, as the server may count after it closes a connection.
+func waitCounter(t *testing.T, metrics *signaling.MemoryMetrics, name string, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for {
+		n := metrics.Snapshot().Counters[name]
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %d, want %d", name, n, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Starts a server with a host grace period, and returns a channel that receives when a host is noticed away.
+func startResumeServer(t *testing.T, grace time.Duration) (*signalingtest.Server, <-chan struct{}) {
+	log, away := logHook("host away, waiting for resume")
+	return startServer(t, log, signaling.ServerOptions{HostGracePeriod: grace}, nil), away
+}
+
+// Joins a guest to host's room through the whole handshake.
+func joinRoom(t *testing.T, srv *signalingtest.Server, host *signalingtest.FakeHost) (*signalingtest.FakeGuest, qp2p.GuestID) {
+	t.Helper()
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+	return g, joined.GuestId
+}
+
+// A host that resumes within the grace period gets its room back with its guests,
+// and the messages sent to it while it was away.
+func TestHostResumeInTime(t *testing.T) {
+	srv, away := startResumeServer(t, signalingtest.Timeout)
+	host := srv.Host(t)
+	a, aId := joinRoom(t, srv, host)
+	host.Ws.CloseNow()
+	waitFor(t, away, "host away")
+
+	b := srv.Join(t, host.RoomId, "")
+	b.Auth()
+	b.Expect(signaling.Joined)
+	a.SendCandidate(0)
+
+	resumed := srv.Dial(t, "host/resume/"+string(host.RoomId), url.Values{"token": {host.ResumeToken}})
+	queued := resumed.ExpectAll(signaling.GuestJoined, signaling.IceCandidate)
+	for _, msg := range queued {
+		if msg.Type == signaling.IceCandidate && msg.GuestId != aId {
+			t.Fatalf("queued candidate from %v, want %v", msg.GuestId, aId)
+		}
+	}
+	resumed.Send(signaling.Msg{Type: signaling.IceCandidate, GuestId: aId, Candidate: signalingtest.Candidate(1)})
+	if c := a.Expect(signaling.IceCandidate); c.Candidate != signalingtest.Candidate(1) {
+		t.Fatalf("guest got candidate %q from the resumed host", c.Candidate)
+	}
+}
+
+// Guests are kicked once the grace period ends, and the room can't be resumed anymore.
+func TestHostResumeTooLate(t *testing.T) {
+	srv, away := startResumeServer(t, 100*time.Millisecond)
+	host := srv.Host(t)
+	a, _ := joinRoom(t, srv, host)
+	host.Ws.CloseNow()
+	waitFor(t, away, "host away")
+
+	a.Expect(signaling.KickGuest)
+	a.ExpectClosed(signaling.StatusHostOffline)
+	status, body := getError(t, srv, "host/resume/"+string(host.RoomId), url.Values{"token": {host.ResumeToken}})
+	if status != http.StatusNotFound || body.Code != signaling.CodeRoomNotFound {
+		t.Fatalf("late resume got %d %q, want %d %q", status, body.Code, http.StatusNotFound, signaling.CodeRoomNotFound)
+	}
+}
+
+// A resume with a bad token is turned away, and the room still waits for its host.
+func TestHostResumeBadToken(t *testing.T) {
+	srv, away := startResumeServer(t, signalingtest.Timeout)
+	host := srv.Host(t)
+	a, _ := joinRoom(t, srv, host)
+	host.Ws.CloseNow()
+	waitFor(t, away, "host away")
+
+	status, body := getError(t, srv, "host/resume/"+string(host.RoomId), url.Values{"token": {"bad" + host.ResumeToken}})
+	if status != http.StatusForbidden || body.Code != signaling.CodeInvalidResumeToken {
+		t.Fatalf("bad token got %d %q, want %d %q", status, body.Code, http.StatusForbidden, signaling.CodeInvalidResumeToken)
+	}
+	a.ExpectNothing(100 * time.Millisecond)
+	resumed := srv.Dial(t, "host/resume/"+string(host.RoomId), url.Values{"token": {host.ResumeToken}})
+	a.SendCandidate(0)
+	resumed.Expect(signaling.IceCandidate)
+}
+
+// A host and a guest that send nothing for over 10 seconds stay connected, as liveness comes from pings.
+func TestIdleConnectionsStayOpen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("idles for over 10 seconds")
+	}
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+	time.Sleep(10*time.Second + 500*time.Millisecond)
+
+	g.SendCandidate(0)
+	host.Expect(signaling.IceCandidate)
+	host.SendCandidate(guestId, 1)
+	g.Expect(signaling.IceCandidate)
+	resp, err := http.Get(fmt.Sprintf("http://%s/room/%s", srv.Addr, host.RoomId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("idle room check got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Opens a host websocket to srv, returning the connection or the failed response.
+func dialHost(srv *signalingtest.Server) (*websocket.Conn, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), signalingtest.Timeout)
+	defer cancel()
+	return websocket.Dial(ctx, fmt.Sprintf("ws://%s/host?v=%d", srv.Addr, qp2p.ProtocolVersion), nil)
+}
+
+// Hosts that connect at once beyond MaxRooms are turned away with 503 and Retry-After,
+// and a room that closes frees its slot.
+func TestMaxRoomsUnderLoad(t *testing.T) {
+	const maxRooms, extra = 20, 10
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics, MaxRooms: maxRooms})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var hosts []*websocket.Conn
+	var rejected int
+	for range maxRooms + extra {
+		wg.Go(func() {
+			ws, resp, err := dialHost(srv)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				hosts = append(hosts, ws)
+			case resp != nil && resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+				rejected++
+			default:
+				t.Errorf("host failed with %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	for _, ws := range hosts {
+		defer ws.CloseNow()
+	}
+	if len(hosts) != maxRooms || rejected != extra {
+		t.Fatalf("%d hosts got rooms and %d were rejected, want %d and %d", len(hosts), rejected, maxRooms, extra)
+	}
+	if n := metrics.Snapshot().Counters[signaling.MetricHostsRejected]; n != extra {
+		t.Fatalf("%s is %d, want %d", signaling.MetricHostsRejected, n, extra)
+	}
+
+	hosts[0].CloseNow()
+	waitCounter(t, metrics, signaling.MetricActiveRooms, maxRooms-1)
+	ws, _, err := dialHost(srv)
+	if err != nil {
+		t.Fatalf("host rejected after a room closed: %v", err)
+	}
+	ws.CloseNow()
+}
+
+// Hosts that connect at once all get distinct room IDs, even when the IDs they are offered collide,
+// and a host is turned away once no free ID is left instead of taking another host's room.
+func TestConcurrentHostsGetDistinctRoomIds(t *testing.T) {
+	const hosts = 300
+	// hands out each of hosts IDs twice in a row, so half the IDs offered are taken.
+	var n atomic.Int64
+	colliding := func() qp2p.RoomId {
+		return qp2p.RoomId(fmt.Sprintf("R%05d", (n.Add(1)-1)/2%hosts))
+	}
+	for _, tc := range []struct {
+		name string
+		gen  func() qp2p.RoomId
+	}{
+		{"default", nil},
+		{"colliding", colliding},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{RoomIdGenerator: tc.gen})
+			ids := make(chan qp2p.RoomId, hosts)
+			var wg sync.WaitGroup
+			for range hosts {
+				wg.Go(func() {
+					ws, _, err := dialHost(srv)
+					if err != nil {
+						t.Errorf("host failed: %v", err)
+						return
+					}
+					t.Cleanup(func() { ws.CloseNow() })
+					created, err := signaling.ReadMsgTimeout(ws, signalingtest.Timeout)
+					if err != nil || created.Type != signaling.RoomCreated {
+						t.Errorf("expected RoomCreated, got %v: %v", created.Type, err)
+						return
+					}
+					ids <- created.RoomId
+				})
+			}
+			wg.Wait()
+			close(ids)
+			seen := make(map[qp2p.RoomId]bool)
+			for id := range ids {
+				if seen[id] {
+					t.Fatalf("room ID %v given to two hosts", id)
+				}
+				seen[id] = true
+			}
+			if len(seen) != hosts {
+				t.Fatalf("%d hosts got rooms, want %d", len(seen), hosts)
+			}
+			if tc.gen == nil {
+				return
+			}
+			// every ID is taken, the colliding generator only offers taken ones.
+			_, resp, err := dialHost(srv)
+			if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("host with no free room ID got %v, want %d", err, http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// A host that answers GuestJoined the instant it reads it always reaches the guest,
+// as the guest is registered before the host is told that it joined.
+func TestInstantHostAuthReachesGuest(t *testing.T) {
+	const guests = 100
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	go func() {
+		for answered := 0; answered < guests; {
+			msg, err := host.Read()
+			if err != nil {
+				return
+			}
+			if msg.Type == signaling.GuestJoined {
+				signaling.WriteMsgTimeout(host.Ws, signaling.Msg{Type: signaling.HostAuth, GuestId: msg.GuestId, Ufrag: signalingtest.Ufrag, Pwd: signalingtest.Pwd}, signalingtest.Timeout)
+				answered++
+			}
+		}
+	}()
+
+	// the guests join at once, racing each other's registration.
+	joining := make([]*signalingtest.FakeGuest, guests)
+	for i := range joining {
+		joining[i] = srv.Join(t, host.RoomId, "")
+	}
+	for _, g := range joining {
+		g.Auth()
+	}
+	for _, g := range joining {
+		g.ExpectAll(signaling.Joined, signaling.HostAuth)
+	}
+}
+
+// Waits for a RoomStatus with Locked set to locked.
+func expectLocked(host *signalingtest.FakeHost, locked bool) {
+	host.T.Helper()
+	for {
+		if host.Expect(signaling.RoomStatus).Locked == locked {
+			return
+		}
+	}
+}
+
+// Returns the public room roomId in GET /rooms.
+func listedRoom(t *testing.T, srv *signalingtest.Server, roomId qp2p.RoomId) signaling.RoomListing {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s/rooms", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rooms []signaling.RoomListing
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		t.Fatalf("decode rooms: %v", err)
+	}
+	for _, r := range rooms {
+		if r.RoomId == roomId {
+			return r
+		}
+	}
+	t.Fatalf("room %v not listed", roomId)
+	return signaling.RoomListing{}
+}
+
+// A locked room turns new guests away with 423 and shows as locked, while its guests carry on,
+// and takes new guests again once unlocked.
+func TestLockRoom(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	host.Send(signaling.Msg{Type: signaling.SetRoomInfo, Name: "lobby", Public: true})
+	before, beforeId := joinRoom(t, srv, host)
+
+	host.Send(signaling.Msg{Type: signaling.LockRoom})
+	expectLocked(host, true)
+	status, body := getError(t, srv, "join/"+string(host.RoomId), nil)
+	if status != http.StatusLocked || body.Code != signaling.CodeRoomLocked {
+		t.Fatalf("join while locked got %d %q, want %d %q", status, body.Code, http.StatusLocked, signaling.CodeRoomLocked)
+	}
+	if !listedRoom(t, srv, host.RoomId).Locked {
+		t.Fatal("locked room listed as unlocked")
+	}
+	before.SendCandidate(0)
+	host.Expect(signaling.IceCandidate)
+	host.SendCandidate(beforeId, 1)
+	before.Expect(signaling.IceCandidate)
+
+	host.Send(signaling.Msg{Type: signaling.UnlockRoom})
+	expectLocked(host, false)
+	if listedRoom(t, srv, host.RoomId).Locked {
+		t.Fatal("unlocked room listed as locked")
+	}
+	joinRoom(t, srv, host)
+}
+
+// Room IDs typed in another case, or with surrounding spaces, find the room.
+func TestJoinNormalizesRoomId(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	host := srv.Host(t)
+	for _, id := range []string{strings.ToLower(string(host.RoomId)), " " + string(host.RoomId) + " "} {
+		g := srv.Join(t, qp2p.RoomId(id), "")
+		g.Auth()
+		joined := host.Expect(signaling.GuestJoined)
+		host.Auth(joined.GuestId)
+		g.ExpectAll(signaling.Joined, signaling.HostAuth)
+	}
+}
+
+// A HostAuth or GuestAuth sent again is dropped, so each is forwarded exactly once.
+func TestDuplicateAuthIsForwardedOnce(t *testing.T) {
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics})
+	host := srv.Host(t)
+	g := srv.Join(t, host.RoomId, "")
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	g.Expect(signaling.Joined)
+
+	g.Auth()
+	host.Auth(joined.GuestId)
+	host.Auth(joined.GuestId)
+	g.Expect(signaling.HostAuth)
+	// the host and guest still talk once the duplicates are dropped.
+	g.SendCandidate(0)
+	host.Expect(signaling.IceCandidate)
+	host.SendCandidate(joined.GuestId, 1)
+	g.Expect(signaling.IceCandidate)
+	g.ExpectNothing(50 * time.Millisecond)
+	host.ExpectNothing(50 * time.Millisecond)
+
+	reasons := map[string]bool{}
+	for range 2 {
+		reasons[waitEvent[signaling.MessageRejectedEvent](t, srv).Reason] = true
+	}
+	if !reasons["duplicate GuestAuth"] || !reasons["duplicate HostAuth"] {
+		t.Fatalf("rejected %v, want both duplicates", reasons)
+	}
+	counters := metrics.Snapshot().Counters
+	if n := counters[signaling.MetricMessagesForwarded+"{type=HostAuth}"]; n != 1 {
+		t.Fatalf("HostAuth forwarded %d times, want 1", n)
+	}
+	if n := counters[signaling.MetricActiveGuests]; n != 1 {
+		t.Fatalf("%d active guests, want 1", n)
+	}
+}
+
+// Returns once no more than want goroutines are running, or fails the test after signalingtest.Timeout.
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(signalingtest.Timeout)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running, want at most %d", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A closed host or guest connection leaves no goroutines behind, even ping loops that won't ping again for an hour.
+func TestClosedConnectionsDoNotLeakGoroutines(t *testing.T) {
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{PingInterval: time.Hour})
+	cycle := func() {
+		host := srv.Host(t)
+		g, _ := joinRoom(t, srv, host)
+		g.Close()
+		host.Expect(signaling.GuestDisconnected)
+		host.Close()
+	}
+	// the first cycle starts the goroutines that live as long as the server.
+	cycle()
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for range 100 {
+		cycle()
+	}
+	// a little slack for the HTTP client's idle connections, a leak is at least one goroutine per cycle.
+	waitGoroutines(t, before+10)
+}
+
+// Dials path negotiating codec, and fails the test if the server picks another.
+func dialCodec(t *testing.T, srv *signalingtest.Server, path string, codec signaling.Codec) *signalingtest.Conn {
+	t.Helper()
+	c := srv.DialOptions(t, path, nil, &websocket.DialOptions{Subprotocols: []string{codec.Subprotocol()}})
+	if got := signaling.ConnCodec(c.Ws); got != codec {
+		t.Fatalf("asked for %s, got %s", codec.Subprotocol(), got.Subprotocol())
+	}
+	return c
+}
+
+// Hosts and guests on different codecs share a room, the server re-encodes what it forwards
+// in the receiver's codec.
+func TestMixedCodecRoom(t *testing.T) {
+	srv := signalingtest.StartServer(t)
+	for _, hostCodec := range allCodecs {
+		for _, guestCodec := range allCodecs {
+			t.Run(hostCodec.Subprotocol()+" "+guestCodec.Subprotocol(), func(t *testing.T) {
+				host := &signalingtest.FakeHost{Conn: dialCodec(t, srv, "host", hostCodec)}
+				host.RoomId = host.Expect(signaling.RoomCreated).RoomId
+				c := dialCodec(t, srv, "join/"+string(host.RoomId), guestCodec)
+				g := &signalingtest.FakeGuest{Conn: c, Info: c.Expect(signaling.RoomInfo)}
+
+				g.Auth()
+				joined := host.Expect(signaling.GuestJoined)
+				if joined.Ufrag != signalingtest.Ufrag || joined.Pwd != signalingtest.Pwd {
+					t.Fatalf("GuestJoined credentials %q %q", joined.Ufrag, joined.Pwd)
+				}
+				host.Auth(joined.GuestId)
+				for _, msg := range g.ExpectAll(signaling.Joined, signaling.HostAuth) {
+					if msg.Type == signaling.HostAuth && (msg.Ufrag != signalingtest.Ufrag || msg.Pwd != signalingtest.Pwd) {
+						t.Fatalf("HostAuth credentials %q %q", msg.Ufrag, msg.Pwd)
+					}
+				}
+				g.SendCandidate(0)
+				if got := host.Expect(signaling.IceCandidate); got.Candidate != signalingtest.Candidate(0) || got.GuestId != joined.GuestId {
+					t.Fatalf("host got candidate %q from %v", got.Candidate, got.GuestId)
+				}
+				host.SendCandidate(joined.GuestId, 1)
+				if got := g.Expect(signaling.IceCandidate); got.Candidate != signalingtest.Candidate(1) {
+					t.Fatalf("guest got candidate %q", got.Candidate)
+				}
+			})
+		}
+	}
+}
+
+// Reads IceCandidate messages from c until it has n candidates, batched or not.
+func expectCandidates(c *signalingtest.Conn, n int) {
+	c.T.Helper()
+	for got := 0; got < n; {
+		msg := c.Expect(signaling.IceCandidate)
+		if msg.Candidate != "" {
+			got++
+		}
+		got += len(msg.Candidates)
+	}
+}
+
+// Right after GuestAuth a guest, and its host, can trickle more candidates than their steady-state burst allows,
+// and once HandshakeWindow is over the guest is rate limited again.
+func TestHandshakeBurst(t *testing.T) {
+	const candidates = 15
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+		GuestMsgRate:         1,
+		GuestMsgBurst:        5,
+		HostMsgRate:          1,
+		HostMsgBurst:         5,
+		HostMsgRatePerGuest:  1,
+		HostMsgBurstPerGuest: 5,
+		HandshakeWindow:      500 * time.Millisecond,
+	})
+	host := srv.Host(t)
+	g, guestId := joinRoom(t, srv, host)
+
+	for i := range candidates {
+		g.SendCandidate(i)
+		host.SendCandidate(guestId, i)
+	}
+	expectCandidates(host.Conn, candidates)
+	expectCandidates(g.Conn, candidates)
+
+	time.Sleep(600 * time.Millisecond)
+	for i := range candidates {
+		g.SendCandidate(i)
+	}
+	g.ExpectClosed(signaling.StatusRateLimited)
+}
+
+// A host that created its room with heartbeat=true and stops sending Heartbeat is treated as dead
+// after HostHeartbeatMisses intervals, even though its connection still answers pings.
+func TestMissedHeartbeatsCloseRoom(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{HostHeartbeatInterval: interval, HostHeartbeatMisses: 3})
+	host := srv.Host(t, url.Values{"heartbeat": {"true"}})
+	g, _ := joinRoom(t, srv, host)
+
+	// heartbeats keep the room open well past the misses allowed.
+	for range 12 {
+		host.Send(signaling.Msg{Type: signaling.Heartbeat})
+		time.Sleep(interval)
+	}
+	host.ExpectNothing(0)
+	g.ExpectNothing(0)
+
+	start := time.Now()
+	kick := signaling.PayloadOf(g.Expect(signaling.KickGuest)).(signaling.KickGuestMsg)
+	if kick.ReasonCode != signaling.KickHostUnresponsive {
+		t.Fatalf("guest kicked with %v, want %v", kick.ReasonCode, signaling.KickHostUnresponsive)
+	}
+	if d := time.Since(start); d > 10*interval {
+		t.Fatalf("room closed %v after the last heartbeat", d)
+	}
+	g.ExpectClosed(signaling.StatusHostUnresponsive)
+	host.ExpectClosed(signaling.StatusHostUnresponsive)
+}
+
+// Rooms created without heartbeat=true are not closed for missing heartbeats.
+func TestHeartbeatsAreOptIn(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{HostHeartbeatInterval: interval, HostHeartbeatMisses: 1})
+	host := srv.Host(t)
+	host.ExpectNothing(10 * interval)
+	srv.Join(t, host.RoomId, "")
+}
+
+// A TCP proxy to a server that counts the bytes it relays, for looking at what goes over the wire.
+type recordingProxy struct {
+	Addr string
+	// bytes from the server to the client.
+	down atomic.Int64
+	mu   sync.Mutex
+	// everything the client sent.
+	up []byte
+	// closed when the test ends, idle keep-alive connections would otherwise stay open.
+	conns []net.Conn
+}
+
+// Starts a recordingProxy to addr. It is closed when the test ends.
+func startRecordingProxy(t *testing.T, addr string) *recordingProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingProxy{Addr: l.Addr().String()}
+	var relays sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		p.cut()
+		relays.Wait()
+	})
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mu.Unlock()
+			relays.Add(2)
+			go func() {
+				defer relays.Done()
+				relay(server, client, func(b []byte) {
+					p.mu.Lock()
+					p.up = append(p.up, b...)
+					p.mu.Unlock()
+				})
+			}()
+			go func() {
+				defer relays.Done()
+				relay(client, server, func(b []byte) { p.down.Add(int64(len(b))) })
+			}()
+		}
+	}()
+	return p
+}
+
+// Copies src to dst, passing what it copies to record, until either fails. Then it closes dst.
+func relay(dst, src net.Conn, record func([]byte)) {
+	defer dst.Close()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		record(buf[:n])
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Closes every connection through the proxy, as if the network between client and server went away.
+func (p *recordingProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+// Returns everything the proxy's clients sent.
+func (p *recordingProxy) sent() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return string(p.up)
+}
+
+// Returns how many bytes the guest is sent for a batch of candidates from its host, with compression set to mode
+// on the server and the guest.
+func candidateBatchSize(t *testing.T, mode websocket.CompressionMode, candidates int) int64 {
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{CompressionMode: mode})
+	proxy := startRecordingProxy(t, srv.Addr)
+	via := &signalingtest.Server{WebsocketSignalingServer: srv.WebsocketSignalingServer, Addr: proxy.Addr}
+	host := srv.Host(t)
+	c := via.DialOptions(t, "join/"+string(host.RoomId), nil, &websocket.DialOptions{CompressionMode: mode})
+	g := &signalingtest.FakeGuest{Conn: c, Info: c.Expect(signaling.RoomInfo)}
+	g.Auth()
+	joined := host.Expect(signaling.GuestJoined)
+	host.Auth(joined.GuestId)
+	g.ExpectAll(signaling.Joined, signaling.HostAuth)
+
+	batch := make([]string, candidates)
+	for i := range batch {
+		batch[i] = signalingtest.Candidate(i)
+	}
+	before := proxy.down.Load()
+	host.Send(signaling.Msg{Type: signaling.IceCandidate, GuestId: joined.GuestId, Candidates: batch})
+	expectCandidates(g.Conn, candidates)
+	return proxy.down.Load() - before
+}
+
+// With CompressionMode set on the server and the client, batched candidates go over the wire deflated.
+func TestCompressionEngagesForCandidateBatches(t *testing.T) {
+	const candidates = 30
+	plain := candidateBatchSize(t, websocket.CompressionDisabled, candidates)
+	deflated := candidateBatchSize(t, websocket.CompressionContextTakeover, candidates)
+	if deflated*2 > plain {
+		t.Fatalf("%d candidates took %d bytes deflated, %d bytes plain", candidates, deflated, plain)
+	}
+}
+
+// Returns a ServerOptions.GuestIDAssigner that gives every guest id.
+func fixedGuestID(id qp2p.GuestID) func(*http.Request, signaling.Msg) (qp2p.GuestID, error) {
+	return func(*http.Request, signaling.Msg) (qp2p.GuestID, error) { return id, nil }
+}
+
+// Guests get the GuestIDs the GuestIDAssigner picks, which can come from the identity the Authenticator checked.
+func TestGuestIDAssigner(t *testing.T) {
+	t.Run("sequential", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{GuestIDAssigner: signalingtest.SequentialGuestIDs()})
+		host := srv.Host(t)
+		for n := 1; n <= 3; n++ {
+			if _, guestId := joinRoom(t, srv, host); guestId != signalingtest.GuestID(n) {
+				t.Fatalf("guest %d got %v, want %v", n, guestId, signalingtest.GuestID(n))
+			}
+		}
+	})
+	t.Run("from identity", func(t *testing.T) {
+		ids := map[string]qp2p.GuestID{"bob": signalingtest.GuestID(7)}
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+			Authenticator: signaling.BearerTokenAuthenticator(map[string]string{"token": "bob"}),
+			GuestIDAssigner: func(r *http.Request, _ signaling.Msg) (qp2p.GuestID, error) {
+				return ids[signaling.Identity(r)], nil
+			},
+		})
+		host := srv.Host(t, url.Values{"auth": {"token"}})
+		c := srv.Dial(t, "join/"+string(host.RoomId), url.Values{"auth": {"token"}})
+		c.Expect(signaling.RoomInfo)
+		(&signalingtest.FakeGuest{Conn: c}).Auth()
+		if joined := host.Expect(signaling.GuestJoined); joined.GuestId != signalingtest.GuestID(7) {
+			t.Fatalf("guest got %v, want %v", joined.GuestId, signalingtest.GuestID(7))
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{
+			GuestIDAssigner: func(*http.Request, signaling.Msg) (qp2p.GuestID, error) {
+				return qp2p.GuestID{}, errors.New("no account")
+			},
+		})
+		host := srv.Host(t)
+		g := srv.Join(t, host.RoomId, "")
+		g.Auth()
+		g.ExpectClosed(signaling.StatusJoinRejected)
+		host.ExpectNothing(50 * time.Millisecond)
+	})
+}
+
+// A guest with the GuestID of a guest already on the server is turned away with RejectDuplicateGuest,
+// and takes the other guest's place with ReplaceDuplicateGuest.
+func TestDuplicateGuestIDs(t *testing.T) {
+	id := signalingtest.GuestID(1)
+
+	t.Run("reject", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{GuestIDAssigner: fixedGuestID(id)})
+		host := srv.Host(t)
+		first, _ := joinRoom(t, srv, host)
+		// the GuestID is taken server-wide, not just in one room.
+		for _, roomHost := range []*signalingtest.FakeHost{host, srv.Host(t)} {
+			g := srv.Join(t, roomHost.RoomId, "")
+			g.Auth()
+			g.ExpectClosed(signaling.StatusDuplicateGuest)
+		}
+		// the first guest is still in the room.
+		first.SendCandidate(0)
+		host.Expect(signaling.IceCandidate)
+	})
+	t.Run("replace", func(t *testing.T) {
+		srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{GuestIDAssigner: fixedGuestID(id), DuplicateGuests: signaling.ReplaceDuplicateGuest})
+		host := srv.Host(t)
+		first, _ := joinRoom(t, srv, host)
+		g := srv.Join(t, host.RoomId, "")
+		g.Auth()
+		first.ExpectClosed(signaling.StatusReplaced)
+		if left := host.Expect(signaling.GuestDisconnected); left.GuestId != id || left.Reason != signaling.ReasonReplaced {
+			t.Fatalf("GuestDisconnected %v %q, want %v %q", left.GuestId, left.Reason, id, signaling.ReasonReplaced)
+		}
+		if joined := host.Expect(signaling.GuestJoined); joined.GuestId != id {
+			t.Fatalf("GuestJoined %v, want %v", joined.GuestId, id)
+		}
+		host.Auth(id)
+		g.ExpectAll(signaling.Joined, signaling.HostAuth)
+	})
+}
+
+// A host can't reach a guest in another room, even knowing its GuestID:
+// every message addressed to it is dropped and counted, and both rooms carry on.
+func TestHostCantMessageGuestInOtherRoom(t *testing.T) {
+	metrics := signaling.NewMemoryMetrics()
+	srv := signalingtest.StartServerOptions(t, signaling.ServerOptions{Metrics: metrics})
+	a := srv.Host(t)
+	b := srv.Host(t)
+	// b's guest is waiting for its host's HostAuth, which another host must not be able to send first.
+	g := srv.Join(t, b.RoomId, "")
+	g.Auth()
+	victim := b.Expect(signaling.GuestJoined).GuestId
+
+	msgs := []signaling.Msg{
+		{Type: signaling.HostAuth, GuestId: victim, Ufrag: "evilUfrag", Pwd: "evilPasswordEvilPassword"},
+		{Type: signaling.IceCandidate, GuestId: victim, Candidate: signalingtest.Candidate(9)},
+		{Type: signaling.EndOfCandidates, GuestId: victim},
+		{Type: signaling.IceRestart, GuestId: victim, Ufrag: "evilUfrag", Pwd: "evilPasswordEvilPassword"},
+		{Type: signaling.Relay, GuestId: victim, Payload: []byte("evil")},
+		{Type: signaling.Error, GuestId: victim, Code: signaling.ErrorMessageRejected, Detail: "evil"},
+		{Type: signaling.KickGuest, GuestId: victim, Ban: true},
+	}
+	for _, msg := range msgs {
+		a.Send(msg)
+	}
+	for _, msg := range msgs {
+		waitCounter(t, metrics, signaling.MetricCrossRoomRejected+"{type="+msg.Type.String()+"}", 1)
+	}
+	g.ExpectAll(signaling.Joined)
+	g.ExpectNothing(50 * time.Millisecond)
+
+	// the guest still gets its own host's HostAuth, and a's room is still open.
+	b.Auth(victim)
+	if got := g.Expect(signaling.HostAuth); got.Ufrag != signalingtest.Ufrag {
+		t.Fatalf("guest got HostAuth with ufrag %q", got.Ufrag)
+	}
+	joinRoom(t, srv, a)
+	a.ExpectNothing(50 * time.Millisecond)
+	b.ExpectNothing(50 * time.Millisecond)
+}